@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Keys are issued as "vys_" + 8 hex characters + "_" + the secret. The first
+// 12 characters are the prefix, stored in clear so a key can be found
+// without scanning every user, the whole key is only stored as a SHA-256
+// digest. Keys issued before hashing have no such format and no public part,
+// the first 8 characters of their digest are used as the prefix.
+const (
+	apiKeyTag          = "vys_"
+	apiKeyPrefixLength = len(apiKeyTag) + 8
+	legacyPrefixLength = 8
+)
+
+// Scopes a named key can be given. The account key on Users has all of them
+// plus the account scopes, so a named key can never create or revoke keys or
+// change who belongs to a workspace.
+const (
+	scopeLinksRead        = "links:read"
+	scopeLinksWrite       = "links:write"
+	scopeLinksBulk        = "links:bulk"
+	scopeStatsRead        = "stats:read"
+	scopeKeysManage       = "keys:manage"
+	scopeWorkspacesManage = "workspaces:manage"
+)
+
+var apiKeyScopes = []string{scopeLinksRead, scopeLinksWrite, scopeLinksBulk, scopeStatsRead}
+
+var accountKeyScopes = append(slices.Clone(apiKeyScopes), scopeKeysManage, scopeWorkspacesManage)
+
+// apiKeyLastUsedResolution limits how often LastUsedAt is written, a busy
+// key would otherwise cost a write on every request.
+const apiKeyLastUsedResolution = time.Minute
+
+// hasScope reports whether the key the user authenticated with carries
+// scope. The account key has every scope.
+func (user *Users) hasScope(scope string) bool {
+	if user.ApiKeyId == nil {
+		return true
+	}
+
+	return slices.Contains(user.Scopes, scope)
+}
+
+func (key *ApiKeys) scopeList() []string {
+	return strings.Fields(key.Scopes)
+}
+
+// BeforeCreate stores the digest and prefix of the plaintext Key.
+func (key *ApiKeys) BeforeCreate(tx *gorm.DB) error {
+	return hashNamedApiKey(key)
+}
+
+func hashNamedApiKey(key *ApiKeys) error {
+	if key.Key == "" {
+		if key.Digest == "" {
+			return errors.New("api key is required")
+		}
+		return nil
+	}
+
+	key.Digest = apiKeyDigest(key.Key)
+	key.Prefix = apiKeyPrefix(key.Key)
+	return nil
+}
+
+func matchesNamedApiKey(key *ApiKeys, apiKey string, now time.Time) bool {
+	if key.ExpiresAt != nil && !key.ExpiresAt.After(now) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(apiKeyDigest(apiKey)), []byte(key.Digest)) == 1
+}
+
+// resolvedUser marks user as authenticated with apiKey. key is nil for the
+// account key.
+func resolvedUser(user Users, apiKey string, key *ApiKeys) *Users {
+	user.ApiKey = apiKey
+	if key == nil {
+		user.Scopes = accountKeyScopes
+		user.ApiKeyId = nil
+		return &user
+	}
+
+	keyId := key.Id
+	user.Scopes = key.scopeList()
+	user.ApiKeyId = &keyId
+	return &user
+}
+
+func newApiKey() (string, error) {
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	encoded := hex.EncodeToString(random)
+	return apiKeyTag + encoded[:8] + "_" + encoded[8:], nil
+}
+
+func apiKeyPrefix(apiKey string) string {
+	if strings.HasPrefix(apiKey, apiKeyTag) && len(apiKey) > apiKeyPrefixLength {
+		return apiKey[:apiKeyPrefixLength]
+	}
+
+	return apiKeyDigest(apiKey)[:legacyPrefixLength]
+}
+
+func apiKeyDigest(apiKey string) string {
+	digest := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(digest[:])
+}
+
+// BeforeCreate stores the digest and prefix of the plaintext ApiKey, the
+// plaintext itself is never written.
+func (user *Users) BeforeCreate(tx *gorm.DB) error {
+	return hashUserApiKey(user)
+}
+
+func hashUserApiKey(user *Users) error {
+	if user.ApiKey == "" {
+		if user.ApiKeyDigest == "" {
+			return errors.New("api key is required")
+		}
+		return nil
+	}
+
+	user.ApiKeyDigest = apiKeyDigest(user.ApiKey)
+	user.ApiKeyPrefix = apiKeyPrefix(user.ApiKey)
+	return nil
+}
+
+// matchesApiKey compares in constant time so the response time does not
+// reveal how much of a digest matched.
+func matchesApiKey(user *Users, apiKey string, now time.Time) bool {
+	digest := []byte(apiKeyDigest(apiKey))
+
+	if subtle.ConstantTimeCompare(digest, []byte(user.ApiKeyDigest)) == 1 {
+		return true
+	}
+
+	if user.PreviousApiKeyDigest == nil || user.PreviousApiKeyExpiresAt == nil || !user.PreviousApiKeyExpiresAt.After(now) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(digest, []byte(*user.PreviousApiKeyDigest)) == 1
+}
+
+// migrateApiKeyDigests replaces the plaintext keys written before keys were
+// hashed. Rows without a prefix still hold plaintext, so running it again
+// is a no-op. It also replaces the legacy prefixes that were once cut from
+// the key itself by the ones of the digest.
+func migrateApiKeyDigests(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var users []Users
+		if err := tx.Where("api_key_prefix = ? OR api_key_prefix IS NULL", "").Find(&users).Error; err != nil {
+			return err
+		}
+
+		for _, user := range users {
+			plaintext := user.ApiKeyDigest
+			updates := map[string]interface{}{
+				"api_key":        apiKeyDigest(plaintext),
+				"api_key_prefix": apiKeyPrefix(plaintext),
+			}
+
+			if user.PreviousApiKeyDigest != nil {
+				previousPlaintext := *user.PreviousApiKeyDigest
+				updates["previous_api_key"] = apiKeyDigest(previousPlaintext)
+				updates["previous_api_key_prefix"] = apiKeyPrefix(previousPlaintext)
+			}
+
+			if err := tx.Model(&Users{}).Where("id = ?", user.Id).UpdateColumns(updates).Error; err != nil {
+				return err
+			}
+		}
+
+		var legacyUsers []Users
+		if err := tx.Where("api_key_prefix NOT LIKE ? OR previous_api_key_prefix NOT LIKE ?", apiKeyTag+"%", apiKeyTag+"%").Find(&legacyUsers).Error; err != nil {
+			return err
+		}
+
+		for _, user := range legacyUsers {
+			updates := map[string]interface{}{}
+			if prefix := user.ApiKeyDigest[:legacyPrefixLength]; !strings.HasPrefix(user.ApiKeyPrefix, apiKeyTag) && user.ApiKeyPrefix != prefix {
+				updates["api_key_prefix"] = prefix
+			}
+			if user.PreviousApiKeyDigest != nil && user.PreviousApiKeyPrefix != nil {
+				if prefix := (*user.PreviousApiKeyDigest)[:legacyPrefixLength]; !strings.HasPrefix(*user.PreviousApiKeyPrefix, apiKeyTag) && *user.PreviousApiKeyPrefix != prefix {
+					updates["previous_api_key_prefix"] = prefix
+				}
+			}
+			if len(updates) == 0 {
+				continue
+			}
+
+			if err := tx.Model(&Users{}).Where("id = ?", user.Id).UpdateColumns(updates).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewApiKeyFormat(t *testing.T) {
+	apiKey, err := newApiKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(apiKey, apiKeyTag) {
+		t.Errorf("got key %q want prefix %q", apiKey, apiKeyTag)
+	}
+	if prefix := apiKeyPrefix(apiKey); len(prefix) != apiKeyPrefixLength || !strings.HasPrefix(apiKey, prefix+"_") {
+		t.Errorf("got prefix %q for key %q", prefix, apiKey)
+	}
+	if prefix := apiKeyPrefix("legacy-plaintext-key"); prefix != apiKeyDigest("legacy-plaintext-key")[:legacyPrefixLength] {
+		t.Errorf("got legacy prefix %q want the start of the digest", prefix)
+	}
+}
+
+func TestApiKeysAreStoredAsDigests(t *testing.T) {
+	ctx := context.Background()
+	db, err := NewDatabase(filepath.Join(t.TempDir(), "keys.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newGormLinkStore(db)
+	defer store.Close()
+
+	apiKey, _ := newApiKey()
+	if err := store.CreateUser(ctx, &Users{Email: "digest@example.com", ApiKey: apiKey}); err != nil {
+		t.Fatal(err)
+	}
+
+	var storedKey string
+	db.Raw("SELECT api_key FROM users WHERE email = ?", "digest@example.com").Scan(&storedKey)
+	if storedKey != apiKeyDigest(apiKey) {
+		t.Errorf("got stored key %q want the digest %q", storedKey, apiKeyDigest(apiKey))
+	}
+
+	user, err := store.GetUserByApiKey(ctx, apiKey)
+	if err != nil {
+		t.Fatalf("GetUserByApiKey returned error: %v", err)
+	}
+	if user.ApiKey != apiKey {
+		t.Errorf("resolved user should carry the presented key: got %q want %q", user.ApiKey, apiKey)
+	}
+
+	if _, err := store.GetUserByApiKey(ctx, apiKeyDigest(apiKey)); err == nil {
+		t.Error("the stored digest must not work as a key")
+	}
+}
+
+func TestMigrateApiKeyDigests(t *testing.T) {
+	ctx := context.Background()
+	db, err := NewDatabase(filepath.Join(t.TempDir(), "legacy.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newGormLinkStore(db)
+	defer store.Close()
+
+	// Rows as written before keys were hashed: plaintext and no prefix.
+	expiresAt := time.Now().Add(time.Hour)
+	db.Exec("INSERT INTO users (email, api_key, tier, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+		"legacy1@example.com", "legacy_key_one", "hobby", time.Now(), time.Now())
+	db.Exec("INSERT INTO users (email, api_key, tier, created_at, updated_at, previous_api_key, previous_api_key_expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		"legacy2@example.com", "legacy_key_two", "hobby", time.Now(), time.Now(), "legacy_key_old", expiresAt)
+	// A row hashed when legacy prefixes were cut from the key itself.
+	db.Exec("INSERT INTO users (email, api_key, api_key_prefix, tier, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+		"legacy3@example.com", apiKeyDigest("legacy_key_three"), "legacy_k", "hobby", time.Now(), time.Now())
+
+	for i := 0; i < 2; i++ {
+		if err := migrateApiKeyDigests(db); err != nil {
+			t.Fatalf("migrateApiKeyDigests run %d returned error: %v", i+1, err)
+		}
+	}
+
+	for _, apiKey := range []string{"legacy_key_one", "legacy_key_two", "legacy_key_old", "legacy_key_three"} {
+		if _, err := store.GetUserByApiKey(ctx, apiKey); err != nil {
+			t.Errorf("legacy key %q no longer works after the migration: %v", apiKey, err)
+		}
+	}
+
+	var plaintextCount int64
+	db.Model(&Users{}).Where("api_key LIKE ? OR previous_api_key LIKE ?", "legacy_key_%", "legacy_key_%").Count(&plaintextCount)
+	if plaintextCount != 0 {
+		t.Errorf("got %d rows with plaintext keys want 0", plaintextCount)
+	}
+
+	var clearPrefixCount int64
+	db.Model(&Users{}).Where("api_key_prefix LIKE ? OR previous_api_key_prefix LIKE ?", "legacy%", "legacy%").Count(&clearPrefixCount)
+	if clearPrefixCount != 0 {
+		t.Errorf("got %d rows with prefixes cut from the key want 0", clearPrefixCount)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const defaultBatchSize = 100
+
+// batchWriter buffers entries in memory and hands them to write in batches
+// from a single goroutine, so request logs and click events never add a
+// database write to the request path. Close flushes whatever is still
+// buffered.
+type batchWriter[T any] struct {
+	name          string
+	write         func(ctx context.Context, batch []T) error
+	entries       chan T
+	flushInterval time.Duration
+	done          chan struct{}
+
+	// mu guards closed, Add holds it while sending so Close cannot close
+	// entries in between.
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newBatchWriter[T any](name string, bufferSize int, flushInterval time.Duration, write func(ctx context.Context, batch []T) error) *batchWriter[T] {
+	writer := &batchWriter[T]{
+		name:          name,
+		write:         write,
+		entries:       make(chan T, bufferSize),
+		flushInterval: flushInterval,
+		done:          make(chan struct{}),
+	}
+
+	go writer.run()
+
+	return writer
+}
+
+func newRequestLogger(store LinkStore, bufferSize int, flushInterval time.Duration) *batchWriter[LogRequests] {
+	return newBatchWriter("request log", bufferSize, flushInterval, store.InsertRequestLogs)
+}
+
+// Add queues an entry without blocking. When the buffer is full the entry is
+// dropped, losing a log line or a click is preferable to slowing down every
+// request. Entries added after Close, by requests that outlived the shutdown
+// timeout, are dropped too.
+func (b *batchWriter[T]) Add(entry T) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		log.Printf("Warning: %s writer is closed, dropping entry", b.name)
+		return
+	}
+
+	select {
+	case b.entries <- entry:
+	default:
+		log.Printf("Warning: %s buffer is full, dropping entry", b.name)
+	}
+}
+
+// Close stops accepting entries and waits until the buffer has been written
+// or ctx is done.
+func (b *batchWriter[T]) Close(ctx context.Context) error {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.entries)
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-b.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *batchWriter[T]) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]T, 0, defaultBatchSize)
+	for {
+		select {
+		case entry, ok := <-b.entries:
+			if !ok {
+				b.flush(batch)
+				return
+			}
+
+			batch = append(batch, entry)
+			if len(batch) >= defaultBatchSize {
+				b.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			b.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (b *batchWriter[T]) flush(batch []T) {
+	if len(batch) == 0 {
+		return
+	}
+
+	if err := b.write(context.Background(), batch); err != nil {
+		log.Printf("Error writing %d %s entries: %v", len(batch), b.name, err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestRequestLoggerFlushesOnClose(t *testing.T) {
+	store := newMemoryLinkStore()
+	// A long flush interval makes sure Close is what writes the logs.
+	logger := newRequestLogger(store, 10, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		logger.Add(LogRequests{Timestamp: time.Now(), Method: "GET", Url: "/health"})
+	}
+
+	if err := logger.Close(context.Background()); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	if len(store.logs) != 3 {
+		t.Errorf("expected 3 flushed logs, got %d", len(store.logs))
+	}
+}
+
+func TestBatchWriterDropsAfterClose(t *testing.T) {
+	store := newMemoryLinkStore()
+	logger := newRequestLogger(store, 10, time.Hour)
+
+	// A request still running after the shutdown timeout must not panic
+	// with a send on the closed buffer.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logger.Add(LogRequests{Timestamp: time.Now(), Method: "GET", Url: "/health"})
+		}()
+	}
+	logger.Close(context.Background())
+	wg.Wait()
+
+	logger.Add(LogRequests{Timestamp: time.Now(), Method: "GET", Url: "/late"})
+	for _, logRequest := range store.logs {
+		if logRequest.Url == "/late" {
+			t.Error("got the entry added after Close written")
+		}
+	}
+}
+
+func TestBatchWriterDropsWhenFull(t *testing.T) {
+	writer := &batchWriter[LogRequests]{
+		name:          "test",
+		entries:       make(chan LogRequests, 1),
+		flushInterval: time.Hour,
+		done:          make(chan struct{}),
+	}
+
+	// The writer goroutine is not running, so the second entry must be
+	// dropped instead of blocking the caller.
+	writer.Add(LogRequests{Method: "GET", Url: "/first"})
+	writer.Add(LogRequests{Method: "GET", Url: "/second"})
+
+	if len(writer.entries) != 1 {
+		t.Errorf("expected 1 buffered entry, got %d", len(writer.entries))
+	}
+}
+
+func TestRedirectRecordsClick(t *testing.T) {
+	initRedis(defaultConfig().Redis)
+
+	store := newMemoryLinkStore()
+	clickRecorder := newClickRecorder(store, 10, time.Hour)
+
+	ctx := withStore(context.Background(), store)
+	ctx = withClickRecorder(ctx, clickRecorder)
+
+	shortCode := "click-" + uuid.NewString()[:8]
+	store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com", ShortCode: shortCode})
+	defer removeCachedUrl(ctx, shortCode)
+
+	// The first request reads the store, the second one the Redis copy, both
+	// must be counted.
+	redirectHandler := serveWithContext(ctx, redirectToOriginalUrl)
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/redirect?code="+shortCode, nil)
+		req.Header.Set("Referer", "http://referrer.example")
+		req.Header.Set("User-Agent", "click-test-agent")
+		rr := httptest.NewRecorder()
+		redirectHandler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("redirect returned %v want %v", rr.Code, http.StatusTemporaryRedirect)
+		}
+	}
+
+	if len(store.clicks) != 0 {
+		t.Fatal("clicks were written synchronously, expected them to be buffered")
+	}
+
+	if err := clickRecorder.Close(context.Background()); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	if len(store.clicks) != 2 {
+		t.Fatalf("expected 2 clicks, got %d", len(store.clicks))
+	}
+	click := store.clicks[0]
+	if click.Referrer != "http://referrer.example" || click.UserAgent != "click-test-agent" || click.ShortCode != shortCode {
+		t.Errorf("click recorded with wrong fields: %+v", click)
+	}
+
+	urlModel, _ := store.GetActiveUrl(ctx, shortCode)
+	if urlModel.Views != 2 {
+		t.Errorf("got %d views want 2", urlModel.Views)
+	}
+	if urlModel.LastViewed == nil {
+		t.Error("LastViewed was not set")
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bulkShortenItem is one link of a bulk request, with the same fields as the
+// body of POST /shorten.
+type bulkShortenItem struct {
+	URL          string  `json:"url"`
+	ExpiresAt    *string `json:"expires_at"`
+	CustomUrl    *string `json:"custom_url"`
+	Password     *string `json:"password"`
+	RedirectType *int    `json:"redirect_type"`
+	// passwordUnreadable marks the links of jobs whose stored password could
+	// not be decrypted, they fail instead of being created without one.
+	passwordUnreadable bool
+}
+
+// bulkShortenResult reports the outcome of the item at Index, either the
+// ShortCode that was created or an ErrorCode with a Message.
+type bulkShortenResult struct {
+	Index     int    `json:"index"`
+	ShortCode string `json:"short_code,omitempty"`
+	ErrorCode string `json:"error_code,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+func (result bulkShortenResult) failed() bool {
+	return result.ErrorCode != ""
+}
+
+// Error codes of bulk items next to the ones of urlValidationError.
+const (
+	bulkErrorUrlRequired        = "url_required"
+	bulkErrorEmptyCustomUrl     = "empty_custom_url"
+	bulkErrorReservedCustomUrl  = "reserved_custom_url"
+	bulkErrorDuplicateCustomUrl = "duplicate_custom_url"
+	bulkErrorCustomUrlExists    = "custom_url_exists"
+	bulkErrorInvalidRedirect    = "invalid_redirect_type"
+	bulkErrorInvalidExpiry      = "invalid_expires_at"
+	bulkErrorInvalidPassword    = "invalid_password"
+	bulkErrorInsertFailed       = "insert_failed"
+	bulkErrorAborted            = "aborted"
+)
+
+// shortenBulk validates every item like shortenUrl does and inserts the
+// valid ones with a single batched insert. The custom URLs and the generated
+// short codes are each checked with one query. Items that fail get an error
+// result and the others are still created, unless atomic is set: then one
+// failing item means no link is created at all.
+func shortenBulk(ctx context.Context, ipAddress string, user *Users, items []bulkShortenItem, atomic bool) []bulkShortenResult {
+	results := make([]bulkShortenResult, len(items))
+	pending := []*UrlShortener{}
+	pendingIndexes := []int{}
+	customUrls := make(map[string]bool)
+	passwordHashes := make(map[string]string)
+	failed := false
+	plan := userPlan(ctx, user)
+	store := getStoreFromContext(ctx)
+
+	// keepPending fails the pending links for which check returns an error
+	// code and keeps the others.
+	keepPending := func(check func(urlShortener *UrlShortener) (string, string)) {
+		kept, keptIndexes := pending[:0], pendingIndexes[:0]
+		for j, urlShortener := range pending {
+			if code, message := check(urlShortener); code != "" {
+				results[pendingIndexes[j]].ErrorCode = code
+				results[pendingIndexes[j]].Message = message
+				failed = true
+				continue
+			}
+			kept = append(kept, urlShortener)
+			keptIndexes = append(keptIndexes, pendingIndexes[j])
+		}
+		pending, pendingIndexes = kept, keptIndexes
+	}
+
+	for i, item := range items {
+		results[i] = bulkShortenResult{Index: i}
+
+		urlShortener, code, message := newBulkUrl(ctx, ipAddress, user, plan, item, customUrls, passwordHashes)
+		if code != "" {
+			results[i].ErrorCode = code
+			results[i].Message = message
+			failed = true
+			continue
+		}
+
+		pending = append(pending, urlShortener)
+		pendingIndexes = append(pendingIndexes, i)
+	}
+
+	if len(customUrls) > 0 {
+		customCodes := make([]string, 0, len(customUrls))
+		for customUrl := range customUrls {
+			customCodes = append(customCodes, customUrl)
+		}
+
+		taken, err := store.TakenShortCodes(ctx, customCodes)
+		keepPending(func(urlShortener *UrlShortener) (string, string) {
+			switch {
+			case urlShortener.ShortCode == "":
+				return "", ""
+			case err != nil:
+				return bulkErrorInsertFailed, "Error creating the short URL"
+			case taken[urlShortener.ShortCode]:
+				return bulkErrorCustomUrlExists, "This custom URL already exists"
+			}
+			return "", ""
+		})
+	}
+
+	// The links over the monthly quota fail, the ones before are created.
+	reserved, month := reserveUsage(ctx, user, usageLinksCreated, int64(len(pending)), plan.MonthlyLinks)
+	if reserved < int64(len(pending)) {
+		for _, i := range pendingIndexes[reserved:] {
+			results[i].ErrorCode = planErrorMonthlyLinks
+			results[i].Message = planErrorMessages[planErrorMonthlyLinks]
+		}
+		pending = pending[:reserved]
+		pendingIndexes = pendingIndexes[:reserved]
+		failed = true
+	}
+
+	// Short codes are only generated for the links within the quota.
+	generated := 0
+	for _, urlShortener := range pending {
+		if urlShortener.ShortCode == "" {
+			generated++
+		}
+	}
+	if generated > 0 {
+		shortCodes, err := createShortCodes(ctx, generated, customUrls)
+		keepPending(func(urlShortener *UrlShortener) (string, string) {
+			switch {
+			case urlShortener.ShortCode != "":
+				return "", ""
+			case err != nil:
+				return bulkErrorInsertFailed, "Error creating the short URL"
+			}
+			urlShortener.ShortCode, shortCodes = shortCodes[0], shortCodes[1:]
+			return "", ""
+		})
+	}
+
+	if atomic && failed {
+		refundUsage(ctx, user, usageLinksCreated, reserved, month)
+		for _, i := range pendingIndexes {
+			results[i].ErrorCode = bulkErrorAborted
+			results[i].Message = "Not created because another item failed"
+		}
+		return results
+	}
+
+	revisions := make([]LinkRevisions, len(pending))
+	for j, urlShortener := range pending {
+		revisions[j] = newLinkRevision(user, revisionCreate, nil, urlShortener)
+	}
+
+	if err := store.InsertUrls(ctx, pending, revisions); err != nil {
+		// The batch is all or nothing. Outside of atomic mode the links are
+		// inserted one at a time to find the ones that failed it.
+		for j, urlShortener := range pending {
+			code, message := bulkErrorInsertFailed, "Error creating the short URL"
+			if !atomic {
+				code, message = insertBulkUrl(ctx, user, urlShortener, customUrls)
+			}
+			results[pendingIndexes[j]].ErrorCode = code
+			results[pendingIndexes[j]].Message = message
+		}
+	}
+
+	created := int64(0)
+	for j, urlShortener := range pending {
+		if results[pendingIndexes[j]].failed() {
+			continue
+		}
+
+		results[pendingIndexes[j]].ShortCode = urlShortener.ShortCode
+		created++
+	}
+	refundUsage(ctx, user, usageLinksCreated, reserved-created, month)
+
+	return results
+}
+
+// insertBulkUrl inserts a single link of a bulk request with its revision and
+// returns the error code and message when it fails. A generated short code
+// taken since it was checked is replaced once before giving up.
+func insertBulkUrl(ctx context.Context, user *Users, urlShortener *UrlShortener, customUrls map[string]bool) (string, string) {
+	store := getStoreFromContext(ctx)
+	isCustomUrl := customUrls[urlShortener.ShortCode]
+	insert := func() error {
+		revisions := []LinkRevisions{newLinkRevision(user, revisionCreate, nil, urlShortener)}
+		return store.InsertUrls(ctx, []*UrlShortener{urlShortener}, revisions)
+	}
+
+	err := insert()
+	if errors.Is(err, ErrConflict) && !isCustomUrl {
+		shortCodes, createErr := createShortCodes(ctx, 1, customUrls)
+		if createErr != nil {
+			return bulkErrorInsertFailed, "Error creating the short URL"
+		}
+		urlShortener.ShortCode = shortCodes[0]
+		err = insert()
+	}
+
+	switch {
+	case err == nil:
+		return "", ""
+	case errors.Is(err, ErrConflict) && isCustomUrl:
+		return bulkErrorCustomUrlExists, "This custom URL already exists"
+	}
+	return bulkErrorInsertFailed, "Error creating the short URL"
+}
+
+// newBulkUrl builds the link for item, or returns the error code and message
+// explaining why it cannot be created, also when the plan does not include
+// it. customUrls collects the custom URLs of the items so duplicates within
+// a request are caught, whether a link already has them is left to
+// shortenBulk like generating the short code of the others. passwordHashes
+// keeps the hash of every password so links sharing one hash it once.
+func newBulkUrl(ctx context.Context, ipAddress string, user *Users, plan Plan, item bulkShortenItem, customUrls map[string]bool, passwordHashes map[string]string) (*UrlShortener, string, string) {
+	if item.URL == "" {
+		return nil, bulkErrorUrlRequired, "URL is required"
+	}
+
+	if item.passwordUnreadable {
+		return nil, bulkErrorInsertFailed, "The password of this link could not be decrypted"
+	}
+	if code := checkPlanFeatures(plan, item.CustomUrl, item.Password); code != "" {
+		return nil, code, planErrorMessages[code]
+	}
+
+	originalUrl, validationErr := normalizeUrl(item.URL)
+	if validationErr != nil {
+		return nil, validationErr.Code, validationErr.Message
+	}
+
+	if isBlockedDestination(ctx, ipAddress, "shorten", "", originalUrl) {
+		blockedErr := blockedDestinationError()
+		return nil, blockedErr.Code, blockedErr.Message
+	}
+
+	if item.RedirectType != nil && !isValidRedirectType(*item.RedirectType) {
+		return nil, bulkErrorInvalidRedirect, "Redirect type must be one of 301, 302, 307 or 308"
+	}
+
+	urlShortener := &UrlShortener{OriginalUrl: originalUrl, RedirectType: defaultRedirectType}
+
+	if item.CustomUrl != nil {
+		customUrl := *item.CustomUrl
+		switch {
+		case customUrl == "":
+			return nil, bulkErrorEmptyCustomUrl, "Custom URL cannot be empty"
+		case isReservedShortCode(customUrl):
+			return nil, bulkErrorReservedCustomUrl, "This custom URL is reserved"
+		case customUrls[customUrl]:
+			return nil, bulkErrorDuplicateCustomUrl, "This custom URL is used more than once in the request"
+		}
+
+		customUrls[customUrl] = true
+		urlShortener.ShortCode = customUrl
+	}
+
+	if item.ExpiresAt != nil {
+		expiresAt, err := time.Parse(time.RFC3339, *item.ExpiresAt)
+		if err != nil {
+			return nil, bulkErrorInvalidExpiry, "Invalid expiry date"
+		}
+		urlShortener.ExpiresAt = &expiresAt
+	}
+
+	if item.RedirectType != nil {
+		urlShortener.RedirectType = *item.RedirectType
+	}
+
+	if user != nil {
+		urlShortener.UserId = &user.Id
+	}
+
+	if item.Password != nil {
+		hashedPasswordString, exists := passwordHashes[*item.Password]
+		if !exists {
+			hashedPassword, err := bcrypt.GenerateFromPassword([]byte(*item.Password), bcrypt.DefaultCost)
+			if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+				return nil, bulkErrorInvalidPassword, "Password cannot be longer than 72 bytes"
+			} else if err != nil {
+				return nil, bulkErrorInsertFailed, "Error creating the short URL"
+			}
+			hashedPasswordString = string(hashedPassword)
+			passwordHashes[*item.Password] = hashedPasswordString
+		}
+		urlShortener.Password = &hashedPasswordString
+	}
+
+	return urlShortener, "", ""
+}
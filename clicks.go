@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+type clickSummary struct {
+	count      int
+	lastViewed time.Time
+}
+
+func newClickRecorder(store LinkStore, bufferSize int, flushInterval time.Duration) *batchWriter[Clicks] {
+	return newBatchWriter("click", bufferSize, flushInterval, store.RecordClicks)
+}
+
+// recordClick queues a click for the redirect being served. It never touches
+// the database itself, the recorder on the context writes clicks in batches.
+func recordClick(ctx context.Context, shortCode string, r *http.Request) {
+	clickRecorder := getClickRecorderFromContext(ctx)
+	if clickRecorder == nil {
+		return
+	}
+
+	clickRecorder.Add(Clicks{
+		ShortCode: shortCode,
+		Timestamp: time.Now(),
+		Referrer:  r.Referer(),
+		UserAgent: r.UserAgent(),
+		IpAddress: clientIp(r),
+	})
+}
+
+// summarizeClicks folds a batch into one views increment and last viewed
+// timestamp per short code, so a batch costs one update per link.
+func summarizeClicks(clicks []Clicks) map[string]clickSummary {
+	summaries := make(map[string]clickSummary)
+	for _, click := range clicks {
+		summary := summaries[click.ShortCode]
+		summary.count++
+		if click.Timestamp.After(summary.lastViewed) {
+			summary.lastViewed = click.Timestamp
+		}
+		summaries[click.ShortCode] = summary
+	}
+
+	return summaries
+}
+
+// clickedShortCodes lists the short codes of a batch once each.
+func clickedShortCodes(clicks []Clicks) []string {
+	shortCodes := []string{}
+	for shortCode := range summarizeClicks(clicks) {
+		shortCodes = append(shortCodes, shortCode)
+	}
+
+	return shortCodes
+}
+
+// redirectUsages counts the clicks of a batch as the Redirects usage of the
+// owners of the links, ownerIds maps a short code to its owner. Clicks of
+// links without an owner are left out.
+func redirectUsages(clicks []Clicks, ownerIds map[string]uint) []Usages {
+	usages := []Usages{}
+	for _, click := range clicks {
+		if ownerId, exists := ownerIds[click.ShortCode]; exists {
+			usages = append(usages, Usages{UserId: ownerId, Month: usageMonth(click.Timestamp), Redirects: 1})
+		}
+	}
+
+	return mergeUsages(usages)
+}
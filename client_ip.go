@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// parsePrefix reads a CIDR range like 10.0.0.0/8 or a single address, which
+// becomes a range of one.
+func parsePrefix(value string) (netip.Prefix, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR range %q", value)
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address %q", value)
+	}
+	addr = addr.Unmap().WithZone("")
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, value := range values {
+		prefix, err := parsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHostAddr reads an address with or without a port, IPv6 addresses
+// with a port in brackets. IPv4-mapped IPv6 addresses become IPv4.
+func parseHostAddr(value string) (netip.Addr, bool) {
+	value = strings.TrimSpace(value)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
+
+// clientIpResolver finds the address of the client behind the proxies in
+// trustedProxies. The proxy headers are only believed when the connection
+// comes from a trusted proxy, anyone else could send them to pick an
+// address of their choosing.
+type clientIpResolver struct {
+	trustedProxies []netip.Prefix
+}
+
+// resolve returns the client address of r without a port. With a trusted
+// peer it is taken from Forwarded, X-Forwarded-For or X-Real-IP, in that
+// order: the last address of the chain that is not a trusted proxy itself.
+func (c *clientIpResolver) resolve(r *http.Request) string {
+	peer, ok := parseHostAddr(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !containsAddr(c.trustedProxies, peer) {
+		return peer.String()
+	}
+
+	var chain []string
+	switch {
+	case r.Header.Get("Forwarded") != "":
+		chain = forwardedFor(r.Header.Values("Forwarded"))
+	case r.Header.Get("X-Forwarded-For") != "":
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			chain = append(chain, strings.Split(header, ",")...)
+		}
+	case r.Header.Get("X-Real-IP") != "":
+		chain = []string{r.Header.Get("X-Real-IP")}
+	}
+
+	// Each proxy appends the address it got the request from, so the chain
+	// is walked from the end, past the proxies we trust.
+	client := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr, ok := parseHostAddr(chain[i])
+		if !ok {
+			// An obfuscated or garbled entry, nothing before it can be
+			// trusted either.
+			break
+		}
+		client = addr
+		if !containsAddr(c.trustedProxies, addr) {
+			break
+		}
+	}
+
+	return client.String()
+}
+
+// forwardedFor lists the for= parameters of RFC 7239 Forwarded headers, in
+// order. Values can be quoted, IPv6 addresses are in brackets.
+func forwardedFor(headers []string) []string {
+	chain := []string{}
+	for _, header := range headers {
+		for _, element := range strings.Split(header, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(name, "for") {
+					chain = append(chain, strings.Trim(value, `"`))
+				}
+			}
+		}
+	}
+
+	return chain
+}
+
+// clientIpMiddleware puts the client address on the request context for
+// the middlewares and handlers after it, see clientIp. Invalid entries of
+// trustedProxies are skipped, Validate reports them on startup.
+func clientIpMiddleware(trustedProxies []string) mux.MiddlewareFunc {
+	resolver := &clientIpResolver{}
+	for _, value := range trustedProxies {
+		prefix, err := parsePrefix(value)
+		if err != nil {
+			log.Printf("Warning: Ignoring trusted proxy: %v", err)
+			continue
+		}
+		resolver.trustedProxies = append(resolver.trustedProxies, prefix)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := withClientIp(r.Context(), resolver.resolve(r))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// clientIp is the client address of r resolved by clientIpMiddleware, or
+// the peer address without its port when the middleware did not run.
+func clientIp(r *http.Request) string {
+	if ip := getClientIpFromContext(r.Context()); ip != "" {
+		return ip
+	}
+	if addr, ok := parseHostAddr(r.RemoteAddr); ok {
+		return addr.String()
+	}
+	return r.RemoteAddr
+}
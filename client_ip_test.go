@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestClientIpResolver(t *testing.T) {
+	resolver := &clientIpResolver{trustedProxies: []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("fd00::/8"),
+	}}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{name: "port is stripped", remoteAddr: "203.0.113.7:52311", want: "203.0.113.7"},
+		{name: "IPv6 port is stripped", remoteAddr: "[2001:db8::1]:52311", want: "2001:db8::1"},
+		{name: "IPv4-mapped", remoteAddr: "[::ffff:203.0.113.7]:52311", want: "203.0.113.7"},
+		{name: "untrusted peer headers are ignored", remoteAddr: "203.0.113.7:1", headers: map[string]string{"X-Forwarded-For": "198.51.100.1"}, want: "203.0.113.7"},
+		{name: "trusted peer without headers", remoteAddr: "10.0.0.1:1", want: "10.0.0.1"},
+		{name: "X-Forwarded-For", remoteAddr: "10.0.0.1:1", headers: map[string]string{"X-Forwarded-For": "198.51.100.1"}, want: "198.51.100.1"},
+		{name: "spoofed entries before the client", remoteAddr: "10.0.0.1:1", headers: map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.1, 10.0.0.2"}, want: "198.51.100.1"},
+		{name: "only trusted proxies", remoteAddr: "10.0.0.1:1", headers: map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, want: "10.0.0.3"},
+		{name: "garbled entry", remoteAddr: "10.0.0.1:1", headers: map[string]string{"X-Forwarded-For": "198.51.100.1, nonsense"}, want: "10.0.0.1"},
+		{name: "Forwarded", remoteAddr: "[fd00::1]:1", headers: map[string]string{"Forwarded": `for=198.51.100.1;proto=https, for="[2001:db8::2]:4711"`}, want: "2001:db8::2"},
+		{name: "Forwarded before X-Forwarded-For", remoteAddr: "10.0.0.1:1", headers: map[string]string{"Forwarded": "for=198.51.100.1", "X-Forwarded-For": "198.51.100.2"}, want: "198.51.100.1"},
+		{name: "Forwarded obfuscated", remoteAddr: "10.0.0.1:1", headers: map[string]string{"Forwarded": "for=_hidden"}, want: "10.0.0.1"},
+		{name: "X-Real-IP", remoteAddr: "10.0.0.1:1", headers: map[string]string{"X-Real-IP": "198.51.100.1"}, want: "198.51.100.1"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+
+		if got := resolver.resolve(req); got != test.want {
+			t.Errorf("%s: got %v want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestClientIpMiddleware(t *testing.T) {
+	var got string
+	handler := clientIpMiddleware([]string{"127.0.0.1"})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = clientIp(r)
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:52311"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got != "198.51.100.1" {
+		t.Errorf("got %v want %v", got, "198.51.100.1")
+	}
+
+	// Without the middleware the peer address is used, without its port.
+	if got := clientIp(req); got != "127.0.0.1" {
+		t.Errorf("without the middleware: got %v want %v", got, "127.0.0.1")
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	for value, want := range map[string]string{
+		"10.1.2.3/8":       "10.0.0.0/8",
+		"192.168.0.1":      "192.168.0.1/32",
+		"2001:db8::1":      "2001:db8::1/128",
+		"2001:db8::/32":    "2001:db8::/32",
+		"::ffff:192.0.2.1": "192.0.2.1/32",
+	} {
+		if prefix, err := parsePrefix(value); err != nil || prefix.String() != want {
+			t.Errorf("parsePrefix(%q): got %v, %v want %v", value, prefix, err, want)
+		}
+	}
+
+	for _, value := range []string{"", "10.0.0.0/33", "example.com"} {
+		if _, err := parsePrefix(value); err == nil {
+			t.Errorf("parsePrefix(%q): expected an error", value)
+		}
+	}
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"vyson/ratelimit"
+)
+
+// Config is resolved in order of precedence: command-line flags, then
+// VYSON_* environment variables, then the YAML file given with -config (or
+// VYSON_CONFIG), then the defaults from defaultConfig.
+type Config struct {
+	Server     ServerConfig     `yaml:"server"`
+	Store      StoreConfig      `yaml:"store"`
+	Redis      RedisConfig      `yaml:"redis"`
+	RateLimits RateLimitsConfig `yaml:"rate_limits"`
+	Blocklist  BlocklistConfig  `yaml:"blocklist"`
+	// DomainBlocklist holds destinations that cannot be shortened or
+	// redirected to, see domain_blocklist.go for the rule syntax.
+	DomainBlocklist DomainBlocklistConfig `yaml:"domain_blocklist"`
+	RequestLog      RequestLogConfig      `yaml:"request_log"`
+	Clicks          ClicksConfig          `yaml:"clicks"`
+	Users           UsersConfig           `yaml:"users"`
+	Jobs            JobsConfig            `yaml:"jobs"`
+	Plans           PlansConfig           `yaml:"plans"`
+	// IpAcl restricts which addresses may use the server, see ip_acl.go.
+	IpAcl IpAclConfig `yaml:"ip_acl"`
+	Admin AdminConfig `yaml:"admin"`
+}
+
+type ServerConfig struct {
+	ListenAddr   string        `yaml:"listen_addr"`
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	// ShutdownTimeout is how long in-flight requests get to finish after
+	// SIGINT/SIGTERM before the server is closed.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// TrustedProxies are the addresses and CIDR ranges of the proxies in
+	// front of the server. Only their Forwarded, X-Forwarded-For and
+	// X-Real-IP headers are used to find the client address.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+type StoreConfig struct {
+	Driver string `yaml:"driver"`
+	DSN    string `yaml:"dsn"`
+}
+
+type RedisConfig struct {
+	Addr     string `yaml:"addr"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+}
+
+type RateLimit struct {
+	Requests int64         `yaml:"requests"`
+	Window   time.Duration `yaml:"window"`
+}
+
+type RateLimitsConfig struct {
+	// Algorithm is sliding_log or token_bucket, see the ratelimit package.
+	Algorithm string    `yaml:"algorithm"`
+	Redirect  RateLimit `yaml:"redirect"`
+	Shorten   RateLimit `yaml:"shorten"`
+	Default   RateLimit `yaml:"default"`
+}
+
+// Plan is what the users of a tier may do.
+type Plan struct {
+	// RateLimit applies to the requests made with the keys of a user, there
+	// is no limit when Requests is 0.
+	RateLimit RateLimit `yaml:"rate_limit"`
+	// MonthlyLinks is the number of links a user may create per calendar
+	// month, 0 for no limit.
+	MonthlyLinks int64 `yaml:"monthly_links"`
+	// MonthlyBulkJobs is the number of POST /shorten/bulk requests and
+	// bulk import jobs a user may run per calendar month, 0 for no limit.
+	MonthlyBulkJobs int64 `yaml:"monthly_bulk_jobs"`
+	// Bulk allows POST /shorten/bulk and bulk import jobs, with at most
+	// MaxBulkSize links each, or any number when it is 0.
+	Bulk        bool `yaml:"bulk"`
+	MaxBulkSize int  `yaml:"max_bulk_size"`
+	CustomUrls  bool `yaml:"custom_urls"`
+	Passwords   bool `yaml:"passwords"`
+}
+
+type PlansConfig struct {
+	// Default is the plan of anonymous requests and of the users whose tier
+	// has no plan.
+	Default string          `yaml:"default"`
+	Tiers   map[string]Plan `yaml:"tiers"`
+}
+
+// IpAclRules are addresses and CIDR ranges. When Allow is not empty only
+// the addresses in it get through, Deny is refused either way.
+type IpAclRules struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+type IpAclConfig struct {
+	// Management applies to every route but the redirects.
+	Management IpAclRules `yaml:"management"`
+	Redirect   IpAclRules `yaml:"redirect"`
+	// ReloadInterval is how often the rules added through /admin/ip-rules
+	// are read again, to pick up the changes made on other instances.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+type AdminConfig struct {
+	// Token is sent in the X-Admin-Token header of the /admin endpoints,
+	// they are disabled while it is empty.
+	Token string `yaml:"token"`
+}
+
+type BlocklistConfig struct {
+	Path           string        `yaml:"path"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+type DomainBlocklistConfig struct {
+	Path           string        `yaml:"path"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+type RequestLogConfig struct {
+	BufferSize    int           `yaml:"buffer_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+type ClicksConfig struct {
+	BufferSize    int           `yaml:"buffer_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+type UsersConfig struct {
+	// KeyRotationGracePeriod is how long the old API key keeps working after
+	// POST /user/keys/rotate.
+	KeyRotationGracePeriod time.Duration `yaml:"key_rotation_grace_period"`
+}
+
+type JobsConfig struct {
+	// Workers is the number of jobs processed at the same time.
+	Workers int `yaml:"workers"`
+	// PollInterval is how often idle workers look for queued jobs, new jobs
+	// of this instance wake them up right away.
+	PollInterval  time.Duration `yaml:"poll_interval"`
+	MaxUploadSize int           `yaml:"max_upload_size"`
+	// LeaseDuration is how long a running job stays claimed without a sign
+	// of life from its instance, the lease is renewed every third of it.
+	// Jobs whose lease expired are failed by the other instances.
+	LeaseDuration time.Duration `yaml:"lease_duration"`
+	// InputKey encrypts the passwords of queued jobs, every instance needs
+	// the same one. Without it a random key is used per process.
+	InputKey string `yaml:"input_key"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Server: ServerConfig{
+			ListenAddr:      ":8080",
+			ReadTimeout:     10 * time.Second,
+			WriteTimeout:    15 * time.Second,
+			IdleTimeout:     60 * time.Second,
+			ShutdownTimeout: 30 * time.Second,
+			TrustedProxies:  []string{},
+		},
+		Store: StoreConfig{
+			Driver: "sqlite",
+			DSN:    "db/database.sqlite",
+		},
+		Redis: RedisConfig{
+			Addr: "localhost:6379",
+		},
+		RateLimits: RateLimitsConfig{
+			Algorithm: string(ratelimit.SlidingLog),
+			Redirect:  RateLimit{Requests: 50, Window: time.Second},
+			Shorten:   RateLimit{Requests: 10, Window: time.Second},
+			Default:   RateLimit{Requests: 100, Window: time.Minute},
+		},
+		Blocklist: BlocklistConfig{
+			Path:           "blacklist.csv",
+			ReloadInterval: 5 * time.Minute,
+		},
+		DomainBlocklist: DomainBlocklistConfig{
+			Path:           "domain_blocklist.txt",
+			ReloadInterval: 30 * time.Second,
+		},
+		RequestLog: RequestLogConfig{
+			BufferSize:    10000,
+			FlushInterval: time.Second,
+		},
+		Clicks: ClicksConfig{
+			BufferSize:    10000,
+			FlushInterval: time.Second,
+		},
+		Users: UsersConfig{
+			KeyRotationGracePeriod: 24 * time.Hour,
+		},
+		Jobs: JobsConfig{
+			Workers:       2,
+			PollInterval:  5 * time.Second,
+			MaxUploadSize: 50 << 20,
+			LeaseDuration: time.Minute,
+		},
+		Plans: PlansConfig{
+			Default: "hobby",
+			Tiers: map[string]Plan{
+				"free": {
+					RateLimit:    RateLimit{Requests: 5, Window: time.Minute},
+					MonthlyLinks: 100,
+				},
+				"hobby": {
+					MonthlyLinks: 1000,
+					CustomUrls:   true,
+					Passwords:    true,
+				},
+				"enterprise": {
+					Bulk:        true,
+					MaxBulkSize: 10000,
+					CustomUrls:  true,
+					Passwords:   true,
+				},
+			},
+		},
+		IpAcl: IpAclConfig{
+			Management:     IpAclRules{Allow: []string{}, Deny: []string{}},
+			Redirect:       IpAclRules{Allow: []string{}, Deny: []string{}},
+			ReloadInterval: 30 * time.Second,
+		},
+	}
+}
+
+type configBinding struct {
+	flag  string
+	env   string
+	usage string
+	apply func(cfg *Config, value string) error
+}
+
+var configBindings = []configBinding{
+	{"listen", "VYSON_LISTEN_ADDR", "address the HTTP server listens on", setString(func(c *Config) *string { return &c.Server.ListenAddr })},
+	{"read-timeout", "VYSON_READ_TIMEOUT", "maximum duration for reading a request", setDuration(func(c *Config) *time.Duration { return &c.Server.ReadTimeout })},
+	{"write-timeout", "VYSON_WRITE_TIMEOUT", "maximum duration for writing a response", setDuration(func(c *Config) *time.Duration { return &c.Server.WriteTimeout })},
+	{"idle-timeout", "VYSON_IDLE_TIMEOUT", "how long idle keep-alive connections are kept open", setDuration(func(c *Config) *time.Duration { return &c.Server.IdleTimeout })},
+	{"shutdown-timeout", "VYSON_SHUTDOWN_TIMEOUT", "how long in-flight requests may take to finish on shutdown", setDuration(func(c *Config) *time.Duration { return &c.Server.ShutdownTimeout })},
+	{"trusted-proxies", "VYSON_TRUSTED_PROXIES", "comma separated addresses and CIDR ranges of trusted reverse proxies", setStringList(func(c *Config) *[]string { return &c.Server.TrustedProxies })},
+	{"store", "VYSON_STORE_DRIVER", "storage backend: sqlite, postgres or memory", setString(func(c *Config) *string { return &c.Store.Driver })},
+	{"dsn", "VYSON_STORE_DSN", "sqlite database file or postgres connection string", setString(func(c *Config) *string { return &c.Store.DSN })},
+	{"redis-addr", "VYSON_REDIS_ADDR", "redis server address", setString(func(c *Config) *string { return &c.Redis.Addr })},
+	{"redis-password", "VYSON_REDIS_PASSWORD", "redis password", setString(func(c *Config) *string { return &c.Redis.Password })},
+	{"redis-db", "VYSON_REDIS_DB", "redis database number", setInt(func(c *Config) *int { return &c.Redis.DB })},
+	{"rate-limit-algorithm", "VYSON_RATE_LIMIT_ALGORITHM", "how requests are counted: sliding_log or token_bucket", setString(func(c *Config) *string { return &c.RateLimits.Algorithm })},
+	{"rate-limit-redirect", "VYSON_RATE_LIMIT_REDIRECT", "redirect requests per IP, as <requests>/<window>", setRateLimit(func(c *Config) *RateLimit { return &c.RateLimits.Redirect })},
+	{"rate-limit-shorten", "VYSON_RATE_LIMIT_SHORTEN", "shorten requests per IP, as <requests>/<window>", setRateLimit(func(c *Config) *RateLimit { return &c.RateLimits.Shorten })},
+	{"rate-limit-default", "VYSON_RATE_LIMIT_DEFAULT", "other requests per IP, as <requests>/<window>", setRateLimit(func(c *Config) *RateLimit { return &c.RateLimits.Default })},
+	{"rate-limit-free-tier", "VYSON_RATE_LIMIT_FREE_TIER", "requests per free tier user, as <requests>/<window>", setPlanRateLimit("free")},
+	{"default-plan", "VYSON_DEFAULT_PLAN", "plan of anonymous requests and of users whose tier has no plan", setString(func(c *Config) *string { return &c.Plans.Default })},
+	{"ip-acl-management-allow", "VYSON_IP_ACL_MANAGEMENT_ALLOW", "comma separated addresses and CIDR ranges allowed to use every route but the redirects", setStringList(func(c *Config) *[]string { return &c.IpAcl.Management.Allow })},
+	{"ip-acl-management-deny", "VYSON_IP_ACL_MANAGEMENT_DENY", "comma separated addresses and CIDR ranges refused on every route but the redirects", setStringList(func(c *Config) *[]string { return &c.IpAcl.Management.Deny })},
+	{"ip-acl-redirect-allow", "VYSON_IP_ACL_REDIRECT_ALLOW", "comma separated addresses and CIDR ranges allowed to follow redirects", setStringList(func(c *Config) *[]string { return &c.IpAcl.Redirect.Allow })},
+	{"ip-acl-redirect-deny", "VYSON_IP_ACL_REDIRECT_DENY", "comma separated addresses and CIDR ranges refused on redirects", setStringList(func(c *Config) *[]string { return &c.IpAcl.Redirect.Deny })},
+	{"ip-acl-reload", "VYSON_IP_ACL_RELOAD_INTERVAL", "how often the IP rules added through the admin API are re-read", setDuration(func(c *Config) *time.Duration { return &c.IpAcl.ReloadInterval })},
+	{"admin-token", "VYSON_ADMIN_TOKEN", "token of the /admin endpoints, which are disabled without one", setString(func(c *Config) *string { return &c.Admin.Token })},
+	{"blocklist", "VYSON_BLOCKLIST_PATH", "file with blocked API keys, one per line", setString(func(c *Config) *string { return &c.Blocklist.Path })},
+	{"blocklist-reload", "VYSON_BLOCKLIST_RELOAD_INTERVAL", "how often the blocklist is re-read", setDuration(func(c *Config) *time.Duration { return &c.Blocklist.ReloadInterval })},
+	{"domain-blocklist", "VYSON_DOMAIN_BLOCKLIST_PATH", "file with blocked destination hosts and patterns, one per line", setString(func(c *Config) *string { return &c.DomainBlocklist.Path })},
+	{"domain-blocklist-reload", "VYSON_DOMAIN_BLOCKLIST_RELOAD_INTERVAL", "how often the domain blocklist is checked for changes", setDuration(func(c *Config) *time.Duration { return &c.DomainBlocklist.ReloadInterval })},
+	{"request-log-buffer", "VYSON_REQUEST_LOG_BUFFER_SIZE", "number of request logs buffered before new ones are dropped", setInt(func(c *Config) *int { return &c.RequestLog.BufferSize })},
+	{"request-log-flush", "VYSON_REQUEST_LOG_FLUSH_INTERVAL", "how often buffered request logs are written", setDuration(func(c *Config) *time.Duration { return &c.RequestLog.FlushInterval })},
+	{"clicks-buffer", "VYSON_CLICKS_BUFFER_SIZE", "number of click events buffered before new ones are dropped", setInt(func(c *Config) *int { return &c.Clicks.BufferSize })},
+	{"clicks-flush", "VYSON_CLICKS_FLUSH_INTERVAL", "how often buffered click events are written", setDuration(func(c *Config) *time.Duration { return &c.Clicks.FlushInterval })},
+	{"key-rotation-grace", "VYSON_KEY_ROTATION_GRACE_PERIOD", "how long the previous API key keeps working after a rotation", setDuration(func(c *Config) *time.Duration { return &c.Users.KeyRotationGracePeriod })},
+	{"jobs-workers", "VYSON_JOBS_WORKERS", "number of background jobs processed at the same time", setInt(func(c *Config) *int { return &c.Jobs.Workers })},
+	{"jobs-poll", "VYSON_JOBS_POLL_INTERVAL", "how often idle workers look for queued jobs", setDuration(func(c *Config) *time.Duration { return &c.Jobs.PollInterval })},
+	{"jobs-max-upload", "VYSON_JOBS_MAX_UPLOAD_SIZE", "maximum size in bytes of a file uploaded to /jobs", setInt(func(c *Config) *int { return &c.Jobs.MaxUploadSize })},
+	{"jobs-lease", "VYSON_JOBS_LEASE_DURATION", "how long a running job stays claimed without a sign of life from its instance", setDuration(func(c *Config) *time.Duration { return &c.Jobs.LeaseDuration })},
+	{"jobs-input-key", "VYSON_JOBS_INPUT_KEY", "secret the passwords of queued jobs are encrypted with, the same on every instance", setString(func(c *Config) *string { return &c.Jobs.InputKey })},
+}
+
+// loadConfig builds the configuration from args (without the program name)
+// and the process environment.
+func loadConfig(args []string) (Config, error) {
+	cfg := defaultConfig()
+
+	flagSet := flag.NewFlagSet("vyson", flag.ContinueOnError)
+	configPath := flagSet.String("config", os.Getenv("VYSON_CONFIG"), "path to a YAML config file")
+	flagValues := make(map[string]*string, len(configBindings))
+	for _, binding := range configBindings {
+		flagValues[binding.flag] = flagSet.String(binding.flag, "", binding.usage)
+	}
+
+	if err := flagSet.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return cfg, fmt.Errorf("reading config file: %w", err)
+		}
+
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("parsing config file %s: %w", *configPath, err)
+		}
+	}
+
+	var errs []error
+	for _, binding := range configBindings {
+		value, ok := os.LookupEnv(binding.env)
+		if !ok {
+			continue
+		}
+
+		if err := binding.apply(&cfg, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", binding.env, err))
+		}
+	}
+
+	setFlags := make(map[string]bool)
+	flagSet.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	for _, binding := range configBindings {
+		if !setFlags[binding.flag] {
+			continue
+		}
+
+		if err := binding.apply(&cfg, *flagValues[binding.flag]); err != nil {
+			errs = append(errs, fmt.Errorf("-%s: %w", binding.flag, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return cfg, errors.Join(errs...)
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Validate reports every invalid setting at once so a bad deploy fails with
+// the full list instead of one problem per restart.
+func (cfg Config) Validate() error {
+	var errs []error
+
+	if cfg.Server.ListenAddr == "" {
+		errs = append(errs, errors.New("server.listen_addr is required"))
+	}
+	if cfg.Server.ReadTimeout <= 0 || cfg.Server.WriteTimeout <= 0 || cfg.Server.IdleTimeout <= 0 {
+		errs = append(errs, errors.New("server read, write and idle timeouts must be positive"))
+	}
+	if cfg.Server.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("server.shutdown_timeout must be positive"))
+	}
+	if _, err := parsePrefixes(cfg.Server.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("server.trusted_proxies: %w", err))
+	}
+
+	switch cfg.Store.Driver {
+	case "sqlite", "postgres":
+		if cfg.Store.DSN == "" {
+			errs = append(errs, fmt.Errorf("store.dsn is required for the %s driver", cfg.Store.Driver))
+		}
+	case "memory":
+	default:
+		errs = append(errs, fmt.Errorf("store.driver must be one of sqlite, postgres or memory, got %q", cfg.Store.Driver))
+	}
+
+	if cfg.Redis.Addr == "" {
+		errs = append(errs, errors.New("redis.addr is required"))
+	}
+	if cfg.Redis.DB < 0 {
+		errs = append(errs, errors.New("redis.db cannot be negative"))
+	}
+
+	if _, err := ratelimit.ParseAlgorithm(cfg.RateLimits.Algorithm); err != nil {
+		errs = append(errs, fmt.Errorf("rate_limits.algorithm: %w", err))
+	}
+	rateLimits := map[string]RateLimit{
+		"redirect": cfg.RateLimits.Redirect,
+		"shorten":  cfg.RateLimits.Shorten,
+		"default":  cfg.RateLimits.Default,
+	}
+	for _, name := range []string{"redirect", "shorten", "default"} {
+		rateLimit := rateLimits[name]
+		if rateLimit.Requests <= 0 {
+			errs = append(errs, fmt.Errorf("rate_limits.%s.requests must be positive", name))
+		}
+		if rateLimit.Window < time.Second {
+			errs = append(errs, fmt.Errorf("rate_limits.%s.window must be at least 1s", name))
+		}
+	}
+
+	if cfg.Blocklist.Path == "" {
+		errs = append(errs, errors.New("blocklist.path is required"))
+	}
+	if cfg.Blocklist.ReloadInterval <= 0 {
+		errs = append(errs, errors.New("blocklist.reload_interval must be positive"))
+	}
+
+	if cfg.DomainBlocklist.Path == "" {
+		errs = append(errs, errors.New("domain_blocklist.path is required"))
+	}
+	if cfg.DomainBlocklist.ReloadInterval <= 0 {
+		errs = append(errs, errors.New("domain_blocklist.reload_interval must be positive"))
+	}
+
+	if cfg.RequestLog.BufferSize <= 0 {
+		errs = append(errs, errors.New("request_log.buffer_size must be positive"))
+	}
+	if cfg.RequestLog.FlushInterval <= 0 {
+		errs = append(errs, errors.New("request_log.flush_interval must be positive"))
+	}
+
+	if cfg.Clicks.BufferSize <= 0 {
+		errs = append(errs, errors.New("clicks.buffer_size must be positive"))
+	}
+	if cfg.Clicks.FlushInterval <= 0 {
+		errs = append(errs, errors.New("clicks.flush_interval must be positive"))
+	}
+
+	if cfg.Users.KeyRotationGracePeriod < 0 {
+		errs = append(errs, errors.New("users.key_rotation_grace_period cannot be negative"))
+	}
+
+	if cfg.Jobs.Workers <= 0 {
+		errs = append(errs, errors.New("jobs.workers must be positive"))
+	}
+	if cfg.Jobs.PollInterval <= 0 {
+		errs = append(errs, errors.New("jobs.poll_interval must be positive"))
+	}
+	if cfg.Jobs.MaxUploadSize <= 0 {
+		errs = append(errs, errors.New("jobs.max_upload_size must be positive"))
+	}
+	if cfg.Jobs.LeaseDuration <= 0 {
+		errs = append(errs, errors.New("jobs.lease_duration must be positive"))
+	}
+
+	for _, list := range []struct {
+		name   string
+		values []string
+	}{
+		{"ip_acl.management.allow", cfg.IpAcl.Management.Allow},
+		{"ip_acl.management.deny", cfg.IpAcl.Management.Deny},
+		{"ip_acl.redirect.allow", cfg.IpAcl.Redirect.Allow},
+		{"ip_acl.redirect.deny", cfg.IpAcl.Redirect.Deny},
+	} {
+		if _, err := parsePrefixes(list.values); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", list.name, err))
+		}
+	}
+	if cfg.IpAcl.ReloadInterval <= 0 {
+		errs = append(errs, errors.New("ip_acl.reload_interval must be positive"))
+	}
+	if cfg.Admin.Token != "" && len(cfg.Admin.Token) < 16 {
+		errs = append(errs, errors.New("admin.token must be at least 16 characters long"))
+	}
+
+	if _, exists := cfg.Plans.Tiers[cfg.Plans.Default]; !exists {
+		errs = append(errs, fmt.Errorf("plans.default %q is not one of plans.tiers", cfg.Plans.Default))
+	}
+	tiers := make([]string, 0, len(cfg.Plans.Tiers))
+	for tier := range cfg.Plans.Tiers {
+		tiers = append(tiers, tier)
+	}
+	sort.Strings(tiers)
+	for _, tier := range tiers {
+		plan := cfg.Plans.Tiers[tier]
+		if plan.RateLimit.Requests < 0 {
+			errs = append(errs, fmt.Errorf("plans.tiers.%s.rate_limit.requests cannot be negative", tier))
+		}
+		if plan.RateLimit.Requests > 0 && plan.RateLimit.Window < time.Second {
+			errs = append(errs, fmt.Errorf("plans.tiers.%s.rate_limit.window must be at least 1s", tier))
+		}
+		if plan.MonthlyLinks < 0 {
+			errs = append(errs, fmt.Errorf("plans.tiers.%s.monthly_links cannot be negative", tier))
+		}
+		if plan.MonthlyBulkJobs < 0 {
+			errs = append(errs, fmt.Errorf("plans.tiers.%s.monthly_bulk_jobs cannot be negative", tier))
+		}
+		if plan.MaxBulkSize < 0 {
+			errs = append(errs, fmt.Errorf("plans.tiers.%s.max_bulk_size cannot be negative", tier))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func setString(field func(*Config) *string) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		*field(cfg) = value
+		return nil
+	}
+}
+
+// setStringList splits a comma separated value, an empty value clears the
+// list.
+func setStringList(field func(*Config) *[]string) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		list := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*field(cfg) = list
+		return nil
+	}
+}
+
+func setInt(field func(*Config) *int) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		*field(cfg) = parsed
+		return nil
+	}
+}
+
+func setDuration(field func(*Config) *time.Duration) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		*field(cfg) = parsed
+		return nil
+	}
+}
+
+// setPlanRateLimit sets the rate limit of the plan of tier like
+// setRateLimit.
+func setPlanRateLimit(tier string) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		var rateLimit RateLimit
+		if err := setRateLimit(func(*Config) *RateLimit { return &rateLimit })(cfg, value); err != nil {
+			return err
+		}
+
+		if cfg.Plans.Tiers == nil {
+			cfg.Plans.Tiers = map[string]Plan{}
+		}
+		plan := cfg.Plans.Tiers[tier]
+		plan.RateLimit = rateLimit
+		cfg.Plans.Tiers[tier] = plan
+		return nil
+	}
+}
+
+// setRateLimit parses limits written as "<requests>/<window>", e.g. "50/1s".
+func setRateLimit(field func(*Config) *RateLimit) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		var requests int64
+		var window string
+		if _, err := fmt.Sscanf(value, "%d/%s", &requests, &window); err != nil {
+			return fmt.Errorf("invalid rate limit %q, expected <requests>/<window>", value)
+		}
+
+		parsedWindow, err := time.ParseDuration(window)
+		if err != nil {
+			return fmt.Errorf("invalid rate limit window %q", window)
+		}
+
+		*field(cfg) = RateLimit{Requests: requests, Window: parsedWindow}
+		return nil
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := loadConfig(nil)
+	if err != nil {
+		t.Fatalf("loadConfig returned error: %v", err)
+	}
+
+	if !reflect.DeepEqual(cfg, defaultConfig()) {
+		t.Errorf("got %+v want %+v", cfg, defaultConfig())
+	}
+}
+
+func TestLoadConfigExampleFile(t *testing.T) {
+	cfg, err := loadConfig([]string{"-config", "config.example.yaml"})
+	if err != nil {
+		t.Fatalf("loadConfig returned error: %v", err)
+	}
+
+	if !reflect.DeepEqual(cfg, defaultConfig()) {
+		t.Errorf("config.example.yaml drifted from defaultConfig: got %+v want %+v", cfg, defaultConfig())
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configPath, []byte(`
+server:
+  listen_addr: ":9000"
+redis:
+  addr: file-redis:6379
+rate_limits:
+  shorten:
+    requests: 20
+    window: 2s
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("VYSON_REDIS_ADDR", "env-redis:6379")
+	t.Setenv("VYSON_LISTEN_ADDR", ":9100")
+	t.Setenv("VYSON_RATE_LIMIT_FREE_TIER", "7/30s")
+
+	cfg, err := loadConfig([]string{"-config", configPath, "-listen", ":9200"})
+	if err != nil {
+		t.Fatalf("loadConfig returned error: %v", err)
+	}
+
+	if cfg.Server.ListenAddr != ":9200" {
+		t.Errorf("flag should win over env and file: got %v want %v", cfg.Server.ListenAddr, ":9200")
+	}
+	if cfg.Redis.Addr != "env-redis:6379" {
+		t.Errorf("env should win over file: got %v want %v", cfg.Redis.Addr, "env-redis:6379")
+	}
+	if want := (RateLimit{Requests: 20, Window: 2 * time.Second}); cfg.RateLimits.Shorten != want {
+		t.Errorf("file value not applied: got %+v want %+v", cfg.RateLimits.Shorten, want)
+	}
+	if want := (RateLimit{Requests: 7, Window: 30 * time.Second}); cfg.Plans.Tiers["free"].RateLimit != want {
+		t.Errorf("env rate limit not applied: got %+v want %+v", cfg.Plans.Tiers["free"].RateLimit, want)
+	}
+	if cfg.Plans.Tiers["free"].MonthlyLinks != defaultConfig().Plans.Tiers["free"].MonthlyLinks {
+		t.Errorf("env rate limit should keep the rest of the plan: got %+v", cfg.Plans.Tiers["free"])
+	}
+	if want := defaultConfig().RateLimits.Redirect; cfg.RateLimits.Redirect != want {
+		t.Errorf("unset value should keep default: got %+v want %+v", cfg.RateLimits.Redirect, want)
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	t.Setenv("VYSON_STORE_DRIVER", "mysql")
+
+	_, err := loadConfig([]string{"-redis-addr", "", "-rate-limit-shorten", "0/1s", "-default-plan", "gold", "-trusted-proxies", "10.0.0.0/8, 10.0.0.0/33", "-ip-acl-redirect-deny", "300.0.0.1", "-admin-token", "secret"})
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+
+	for _, expected := range []string{"store.driver", "redis.addr", "rate_limits.shorten.requests", "plans.default", "server.trusted_proxies", "ip_acl.redirect.deny", "admin.token"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error to mention %s, got %v", expected, err)
+		}
+	}
+}
+
+func TestLoadConfigInvalidValue(t *testing.T) {
+	_, err := loadConfig([]string{"-rate-limit-redirect", "fifty"})
+	if err == nil || !strings.Contains(err.Error(), "-rate-limit-redirect") {
+		t.Errorf("expected an error for the malformed rate limit, got %v", err)
+	}
+}
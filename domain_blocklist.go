@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+// domainRule is one line of the domain blocklist file:
+//
+//	example.com          the host itself
+//	*.example.com        any subdomain of example.com, not example.com itself
+//	regex:^https?://...  a regular expression matched against the full URL
+type domainRule struct {
+	raw     string
+	host    string
+	suffix  string
+	pattern *regexp.Regexp
+}
+
+func parseDomainRule(line string) (domainRule, error) {
+	rule := domainRule{raw: line}
+
+	if expr, ok := strings.CutPrefix(line, "regex:"); ok {
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return rule, err
+		}
+		rule.pattern = pattern
+		return rule, nil
+	}
+
+	host, isWildcard := strings.CutPrefix(line, "*.")
+	asciiHost, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return rule, err
+	}
+
+	if isWildcard {
+		rule.suffix = "." + asciiHost
+	} else {
+		rule.host = asciiHost
+	}
+
+	return rule, nil
+}
+
+func (rule domainRule) matches(host string, rawUrl string) bool {
+	switch {
+	case rule.pattern != nil:
+		return rule.pattern.MatchString(rawUrl)
+	case rule.suffix != "":
+		return strings.HasSuffix(host, rule.suffix)
+	default:
+		return host == rule.host
+	}
+}
+
+// domainBlocklist rejects destination URLs by host or pattern. Like the API
+// key blocklist the file is re-read lazily, at most once per ReloadInterval
+// and only when its modification time changed. Rejected attempts are written
+// to the blocked_attempts table through audit.
+type domainBlocklist struct {
+	cfg   DomainBlocklistConfig
+	audit *batchWriter[BlockedAttempts]
+
+	mu        sync.RWMutex
+	rules     []domainRule
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newDomainBlocklist(cfg DomainBlocklistConfig, audit *batchWriter[BlockedAttempts]) *domainBlocklist {
+	blocklist := &domainBlocklist{cfg: cfg, audit: audit}
+
+	if err := blocklist.reload(); err != nil {
+		log.Printf("Warning: Failed to load domain blocklist: %v", err)
+	}
+
+	return blocklist
+}
+
+func newBlockedAttemptRecorder(store LinkStore, bufferSize int, flushInterval time.Duration) *batchWriter[BlockedAttempts] {
+	return newBatchWriter("blocked attempt", bufferSize, flushInterval, store.InsertBlockedAttempts)
+}
+
+func (b *domainBlocklist) reloadIfChanged() error {
+	b.mu.RLock()
+	isFresh := time.Since(b.lastCheck) < b.cfg.ReloadInterval
+	b.mu.RUnlock()
+
+	if isFresh {
+		return nil
+	}
+
+	return b.reload()
+}
+
+func (b *domainBlocklist) reload() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastCheck = time.Now()
+
+	info, err := os.Stat(b.cfg.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			b.rules = nil
+			b.modTime = time.Time{}
+			return nil
+		}
+		return err
+	}
+
+	if b.rules != nil && info.ModTime().Equal(b.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(b.cfg.Path)
+	if err != nil {
+		return err
+	}
+
+	rules := []domainRule{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseDomainRule(line)
+		if err != nil {
+			// One bad line should not unblock everything else in the file.
+			log.Printf("Warning: Skipping domain blocklist rule on line %d: %v", i+1, err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	b.rules = rules
+	b.modTime = info.ModTime()
+	return nil
+}
+
+// match returns the rule blocking rawUrl, if any.
+func (b *domainBlocklist) match(rawUrl string) (string, bool) {
+	if err := b.reloadIfChanged(); err != nil {
+		log.Printf("Warning: Failed to reload domain blocklist: %v", err)
+	}
+
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", false
+	}
+	host := strings.ToLower(parsedUrl.Hostname())
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, rule := range b.rules {
+		if rule.matches(host, rawUrl) {
+			return rule.raw, true
+		}
+	}
+
+	return "", false
+}
+
+// isBlockedDestination checks rawUrl against the blocklist on the context and
+// records an audit entry for ipAddress when it is rejected. action is
+// "shorten" or "redirect".
+func isBlockedDestination(ctx context.Context, ipAddress string, action string, shortCode string, rawUrl string) bool {
+	blocklist := getDomainBlocklistFromContext(ctx)
+	if blocklist == nil {
+		return false
+	}
+
+	rule, blocked := blocklist.match(rawUrl)
+	if !blocked {
+		return false
+	}
+
+	log.Printf("Blocked %s of %s by domain rule %q request_id=%s", action, rawUrl, rule, getRequestIdFromContext(ctx))
+
+	if blocklist.audit != nil {
+		attempt := BlockedAttempts{
+			Timestamp: time.Now(),
+			Action:    action,
+			Url:       rawUrl,
+			Rule:      rule,
+			IpAddress: ipAddress,
+			RequestId: getRequestIdFromContext(ctx),
+		}
+		if shortCode != "" {
+			attempt.ShortCode = &shortCode
+		}
+		if user := getUserFromContext(ctx); user != nil {
+			attempt.UserId = &user.Id
+		}
+		blocklist.audit.Add(attempt)
+	}
+
+	return true
+}
+
+func blockedDestinationError() *urlValidationError {
+	return &urlValidationError{
+		Code:    "blocked_domain",
+		Message: "URL points to a blocked destination",
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func writeDomainBlocklist(t *testing.T, path string, rules ...string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(strings.Join(rules, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDomainBlocklistRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "domain_blocklist.txt")
+	writeDomainBlocklist(t, path,
+		"# comment",
+		"evil.example",
+		"*.phish.example",
+		"bücher.example",
+		`regex:^https?://[^/]+/download/.*\.exe$`,
+		"regex:[invalid",
+	)
+
+	blocklist := newDomainBlocklist(DomainBlocklistConfig{Path: path, ReloadInterval: time.Minute}, nil)
+
+	tests := []struct {
+		rawUrl  string
+		blocked bool
+	}{
+		{"http://evil.example/path", true},
+		{"http://sub.evil.example/path", false},
+		{"https://login.phish.example/", true},
+		{"https://a.b.phish.example/", true},
+		{"https://phish.example/", false},
+		{"http://xn--bcher-kva.example/", true},
+		{"http://files.example/download/setup.exe", true},
+		{"http://files.example/download/readme.txt", false},
+		{"http://example.com", false},
+	}
+
+	for _, test := range tests {
+		if _, blocked := blocklist.match(test.rawUrl); blocked != test.blocked {
+			t.Errorf("match(%q): got %v want %v", test.rawUrl, blocked, test.blocked)
+		}
+	}
+}
+
+func TestDomainBlocklistReloadsOnChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "domain_blocklist.txt")
+	writeDomainBlocklist(t, path, "old.example")
+
+	blocklist := newDomainBlocklist(DomainBlocklistConfig{Path: path, ReloadInterval: time.Nanosecond}, nil)
+
+	if _, blocked := blocklist.match("http://new.example"); blocked {
+		t.Fatal("new.example should not be blocked before the file changes")
+	}
+
+	writeDomainBlocklist(t, path, "new.example")
+	modTime := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, blocked := blocklist.match("http://new.example"); !blocked {
+		t.Error("new.example should be blocked after the file changed")
+	}
+	if _, blocked := blocklist.match("http://old.example"); blocked {
+		t.Error("old.example should no longer be blocked after the file changed")
+	}
+}
+
+func TestBlockedDestinationAtShortenAndRedirect(t *testing.T) {
+	initRedis(defaultConfig().Redis)
+
+	path := filepath.Join(t.TempDir(), "domain_blocklist.txt")
+	writeDomainBlocklist(t, path, "*.banned.example")
+
+	store := newMemoryLinkStore()
+	audit := newBlockedAttemptRecorder(store, 10, time.Hour)
+	blocklist := newDomainBlocklist(DomainBlocklistConfig{Path: path, ReloadInterval: time.Minute}, audit)
+	ctx := withDomainBlocklist(withStore(context.Background(), store), blocklist)
+
+	// Test 1: Shortening a blocked destination is rejected
+	shortenReqBody := strings.NewReader(`{"url": "https://www.banned.example/offer"}`)
+	shortenReq, _ := http.NewRequest("POST", "/shorten", shortenReqBody)
+	shortenRR := httptest.NewRecorder()
+	serveWithContext(ctx, shortenUrl).ServeHTTP(shortenRR, shortenReq)
+
+	if status := shortenRR.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	var response urlValidationError
+	json.NewDecoder(shortenRR.Body).Decode(&response)
+	if response.Code != "blocked_domain" {
+		t.Errorf("got error code %v want %v", response.Code, "blocked_domain")
+	}
+
+	// Test 2: Links created before the ban stop resolving
+	shortCode := uuid.NewString()[:8]
+	store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "https://cdn.banned.example/file", ShortCode: shortCode})
+	defer removeCachedUrl(ctx, shortCode)
+
+	redirectReq, _ := http.NewRequest("GET", "/redirect?code="+shortCode, nil)
+	redirectRR := httptest.NewRecorder()
+	serveWithContext(ctx, redirectToOriginalUrl).ServeHTTP(redirectRR, redirectReq)
+
+	if status := redirectRR.Code; status != http.StatusForbidden {
+		t.Errorf("redirect returned wrong status code: got %v want %v", status, http.StatusForbidden)
+	}
+
+	// Test 3: Both attempts end up in the audit log
+	if err := audit.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if len(store.blocked) != 2 {
+		t.Fatalf("got %d blocked attempts want 2", len(store.blocked))
+	}
+	if store.blocked[0].Action != "shorten" || store.blocked[1].Action != "redirect" {
+		t.Errorf("got actions %v and %v want shorten and redirect", store.blocked[0].Action, store.blocked[1].Action)
+	}
+	if store.blocked[1].ShortCode == nil || *store.blocked[1].ShortCode != shortCode {
+		t.Errorf("redirect attempt should record the short code %v", shortCode)
+	}
+}
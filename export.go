@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportFlushInterval is the number of links written between two flushes
+// of an export, each flush also extends the write deadline by
+// exportWriteTimeout so large exports are not cut off by the server's
+// write timeout while slow clients still are.
+const (
+	exportFlushInterval = 1000
+	exportWriteTimeout  = 30 * time.Second
+)
+
+// exportColumn is a column of GET /user/urls/export. value returns nil for
+// an empty cell, numbers and booleans keep their type in JSON Lines.
+type exportColumn struct {
+	name  string
+	value func(urlModel *UrlShortener, now time.Time) interface{}
+}
+
+// exportColumns are every column in the default order of an export.
+var exportColumns = []exportColumn{
+	{"short_code", func(u *UrlShortener, now time.Time) interface{} { return u.ShortCode }},
+	{"original_url", func(u *UrlShortener, now time.Time) interface{} { return u.OriginalUrl }},
+	{"status", func(u *UrlShortener, now time.Time) interface{} { return linkStatus(u, now) }},
+	{"views", func(u *UrlShortener, now time.Time) interface{} { return u.Views }},
+	{"last_viewed", func(u *UrlShortener, now time.Time) interface{} { return exportTime(u.LastViewed) }},
+	{"created_at", func(u *UrlShortener, now time.Time) interface{} { return exportTime(&u.CreatedAt) }},
+	{"updated_at", func(u *UrlShortener, now time.Time) interface{} { return exportTime(&u.UpdatedAt) }},
+	{"expires_at", func(u *UrlShortener, now time.Time) interface{} { return exportTime(u.ExpiresAt) }},
+	{"deleted_at", func(u *UrlShortener, now time.Time) interface{} { return exportTime(u.DeletedAt) }},
+	{"redirect_type", func(u *UrlShortener, now time.Time) interface{} { return u.RedirectType }},
+	{"password_protected", func(u *UrlShortener, now time.Time) interface{} { return u.Password != nil }},
+	{"workspace_id", func(u *UrlShortener, now time.Time) interface{} {
+		if u.WorkspaceId == nil {
+			return nil
+		}
+		return *u.WorkspaceId
+	}},
+}
+
+func exportTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+
+	return t.UTC().Format(time.RFC3339)
+}
+
+// parseExportColumns resolves the comma separated columns parameter, all
+// columns when it is empty.
+func parseExportColumns(raw string) ([]exportColumn, error) {
+	if raw == "" {
+		return exportColumns, nil
+	}
+
+	columns := []exportColumn{}
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+
+		found := false
+		for _, column := range exportColumns {
+			if column.name == name {
+				columns = append(columns, column)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+	}
+
+	return columns, nil
+}
+
+// exportWriter writes the rows of one export format.
+type exportWriter interface {
+	writeHeader(columns []exportColumn) error
+	writeRow(columns []exportColumn, values []interface{}) error
+	flush() error
+}
+
+type csvExportWriter struct {
+	w      io.Writer
+	writer *csv.Writer
+	// excel starts the file with a byte order mark, without one Excel does
+	// not read it as UTF-8, and escapes the cells Excel would run as a
+	// formula.
+	excel bool
+}
+
+func (e *csvExportWriter) writeHeader(columns []exportColumn) error {
+	if e.excel {
+		if _, err := io.WriteString(e.w, "\ufeff"); err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.name
+	}
+
+	return e.writer.Write(names)
+}
+
+func (e *csvExportWriter) writeRow(columns []exportColumn, values []interface{}) error {
+	cells := make([]string, len(values))
+	for i, value := range values {
+		if value != nil {
+			cells[i] = fmt.Sprint(value)
+		}
+		if e.excel && cells[i] != "" && strings.ContainsAny(cells[i][:1], "=+-@") {
+			cells[i] = "'" + cells[i]
+		}
+	}
+
+	return e.writer.Write(cells)
+}
+
+func (e *csvExportWriter) flush() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+type jsonlExportWriter struct {
+	encoder *json.Encoder
+}
+
+func (e *jsonlExportWriter) writeHeader(columns []exportColumn) error {
+	return nil
+}
+
+func (e *jsonlExportWriter) writeRow(columns []exportColumn, values []interface{}) error {
+	row := make(map[string]interface{}, len(columns))
+	for i, column := range columns {
+		row[column.name] = values[i]
+	}
+
+	return e.encoder.Encode(row)
+}
+
+func (e *jsonlExportWriter) flush() error {
+	return nil
+}
+
+// newExportWriter returns the writer, content type and file extension of
+// format: csv, jsonl or excel, a CSV meant to be opened in Excel.
+func newExportWriter(w io.Writer, format string) (exportWriter, string, string, error) {
+	switch format {
+	case "", "csv":
+		return &csvExportWriter{w: w, writer: csv.NewWriter(w)}, "text/csv; charset=utf-8", "csv", nil
+	case "jsonl":
+		return &jsonlExportWriter{encoder: json.NewEncoder(w)}, "application/x-ndjson", "jsonl", nil
+	case "excel":
+		writer := csv.NewWriter(w)
+		writer.UseCRLF = true
+		return &csvExportWriter{w: w, writer: writer, excel: true}, "text/csv; charset=utf-8", "csv", nil
+	default:
+		return nil, "", "", errors.New("format must be csv, jsonl or excel")
+	}
+}
+
+// exportUserUrls streams the links of the user as a file. Only the active
+// links are exported unless include_inactive or status is set, the other
+// parameters of parseUrlFilter narrow them down further and columns picks
+// the columns. Links are read and written in batches, the export is never held
+// in memory as a whole.
+func exportUserUrls(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := getUserFromContext(ctx)
+
+	columns, err := parseExportColumns(r.URL.Query().Get("columns"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filter, err := parseUrlFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filter.Status == "" {
+		includeInactive := false
+		if raw := r.URL.Query().Get("include_inactive"); raw != "" {
+			if includeInactive, err = strconv.ParseBool(raw); err != nil {
+				http.Error(w, "include_inactive must be true or false", http.StatusBadRequest)
+				return
+			}
+		}
+		if !includeInactive {
+			filter.Status = linkStatusActive
+		}
+	}
+
+	writer, contentType, extension, err := newExportWriter(w, r.URL.Query().Get("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="links.`+extension+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	// The response time middleware buffers responses unless told otherwise.
+	if streamer, ok := w.(interface{ Stream() }); ok {
+		streamer.Stream()
+	}
+	controller := http.NewResponseController(w)
+	controller.SetWriteDeadline(time.Now().Add(exportWriteTimeout))
+
+	written := 0
+	now := time.Now()
+	values := make([]interface{}, len(columns))
+
+	err = writer.writeHeader(columns)
+	if err == nil {
+		err = getStoreFromContext(ctx).EachUrlByUserId(ctx, user.Id, filter, func(urlModel UrlShortener) error {
+			for i, column := range columns {
+				values[i] = column.value(&urlModel, now)
+			}
+			if err := writer.writeRow(columns, values); err != nil {
+				return err
+			}
+
+			written++
+			if written%exportFlushInterval == 0 {
+				if err := writer.flush(); err != nil {
+					return err
+				}
+				controller.Flush()
+				controller.SetWriteDeadline(time.Now().Add(exportWriteTimeout))
+			}
+			return nil
+		})
+	}
+	if err == nil {
+		err = writer.flush()
+	}
+
+	// The status was sent already, the client sees a truncated file.
+	if err != nil {
+		log.Printf("Error exporting links of user %d after %d rows: %v request_id=%s", user.Id, written, err, getRequestIdFromContext(ctx))
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestExportUserUrls(t *testing.T) {
+	initRedis(defaultConfig().Redis)
+
+	store := newMemoryLinkStore()
+	ctx := context.Background()
+	user := &Users{Email: uuid.NewString() + "@example.com", ApiKey: uuid.NewString()}
+	store.CreateUser(ctx, user)
+
+	now := time.Now()
+	active := &UrlShortener{OriginalUrl: "http://example.com/active", ShortCode: uuid.NewString()[:8], UserId: &user.Id, Views: 3, CreatedAt: now.Add(-2 * time.Hour)}
+	deleted := &UrlShortener{OriginalUrl: "http://example.com/deleted", ShortCode: uuid.NewString()[:8], UserId: &user.Id, CreatedAt: now.Add(-time.Hour), Password: addressOf("hash")}
+	for _, urlShortener := range []*UrlShortener{active, deleted} {
+		store.InsertUrl(ctx, urlShortener)
+	}
+	store.DeleteUrl(ctx, deleted.ShortCode)
+
+	router := newTestRouter(t, store, nil, nil)
+
+	// Test 1: CSV with every column, only active links by default
+	rr := serveUsersRequest(router, "GET", "/user/urls/export", user.ApiKey, "")
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "text/csv; charset=utf-8" || rr.Header().Get("X-Response-Time") == "" {
+		t.Fatalf("got %v %v want a CSV with a response time", rr.Code, rr.Header())
+	}
+
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil || len(records) != 2 {
+		t.Fatalf("got %v, %v want a header and one link", records, err)
+	}
+	if len(records[0]) != len(exportColumns) || records[0][0] != "short_code" {
+		t.Errorf("got header %v want every column", records[0])
+	}
+	if records[1][0] != active.ShortCode || records[1][2] != linkStatusActive || records[1][3] != "3" {
+		t.Errorf("got row %v want %s active with 3 views", records[1], active.ShortCode)
+	}
+
+	// Test 2: JSON Lines with selected columns and inactive links
+	rr = serveUsersRequest(router, "GET", "/user/urls/export?format=jsonl&include_inactive=true&columns=short_code,status,password_protected", user.ApiKey, "")
+	lines := []map[string]interface{}{}
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		json.Unmarshal(scanner.Bytes(), &line)
+		lines = append(lines, line)
+	}
+
+	if len(lines) != 2 || len(lines[1]) != 3 || lines[1]["short_code"] != deleted.ShortCode || lines[1]["status"] != linkStatusDeleted || lines[1]["password_protected"] != true {
+		t.Errorf("got %v want both links, the deleted one password protected", lines)
+	}
+
+	// Test 3: The Excel flavour starts with a byte order mark and uses CRLF
+	rr = serveUsersRequest(router, "GET", "/user/urls/export?format=excel&columns=original_url&created_from="+now.Add(-3*time.Hour).UTC().Format(time.DateOnly), user.ApiKey, "")
+	if body := rr.Body.String(); body != "\ufefforiginal_url\r\n"+active.OriginalUrl+"\r\n" {
+		t.Errorf("got %q want a byte order mark, CRLF and the active link", body)
+	}
+
+	// Test 4: Excel cells that would run as a formula are escaped, plain
+	// CSV keeps them as they are
+	formulaUser := &Users{Email: uuid.NewString() + "@example.com", ApiKey: uuid.NewString()}
+	store.CreateUser(ctx, formulaUser)
+	for _, shortCode := range []string{"=1+1", "+1", "-1", "@SUM(A1)"} {
+		store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com", ShortCode: shortCode + uuid.NewString()[:8], UserId: &formulaUser.Id})
+	}
+
+	rr = serveUsersRequest(router, "GET", "/user/urls/export?format=excel&columns=short_code", formulaUser.ApiKey, "")
+	records, _ = csv.NewReader(strings.NewReader(strings.TrimPrefix(rr.Body.String(), "\ufeff"))).ReadAll()
+	if len(records) != 5 {
+		t.Fatalf("got %v want a header and four links", records)
+	}
+	for _, record := range records[1:] {
+		if !strings.HasPrefix(record[0], "'") {
+			t.Errorf("got cell %q want it prefixed with '", record[0])
+		}
+	}
+
+	rr = serveUsersRequest(router, "GET", "/user/urls/export?columns=short_code", formulaUser.ApiKey, "")
+	records, _ = csv.NewReader(rr.Body).ReadAll()
+	for _, record := range records[1:] {
+		if strings.HasPrefix(record[0], "'") {
+			t.Errorf("got CSV cell %q want it unchanged", record[0])
+		}
+	}
+
+	// Test 5: Invalid parameters are rejected before anything is written
+	for _, query := range []string{"columns=secret", "format=xlsx", "created_to=yesterday", "include_inactive=maybe"} {
+		if rr := serveUsersRequest(router, "GET", "/user/urls/export?"+query, user.ApiKey, ""); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %v want %v", query, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
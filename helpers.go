@@ -1,45 +1,214 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
 	"context"
 
-	"github.com/go-redis/redis"
-	"gorm.io/gorm"
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
 )
 
 var counter uint64
 var lastCounterEpochTimestamp int64
 
-func ctxServiceHandler(serviceFunc func(ctx *context.Context, w http.ResponseWriter, r *http.Request), ctx *context.Context) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		serviceFunc(ctx, w, r)
+// contextKey keeps the request scoped values from colliding with keys set by
+// other packages.
+type contextKey int
+
+const (
+	storeContextKey contextKey = iota
+	userContextKey
+	requestIdContextKey
+	clickRecorderContextKey
+	domainBlocklistContextKey
+	plansContextKey
+	clientIpContextKey
+)
+
+func withStore(ctx context.Context, store LinkStore) context.Context {
+	return context.WithValue(ctx, storeContextKey, store)
+}
+
+func getStoreFromContext(ctx context.Context) LinkStore {
+	return ctx.Value(storeContextKey).(LinkStore)
+}
+
+func withUser(ctx context.Context, user *Users) context.Context {
+	return context.WithValue(ctx, userContextKey, user)
+}
+
+func getUserFromContext(ctx context.Context) *Users {
+	user, _ := ctx.Value(userContextKey).(*Users)
+	return user
+}
+
+func withRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdContextKey, requestId)
+}
+
+func getRequestIdFromContext(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdContextKey).(string)
+	return requestId
+}
+
+func withClickRecorder(ctx context.Context, clickRecorder *batchWriter[Clicks]) context.Context {
+	return context.WithValue(ctx, clickRecorderContextKey, clickRecorder)
+}
+
+func getClickRecorderFromContext(ctx context.Context) *batchWriter[Clicks] {
+	clickRecorder, _ := ctx.Value(clickRecorderContextKey).(*batchWriter[Clicks])
+	return clickRecorder
+}
+
+func withDomainBlocklist(ctx context.Context, blocklist *domainBlocklist) context.Context {
+	return context.WithValue(ctx, domainBlocklistContextKey, blocklist)
+}
+
+func getDomainBlocklistFromContext(ctx context.Context) *domainBlocklist {
+	blocklist, _ := ctx.Value(domainBlocklistContextKey).(*domainBlocklist)
+	return blocklist
+}
+
+func withPlans(ctx context.Context, plans PlansConfig) context.Context {
+	return context.WithValue(ctx, plansContextKey, plans)
+}
+
+// getPlansFromContext falls back to the built-in plans.
+func getPlansFromContext(ctx context.Context) PlansConfig {
+	plans, ok := ctx.Value(plansContextKey).(PlansConfig)
+	if !ok {
+		return defaultConfig().Plans
 	}
+	return plans
 }
 
-func addValueToContext(ctx *context.Context, key, value interface{}) context.Context {
-	return context.WithValue(*ctx, key, value)
+func withClientIp(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIpContextKey, ip)
 }
 
-func getDbFromContext(ctx *context.Context) *gorm.DB {
-	return (*ctx).Value("db").(*gorm.DB)
+func getClientIpFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIpContextKey).(string)
+	return ip
 }
 
-func getUserFromContext(ctx *context.Context) *Users {
-	user := (*ctx).Value("user")
-	if user == nil {
-		return nil
+// reservedShortCodes are the first path segments used by the router, a custom
+// short code with one of these names would never be reachable through
+// GET /{code}. Keep in sync with newRouter.
+var reservedShortCodes = map[string]bool{
+	"health":      true,
+	"shorten":     true,
+	"redirect":    true,
+	"user":        true,
+	"users":       true,
+	"workspaces":  true,
+	"jobs":        true,
+	"admin":       true,
+	"favicon.ico": true,
+	"robots.txt":  true,
+}
+
+func isReservedShortCode(shortCode string) bool {
+	return reservedShortCodes[strings.ToLower(shortCode)]
+}
+
+// isRedirectRequest reports whether r is served by one of the redirect
+// routes, either /redirect?code= or the GET /{code} catch-all.
+func isRedirectRequest(r *http.Request) bool {
+	if r.URL.Path == "/redirect" {
+		return true
 	}
 
-	return user.(*Users)
+	route := mux.CurrentRoute(r)
+	return route != nil && (route.GetName() == "redirect" || route.GetName() == "resolve_code")
+}
+
+// defaultRedirectType is used for links created without a redirect_type and
+// for entries cached before the field existed.
+const defaultRedirectType = http.StatusTemporaryRedirect
+
+var redirectTypes = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
+func isValidRedirectType(redirectType int) bool {
+	return redirectTypes[redirectType]
 }
 
-func createShortCode(ctx *context.Context, retryCount uint) string {
+func redirectStatusCode(urlModel *UrlShortener) int {
+	if !isValidRedirectType(urlModel.RedirectType) {
+		return defaultRedirectType
+	}
+
+	return urlModel.RedirectType
+}
+
+func createShortCode(ctx context.Context, retryCount uint) string {
+	shortCode := nextShortCode()
+
+	shortCodeExists := doesShortCodeExist(ctx, shortCode)
+	if shortCodeExists {
+		if retryCount > MAX_RETRIES {
+			errMsg := "Error creating short url, max retry count exceded " + shortCode
+			panic(errMsg)
+		}
+		return createShortCode(ctx, retryCount+1)
+	}
+
+	return shortCode
+}
+
+// createShortCodes returns n short codes that no link has, in any state, and
+// that are not in exclude. Each round checks all its codes with one query.
+func createShortCodes(ctx context.Context, n int, exclude map[string]bool) ([]string, error) {
+	shortCodes := make([]string, n)
+	missing := make([]int, n)
+	for i := range missing {
+		missing[i] = i
+	}
+
+	for retryCount := uint(0); len(missing) > 0; retryCount++ {
+		if retryCount > MAX_RETRIES {
+			return nil, errors.New("max retry count exceeded creating short codes")
+		}
+
+		candidates := make([]string, len(missing))
+		for j, i := range missing {
+			shortCodes[i] = nextShortCode()
+			candidates[j] = shortCodes[i]
+		}
+
+		taken, err := getStoreFromContext(ctx).TakenShortCodes(ctx, candidates)
+		if err != nil {
+			return nil, err
+		}
+
+		stillMissing := []int{}
+		for _, i := range missing {
+			if taken[shortCodes[i]] || exclude[shortCodes[i]] {
+				stillMissing = append(stillMissing, i)
+			}
+		}
+		missing = stillMissing
+	}
+
+	return shortCodes, nil
+}
+
+// nextShortCode derives a short code from the time and a counter, without
+// checking whether a link already has it.
+func nextShortCode() string {
 	// get current time in epoch starting from 1st Jan 2025
 	currentEpochTime := getCustomEpochTime()
 
@@ -65,18 +234,7 @@ func createShortCode(ctx *context.Context, retryCount uint) string {
 
 	stringShortCode := strconv.FormatInt(currentEpochTime, 10) + strconv.FormatUint(count, 10)
 	numbericShortCode, _ := strconv.ParseInt(stringShortCode, 10, 64)
-	shortCode := toBase36(numbericShortCode)
-
-	shortCodeExists := doesShortCodeExist(ctx, shortCode)
-	if shortCodeExists {
-		if retryCount > MAX_RETRIES {
-			errMsg := "Error creating short url, max retry count exceded " + shortCode
-			panic(errMsg)
-		}
-		return createShortCode(ctx, retryCount+1)
-	}
-
-	return shortCode
+	return toBase36(numbericShortCode)
 }
 
 func getCustomEpochTime() int64 {
@@ -102,110 +260,157 @@ func toBase36(num int64) string {
 	return string(result)
 }
 
-func doesShortCodeExist(ctx *context.Context, shortCode string) bool {
-	db := getDbFromContext(ctx)
-	var exists int64
-
-	urlModel, _ := getCachedUrl(shortCode)
+func doesShortCodeExist(ctx context.Context, shortCode string) bool {
+	urlModel, _ := getCachedUrl(ctx, shortCode)
 	if urlModel != nil {
 		return true
 	}
 
-	result := db.Model(&UrlShortener{}).
-		Where("short_code = ?", shortCode).
-		Where("deleted_at IS NULL").
-		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
-		Count(&exists)
-
-	if result.Error != nil {
+	exists, err := getStoreFromContext(ctx).ShortCodeExists(ctx, shortCode)
+	if err != nil {
 		return false
 	}
 
-	return exists > 0
+	return exists
 }
 
-func insertUrl(ctx *context.Context, urlShortener *UrlShortener) *error {
-	db := getDbFromContext(ctx)
-	result := db.Create(urlShortener)
+// isShortCodeTaken also counts deleted and expired links, which keep their
+// short code until they are purged.
+func isShortCodeTaken(ctx context.Context, shortCode string) (bool, error) {
+	if doesShortCodeExist(ctx, shortCode) {
+		return true, nil
+	}
 
-	if result.Error != nil {
-		return &result.Error
+	_, err := getStoreFromContext(ctx).GetUrl(ctx, shortCode)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
 	}
 
-	return nil
+	return err == nil, err
 }
 
-func getUrlModel(ctx *context.Context, shortCode string) *UrlShortener {
-	db := getDbFromContext(ctx)
+func getUrlModel(ctx context.Context, shortCode string) *UrlShortener {
+	urlShortener, err := getStoreFromContext(ctx).GetActiveUrl(ctx, shortCode)
+	if err != nil {
+		return nil
+	}
 
-	urlShortener := UrlShortener{}
-	result := db.
-		Model(&UrlShortener{}).
-		Where("short_code = ?", shortCode).
-		Where("deleted_at IS NULL").
-		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
-		First(&urlShortener)
+	return urlShortener
+}
 
-	if result.Error != nil {
+func deleteUrl(ctx context.Context, shortCode string) error {
+	return getStoreFromContext(ctx).DeleteUrl(ctx, shortCode)
+}
+
+func activateUrl(ctx context.Context, shortCode string) error {
+	return getStoreFromContext(ctx).ActivateUrl(ctx, shortCode)
+}
+
+func getUserFromApiKeyIfExists(ctx context.Context, apiKey string) *Users {
+	user, err := getStoreFromContext(ctx).GetUserByApiKey(ctx, apiKey)
+	if err != nil {
 		return nil
 	}
 
-	return &urlShortener
+	return user
 }
 
-func deleteUrl(ctx *context.Context, shortCode string) error {
-	db := getDbFromContext(ctx)
-	now := time.Now()
-	newUrlShortener := UrlShortener{
-		DeletedAt: &now,
+func getUrlsByUserId(ctx context.Context, userId uint, filter UrlFilter, sort UrlSort, page int, pageSize int) []UrlShortener {
+	urls, _ := getStoreFromContext(ctx).GetUrlsByUserId(ctx, userId, filter, sort, page, pageSize)
+
+	return urls
+}
+
+// parseFilterTime accepts an RFC 3339 timestamp or a date. A date stands for
+// the start of the day, or its end when endOfDay is set, so a date range
+// includes both days.
+func parseFilterTime(raw string, endOfDay bool) (*time.Time, error) {
+	if raw == "" {
+		return nil, nil
 	}
 
-	result := db.Model(UrlShortener{}).
-		Where(UrlShortener{
-			ShortCode: shortCode,
-		}).Updates(newUrlShortener)
+	if parsed, err := time.Parse(time.RFC3339, raw); err == nil {
+		return &parsed, nil
+	}
 
-	if result.Error != nil {
-		return result.Error
+	parsed, err := time.Parse(time.DateOnly, raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid date %q, expected YYYY-MM-DD or RFC 3339", raw)
+	}
+	if endOfDay {
+		parsed = parsed.Add(24*time.Hour - time.Nanosecond)
 	}
 
-	return nil
+	return &parsed, nil
 }
 
-func activateUrl(ctx *context.Context, shortCode string) error {
-	db := getDbFromContext(ctx)
+// maxUrlSearchLength bounds the search parameter of the link listings.
+const maxUrlSearchLength = 200
 
-	result := db.Model(&UrlShortener{}).
-		Where("short_code = ?", shortCode).
-		Update("deleted_at", nil)
+// parseUrlFilter reads status, search, created_from and created_to from the
+// query string.
+func parseUrlFilter(r *http.Request) (UrlFilter, error) {
+	query := r.URL.Query()
+	filter := UrlFilter{
+		Status: query.Get("status"),
+		Search: strings.TrimSpace(query.Get("search")),
+	}
 
-	if result.Error != nil {
-		return result.Error
+	switch filter.Status {
+	case "", linkStatusActive, linkStatusDeleted, linkStatusExpired, urlFilterPasswordProtected:
+	default:
+		return filter, errors.New("status must be active, deleted, expired or password_protected")
+	}
+	if len(filter.Search) > maxUrlSearchLength {
+		return filter, fmt.Errorf("search must be at most %d characters", maxUrlSearchLength)
 	}
 
-	return nil
-}
+	var err error
+	if filter.CreatedFrom, err = parseFilterTime(query.Get("created_from"), false); err != nil {
+		return filter, err
+	}
+	if filter.CreatedTo, err = parseFilterTime(query.Get("created_to"), true); err != nil {
+		return filter, err
+	}
 
-func getUserFromApiKeyIfExists(ctx *context.Context, apiKey string) *Users {
-	db := getDbFromContext(ctx)
-	var user Users
+	return filter, nil
+}
 
-	result := db.Where("api_key = ?", apiKey).First(&user)
-	if result.Error != nil {
-		return nil
+// parseUrlSort reads the sort parameter, a field of UrlSort that a leading
+// "-" sorts in descending order, e.g. sort=-views.
+func parseUrlSort(r *http.Request) (UrlSort, error) {
+	raw := r.URL.Query().Get("sort")
+	sort := UrlSort{Field: strings.TrimPrefix(raw, "-"), Descending: strings.HasPrefix(raw, "-")}
+
+	switch sort.Field {
+	case "", urlSortCreatedAt, urlSortViews, urlSortLastViewed:
+		return sort, nil
+	default:
+		return sort, errors.New("sort must be created_at, views or last_viewed, optionally prefixed with -")
 	}
+}
 
-	return &user
+// optional tells a JSON field that was left out apart from one that was set
+// to null, so a PUT can clear a value without touching the absent ones.
+type optional[T any] struct {
+	Set   bool
+	Value *T
 }
 
-func getUrlsByUserId(ctx *context.Context, userId uint, page int, pageSize int) []UrlShortener {
-	db := getDbFromContext(ctx)
-	var urls []UrlShortener
+func (o *optional[T]) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	if string(data) == "null" {
+		o.Value = nil
+		return nil
+	}
 
-	offset := (page - 1) * pageSize
-	db.Where("user_id = ?", userId).Limit(pageSize).Offset(offset).Find(&urls)
+	var value T
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	o.Value = &value
 
-	return urls
+	return nil
 }
 
 func addressOf[T any](v T) *T {
@@ -217,6 +422,7 @@ func newResponseWriter(w http.ResponseWriter) *CustomResponseWriter {
 		ResponseWriter: w,
 		headers:        make(http.Header),
 		statusCode:     http.StatusOK,
+		startTime:      time.Now(),
 	}
 }
 
@@ -229,11 +435,43 @@ func (rw *CustomResponseWriter) WriteHeader(statusCode int) {
 }
 
 func (rw *CustomResponseWriter) Write(b []byte) (int, error) {
+	if rw.streaming {
+		return rw.ResponseWriter.Write(b)
+	}
+
 	rw.body = append(rw.body, b...)
 	return len(b), nil
 }
 
+// Stream sends the headers and the status code right away and writes the
+// rest of the body straight through, for responses too large to buffer.
+// X-Response-Time is then the time until the response started.
+func (rw *CustomResponseWriter) Stream() {
+	if rw.streaming {
+		return
+	}
+
+	rw.headers.Set("X-Response-Time", time.Since(rw.startTime).String())
+	rw.Flush()
+	rw.body = nil
+	rw.streaming = true
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (rw *CustomResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Flush writes the buffered response, or only flushes the connection once
+// the response is streamed.
 func (rw *CustomResponseWriter) Flush() {
+	if rw.streaming {
+		if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		return
+	}
+
 	// Copy all headers to the original response writer
 	for k, v := range rw.headers {
 		for _, val := range v {
@@ -248,7 +486,7 @@ func (rw *CustomResponseWriter) Flush() {
 	rw.ResponseWriter.Write(rw.body)
 }
 
-func cacheUrl(shortCode string, urlModel *UrlShortener) error {
+func cacheUrl(ctx context.Context, shortCode string, urlModel *UrlShortener) error {
 	data, err := json.Marshal(urlModel)
 	if err != nil {
 		return err
@@ -262,11 +500,11 @@ func cacheUrl(shortCode string, urlModel *UrlShortener) error {
 		}
 	}
 
-	return redisClient.Set(shortCode, data, expiration).Err()
+	return redisClient.Set(ctx, shortCode, data, expiration).Err()
 }
 
-func getCachedUrl(shortCode string) (*UrlShortener, error) {
-	data, err := redisClient.Get(shortCode).Bytes()
+func getCachedUrl(ctx context.Context, shortCode string) (*UrlShortener, error) {
+	data, err := redisClient.Get(ctx, shortCode).Bytes()
 	if err != nil {
 		if err == redis.Nil {
 			// Key does not exist
@@ -283,14 +521,14 @@ func getCachedUrl(shortCode string) (*UrlShortener, error) {
 	return &urlModel, nil
 }
 
-func removeCachedUrl(shortCode string) error {
-	return redisClient.Del(shortCode).Err()
+func removeCachedUrl(ctx context.Context, shortCode string) error {
+	return redisClient.Del(ctx, shortCode).Err()
 }
 
-func updateCachedUrl(shortCode string, urlModel *UrlShortener) error {
-	cachedUrl, _ := getCachedUrl(shortCode)
+func updateCachedUrl(ctx context.Context, shortCode string, urlModel *UrlShortener) error {
+	cachedUrl, _ := getCachedUrl(ctx, shortCode)
 
-	err := removeCachedUrl(shortCode)
+	err := removeCachedUrl(ctx, shortCode)
 	if err != nil {
 		return err
 	}
@@ -299,5 +537,35 @@ func updateCachedUrl(shortCode string, urlModel *UrlShortener) error {
 		return nil
 	}
 
-	return cacheUrl(shortCode, urlModel)
+	return cacheUrl(ctx, shortCode, urlModel)
+}
+
+// encodeUrlCursor returns the opaque cursor of GET /user/urls pointing
+// after urlModel.
+func encodeUrlCursor(urlModel UrlShortener) string {
+	raw, _ := json.Marshal(urlCursorJson{CreatedAt: urlModel.CreatedAt, ShortCode: urlModel.ShortCode})
+
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// decodeUrlCursor reads a cursor of encodeUrlCursor.
+func decodeUrlCursor(raw string) (*UrlCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+
+	var cursor urlCursorJson
+	if err := json.Unmarshal(decoded, &cursor); err != nil || cursor.ShortCode == "" {
+		return nil, errors.New("invalid cursor")
+	}
+
+	return &UrlCursor{CreatedAt: cursor.CreatedAt, ShortCode: cursor.ShortCode}, nil
+}
+
+// urlCursorJson is the content of a cursor. created_at keeps its offset, the
+// SQLite store compares the timestamps as text.
+type urlCursorJson struct {
+	CreatedAt time.Time `json:"c"`
+	ShortCode string    `json:"s"`
 }
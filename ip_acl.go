@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Scopes and actions of IP rules. The redirect scope covers the redirect
+// routes, management everything else.
+const (
+	ipRuleScopeManagement = "management"
+	ipRuleScopeRedirect   = "redirect"
+	ipRuleActionAllow     = "allow"
+	ipRuleActionDeny      = "deny"
+)
+
+type ipAclRule struct {
+	scope  string
+	action string
+	prefix netip.Prefix
+}
+
+// ipAcl refuses requests by client address. A scope with allow rules only
+// lets in the addresses they match, deny rules win over allow rules. The
+// rules of the config are fixed, the ones of the store are managed through
+// /admin/ip-rules and re-read at most once per ReloadInterval, right away
+// after a change on this instance.
+type ipAcl struct {
+	cfg   IpAclConfig
+	store LinkStore
+
+	mu          sync.RWMutex
+	configRules []ipAclRule
+	storeRules  []ipAclRule
+	// lastLoad is when the last reload started, it is moved forward before
+	// reading the store so a single request reloads stale rules.
+	lastLoad time.Time
+	// loadMu keeps a slow read of the store from replacing the rules of a
+	// later one.
+	loadMu sync.Mutex
+}
+
+func newIpAcl(cfg IpAclConfig, store LinkStore) *ipAcl {
+	acl := &ipAcl{cfg: cfg, store: store}
+
+	for _, list := range []struct {
+		scope  string
+		action string
+		values []string
+	}{
+		{ipRuleScopeManagement, ipRuleActionAllow, cfg.Management.Allow},
+		{ipRuleScopeManagement, ipRuleActionDeny, cfg.Management.Deny},
+		{ipRuleScopeRedirect, ipRuleActionAllow, cfg.Redirect.Allow},
+		{ipRuleScopeRedirect, ipRuleActionDeny, cfg.Redirect.Deny},
+	} {
+		for _, value := range list.values {
+			prefix, err := parsePrefix(value)
+			if err != nil {
+				log.Printf("Warning: Skipping IP %s rule: %v", list.action, err)
+				continue
+			}
+			acl.configRules = append(acl.configRules, ipAclRule{scope: list.scope, action: list.action, prefix: prefix})
+		}
+	}
+
+	if err := acl.reload(context.Background()); err != nil {
+		log.Printf("Warning: Failed to load IP rules: %v", err)
+	}
+
+	return acl
+}
+
+// reloadIfStale reloads the rules once ReloadInterval passed. The requests
+// arriving while another one reloads keep using the rules read before.
+func (a *ipAcl) reloadIfStale(ctx context.Context) error {
+	a.mu.Lock()
+	isFresh := time.Since(a.lastLoad) < a.cfg.ReloadInterval
+	if !isFresh {
+		a.lastLoad = time.Now()
+	}
+	a.mu.Unlock()
+
+	if isFresh {
+		return nil
+	}
+
+	return a.load(ctx)
+}
+
+// reload reads the rules of the store. On errors the rules read before stay
+// in place.
+func (a *ipAcl) reload(ctx context.Context) error {
+	a.mu.Lock()
+	a.lastLoad = time.Now()
+	a.mu.Unlock()
+
+	return a.load(ctx)
+}
+
+func (a *ipAcl) load(ctx context.Context) error {
+	a.loadMu.Lock()
+	defer a.loadMu.Unlock()
+
+	stored, err := a.store.ListIpRules(ctx)
+	if err != nil {
+		return err
+	}
+
+	rules := []ipAclRule{}
+	for _, rule := range stored {
+		prefix, err := parsePrefix(rule.Cidr)
+		if err != nil {
+			log.Printf("Warning: Skipping IP rule %d: %v", rule.Id, err)
+			continue
+		}
+		rules = append(rules, ipAclRule{scope: rule.Scope, action: rule.Action, prefix: prefix})
+	}
+
+	a.mu.Lock()
+	a.storeRules = rules
+	a.mu.Unlock()
+	return nil
+}
+
+// allowed reports whether addr may make a request of scope. An address that
+// could not be parsed matches no rule.
+func (a *ipAcl) allowed(ctx context.Context, scope string, addr netip.Addr) bool {
+	if err := a.reloadIfStale(ctx); err != nil {
+		log.Printf("Warning: Failed to reload IP rules: %v request_id=%s", err, getRequestIdFromContext(ctx))
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	hasAllowRules := false
+	isAllowed := false
+	for _, rules := range [][]ipAclRule{a.configRules, a.storeRules} {
+		for _, rule := range rules {
+			if rule.scope != scope {
+				continue
+			}
+
+			matches := rule.prefix.Contains(addr)
+			if rule.action == ipRuleActionDeny && matches {
+				return false
+			}
+			if rule.action == ipRuleActionAllow {
+				hasAllowRules = true
+				isAllowed = isAllowed || matches
+			}
+		}
+	}
+
+	return !hasAllowRules || isAllowed
+}
+
+// ipAclMiddleware answers 403 to the clients the acl refuses. It needs the
+// address found by clientIpMiddleware. Requests to /admin with the admin
+// token skip the acl, so a management rule locking out the admin can still
+// be deleted.
+func ipAclMiddleware(acl *ipAcl, admin AdminConfig) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/admin/") && hasAdminToken(r, admin) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			scope := ipRuleScopeManagement
+			if isRedirectRequest(r) {
+				scope = ipRuleScopeRedirect
+			}
+
+			addr, _ := netip.ParseAddr(clientIp(r))
+			if !acl.allowed(r.Context(), scope, addr) {
+				http.Error(w, "Your IP address is not allowed", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// adminMiddleware checks the X-Admin-Token header. Without a configured
+// token the admin endpoints do not exist.
+func adminMiddleware(cfg AdminConfig) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if cfg.Token == "" {
+				http.NotFound(w, r)
+				return
+			}
+
+			if !hasAdminToken(r, cfg) {
+				http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// hasAdminToken reports whether r carries the configured admin token.
+func hasAdminToken(r *http.Request, cfg AdminConfig) bool {
+	token := r.Header.Get("X-Admin-Token")
+	return cfg.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Token)) == 1
+}
+
+func ipRuleResponse(rule IpRules) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         rule.Id,
+		"scope":      rule.Scope,
+		"action":     rule.Action,
+		"cidr":       rule.Cidr,
+		"note":       rule.Note,
+		"created_at": rule.CreatedAt,
+	}
+}
+
+// listIpRules returns the rules of the store, the ones of the config are
+// not listed.
+func listIpRules(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	rules, err := getStoreFromContext(ctx).ListIpRules(ctx)
+	if err != nil {
+		http.Error(w, "Error listing the IP rules", http.StatusInternalServerError)
+		return
+	}
+
+	response := []map[string]interface{}{}
+	for _, rule := range rules {
+		response = append(response, ipRuleResponse(rule))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"rules": response})
+}
+
+// createIpRule adds a rule that applies on this instance right away and on
+// the others within ip_acl.reload_interval.
+func createIpRule(acl *ipAcl) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		var requestBody struct {
+			Scope  string `json:"scope"`
+			Action string `json:"action"`
+			Cidr   string `json:"cidr"`
+			Note   string `json:"note"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if requestBody.Scope != ipRuleScopeManagement && requestBody.Scope != ipRuleScopeRedirect {
+			http.Error(w, fmt.Sprintf("Scope must be %s or %s", ipRuleScopeManagement, ipRuleScopeRedirect), http.StatusBadRequest)
+			return
+		}
+		if requestBody.Action != ipRuleActionAllow && requestBody.Action != ipRuleActionDeny {
+			http.Error(w, fmt.Sprintf("Action must be %s or %s", ipRuleActionAllow, ipRuleActionDeny), http.StatusBadRequest)
+			return
+		}
+
+		prefix, err := parsePrefix(requestBody.Cidr)
+		if err != nil {
+			http.Error(w, "Invalid cidr: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		note := strings.TrimSpace(requestBody.Note)
+		if len(note) > 200 {
+			http.Error(w, "The note can be at most 200 characters long", http.StatusBadRequest)
+			return
+		}
+
+		rule := &IpRules{Scope: requestBody.Scope, Action: requestBody.Action, Cidr: prefix.String(), Note: note}
+		if err := getStoreFromContext(ctx).CreateIpRule(ctx, rule); err != nil {
+			http.Error(w, "Error creating the IP rule", http.StatusInternalServerError)
+			return
+		}
+
+		if err := acl.reload(ctx); err != nil {
+			log.Printf("Error reloading IP rules: %v request_id=%s", err, getRequestIdFromContext(ctx))
+		}
+		log.Printf("Added IP %s rule %d for %s on %s request_id=%s", rule.Action, rule.Id, rule.Cidr, rule.Scope, getRequestIdFromContext(ctx))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(ipRuleResponse(*rule))
+	}
+}
+
+func deleteIpRule(acl *ipAcl) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		ruleId, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 0)
+		if err != nil {
+			http.Error(w, "IP rule not found", http.StatusNotFound)
+			return
+		}
+
+		if err := getStoreFromContext(ctx).DeleteIpRule(ctx, uint(ruleId)); errors.Is(err, ErrNotFound) {
+			http.Error(w, "IP rule not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Error deleting the IP rule", http.StatusInternalServerError)
+			return
+		}
+
+		if err := acl.reload(ctx); err != nil {
+			log.Printf("Error reloading IP rules: %v request_id=%s", err, getRequestIdFromContext(ctx))
+		}
+		log.Printf("Deleted IP rule %d request_id=%s", ruleId, getRequestIdFromContext(ctx))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	}
+}
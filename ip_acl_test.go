@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newIpAclTestStore is a store with a link at abc123.
+func newIpAclTestStore(t *testing.T) LinkStore {
+	t.Helper()
+	initRedis(defaultConfig().Redis)
+
+	ctx := context.Background()
+	store := newMemoryLinkStore()
+	store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com", ShortCode: "abc123"})
+	t.Cleanup(func() { removeCachedUrl(ctx, "abc123") })
+
+	return store
+}
+
+func serveIpAclRequest(router http.Handler, method string, path string, remoteAddr string, adminToken string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.RemoteAddr = remoteAddr
+	if adminToken != "" {
+		req.Header.Set("X-Admin-Token", adminToken)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestIpAclConfigRules(t *testing.T) {
+	cfg := defaultConfig().IpAcl
+	cfg.Management.Allow = []string{"10.0.0.0/8", "2001:db8::/32"}
+	cfg.Management.Deny = []string{"10.0.0.66"}
+	cfg.Redirect.Deny = []string{"198.51.100.0/24"}
+	router := newTestRouter(t, newIpAclTestStore(t), nil, func(c *Config) { c.IpAcl = cfg })
+
+	tests := []struct {
+		path       string
+		remoteAddr string
+		want       int
+	}{
+		{path: "/health", remoteAddr: "10.1.2.3:1234", want: http.StatusOK},
+		{path: "/health", remoteAddr: "[2001:db8::7]:1234", want: http.StatusOK},
+		{path: "/health", remoteAddr: "[2001:db9::7]:1234", want: http.StatusForbidden},
+		{path: "/health", remoteAddr: "203.0.113.1:1234", want: http.StatusForbidden},
+		{path: "/health", remoteAddr: "10.0.0.66:1234", want: http.StatusForbidden},
+		{path: "/abc123", remoteAddr: "203.0.113.1:1234", want: http.StatusTemporaryRedirect},
+		{path: "/abc123", remoteAddr: "198.51.100.9:1234", want: http.StatusForbidden},
+		{path: "/abc123", remoteAddr: "10.0.0.66:1234", want: http.StatusTemporaryRedirect},
+	}
+
+	for _, test := range tests {
+		if rr := serveIpAclRequest(router, "GET", test.path, test.remoteAddr, "", ""); rr.Code != test.want {
+			t.Errorf("%s from %s: got %v want %v", test.path, test.remoteAddr, rr.Code, test.want)
+		}
+	}
+}
+
+func TestIpAclAdminRules(t *testing.T) {
+	token := "0123456789abcdef"
+	router := newTestRouter(t, newIpAclTestStore(t), nil, func(cfg *Config) { cfg.Admin.Token = token })
+
+	// Test 1: The admin endpoints need the token
+	if rr := serveIpAclRequest(router, "GET", "/admin/ip-rules", "127.0.0.1:1", "wrong", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+	disabled := newTestRouter(t, newMemoryLinkStore(), nil, nil)
+	if rr := serveIpAclRequest(disabled, "GET", "/admin/ip-rules", "127.0.0.1:1", "wrong", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("without a token configured: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// Test 2: Invalid rules are rejected
+	for _, body := range []string{
+		`{"scope": "everything", "action": "deny", "cidr": "10.0.0.0/8"}`,
+		`{"scope": "redirect", "action": "block", "cidr": "10.0.0.0/8"}`,
+		`{"scope": "redirect", "action": "deny", "cidr": "10.0.0.0/33"}`,
+	} {
+		if rr := serveIpAclRequest(router, "POST", "/admin/ip-rules", "127.0.0.1:1", token, body); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %v want %v", body, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	// Test 3: A new rule applies right away
+	rr := serveIpAclRequest(router, "POST", "/admin/ip-rules", "127.0.0.1:1", token, `{"scope": "redirect", "action": "deny", "cidr": "2001:db8::1/32", "note": "scrapers"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("got %v want %v", rr.Code, http.StatusCreated)
+	}
+	var rule struct {
+		Id   uint   `json:"id"`
+		Cidr string `json:"cidr"`
+	}
+	json.NewDecoder(rr.Body).Decode(&rule)
+	if rule.Cidr != "2001:db8::/32" {
+		t.Errorf("got cidr %v want the masked range", rule.Cidr)
+	}
+
+	if rr := serveIpAclRequest(router, "GET", "/abc123", "[2001:db8::5]:1", "", ""); rr.Code != http.StatusForbidden {
+		t.Errorf("denied redirect: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	if rr := serveIpAclRequest(router, "GET", "/health", "[2001:db8::5]:1", "", ""); rr.Code != http.StatusOK {
+		t.Errorf("management is another scope: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	rr = serveIpAclRequest(router, "GET", "/admin/ip-rules", "127.0.0.1:1", token, "")
+	var listed struct {
+		Rules []map[string]interface{} `json:"rules"`
+	}
+	json.NewDecoder(rr.Body).Decode(&listed)
+	if len(listed.Rules) != 1 || listed.Rules[0]["note"] != "scrapers" {
+		t.Errorf("got %+v want the new rule", listed.Rules)
+	}
+
+	// Test 4: Deleting the rule lifts it
+	if rr := serveIpAclRequest(router, "DELETE", fmt.Sprintf("/admin/ip-rules/%d", rule.Id), "127.0.0.1:1", token, ""); rr.Code != http.StatusOK {
+		t.Errorf("delete: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := serveIpAclRequest(router, "GET", "/abc123", "[2001:db8::5]:1", "", ""); rr.Code != http.StatusTemporaryRedirect {
+		t.Errorf("after the delete: got %v want %v", rr.Code, http.StatusTemporaryRedirect)
+	}
+	if rr := serveIpAclRequest(router, "DELETE", fmt.Sprintf("/admin/ip-rules/%d", rule.Id), "127.0.0.1:1", token, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("deleting twice: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestIpAclAdminTokenSkipsManagementRules(t *testing.T) {
+	token := "0123456789abcdef"
+	router := newTestRouter(t, newMemoryLinkStore(), nil, func(cfg *Config) { cfg.Admin.Token = token })
+
+	// The admin locks themselves out of the management scope.
+	rr := serveIpAclRequest(router, "POST", "/admin/ip-rules", "127.0.0.1:1", token, `{"scope": "management", "action": "deny", "cidr": "127.0.0.0/8"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("got %v want %v", rr.Code, http.StatusCreated)
+	}
+	var rule struct {
+		Id uint `json:"id"`
+	}
+	json.NewDecoder(rr.Body).Decode(&rule)
+
+	if rr := serveIpAclRequest(router, "GET", "/health", "127.0.0.1:1", token, ""); rr.Code != http.StatusForbidden {
+		t.Errorf("other routes: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	if rr := serveIpAclRequest(router, "GET", "/admin/ip-rules", "127.0.0.1:1", "wrong", ""); rr.Code != http.StatusForbidden {
+		t.Errorf("wrong token: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// The admin token still lets them delete the rule.
+	if rr := serveIpAclRequest(router, "DELETE", fmt.Sprintf("/admin/ip-rules/%d", rule.Id), "127.0.0.1:1", token, ""); rr.Code != http.StatusOK {
+		t.Errorf("delete: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := serveIpAclRequest(router, "GET", "/health", "127.0.0.1:1", "", ""); rr.Code != http.StatusOK {
+		t.Errorf("after the delete: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestIpAclReloadsStoreRules(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryLinkStore()
+	cfg := defaultConfig().IpAcl
+	cfg.ReloadInterval = time.Hour
+	acl := newIpAcl(cfg, store)
+
+	// A rule added by another instance shows up after the reload interval.
+	store.CreateIpRule(ctx, &IpRules{Scope: ipRuleScopeManagement, Action: ipRuleActionDeny, Cidr: "192.0.2.0/24"})
+	addr, _ := parseHostAddr("192.0.2.10")
+	if !acl.allowed(ctx, ipRuleScopeManagement, addr) {
+		t.Error("got denied want the old rules until the reload interval passed")
+	}
+
+	acl.lastLoad = time.Now().Add(-time.Hour)
+	if acl.allowed(ctx, ipRuleScopeManagement, addr) {
+		t.Error("got allowed want the new rule after the reload interval")
+	}
+}
+
+// slowIpRuleStore counts the reads of the IP rules, which take a while.
+type slowIpRuleStore struct {
+	LinkStore
+	reads atomic.Int32
+}
+
+func (s *slowIpRuleStore) ListIpRules(ctx context.Context) ([]IpRules, error) {
+	s.reads.Add(1)
+	time.Sleep(50 * time.Millisecond)
+	return s.LinkStore.ListIpRules(ctx)
+}
+
+func TestIpAclReloadsOnceForConcurrentRequests(t *testing.T) {
+	ctx := context.Background()
+	store := &slowIpRuleStore{LinkStore: newMemoryLinkStore()}
+	cfg := defaultConfig().IpAcl
+	cfg.ReloadInterval = time.Hour
+	acl := newIpAcl(cfg, store)
+	store.reads.Store(0)
+
+	acl.lastLoad = time.Now().Add(-time.Hour)
+	addr, _ := parseHostAddr("192.0.2.10")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			acl.allowed(ctx, ipRuleScopeManagement, addr)
+		}()
+	}
+	wg.Wait()
+
+	if reads := store.reads.Load(); reads != 1 {
+		t.Errorf("got %d reads of the rules want 1", reads)
+	}
+}
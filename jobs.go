@@ -0,0 +1,721 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Statuses of Jobs. A job is queued until a worker claims it and ends up
+// completed, even when some of its rows failed, or failed when it could not
+// be processed at all.
+const (
+	jobStatusQueued    = "queued"
+	jobStatusRunning   = "running"
+	jobStatusCompleted = "completed"
+	jobStatusFailed    = "failed"
+)
+
+const jobTypeBulkShorten = "bulk_shorten"
+
+// bulkJobChunkSize is the number of rows shortened with one batched insert,
+// the progress of a job is saved after every chunk.
+var bulkJobChunkSize = 500
+
+// maxJsonlLineSize bounds a single line of a JSONL upload.
+const maxJsonlLineSize = 1 << 20
+
+// bulkJobCsvColumns are the columns understood in a CSV upload, the header
+// row names them in any order and other columns are ignored.
+var bulkJobCsvColumns = []string{"url", "custom_url", "expires_at", "password", "redirect_type"}
+
+// jobRunner processes queued jobs with a fixed number of workers. Workers
+// claim jobs through the store, so jobs survive a restart while queued and
+// several instances can share the same database. A claimed job has a lease
+// that its worker keeps renewing. Jobs interrupted by Close are queued again
+// between two chunks, jobs still running when their instance died are marked
+// failed by any instance once the lease expired.
+type jobRunner struct {
+	store         LinkStore
+	blocklist     *domainBlocklist
+	plans         PlansConfig
+	pollInterval  time.Duration
+	leaseDuration time.Duration
+	wake          chan struct{}
+	done          chan struct{}
+	// stopped is cancelled by Close, running jobs stop between two chunks.
+	stopped context.Context
+	stop    context.CancelFunc
+	// inputCipher encrypts the passwords in Jobs.Input, see
+	// newJobInputCipher.
+	inputCipher cipher.AEAD
+}
+
+func newJobRunner(store LinkStore, blocklist *domainBlocklist, plans PlansConfig, cfg JobsConfig) *jobRunner {
+	stopped, stop := context.WithCancel(context.Background())
+	runner := &jobRunner{
+		store:         store,
+		blocklist:     blocklist,
+		plans:         plans,
+		pollInterval:  cfg.PollInterval,
+		leaseDuration: cfg.LeaseDuration,
+		inputCipher:   newJobInputCipher(cfg.InputKey),
+		wake:          make(chan struct{}, cfg.Workers),
+		stopped:       stopped,
+		stop:          stop,
+		done:          make(chan struct{}),
+	}
+
+	var workers sync.WaitGroup
+	for i := 0; i < cfg.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			runner.work()
+		}()
+	}
+
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		runner.failExpiredJobs()
+	}()
+
+	go func() {
+		workers.Wait()
+		close(runner.done)
+	}()
+
+	return runner
+}
+
+// Notify wakes up an idle worker to pick up a job that was just queued.
+func (j *jobRunner) Notify() {
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops the workers and waits until the jobs they are running finished
+// their current chunk and were queued again, or ctx is done. Jobs that did
+// not stop in time are failed once their lease expired.
+func (j *jobRunner) Close(ctx context.Context) error {
+	j.stop()
+
+	select {
+	case <-j.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (j *jobRunner) work() {
+	ticker := time.NewTicker(j.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		for j.runNext() {
+			select {
+			case <-j.stopped.Done():
+				return
+			default:
+			}
+		}
+
+		select {
+		case <-j.stopped.Done():
+			return
+		case <-j.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// failExpiredJobs fails the jobs abandoned by stopped instances, right away
+// and then once per lease duration.
+func (j *jobRunner) failExpiredJobs() {
+	ticker := time.NewTicker(j.leaseDuration)
+	defer ticker.Stop()
+
+	for {
+		if err := j.store.FailExpiredJobs(context.Background(), time.Now(), "Interrupted by a restart"); err != nil {
+			log.Printf("Error failing interrupted jobs: %v", err)
+		}
+
+		select {
+		case <-j.stopped.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// keepLease renews the lease of a running job until the returned function
+// is called.
+func (j *jobRunner) keepLease(jobId string) func() {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(j.leaseDuration / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := j.store.RenewJobLease(context.Background(), jobId, time.Now().Add(j.leaseDuration)); err != nil {
+					log.Printf("Error renewing the lease of job %s: %v", jobId, err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+// runNext claims and runs one job, it reports whether there was one.
+func (j *jobRunner) runNext() bool {
+	job, err := j.store.ClaimJob(context.Background(), time.Now().Add(j.leaseDuration))
+	if errors.Is(err, ErrNotFound) {
+		return false
+	} else if err != nil {
+		log.Printf("Error claiming a job: %v", err)
+		return false
+	}
+
+	stopLease := j.keepLease(job.Id)
+	defer stopLease()
+
+	log.Printf("Running %s job %s with %d rows", job.Type, job.Id, job.TotalRows)
+
+	switch job.Type {
+	case jobTypeBulkShorten:
+		j.runBulkShorten(job)
+	default:
+		j.finish(job, fmt.Errorf("unknown job type %q", job.Type))
+	}
+
+	return true
+}
+
+// runBulkShorten shortens the rows of job in chunks like POST /shorten/bulk
+// without atomic, as the user who created the job. A job queued again after
+// an interruption continues after its ProcessedRows, the results of those
+// are already in its Result.
+func (j *jobRunner) runBulkShorten(job *Jobs) {
+	items, err := decodeBulkJobInput(j.inputCipher, job.Input)
+	if err != nil {
+		j.finish(job, err)
+		return
+	}
+
+	// The id of the user owns the links and the revisions, the tier at the
+	// time the job was created picks the plan. The scopes were checked then.
+	// A chunk is not cancelled halfway, Close only stops the job between
+	// two chunks.
+	user := &Users{Id: job.UserId, Tier: job.Tier}
+	chunkCtx := withStore(context.WithoutCancel(j.stopped), j.store)
+	chunkCtx = withDomainBlocklist(chunkCtx, j.blocklist)
+	chunkCtx = withPlans(chunkCtx, j.plans)
+	chunkCtx = withUser(chunkCtx, user)
+	chunkCtx = withRequestId(chunkCtx, job.Id)
+
+	results := []bulkShortenResult{}
+	for start := job.ProcessedRows; start < len(items); start += bulkJobChunkSize {
+		if j.stopped.Err() != nil {
+			j.requeue(job, items, results)
+			return
+		}
+
+		end := min(start+bulkJobChunkSize, len(items))
+		for _, result := range shortenBulk(chunkCtx, job.IpAddress, user, items[start:end], false) {
+			result.Index += start
+			if result.failed() {
+				job.FailedRows++
+			}
+			results = append(results, result)
+		}
+
+		job.ProcessedRows = end
+		if err := j.store.UpdateJobProgress(chunkCtx, job.Id, job.ProcessedRows, job.FailedRows); err != nil {
+			log.Printf("Error saving the progress of job %s: %v", job.Id, err)
+		}
+	}
+
+	result, err := appendBulkJobResultCsv(job.Result, items, results)
+	if err != nil {
+		j.finish(job, err)
+		return
+	}
+
+	job.Result = result
+	j.finish(job, nil)
+}
+
+// requeue saves the results of the rows processed so far and queues job
+// again, for this or another instance to continue it.
+func (j *jobRunner) requeue(job *Jobs, items []bulkShortenItem, results []bulkShortenResult) {
+	result, err := appendBulkJobResultCsv(job.Result, items, results)
+	if err != nil {
+		j.finish(job, err)
+		return
+	}
+
+	job.Result = result
+	if err := j.store.RequeueJob(context.Background(), job); err != nil {
+		log.Printf("Error queueing job %s again: %v", job.Id, err)
+		return
+	}
+
+	log.Printf("Job %s stopped after %d of %d rows, queued again", job.Id, job.ProcessedRows, job.TotalRows)
+}
+
+// finish stores the outcome of job, err fails it.
+func (j *jobRunner) finish(job *Jobs, err error) {
+	job.Status = jobStatusCompleted
+	if err != nil {
+		log.Printf("Job %s failed: %v", job.Id, err)
+		job.Status = jobStatusFailed
+		job.Error = err.Error()
+	}
+	job.FinishedAt = addressOf(time.Now())
+
+	if err := j.store.FinishJob(context.Background(), job); err != nil {
+		log.Printf("Error finishing job %s: %v", job.Id, err)
+	}
+}
+
+// parseBulkJobUpload reads the links of a CSV or JSONL upload. CSV files
+// start with a header row naming the columns of bulkJobCsvColumns, JSONL
+// files have one object per line with the fields of POST /shorten/bulk.
+// Problems with single links are left to shortenBulk so they end up in the
+// result file, only malformed files are rejected.
+func parseBulkJobUpload(body io.Reader, format string) ([]bulkShortenItem, error) {
+	switch format {
+	case "csv":
+		return parseBulkJobCsv(body)
+	case "jsonl":
+		return parseBulkJobJsonl(body)
+	default:
+		return nil, fmt.Errorf("unsupported format %q, expected csv or jsonl", format)
+	}
+}
+
+func parseBulkJobCsv(body io.Reader) ([]bulkShortenItem, error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("the file is empty")
+	} else if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		// Excel prefixes UTF-8 files with a byte order mark.
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		columns[name] = i
+	}
+	if _, exists := columns["url"]; !exists {
+		return nil, fmt.Errorf("the header row needs a url column, the known columns are %s", strings.Join(bulkJobCsvColumns, ", "))
+	}
+
+	items := []bulkShortenItem{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return items, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		value := func(column string) *string {
+			i, exists := columns[column]
+			if !exists || strings.TrimSpace(record[i]) == "" {
+				return nil
+			}
+			return addressOf(strings.TrimSpace(record[i]))
+		}
+
+		item := bulkShortenItem{
+			CustomUrl: value("custom_url"),
+			ExpiresAt: value("expires_at"),
+			Password:  value("password"),
+		}
+		if url := value("url"); url != nil {
+			item.URL = *url
+		}
+		if redirectType := value("redirect_type"); redirectType != nil {
+			// A value that is not a number is kept as 0, which shortenBulk
+			// reports as an invalid redirect type for this row.
+			parsed, _ := strconv.Atoi(*redirectType)
+			item.RedirectType = &parsed
+		}
+
+		items = append(items, item)
+	}
+}
+
+func parseBulkJobJsonl(body io.Reader) ([]bulkShortenItem, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxJsonlLineSize)
+
+	items := []bulkShortenItem{}
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		var item bulkShortenItem
+		if err := json.Unmarshal(text, &item); err != nil {
+			return nil, fmt.Errorf("line %d is not a JSON object: %w", line, err)
+		}
+		items = append(items, item)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// newJobInputCipher returns the cipher of the passwords in Jobs.Input, keyed
+// with the SHA-256 of key. Every instance sharing the database needs the
+// same key. Without one a random key is used, the passwords of jobs queued
+// by other instances or before a restart can then not be read.
+func newJobInputCipher(key string) cipher.AEAD {
+	secret := sha256.Sum256([]byte(key))
+	if key == "" {
+		log.Printf("jobs.input_key is not set, passwords of jobs are only readable by this instance until it restarts")
+		rand.Read(secret[:])
+	}
+
+	// Neither fails with a 32 byte key.
+	block, _ := aes.NewCipher(secret[:])
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+// bulkJobItem is a line of Jobs.Input. The password of the link is kept out
+// of the database in plaintext: EncryptedPassword holds it encrypted with
+// the input cipher of the jobs and Password is left empty. The worker hashes
+// it like POST /shorten/bulk does, uploads would be slow to answer if every
+// password was hashed before the job is queued.
+type bulkJobItem struct {
+	bulkShortenItem
+	EncryptedPassword *string `json:"encrypted_password,omitempty"`
+}
+
+// encodeBulkJobInput stores the parsed links as JSONL, whatever format was
+// uploaded, with their passwords encrypted by aead.
+func encodeBulkJobInput(aead cipher.AEAD, items []bulkShortenItem) (string, error) {
+	var input strings.Builder
+	encoder := json.NewEncoder(&input)
+	for _, item := range items {
+		line := bulkJobItem{bulkShortenItem: item}
+		if item.Password != nil {
+			nonce := make([]byte, aead.NonceSize())
+			if _, err := rand.Read(nonce); err != nil {
+				return "", err
+			}
+			line.Password = nil
+			line.EncryptedPassword = addressOf(base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(*item.Password), nil)))
+		}
+
+		if err := encoder.Encode(line); err != nil {
+			return "", err
+		}
+	}
+
+	return input.String(), nil
+}
+
+// decodeBulkJobInput reads the links written by encodeBulkJobInput. Links
+// whose password aead cannot decrypt are marked so shortenBulk fails them.
+func decodeBulkJobInput(aead cipher.AEAD, input string) ([]bulkShortenItem, error) {
+	scanner := bufio.NewScanner(strings.NewReader(input))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxJsonlLineSize)
+
+	items := []bulkShortenItem{}
+	for scanner.Scan() {
+		var line bulkJobItem
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return nil, err
+		}
+
+		item := line.bulkShortenItem
+		if line.EncryptedPassword != nil {
+			password, err := decryptJobPassword(aead, *line.EncryptedPassword)
+			if err != nil {
+				item.passwordUnreadable = true
+			} else {
+				item.Password = &password
+			}
+		}
+		items = append(items, item)
+	}
+
+	return items, scanner.Err()
+}
+
+func decryptJobPassword(aead cipher.AEAD, encryptedPassword string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encryptedPassword)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("the encrypted password is too short")
+	}
+
+	password, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	return string(password), err
+}
+
+// appendBulkJobResultCsv adds the rows of results to the result CSV of a job,
+// which starts with a header when empty. Every row of the upload, counted
+// from 1 without the CSV header, is mapped to its short code or error.
+func appendBulkJobResultCsv(previous string, items []bulkShortenItem, results []bulkShortenResult) (string, error) {
+	var result strings.Builder
+	result.WriteString(previous)
+	writer := csv.NewWriter(&result)
+
+	if previous == "" {
+		writer.Write([]string{"row", "url", "short_code", "error_code", "message"})
+	}
+	for _, itemResult := range results {
+		writer.Write([]string{
+			strconv.Itoa(itemResult.Index + 1),
+			items[itemResult.Index].URL,
+			itemResult.ShortCode,
+			itemResult.ErrorCode,
+			itemResult.Message,
+		})
+	}
+
+	writer.Flush()
+	return result.String(), writer.Error()
+}
+
+// bulkJobUploadFormat picks csv or jsonl from the format query parameter,
+// the file name or the content type, in that order.
+func bulkJobUploadFormat(r *http.Request, filename string, contentType string) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return strings.ToLower(format)
+	}
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		return "csv"
+	case ".jsonl", ".ndjson":
+		return "jsonl"
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/csv":
+		return "csv"
+	case "application/jsonl", "application/x-ndjson", "application/x-jsonlines":
+		return "jsonl"
+	}
+
+	return ""
+}
+
+func jobResponse(job *Jobs) map[string]interface{} {
+	response := map[string]interface{}{
+		"id":             job.Id,
+		"type":           job.Type,
+		"status":         job.Status,
+		"total_rows":     job.TotalRows,
+		"processed_rows": job.ProcessedRows,
+		"failed_rows":    job.FailedRows,
+		"created_at":     job.CreatedAt,
+		"started_at":     job.StartedAt,
+		"finished_at":    job.FinishedAt,
+	}
+
+	if job.Error != "" {
+		response["error"] = job.Error
+	}
+	if job.Status == jobStatusCompleted {
+		response["result_url"] = "/jobs/" + job.Id + "/result"
+	}
+
+	return response
+}
+
+// createBulkShortenJob queues the links of a CSV or JSONL file, sent either
+// as the request body or as the "file" field of a multipart form. The file is
+// parsed right away so malformed uploads are rejected with a 400, the links
+// themselves are only validated by the worker.
+func createBulkShortenJob(runner *jobRunner, maxUploadSize int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		user := getUserFromContext(ctx)
+
+		r.Body = http.MaxBytesReader(w, r.Body, int64(maxUploadSize))
+
+		body := io.Reader(r.Body)
+		filename := ""
+		contentType := r.Header.Get("Content-Type")
+
+		if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "multipart/form-data" {
+			file, header, err := r.FormFile("file")
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, fmt.Sprintf("The file is larger than %d bytes", maxUploadSize), http.StatusRequestEntityTooLarge)
+				return
+			} else if err != nil {
+				http.Error(w, "The form needs a file field", http.StatusBadRequest)
+				return
+			}
+			defer file.Close()
+
+			body = file
+			filename = header.Filename
+			contentType = header.Header.Get("Content-Type")
+		}
+
+		format := bulkJobUploadFormat(r, filename, contentType)
+		if format != "csv" && format != "jsonl" {
+			http.Error(w, "Upload a CSV or JSONL file, or set format to csv or jsonl", http.StatusBadRequest)
+			return
+		}
+
+		items, err := parseBulkJobUpload(body, format)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, fmt.Sprintf("The file is larger than %d bytes", maxUploadSize), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, "Invalid file: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(items) == 0 {
+			http.Error(w, "The file has no links", http.StatusBadRequest)
+			return
+		}
+
+		plan := userPlan(ctx, user)
+		if plan.MaxBulkSize > 0 && len(items) > plan.MaxBulkSize {
+			http.Error(w, bulkSizeMessage(plan), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		input, err := encodeBulkJobInput(runner.inputCipher, items)
+		if err != nil {
+			http.Error(w, "Error creating the job", http.StatusInternalServerError)
+			return
+		}
+
+		job := &Jobs{
+			Id:        uuid.NewString(),
+			UserId:    user.Id,
+			Type:      jobTypeBulkShorten,
+			Status:    jobStatusQueued,
+			TotalRows: len(items),
+			Tier:      user.Tier,
+			Input:     input,
+			IpAddress: clientIp(r),
+		}
+		reserved, month := reserveUsage(ctx, user, usageBulkJobs, 1, plan.MonthlyBulkJobs)
+		if reserved == 0 {
+			writeQuotaError(w, planErrorMonthlyBulkJobs)
+			return
+		}
+		if err := getStoreFromContext(ctx).CreateJob(ctx, job); err != nil {
+			refundUsage(ctx, user, usageBulkJobs, 1, month)
+			http.Error(w, "Error creating the job", http.StatusInternalServerError)
+			return
+		}
+
+		runner.Notify()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/jobs/"+job.Id)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(jobResponse(job))
+	}
+}
+
+// requestJob returns the job of the {id} route variable. Jobs of other users
+// are reported as not found.
+func requestJob(w http.ResponseWriter, r *http.Request) *Jobs {
+	ctx := r.Context()
+	user := getUserFromContext(ctx)
+
+	job, err := getStoreFromContext(ctx).GetJob(ctx, mux.Vars(r)["id"])
+	if errors.Is(err, ErrNotFound) || (err == nil && job.UserId != user.Id) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return nil
+	} else if err != nil {
+		http.Error(w, "Error getting the job", http.StatusInternalServerError)
+		return nil
+	}
+
+	return job
+}
+
+func getJob(w http.ResponseWriter, r *http.Request) {
+	job := requestJob(w, r)
+	if job == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(jobResponse(job))
+}
+
+// getJobResult downloads the result file of a completed job.
+func getJobResult(w http.ResponseWriter, r *http.Request) {
+	job := requestJob(w, r)
+	if job == nil {
+		return
+	}
+
+	if job.Status != jobStatusCompleted {
+		http.Error(w, "The job is "+job.Status+", its result is available once it completed", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.csv"`, strings.ReplaceAll(job.Type, "_", "-"), job.Id))
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, job.Result)
+}
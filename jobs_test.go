@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func waitForJob(t *testing.T, router http.Handler, apiKey string, jobId string) map[string]interface{} {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rr := serveUsersRequest(router, "GET", "/jobs/"+jobId, apiKey, "")
+		var job map[string]interface{}
+		json.NewDecoder(rr.Body).Decode(&job)
+
+		if job["status"] == jobStatusCompleted || job["status"] == jobStatusFailed {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s did not finish: %v", jobId, job)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBulkShortenJob(t *testing.T) {
+	initRedis(defaultConfig().Redis)
+
+	// Users sign up on the hobby tier, which needs bulk shortening here.
+	plans := defaultConfig().Plans
+	plans.Tiers["hobby"] = plans.Tiers["enterprise"]
+
+	store := newMemoryLinkStore()
+	runner := newJobRunner(store, nil, plans, JobsConfig{Workers: 2, PollInterval: 10 * time.Millisecond, LeaseDuration: time.Minute})
+	defer runner.Close(context.Background())
+
+	router := newTestRouter(t, store, runner, func(cfg *Config) { cfg.Plans = plans })
+	_, apiKey := signUpTestUser(t, router, "campaigns@example.com")
+	_, otherKey := signUpTestUser(t, router, "other@example.com")
+
+	// Test 1: A CSV upload is queued and every row ends up in the result
+	customUrl := "job" + uuid.NewString()[:8]
+	upload := "\ufeffURL,custom_url,redirect_type,campaign\n" +
+		"http://example.com/1," + customUrl + ",,spring\n" +
+		"http://example.com/2," + customUrl + ",,spring\n" +
+		"http://example.com/3,,abc,spring\n" +
+		",,,spring\n" +
+		"http://example.com/5,,301,spring\n"
+
+	rr := serveUsersRequest(router, "POST", "/jobs/bulk-shorten?format=csv", apiKey, upload)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("creating a job returned wrong status code: got %v want %v: %s", rr.Code, http.StatusAccepted, rr.Body.String())
+	}
+
+	var created struct {
+		Id     string `json:"id"`
+		Status string `json:"status"`
+	}
+	json.NewDecoder(rr.Body).Decode(&created)
+	if rr.Header().Get("Location") != "/jobs/"+created.Id {
+		t.Errorf("got Location %q want /jobs/%s", rr.Header().Get("Location"), created.Id)
+	}
+
+	job := waitForJob(t, router, apiKey, created.Id)
+	if job["status"] != jobStatusCompleted || job["total_rows"] != 5.0 || job["processed_rows"] != 5.0 || job["failed_rows"] != 3.0 {
+		t.Fatalf("got job %v want 5 rows processed and 3 failed", job)
+	}
+
+	rr = serveUsersRequest(router, "GET", "/jobs/"+created.Id+"/result", apiKey, "")
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil || len(records) != 6 {
+		t.Fatalf("got result %v, %v want a header and 5 rows", records, err)
+	}
+
+	expected := []struct {
+		shortCode string
+		errorCode string
+	}{
+		{customUrl, ""},
+		{"", bulkErrorDuplicateCustomUrl},
+		{"", bulkErrorInvalidRedirect},
+		{"", bulkErrorUrlRequired},
+	}
+	for i, want := range expected {
+		row := records[i+1]
+		if row[2] != want.shortCode || row[3] != want.errorCode {
+			t.Errorf("row %s: got short code %q error %q want %q %q", row[0], row[2], row[3], want.shortCode, want.errorCode)
+		}
+	}
+
+	if found, err := store.GetActiveUrl(context.Background(), records[5][2]); err != nil || found.RedirectType != http.StatusMovedPermanently {
+		t.Errorf("got %+v, %v want the fifth link with a 301 redirect", found, err)
+	}
+
+	// Test 2: Jobs of other users are not found
+	if rr := serveUsersRequest(router, "GET", "/jobs/"+created.Id, otherKey, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("other user getting the job: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// Test 3: JSONL files can be sent as a form, malformed ones are rejected
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	file, _ := writer.CreateFormFile("file", "links.jsonl")
+	file.Write([]byte(`{"url": "http://example.com/jsonl"}` + "\n\n" + `{"url": "http://example.com/jsonl", "redirect_type": 308}` + "\n"))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/jobs/bulk-shorten", &form)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("X-API-Key", apiKey)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("creating a job from a form returned wrong status code: got %v want %v: %s", rr.Code, http.StatusAccepted, rr.Body.String())
+	}
+
+	json.NewDecoder(rr.Body).Decode(&created)
+	if job := waitForJob(t, router, apiKey, created.Id); job["processed_rows"] != 2.0 || job["failed_rows"] != 0.0 {
+		t.Errorf("got job %v want 2 rows processed without failures", job)
+	}
+
+	if rr := serveUsersRequest(router, "POST", "/jobs/bulk-shorten?format=jsonl", apiKey, "{\"url\": \"http://example.com\"}\nnot json\n"); rr.Code != http.StatusBadRequest {
+		t.Errorf("malformed JSONL: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	if rr := serveUsersRequest(router, "POST", "/jobs/bulk-shorten?format=csv", apiKey, "destination\nhttp://example.com\n"); rr.Code != http.StatusBadRequest {
+		t.Errorf("CSV without a url column: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	// Test 4: Passwords are hashed by the worker, one too long for bcrypt
+	// only fails its row
+	upload = "url,password\n" +
+		"http://example.com/protected,secret\n" +
+		"http://example.com/long," + strings.Repeat("x", 100) + "\n"
+	rr = serveUsersRequest(router, "POST", "/jobs/bulk-shorten?format=csv", apiKey, upload)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("creating a job with passwords returned wrong status code: got %v want %v: %s", rr.Code, http.StatusAccepted, rr.Body.String())
+	}
+
+	json.NewDecoder(rr.Body).Decode(&created)
+	waitForJob(t, router, apiKey, created.Id)
+	rr = serveUsersRequest(router, "GET", "/jobs/"+created.Id+"/result", apiKey, "")
+	records, _ = csv.NewReader(rr.Body).ReadAll()
+	if len(records) != 3 || records[2][3] != bulkErrorInvalidPassword {
+		t.Fatalf("got result %v want the second row failed with %s", records, bulkErrorInvalidPassword)
+	}
+
+	found, err := store.GetActiveUrl(context.Background(), records[1][2])
+	if err != nil || found.Password == nil || bcrypt.CompareHashAndPassword([]byte(*found.Password), []byte("secret")) != nil {
+		t.Errorf("got %+v, %v want the first link protected by secret", found, err)
+	}
+}
+
+func TestJobRunnerOnlyFailsExpiredJobs(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryLinkStore()
+
+	// Jobs claimed by another instance, one of which stopped a while ago.
+	for _, id := range []string{"alive", "abandoned"} {
+		store.CreateJob(ctx, &Jobs{Id: id, UserId: 1, Type: jobTypeBulkShorten, Status: jobStatusQueued, TotalRows: 1})
+	}
+	store.ClaimJob(ctx, time.Now().Add(time.Minute))
+	store.ClaimJob(ctx, time.Now().Add(-time.Second))
+
+	runner := newJobRunner(store, nil, defaultConfig().Plans, JobsConfig{Workers: 1, PollInterval: time.Hour, LeaseDuration: time.Minute})
+	runner.Close(ctx)
+
+	if job, _ := store.GetJob(ctx, "alive"); job.Status != jobStatusRunning {
+		t.Errorf("job with a lease: got %v want %v", job.Status, jobStatusRunning)
+	}
+	if job, _ := store.GetJob(ctx, "abandoned"); job.Status != jobStatusFailed {
+		t.Errorf("job with an expired lease: got %v want %v", job.Status, jobStatusFailed)
+	}
+}
+
+func TestBulkJobInputEncryptsPasswords(t *testing.T) {
+	items := []bulkShortenItem{
+		{URL: "http://example.com/1", Password: addressOf("secret")},
+		{URL: "http://example.com/2"},
+	}
+
+	aead := newJobInputCipher("input key")
+	input, err := encodeBulkJobInput(aead, items)
+	if err != nil {
+		t.Fatalf("encodeBulkJobInput returned error: %v", err)
+	}
+	if strings.Contains(input, "secret") {
+		t.Errorf("the input holds the plaintext password: %s", input)
+	}
+
+	decoded, err := decodeBulkJobInput(newJobInputCipher("input key"), input)
+	if err != nil || len(decoded) != 2 {
+		t.Fatalf("decodeBulkJobInput got %d items, %v want 2", len(decoded), err)
+	}
+	if decoded[0].Password == nil || *decoded[0].Password != "secret" || decoded[0].passwordUnreadable {
+		t.Errorf("got password %v want secret", decoded[0].Password)
+	}
+	if decoded[1].Password != nil || decoded[1].passwordUnreadable {
+		t.Errorf("got password %v for a link without one", decoded[1].Password)
+	}
+
+	// Another key cannot read the password, only that link fails.
+	decoded, err = decodeBulkJobInput(newJobInputCipher("other key"), input)
+	if err != nil || !decoded[0].passwordUnreadable || decoded[0].Password != nil || decoded[1].passwordUnreadable {
+		t.Errorf("got %+v, %v want only the first link unreadable", decoded, err)
+	}
+
+	results := shortenBulk(withStore(context.Background(), newMemoryLinkStore()), "", nil, decoded, false)
+	if results[0].ErrorCode != bulkErrorInsertFailed || results[1].failed() {
+		t.Errorf("got %+v want only the first link failed", results)
+	}
+}
+
+// stoppingStore calls stop once the progress of a job was saved, as if the
+// server was shut down after the first chunk.
+type stoppingStore struct {
+	LinkStore
+	stop context.CancelFunc
+}
+
+func (s *stoppingStore) UpdateJobProgress(ctx context.Context, jobId string, processedRows int, failedRows int) error {
+	s.stop()
+	return s.LinkStore.UpdateJobProgress(ctx, jobId, processedRows, failedRows)
+}
+
+func TestBulkShortenJobContinuesAfterStop(t *testing.T) {
+	ctx := context.Background()
+	defer func(chunkSize int) { bulkJobChunkSize = chunkSize }(bulkJobChunkSize)
+	bulkJobChunkSize = 2
+
+	store := newMemoryLinkStore()
+	aead := newJobInputCipher("input key")
+	items := []bulkShortenItem{{URL: "http://example.com/1"}, {URL: "/relative"}, {URL: "http://example.com/3"}}
+	input, _ := encodeBulkJobInput(aead, items)
+	store.CreateJob(ctx, &Jobs{Id: "stopped", UserId: 1, Type: jobTypeBulkShorten, Status: jobStatusQueued, TotalRows: len(items), Input: input})
+
+	// Test 1: A stopped runner queues the job again after its first chunk
+	stopped, stop := context.WithCancel(ctx)
+	runner := &jobRunner{store: &stoppingStore{LinkStore: store, stop: stop}, plans: defaultConfig().Plans, leaseDuration: time.Minute, inputCipher: aead, stopped: stopped, stop: stop}
+	if !runner.runNext() {
+		t.Fatal("runNext found no job")
+	}
+
+	job, _ := store.GetJob(ctx, "stopped")
+	if job.Status != jobStatusQueued || job.LeaseExpiresAt != nil || job.ProcessedRows != 2 || job.FailedRows != 1 {
+		t.Fatalf("got %+v want the job queued again after 2 rows", job)
+	}
+
+	// Test 2: The next runner continues with the remaining rows
+	runner = &jobRunner{store: store, plans: defaultConfig().Plans, leaseDuration: time.Minute, inputCipher: aead, stopped: ctx}
+	runner.runNext()
+
+	job, _ = store.GetJob(ctx, "stopped")
+	if job.Status != jobStatusCompleted || job.ProcessedRows != 3 || job.FailedRows != 1 {
+		t.Fatalf("got %+v want the job completed with 3 rows", job)
+	}
+
+	records, err := csv.NewReader(strings.NewReader(job.Result)).ReadAll()
+	if err != nil || len(records) != 4 {
+		t.Fatalf("got result %v, %v want a header and 3 rows", records, err)
+	}
+	for i, record := range records[1:] {
+		if record[0] != strconv.Itoa(i+1) || record[1] != items[i].URL {
+			t.Errorf("got row %v want row %d of %s", record, i+1, items[i].URL)
+		}
+	}
+	if records[2][3] == "" || records[1][2] == "" || records[3][2] == "" {
+		t.Errorf("got result %v want only the second row failed", records)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Actions recorded in LinkRevisions.
+const (
+	revisionCreate     = "create"
+	revisionEdit       = "edit"
+	revisionActivate   = "activate"
+	revisionDeactivate = "deactivate"
+	revisionDelete     = "delete"
+	revisionRollback   = "rollback"
+)
+
+// linkSnapshot is the state of a link stored in a revision. It holds the
+// password hash so a rollback can restore it, revisionResponse only tells
+// whether there was one.
+type linkSnapshot struct {
+	ShortCode    string     `json:"short_code"`
+	OriginalUrl  string     `json:"original_url"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	Password     *string    `json:"password,omitempty"`
+	RedirectType int        `json:"redirect_type"`
+	WorkspaceId  *uint      `json:"workspace_id"`
+	DeletedAt    *time.Time `json:"deleted_at"`
+}
+
+func snapshotOf(urlModel *UrlShortener) linkSnapshot {
+	return linkSnapshot{
+		ShortCode:    urlModel.ShortCode,
+		OriginalUrl:  urlModel.OriginalUrl,
+		ExpiresAt:    urlModel.ExpiresAt,
+		Password:     urlModel.Password,
+		RedirectType: urlModel.RedirectType,
+		WorkspaceId:  urlModel.WorkspaceId,
+		DeletedAt:    urlModel.DeletedAt,
+	}
+}
+
+// newLinkRevision describes the change from before to after made by user.
+// before is nil when the link was created, user is nil for anonymous links.
+func newLinkRevision(user *Users, action string, before *UrlShortener, after *UrlShortener) LinkRevisions {
+	revision := LinkRevisions{ShortCode: after.ShortCode, Action: action, CreatedAt: time.Now()}
+
+	if user != nil {
+		revision.UserId = addressOf(user.Id)
+	}
+
+	if before != nil {
+		oldValues, _ := json.Marshal(snapshotOf(before))
+		revision.OldValues = string(oldValues)
+	}
+
+	newValues, _ := json.Marshal(snapshotOf(after))
+	revision.NewValues = string(newValues)
+
+	return revision
+}
+
+// editRevisionAction tells edits that only switched the link on or off
+// apart from other edits, so deactivations stand out in the history.
+func editRevisionAction(before *UrlShortener, after *UrlShortener) string {
+	withoutActivation := snapshotOf(before)
+	withoutActivation.DeletedAt = after.DeletedAt
+	beforeValues, _ := json.Marshal(withoutActivation)
+	afterValues, _ := json.Marshal(snapshotOf(after))
+	if string(beforeValues) != string(afterValues) {
+		return revisionEdit
+	}
+
+	switch {
+	case before.DeletedAt != nil && after.DeletedAt == nil:
+		return revisionActivate
+	case before.DeletedAt == nil && after.DeletedAt != nil:
+		return revisionDeactivate
+	}
+
+	return revisionEdit
+}
+
+// canViewUrl reports whether user may see the history of the link, which
+// every member of its workspace can.
+func canViewUrl(ctx context.Context, user *Users, urlModel *UrlShortener) bool {
+	if urlModel.WorkspaceId != nil {
+		return getWorkspaceMember(ctx, *urlModel.WorkspaceId, user.Id) != nil
+	}
+
+	return urlModel.UserId != nil && *urlModel.UserId == user.Id
+}
+
+func revisionValues(values string) map[string]interface{} {
+	if values == "" {
+		return nil
+	}
+
+	var snapshot linkSnapshot
+	if err := json.Unmarshal([]byte(values), &snapshot); err != nil {
+		return nil
+	}
+
+	return map[string]interface{}{
+		"short_code":         snapshot.ShortCode,
+		"original_url":       snapshot.OriginalUrl,
+		"expires_at":         snapshot.ExpiresAt,
+		"password_protected": snapshot.Password != nil,
+		"redirect_type":      snapshot.RedirectType,
+		"workspace_id":       snapshot.WorkspaceId,
+		"active":             snapshot.DeletedAt == nil,
+	}
+}
+
+func revisionResponse(revision LinkRevisions) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         revision.Id,
+		"action":     revision.Action,
+		"user_id":    revision.UserId,
+		"created_at": revision.CreatedAt,
+		"old":        revisionValues(revision.OldValues),
+		"new":        revisionValues(revision.NewValues),
+	}
+}
+
+func listLinkRevisions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := getUserFromContext(ctx)
+	shortCode := mux.Vars(r)["code"]
+
+	urlModel, err := getStoreFromContext(ctx).GetUrl(ctx, shortCode)
+	if err != nil || !canViewUrl(ctx, user, urlModel) {
+		http.Error(w, "Short code not found", http.StatusNotFound)
+		return
+	}
+
+	revisions, err := getStoreFromContext(ctx).ListLinkRevisions(ctx, shortCode)
+	if err != nil {
+		http.Error(w, "Error listing the revisions", http.StatusInternalServerError)
+		return
+	}
+
+	response := []map[string]interface{}{}
+	for _, revision := range revisions {
+		response = append(response, revisionResponse(revision))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"revisions": response})
+}
+
+// rollbackLink restores the link to the state right after the given
+// revision. The workspace is left alone, moving links is not undone by a
+// rollback, and a short code that was renamed since is only restored when
+// it is still free.
+func rollbackLink(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store := getStoreFromContext(ctx)
+	user := getUserFromContext(ctx)
+	shortCode := mux.Vars(r)["code"]
+
+	urlModel, err := store.GetUrl(ctx, shortCode)
+	if err != nil || !canViewUrl(ctx, user, urlModel) {
+		http.Error(w, "Short code not found", http.StatusNotFound)
+		return
+	}
+
+	if !canManageUrl(ctx, user, urlModel) {
+		http.Error(w, "You are not authorized to edit this short code", http.StatusForbidden)
+		return
+	}
+
+	revisionId, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 0)
+	if err != nil {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+
+	revision, err := store.GetLinkRevision(ctx, shortCode, uint(revisionId))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Error rolling back the short code", http.StatusInternalServerError)
+		return
+	}
+
+	var snapshot linkSnapshot
+	if err := json.Unmarshal([]byte(revision.NewValues), &snapshot); err != nil {
+		http.Error(w, "Error rolling back the short code", http.StatusInternalServerError)
+		return
+	}
+
+	// The destination may have been blocked since the revision was made.
+	if isBlockedDestination(ctx, clientIp(r), "rollback", shortCode, snapshot.OriginalUrl) {
+		writeUrlValidationError(w, blockedDestinationError())
+		return
+	}
+
+	if snapshot.ShortCode != shortCode {
+		taken, err := isShortCodeTaken(ctx, snapshot.ShortCode)
+		if err != nil {
+			http.Error(w, "Error rolling back the short code", http.StatusInternalServerError)
+			return
+		}
+		if taken || isReservedShortCode(snapshot.ShortCode) {
+			http.Error(w, "The short code of this revision is taken by another link", http.StatusConflict)
+			return
+		}
+	}
+
+	before := *urlModel
+	urlModel.OriginalUrl = snapshot.OriginalUrl
+	urlModel.ExpiresAt = snapshot.ExpiresAt
+	urlModel.Password = snapshot.Password
+	urlModel.RedirectType = snapshot.RedirectType
+
+	urlModel.ShortCode = snapshot.ShortCode
+	if snapshot.DeletedAt == nil {
+		urlModel.DeletedAt = nil
+	} else if urlModel.DeletedAt == nil {
+		urlModel.DeletedAt = addressOf(time.Now())
+	}
+
+	rollback := newLinkRevision(user, revisionRollback, &before, urlModel)
+	if err := store.EditUrl(ctx, shortCode, urlModel, &rollback); errors.Is(err, ErrConflict) {
+		http.Error(w, "The short code of this revision is taken by another link", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Error rolling back the short code", http.StatusInternalServerError)
+		return
+	}
+
+	if urlModel.ShortCode != shortCode {
+		if err := removeCachedUrl(ctx, shortCode); err != nil {
+			http.Error(w, "Error removing cached URL", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if urlModel.DeletedAt != nil {
+		err = removeCachedUrl(ctx, urlModel.ShortCode)
+	} else {
+		err = updateCachedUrl(ctx, urlModel.ShortCode, urlModel)
+	}
+	if err != nil {
+		http.Error(w, "Error updating cached URL", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok", "short_code": urlModel.ShortCode})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestLinkRevisionsAndRollback(t *testing.T) {
+	initRedis(defaultConfig().Redis)
+
+	store := newMemoryLinkStore()
+	router := newTestRouter(t, store, nil, nil)
+	_, apiKey := signUpTestUser(t, router, "history@example.com")
+	_, otherKey := signUpTestUser(t, router, "other@example.com")
+
+	rr := serveUsersRequest(router, "POST", "/shorten", apiKey, `{"url": "http://example.com/first"}`)
+	var shortened struct {
+		ShortCode string `json:"short_code"`
+	}
+	json.NewDecoder(rr.Body).Decode(&shortened)
+	shortCode := shortened.ShortCode
+	defer removeCachedUrl(context.Background(), shortCode)
+
+	edits := []string{
+		`{"short_code": "` + shortCode + `", "url": "http://example.com/second"}`,
+		`{"short_code": "` + shortCode + `", "activate": false}`,
+		`{"short_code": "` + shortCode + `", "activate": true}`,
+	}
+	for _, edit := range edits {
+		if rr := serveUsersRequest(router, "PUT", "/shorten", apiKey, edit); rr.Code != http.StatusOK {
+			t.Fatalf("edit %s returned wrong status code: got %v want %v", edit, rr.Code, http.StatusOK)
+		}
+	}
+
+	// Test 1: Every change is listed, newest first, with its actor
+	rr = serveUsersRequest(router, "GET", "/shorten/"+shortCode+"/revisions", apiKey, "")
+	var listed struct {
+		Revisions []struct {
+			Id     uint                   `json:"id"`
+			Action string                 `json:"action"`
+			UserId *uint                  `json:"user_id"`
+			Old    map[string]interface{} `json:"old"`
+			New    map[string]interface{} `json:"new"`
+		} `json:"revisions"`
+	}
+	json.NewDecoder(rr.Body).Decode(&listed)
+
+	actions := []string{}
+	for _, revision := range listed.Revisions {
+		actions = append(actions, revision.Action)
+		if revision.UserId == nil {
+			t.Errorf("revision %v has no actor", revision.Action)
+		}
+	}
+	if fmt.Sprint(actions) != "[activate deactivate edit create]" {
+		t.Fatalf("got actions %v want [activate deactivate edit create]", actions)
+	}
+	if listed.Revisions[2].Old["original_url"] != "http://example.com/first" || listed.Revisions[2].New["original_url"] != "http://example.com/second" {
+		t.Errorf("got edit from %v to %v", listed.Revisions[2].Old["original_url"], listed.Revisions[2].New["original_url"])
+	}
+
+	// Test 2: Other users cannot see the history
+	if rr := serveUsersRequest(router, "GET", "/shorten/"+shortCode+"/revisions", otherKey, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("history of another user's link: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// Test 3: Rolling back to the create revision restores the first destination
+	rollbackPath := fmt.Sprintf("/shorten/%s/revisions/%d/rollback", shortCode, listed.Revisions[3].Id)
+	if rr := serveUsersRequest(router, "POST", rollbackPath, apiKey, ""); rr.Code != http.StatusOK {
+		t.Fatalf("rollback returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	rr = serveUsersRequest(router, "GET", "/redirect?code="+shortCode, "", "")
+	if location := rr.Header().Get("Location"); location != "http://example.com/first" {
+		t.Errorf("got location %v after the rollback want %v", location, "http://example.com/first")
+	}
+
+	rr = serveUsersRequest(router, "GET", "/shorten/"+shortCode+"/revisions", apiKey, "")
+	json.NewDecoder(rr.Body).Decode(&listed)
+	if len(listed.Revisions) != 5 || listed.Revisions[0].Action != revisionRollback {
+		t.Errorf("got %d revisions starting with %v want 5 starting with a rollback", len(listed.Revisions), listed.Revisions[0].Action)
+	}
+
+	if rr := serveUsersRequest(router, "POST", fmt.Sprintf("/shorten/%s/revisions/999/rollback", shortCode), apiKey, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("rollback to an unknown revision: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// Test 4: A deleted link holding the old short code blocks the rollback
+	ctx := context.Background()
+	renamedCode := shortCode + "x"
+	urlModel, _ := store.GetUrl(ctx, shortCode)
+	urlModel.ShortCode = renamedCode
+	store.EditUrl(ctx, shortCode, urlModel, nil)
+	store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com/deleted", ShortCode: shortCode})
+	store.DeleteUrl(ctx, shortCode)
+	defer removeCachedUrl(ctx, renamedCode)
+
+	rollbackPath = fmt.Sprintf("/shorten/%s/revisions/%d/rollback", renamedCode, listed.Revisions[2].Id)
+	if rr := serveUsersRequest(router, "POST", rollbackPath, apiKey, ""); rr.Code != http.StatusConflict {
+		t.Errorf("rollback to a taken short code: got %v want %v", rr.Code, http.StatusConflict)
+	}
+	if urlModel, err := store.GetUrl(ctx, renamedCode); err != nil || urlModel.OriginalUrl != "http://example.com/first" {
+		t.Errorf("link changed by a rejected rollback: got %+v, %v", urlModel, err)
+	}
+}
@@ -4,18 +4,27 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 
-	"github.com/go-redis/redis"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/redis/go-redis/v9"
+
+	"vyson/ratelimit"
 )
 
 var (
@@ -29,61 +38,173 @@ type CustomResponseWriter struct {
 	headers    http.Header
 	body       []byte
 	statusCode int
+	startTime  time.Time
+	// streaming is set once Stream sent the headers, writes go straight to
+	// the ResponseWriter from then on.
+	streaming bool
 }
 
 var redisClient *redis.Client
 
-func initRedis() {
+// rateLimiter counts requests in Redis, shared by every instance, and in
+// process memory while Redis cannot be reached.
+var rateLimiter ratelimit.Limiter
+
+func initRedis(cfg RedisConfig) {
 	redisClient = redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379", // Redis server address
-		Password: "",               // No password by default
-		DB:       0,                // Default DB
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
 	})
+	rateLimiter = ratelimit.NewFallback(ratelimit.NewRedis(redisClient), ratelimit.NewMemory())
 }
 
 func main() {
-	err := os.MkdirAll("db", 0755)
+	cfg, err := loadConfig(os.Args[1:])
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("Invalid configuration: ", err)
 	}
 
-	db, err := NewDatabase("db/database.sqlite")
+	if cfg.Store.Driver == "sqlite" {
+		err := os.MkdirAll(filepath.Dir(cfg.Store.DSN), 0755)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	store, err := NewLinkStore(cfg.Store.Driver, cfg.Store.DSN)
 	if err != nil {
 		log.Fatal(err)
 	}
-	initRedis()
+	initRedis(cfg.Redis)
+	requestLogger := newRequestLogger(store, cfg.RequestLog.BufferSize, cfg.RequestLog.FlushInterval)
+	clickRecorder := newClickRecorder(store, cfg.Clicks.BufferSize, cfg.Clicks.FlushInterval)
+	blockedAttemptRecorder := newBlockedAttemptRecorder(store, cfg.RequestLog.BufferSize, cfg.RequestLog.FlushInterval)
+	domainBlocklist := newDomainBlocklist(cfg.DomainBlocklist, blockedAttemptRecorder)
+	jobRunner := newJobRunner(store, domainBlocklist, cfg.Plans, cfg.Jobs)
+
+	router := newRouter(cfg, store, requestLogger, clickRecorder, domainBlocklist, jobRunner)
+
+	listener, err := net.Listen("tcp", cfg.Server.ListenAddr)
+	if err != nil {
+		log.Fatal("Error starting server: ", err)
+	}
+
+	signalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	ctx := context.Background()
-	ctx = addValueToContext(&ctx, "db", db)
+	fmt.Printf("Server starting on %s...\n", cfg.Server.ListenAddr)
+
+	server := newHttpServer(cfg.Server, router)
+	if err := serveUntilDone(signalCtx, server, listener, cfg.Server.ShutdownTimeout); err != nil {
+		log.Printf("Error while serving: %v", err)
+	}
+
+	log.Println("Server stopped, waiting for running jobs, flushing request logs, clicks and blocked attempts and closing connections")
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+
+	if err := jobRunner.Close(flushCtx); err != nil {
+		log.Printf("Error waiting for running jobs: %v", err)
+	}
+	if err := requestLogger.Close(flushCtx); err != nil {
+		log.Printf("Error flushing request logs: %v", err)
+	}
+	if err := clickRecorder.Close(flushCtx); err != nil {
+		log.Printf("Error flushing clicks: %v", err)
+	}
+	if err := blockedAttemptRecorder.Close(flushCtx); err != nil {
+		log.Printf("Error flushing blocked attempts: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		log.Printf("Error closing store: %v", err)
+	}
+	if err := redisClient.Close(); err != nil {
+		log.Printf("Error closing redis client: %v", err)
+	}
+}
+
+func newRouter(cfg Config, store LinkStore, requestLogger *batchWriter[LogRequests], clickRecorder *batchWriter[Clicks], domainBlocklist *domainBlocklist, jobRunner *jobRunner) *mux.Router {
+	acl := newIpAcl(cfg.IpAcl, store)
 
 	unauthenticatedRouter := mux.NewRouter()
+	unauthenticatedRouter.Use(requestContextMiddleware(store, clickRecorder, domainBlocklist))
+	unauthenticatedRouter.Use(clientIpMiddleware(cfg.Server.TrustedProxies))
 	unauthenticatedRouter.Use(responseTimeMiddleware())
-	unauthenticatedRouter.Use(loggingMiddleware(&ctx))
-	unauthenticatedRouter.Use(blocklistMiddleware())
-	unauthenticatedRouter.Use(ipRateLimitMiddleware())
-	unauthenticatedRouter.Use(freeTierRateLimitMiddleware(&ctx))
+	unauthenticatedRouter.Use(loggingMiddleware(requestLogger))
+	unauthenticatedRouter.Use(ipAclMiddleware(acl, cfg.Admin))
+	unauthenticatedRouter.Use(blocklistMiddleware(cfg.Blocklist))
+	unauthenticatedRouter.Use(ipRateLimitMiddleware(cfg.RateLimits))
+	unauthenticatedRouter.Use(userRateLimitMiddleware(cfg.RateLimits, cfg.Plans))
 
 	authenticatedRouter := unauthenticatedRouter.PathPrefix("").Subrouter()
-	authenticatedRouter.Use(apiKeyMiddleware(&ctx))
+	authenticatedRouter.Use(apiKeyMiddleware())
 
 	pricingRouter := authenticatedRouter.PathPrefix("").Subrouter()
-	pricingRouter.Use(pricingPlanMiddleware(&ctx))
-
-	unauthenticatedRouter.HandleFunc("/health", ctxServiceHandler(health, &ctx)).Methods("GET")
-	unauthenticatedRouter.HandleFunc("/shorten", ctxServiceHandler(shortenUrl, &ctx)).Methods("POST")
-	unauthenticatedRouter.HandleFunc("/redirect", ctxServiceHandler(redirectToOriginalUrl, &ctx)).Methods("GET")
-
-	authenticatedRouter.HandleFunc("/shorten", ctxServiceHandler(deleteShortCode, &ctx)).Methods("DELETE")
-	authenticatedRouter.HandleFunc("/shorten", ctxServiceHandler(editUrl, &ctx)).Methods("PUT")
-	authenticatedRouter.HandleFunc("/user/urls", ctxServiceHandler(getUserUrls, &ctx)).Methods("GET")
+	pricingRouter.Use(pricingPlanMiddleware())
+
+	adminRouter := unauthenticatedRouter.PathPrefix("/admin").Subrouter()
+	adminRouter.Use(adminMiddleware(cfg.Admin))
+
+	unauthenticatedRouter.HandleFunc("/health", health).Methods("GET")
+	unauthenticatedRouter.HandleFunc("/shorten", shortenUrl).Methods("POST")
+	unauthenticatedRouter.HandleFunc("/redirect", redirectToOriginalUrl).Methods("GET").Name("redirect")
+	unauthenticatedRouter.HandleFunc("/users", createUser).Methods("POST")
+
+	authenticatedRouter.HandleFunc("/shorten", deleteShortCode).Methods("DELETE").Name("delete_url")
+	authenticatedRouter.HandleFunc("/shorten", editUrl).Methods("PUT").Name("edit_url")
+	authenticatedRouter.HandleFunc("/user/urls", getUserUrls).Methods("GET").Name("user_urls")
+	authenticatedRouter.HandleFunc("/user/urls/export", exportUserUrls).Methods("GET").Name("export_urls")
+	authenticatedRouter.HandleFunc("/user/usage", getUserUsage).Methods("GET").Name("user_usage")
+	authenticatedRouter.HandleFunc("/shorten/{code}/revisions", listLinkRevisions).Methods("GET").Name("list_revisions")
+	authenticatedRouter.HandleFunc("/shorten/{code}/revisions/{id}/rollback", rollbackLink).Methods("POST").Name("rollback_link")
+	authenticatedRouter.HandleFunc("/user/keys", listApiKeys).Methods("GET").Name("list_keys")
+	authenticatedRouter.HandleFunc("/user/keys", createApiKey).Methods("POST").Name("create_key")
+	authenticatedRouter.HandleFunc("/user/keys/rotate", rotateApiKey(cfg.Users.KeyRotationGracePeriod)).Methods("POST").Name("rotate_key")
+	authenticatedRouter.HandleFunc("/user/keys/{id}", revokeApiKey).Methods("DELETE").Name("revoke_key")
+	authenticatedRouter.HandleFunc("/workspaces", listWorkspaces).Methods("GET").Name("list_workspaces")
+	authenticatedRouter.HandleFunc("/workspaces", createWorkspace).Methods("POST").Name("create_workspace")
+	authenticatedRouter.HandleFunc("/workspaces/{id}/members", listWorkspaceMembers).Methods("GET").Name("list_members")
+	authenticatedRouter.HandleFunc("/workspaces/{id}/members", saveWorkspaceMember).Methods("PUT").Name("save_member")
+	authenticatedRouter.HandleFunc("/workspaces/{id}/members/{user_id}", removeWorkspaceMember).Methods("DELETE").Name("remove_member")
+	authenticatedRouter.HandleFunc("/jobs/{id}", getJob).Methods("GET").Name("get_job")
+	authenticatedRouter.HandleFunc("/jobs/{id}/result", getJobResult).Methods("GET").Name("job_result")
+
+	pricingRouter.HandleFunc("/shorten/bulk", shortenUrlBulk).Methods("POST").Name("bulk_shorten")
+	pricingRouter.HandleFunc("/jobs/bulk-shorten", createBulkShortenJob(jobRunner, cfg.Jobs.MaxUploadSize)).Methods("POST").Name("create_bulk_job")
+
+	adminRouter.HandleFunc("/ip-rules", listIpRules).Methods("GET")
+	adminRouter.HandleFunc("/ip-rules", createIpRule(acl)).Methods("POST")
+	adminRouter.HandleFunc("/ip-rules/{id}", deleteIpRule(acl)).Methods("DELETE")
+
+	// The catch-all has to be registered last so it never shadows the routes
+	// above, reservedShortCodes keeps custom codes from taking their paths.
+	unauthenticatedRouter.HandleFunc("/{code}", redirectToOriginalUrl).Methods("GET").Name("resolve_code")
+
+	return unauthenticatedRouter
+}
 
-	pricingRouter.HandleFunc("/shorten/bulk", ctxServiceHandler(shortenUrlBulk, &ctx)).Methods("POST")
+// requestContextMiddleware gives every request its own context carrying the
+// store, the click recorder, the domain blocklist and a request ID. The ID is
+// taken from X-Request-ID when the caller sends one and echoed back in the
+// response.
+func requestContextMiddleware(store LinkStore, clickRecorder *batchWriter[Clicks], domainBlocklist *domainBlocklist) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestId := r.Header.Get("X-Request-ID")
+			if requestId == "" || len(requestId) > 128 {
+				requestId = uuid.NewString()
+			}
 
-	port := ":8080"
-	fmt.Printf("Server starting on port %s...\n", port)
+			ctx := withStore(r.Context(), store)
+			ctx = withClickRecorder(ctx, clickRecorder)
+			ctx = withDomainBlocklist(ctx, domainBlocklist)
+			ctx = withRequestId(ctx, requestId)
 
-	if err := http.ListenAndServe(port, unauthenticatedRouter); err != nil {
-		log.Fatal("Error starting server: ", err)
+			w.Header().Set("X-Request-ID", requestId)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
 	}
 }
 
@@ -92,11 +213,9 @@ func responseTimeMiddleware() mux.MiddlewareFunc {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			wrapper := newResponseWriter(w)
 
-			startTime := time.Now()
-
 			next.ServeHTTP(wrapper, r)
 
-			elapsedTime := time.Since(startTime)
+			elapsedTime := time.Since(wrapper.startTime)
 
 			wrapper.Header().Set("X-Response-Time", elapsedTime.String())
 
@@ -105,34 +224,33 @@ func responseTimeMiddleware() mux.MiddlewareFunc {
 	}
 }
 
-func loggingMiddleware(ctx *context.Context) mux.MiddlewareFunc {
+func loggingMiddleware(requestLogger *batchWriter[LogRequests]) mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			db := getDbFromContext(ctx)
 			timestamp := time.Now()
 			logRequest := LogRequests{
 				Timestamp: timestamp,
 				Method:    r.Method,
 				Url:       r.URL.Path,
 				UserAgent: r.UserAgent(),
-				IpAddress: r.RemoteAddr,
+				IpAddress: clientIp(r),
 			}
-			db.Create(&logRequest)
+			requestLogger.Add(logRequest)
 			next.ServeHTTP(w, r)
-			log.Printf("%s %s %v", r.Method, r.URL.Path, time.Since(timestamp))
+			log.Printf("%s %s %v request_id=%s", r.Method, r.URL.Path, time.Since(timestamp), getRequestIdFromContext(r.Context()))
 		})
 	}
 }
 
-func loadBlocklist() error {
+func loadBlocklist(cfg BlocklistConfig) error {
 	blocklistMutex.Lock()
 	defer blocklistMutex.Unlock()
 
-	if time.Since(lastBlocklistLoad) < 5*time.Minute && blockedAPIKeys != nil {
+	if time.Since(lastBlocklistLoad) < cfg.ReloadInterval && blockedAPIKeys != nil {
 		return nil
 	}
 
-	data, err := os.ReadFile("blacklist.csv")
+	data, err := os.ReadFile(cfg.Path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			blockedAPIKeys = make(map[string]bool)
@@ -156,8 +274,8 @@ func loadBlocklist() error {
 	return nil
 }
 
-func blocklistMiddleware() mux.MiddlewareFunc {
-	if err := loadBlocklist(); err != nil {
+func blocklistMiddleware(cfg BlocklistConfig) mux.MiddlewareFunc {
+	if err := loadBlocklist(cfg); err != nil {
 		log.Printf("Warning: Failed to load API key blocklist: %v", err)
 	}
 
@@ -170,7 +288,7 @@ func blocklistMiddleware() mux.MiddlewareFunc {
 				return
 			}
 
-			if err := loadBlocklist(); err != nil {
+			if err := loadBlocklist(cfg); err != nil {
 				http.Error(w, "Something went wrong", http.StatusInternalServerError)
 			}
 
@@ -188,48 +306,26 @@ func blocklistMiddleware() mux.MiddlewareFunc {
 	}
 }
 
-func ipRateLimitMiddleware() mux.MiddlewareFunc {
+func ipRateLimitMiddleware(limits RateLimitsConfig) mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ip := r.RemoteAddr
+			ip := clientIp(r)
 
-			var redisKey string
-			var rateLimit int64
+			var key string
+			var rateLimit RateLimit
 
-			if r.URL.Path == "/redirect" {
-				redisKey = "redirect:" + ip
-				rateLimit = 50
+			if isRedirectRequest(r) {
+				key = "redirect:" + ip
+				rateLimit = limits.Redirect
 			} else if r.URL.Path == "/shorten" {
-				redisKey = "shorten:" + ip
-				rateLimit = 10
+				key = "shorten:" + ip
+				rateLimit = limits.Shorten
 			} else {
-				redisKey = "default:" + ip
-				rateLimit = 100
+				key = "default:" + ip
+				rateLimit = limits.Default
 			}
 
-			count, err := redisClient.Incr(redisKey).Result()
-			if err != nil {
-				http.Error(w, "Error incrementing request count", http.StatusInternalServerError)
-				return
-			}
-
-			if count == 1 {
-				var expiry time.Duration
-				if r.URL.Path == "/redirect" || r.URL.Path == "/shorten" {
-					expiry = 1 * time.Second
-				} else {
-					expiry = 1 * time.Minute
-				}
-
-				err = redisClient.Expire(redisKey, expiry).Err()
-				if err != nil {
-					http.Error(w, "Error setting expiry", http.StatusInternalServerError)
-					return
-				}
-			}
-
-			if count > rateLimit {
-				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			if !allowRequest(w, r, key, limits.Algorithm, rateLimit) {
 				return
 			}
 
@@ -238,38 +334,24 @@ func ipRateLimitMiddleware() mux.MiddlewareFunc {
 	}
 }
 
-func freeTierRateLimitMiddleware(ctx *context.Context) mux.MiddlewareFunc {
+// userRateLimitMiddleware resolves the API key to a user and stores it and
+// the plans on the request context for the handlers and middlewares after
+// it. Requests with a key count against the rate limit of the user's plan.
+func userRateLimitMiddleware(limits RateLimitsConfig, plans PlansConfig) mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			apiKey := r.Header.Get("X-API-Key")
+			ctx := withPlans(r.Context(), plans)
+			r = r.WithContext(ctx)
 
-			if apiKey != "" {
+			if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
 				user := getUserFromApiKeyIfExists(ctx, apiKey)
 
 				if user != nil {
-					*ctx = addValueToContext(ctx, "user", user)
-
-					if user.Tier == "free" {
-						redisKey := fmt.Sprintf("free_tier:%d", user.Id)
-
-						count, err := redisClient.Incr(redisKey).Result()
-						if err != nil {
-							http.Error(w, "Error tracking request count", http.StatusInternalServerError)
-							return
-						}
-
-						if count == 1 {
-							err = redisClient.Expire(redisKey, 60*time.Second).Err()
-							if err != nil {
-								http.Error(w, "Error setting rate limit expiry", http.StatusInternalServerError)
-								return
-							}
-						}
-
-						if count > 5 {
-							w.Header().Set("Content-Type", "application/json")
-							http.Error(w, "Too many requests", http.StatusTooManyRequests)
-						}
+					r = r.WithContext(withUser(ctx, user))
+
+					plan := plans.planFor(user.Tier)
+					if plan.RateLimit.Requests > 0 && !allowRequest(w, r, fmt.Sprintf("user:%d", user.Id), limits.Algorithm, plan.RateLimit) {
+						return
 					}
 				}
 			}
@@ -279,7 +361,68 @@ func freeTierRateLimitMiddleware(ctx *context.Context) mux.MiddlewareFunc {
 	}
 }
 
-func apiKeyMiddleware(ctx *context.Context) mux.MiddlewareFunc {
+// allowRequest counts the request under key and answers 429 with a
+// Retry-After header once rateLimit is exceeded. It reports whether the
+// request may go on.
+func allowRequest(w http.ResponseWriter, r *http.Request, key string, algorithm string, rateLimit RateLimit) bool {
+	result, err := rateLimiter.Allow(r.Context(), key, ratelimit.Limit{
+		Algorithm: ratelimit.Algorithm(algorithm),
+		Requests:  rateLimit.Requests,
+		Window:    rateLimit.Window,
+	})
+	if err != nil {
+		http.Error(w, "Error checking the rate limit", http.StatusInternalServerError)
+		return false
+	}
+
+	if !result.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return false
+	}
+
+	return true
+}
+
+// routeScopes maps the name of an authenticated route to the scope its key
+// needs. Routes without an entry only need a valid key.
+var routeScopes = map[string]string{
+	"delete_url":     scopeLinksWrite,
+	"edit_url":       scopeLinksWrite,
+	"user_urls":      scopeLinksRead,
+	"export_urls":    scopeLinksRead,
+	"user_usage":     scopeStatsRead,
+	"list_revisions": scopeLinksRead,
+	"rollback_link":  scopeLinksWrite,
+	"list_keys":      scopeKeysManage,
+	"create_key":     scopeKeysManage,
+	"rotate_key":     scopeKeysManage,
+	"revoke_key":     scopeKeysManage,
+	"bulk_shorten":   scopeLinksBulk,
+
+	"create_bulk_job": scopeLinksBulk,
+	"get_job":         scopeLinksBulk,
+	"job_result":      scopeLinksBulk,
+
+	"list_workspaces":  scopeLinksRead,
+	"list_members":     scopeLinksRead,
+	"create_workspace": scopeWorkspacesManage,
+	"save_member":      scopeWorkspacesManage,
+	"remove_member":    scopeWorkspacesManage,
+}
+
+// hasRouteScope reports whether the key of user may call the matched route.
+func hasRouteScope(r *http.Request, user *Users) bool {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return true
+	}
+
+	scope, exists := routeScopes[route.GetName()]
+	return !exists || user.hasScope(scope)
+}
+
+func apiKeyMiddleware() mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			apiKey := r.Header.Get("X-API-Key")
@@ -289,25 +432,33 @@ func apiKeyMiddleware(ctx *context.Context) mux.MiddlewareFunc {
 				return
 			}
 
-			user := getUserFromContext(ctx)
+			user := getUserFromContext(r.Context())
 
 			if user == nil {
 				http.Error(w, "Invalid API key", http.StatusUnauthorized)
 				return
 			}
 
+			if !hasRouteScope(r, user) {
+				http.Error(w, "This API key is missing the scope for this resource", http.StatusForbidden)
+				return
+			}
+
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
-func pricingPlanMiddleware(ctx *context.Context) mux.MiddlewareFunc {
+// pricingPlanMiddleware lets through the users whose plan includes bulk
+// shortening. It runs after apiKeyMiddleware, which checks the scopes.
+func pricingPlanMiddleware() mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
 			user := getUserFromContext(ctx)
 
-			if user.Tier != "enterprise" {
-				http.Error(w, "You are not authorized to access this resource", http.StatusForbidden)
+			if !userPlan(ctx, user).Bulk {
+				http.Error(w, "Your plan does not include bulk shortening", http.StatusForbidden)
 				return
 			}
 
@@ -317,14 +468,22 @@ func pricingPlanMiddleware(ctx *context.Context) mux.MiddlewareFunc {
 }
 
 func NewDatabase(dbPath string) (*gorm.DB, error) {
-	db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
+	db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{TranslateError: true})
 	if err != nil {
 		return nil, err
 	}
 
-	db.AutoMigrate(&UrlShortener{})
-	db.AutoMigrate(&Users{})
-	db.AutoMigrate(&LogRequests{})
+	if err := migrateDatabase(db); err != nil {
+		return nil, err
+	}
 
 	return db, nil
 }
+
+func migrateDatabase(db *gorm.DB) error {
+	if err := db.AutoMigrate(&UrlShortener{}, &Users{}, &ApiKeys{}, &Workspaces{}, &WorkspaceMembers{}, &LinkRevisions{}, &Jobs{}, &LogRequests{}, &Clicks{}, &Usages{}, &IpRules{}, &BlockedAttempts{}); err != nil {
+		return err
+	}
+
+	return migrateApiKeyDigests(db)
+}
@@ -16,17 +16,90 @@ type UrlShortener struct {
 	UpdatedAt   time.Time  `gorm:"not null"`
 	DeletedAt   *time.Time `gorm:"default:null"`
 	ExpiresAt   *time.Time `gorm:"default:null"`
+	// RedirectType is the HTTP status used by the redirect, one of 301, 302,
+	// 307 or 308.
+	RedirectType int `gorm:"not null;default:307"`
+	// WorkspaceId is set for links owned by a workspace. Those are managed by
+	// its members according to their role, UserId only records who created
+	// the link. Links without a workspace belong to UserId alone.
+	WorkspaceId *uint `gorm:"index"`
 }
 
 type Users struct {
-	Id        uint       `gorm:"primaryKey"`
-	Email     string     `gorm:"unique;not null"`
-	Name      *string    `gorm:"default:null"`
-	ApiKey    string     `gorm:"unique;not null"`
-	Tier      string     `gorm:"default:hobby"`
-	CreatedAt time.Time  `gorm:"not null"`
-	UpdatedAt time.Time  `gorm:"not null"`
-	DeletedAt *time.Time `gorm:"default:null"`
+	Id    uint    `gorm:"primaryKey"`
+	Email string  `gorm:"unique;not null"`
+	Name  *string `gorm:"default:null"`
+	// ApiKey is the plaintext key. It is never stored, it is only set on a
+	// user that is being created and on the user resolved from a request.
+	ApiKey string `gorm:"-" json:"-"`
+	// ApiKeyDigest is the SHA-256 of the key, see api_keys.go. It lives in
+	// the api_key column that held plaintext keys before.
+	ApiKeyDigest string     `gorm:"column:api_key;unique;not null" json:"-"`
+	ApiKeyPrefix string     `gorm:"index;not null;default:''"`
+	Tier         string     `gorm:"default:hobby"`
+	CreatedAt    time.Time  `gorm:"not null"`
+	UpdatedAt    time.Time  `gorm:"not null"`
+	DeletedAt    *time.Time `gorm:"default:null"`
+	// The previous key keeps working until PreviousApiKeyExpiresAt after the
+	// key has been rotated, so clients can switch over without downtime.
+	PreviousApiKeyDigest    *string    `gorm:"column:previous_api_key;default:null" json:"-"`
+	PreviousApiKeyPrefix    *string    `gorm:"index;default:null"`
+	PreviousApiKeyExpiresAt *time.Time `gorm:"default:null"`
+	// Scopes and ApiKeyId describe the key the user was resolved from, see
+	// GetUserByApiKey. ApiKeyId is nil for the account key above.
+	Scopes   []string `gorm:"-" json:"-"`
+	ApiKeyId *uint    `gorm:"-" json:"-"`
+}
+
+// ApiKeys are the named keys a user creates next to the account key, each
+// limited to a set of scopes. Like the account key only a digest is stored.
+type ApiKeys struct {
+	Id     uint   `gorm:"primaryKey"`
+	UserId uint   `gorm:"not null;index"`
+	Name   string `gorm:"not null"`
+	// Key is the plaintext key, only set while the key is being created.
+	Key    string `gorm:"-" json:"-"`
+	Digest string `gorm:"unique;not null" json:"-"`
+	Prefix string `gorm:"not null;index"`
+	// Scopes is a space separated list, see apiKeyScopes.
+	Scopes     string     `gorm:"not null"`
+	ExpiresAt  *time.Time `gorm:"default:null"`
+	LastUsedAt *time.Time `gorm:"default:null"`
+	CreatedAt  time.Time  `gorm:"not null"`
+	UpdatedAt  time.Time  `gorm:"not null"`
+}
+
+// Workspaces own links on behalf of a team, see workspaces.go for the roles
+// of their members.
+type Workspaces struct {
+	Id        uint      `gorm:"primaryKey"`
+	Name      string    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null"`
+	UpdatedAt time.Time `gorm:"not null"`
+}
+
+type WorkspaceMembers struct {
+	Id          uint       `gorm:"primaryKey"`
+	WorkspaceId uint       `gorm:"not null;uniqueIndex:idx_workspace_member"`
+	Workspace   Workspaces `gorm:"foreignKey:WorkspaceId" json:"-"`
+	UserId      uint       `gorm:"not null;uniqueIndex:idx_workspace_member;index"`
+	User        Users      `gorm:"foreignKey:UserId" json:"-"`
+	Role        string     `gorm:"not null"`
+	CreatedAt   time.Time  `gorm:"not null"`
+	UpdatedAt   time.Time  `gorm:"not null"`
+}
+
+// LinkRevisions is the history of a link, one row per change with the state
+// before and after it as JSON, see linkSnapshot. OldValues is empty for the
+// revision that created the link.
+type LinkRevisions struct {
+	Id        uint      `gorm:"primaryKey"`
+	ShortCode string    `gorm:"not null;index"`
+	UserId    *uint     `gorm:"index"`
+	Action    string    `gorm:"not null"`
+	OldValues string    `gorm:"not null"`
+	NewValues string    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null;index"`
 }
 
 type LogRequests struct {
@@ -40,3 +113,84 @@ type LogRequests struct {
 	UpdatedAt time.Time  `gorm:"not null"`
 	DeletedAt *time.Time `gorm:"default:null"`
 }
+
+type Clicks struct {
+	Id        uint      `gorm:"primaryKey"`
+	ShortCode string    `gorm:"not null;index"`
+	Timestamp time.Time `gorm:"not null"`
+	Referrer  string    `gorm:"not null"`
+	UserAgent string    `gorm:"not null"`
+	IpAddress string    `gorm:"not null"`
+	// Country stays empty until a GeoIP lookup is wired in.
+	Country   *string   `gorm:"default:null"`
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+// Usages counts what a user did in a calendar month, one row per user and
+// Month ("2006-01" in UTC). The counters only ever grow, see AddUsages.
+type Usages struct {
+	Id           uint      `gorm:"primaryKey" json:"-"`
+	UserId       uint      `gorm:"not null;uniqueIndex:idx_usage_user_month" json:"-"`
+	Month        string    `gorm:"not null;uniqueIndex:idx_usage_user_month" json:"month"`
+	LinksCreated int64     `gorm:"not null;default:0" json:"links_created"`
+	Redirects    int64     `gorm:"not null;default:0" json:"redirects"`
+	BulkJobs     int64     `gorm:"not null;default:0" json:"bulk_jobs"`
+	UpdatedAt    time.Time `gorm:"not null" json:"-"`
+}
+
+// BlockedAttempts is the audit trail of destinations rejected by the domain
+// blocklist, either when shortening or when redirecting.
+type BlockedAttempts struct {
+	Id        uint      `gorm:"primaryKey"`
+	Timestamp time.Time `gorm:"not null"`
+	Action    string    `gorm:"not null"`
+	Url       string    `gorm:"not null"`
+	Rule      string    `gorm:"not null"`
+	ShortCode *string
+	UserId    *uint
+	IpAddress string    `gorm:"not null"`
+	RequestId string    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+// IpRules are the IP access control rules managed through /admin/ip-rules,
+// next to the ones of the ip_acl config. See ip_acl.go for how they apply.
+type IpRules struct {
+	Id uint `gorm:"primaryKey"`
+	// Scope is management or redirect, Action allow or deny.
+	Scope  string `gorm:"not null"`
+	Action string `gorm:"not null"`
+	// Cidr is a range like 10.0.0.0/8 or 2001:db8::/32, or a single address.
+	Cidr      string    `gorm:"not null"`
+	Note      string    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+// Jobs are background tasks processed by the workers of jobRunner. Input
+// holds the uploaded rows until the job finished, Result the file served by
+// GET /jobs/{id}/result.
+type Jobs struct {
+	Id            string `gorm:"primaryKey"`
+	UserId        uint   `gorm:"not null;index"`
+	Type          string `gorm:"not null"`
+	Status        string `gorm:"not null;index"`
+	TotalRows     int    `gorm:"not null"`
+	ProcessedRows int    `gorm:"not null"`
+	FailedRows    int    `gorm:"not null"`
+	// Tier is the tier of the user when the job was created, the worker
+	// applies the limits of its plan.
+	Tier string `gorm:"not null;default:''"`
+	// Input holds the links as JSONL with their passwords encrypted, see
+	// bulkJobItem. It is cleared once the job finished.
+	Input      string    `gorm:"not null" json:"-"`
+	Result     string    `gorm:"not null" json:"-"`
+	Error      string    `gorm:"not null"`
+	IpAddress  string    `gorm:"not null"`
+	CreatedAt  time.Time `gorm:"not null;index"`
+	UpdatedAt  time.Time `gorm:"not null"`
+	StartedAt  *time.Time
+	FinishedAt *time.Time
+	// LeaseExpiresAt is pushed back by the instance running the job. A
+	// running job whose lease expired was abandoned by a stopped instance.
+	LeaseExpiresAt *time.Time `gorm:"index"`
+}
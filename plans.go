@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// planFor returns the plan of tier, the default plan for unknown tiers.
+func (plans PlansConfig) planFor(tier string) Plan {
+	if plan, exists := plans.Tiers[tier]; exists {
+		return plan
+	}
+	return plans.Tiers[plans.Default]
+}
+
+// userPlan is the plan of user, the default plan for anonymous requests.
+func userPlan(ctx context.Context, user *Users) Plan {
+	plans := getPlansFromContext(ctx)
+	if user == nil {
+		return plans.planFor(plans.Default)
+	}
+	return plans.planFor(user.Tier)
+}
+
+// Messages of the plan checks, shared by the single and the bulk endpoints.
+const (
+	planErrorCustomUrls      = "custom_url_not_in_plan"
+	planErrorPasswords       = "password_not_in_plan"
+	planErrorMonthlyLinks    = "monthly_quota_exceeded"
+	planErrorMonthlyBulkJobs = "monthly_bulk_quota_exceeded"
+)
+
+var planErrorMessages = map[string]string{
+	planErrorCustomUrls:      "Your plan does not include custom URLs",
+	planErrorPasswords:       "Your plan does not include password protected links",
+	planErrorMonthlyLinks:    "Your plan's monthly link quota is used up",
+	planErrorMonthlyBulkJobs: "Your plan's monthly bulk shortening quota is used up",
+}
+
+// checkPlanFeatures returns the plan error code of a link asking for a
+// custom URL or a password, or "" when the plan includes them.
+func checkPlanFeatures(plan Plan, customUrl *string, password *string) string {
+	if customUrl != nil && !plan.CustomUrls {
+		return planErrorCustomUrls
+	}
+	if password != nil && !plan.Passwords {
+		return planErrorPasswords
+	}
+	return ""
+}
+
+// monthlyLinksLeft is the number of links user may still create this
+// calendar month, and false when the plan has no quota. Anonymous links are
+// not counted. It only reads the usage, links are counted against the quota
+// with reserveUsage.
+func monthlyLinksLeft(ctx context.Context, user *Users, plan Plan) (int64, bool) {
+	if user == nil || plan.MonthlyLinks == 0 {
+		return 0, false
+	}
+
+	usage, err := getStoreFromContext(ctx).GetUsage(ctx, user.Id, usageMonth(time.Now()))
+	if err != nil {
+		// Nothing should fail because the usage cannot be read.
+		log.Printf("Error reading the usage of user %d: %v request_id=%s", user.Id, err, getRequestIdFromContext(ctx))
+		return 0, false
+	}
+
+	return max(plan.MonthlyLinks-usage.LinksCreated, 0), true
+}
+
+// reserveUsage adds up to n to counter of user this month without going
+// over quota, 0 for no limit, and returns how much it added and the month it
+// was added to. It is called before anything is created so concurrent
+// requests cannot overshoot the quota together, what ends up not being
+// created is given back with refundUsage. Anonymous requests are not counted.
+func reserveUsage(ctx context.Context, user *Users, counter string, n int64, quota int64) (int64, string) {
+	month := usageMonth(time.Now())
+	if user == nil || n <= 0 {
+		return n, month
+	}
+
+	reserved, err := getStoreFromContext(ctx).ReserveUsage(ctx, user.Id, month, counter, n, quota)
+	if err != nil {
+		// Nothing should fail because the usage cannot be counted.
+		log.Printf("Error reserving the usage of user %d: %v request_id=%s", user.Id, err, getRequestIdFromContext(ctx))
+		return n, month
+	}
+
+	return reserved, month
+}
+
+// refundUsage gives back n of counter reserved with reserveUsage in month,
+// which stays the month of the reservation when the refund comes after the
+// month changed.
+func refundUsage(ctx context.Context, user *Users, counter string, n int64, month string) {
+	if user == nil || n <= 0 {
+		return
+	}
+
+	usage := counterUsage(user.Id, month, counter, -n)
+	if err := getStoreFromContext(ctx).AddUsages(ctx, []Usages{usage}); err != nil {
+		log.Printf("Error refunding the usage of user %d: %v request_id=%s", user.Id, err, getRequestIdFromContext(ctx))
+	}
+}
+
+// writeQuotaError answers a request over a monthly quota like
+// writeUrlValidationError, with the code and message of the quota. Links
+// need a bigger plan so they get a 402, bulk requests are only limited in
+// how often they run and get a 429 until the next month. A bulk request
+// counts as a run once it is accepted, even when every item then fails
+// validation, only a job that could not be stored is given back.
+func writeQuotaError(w http.ResponseWriter, code string) {
+	status := http.StatusPaymentRequired
+	if code == planErrorMonthlyBulkJobs {
+		status = http.StatusTooManyRequests
+		retryAfter := time.Until(nextMonth(time.Now()))
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(urlValidationError{Code: code, Message: planErrorMessages[code]})
+}
+
+func bulkSizeMessage(plan Plan) string {
+	return fmt.Sprintf("Your plan allows at most %d links at once", plan.MaxBulkSize)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func createPlanTestUser(t *testing.T, store LinkStore, tier string) *Users {
+	t.Helper()
+
+	user := &Users{Email: uuid.NewString() + "@example.com", ApiKey: uuid.NewString(), Tier: tier}
+	if err := store.CreateUser(context.Background(), user); err != nil {
+		t.Fatalf("CreateUser returned error: %v", err)
+	}
+	return user
+}
+
+func TestPlanFor(t *testing.T) {
+	plans := defaultConfig().Plans
+
+	if plan := plans.planFor("enterprise"); !plan.Bulk {
+		t.Errorf("got %+v want the enterprise plan", plan)
+	}
+	if plan := plans.planFor("platinum"); plan != plans.Tiers["hobby"] {
+		t.Errorf("unknown tier: got %+v want the default hobby plan", plan)
+	}
+}
+
+func TestPlanLimits(t *testing.T) {
+	initRedis(defaultConfig().Redis)
+
+	plans := defaultConfig().Plans
+	plans.Tiers["free"] = Plan{MonthlyLinks: 2}
+	plans.Tiers["team"] = Plan{Bulk: true, MaxBulkSize: 3, MonthlyLinks: 2, CustomUrls: true}
+
+	store := newMemoryLinkStore()
+	router := newTestRouter(t, store, nil, func(cfg *Config) { cfg.Plans = plans })
+	free := createPlanTestUser(t, store, "free")
+	team := createPlanTestUser(t, store, "team")
+	hobby := createPlanTestUser(t, store, "hobby")
+
+	// Test 1: Custom URLs and passwords need a plan that includes them
+	for _, body := range []string{
+		`{"url": "http://example.com", "custom_url": "free` + uuid.NewString()[:8] + `"}`,
+		`{"url": "http://example.com", "password": "secret"}`,
+	} {
+		if rr := serveUsersRequest(router, "POST", "/shorten", free.ApiKey, body); rr.Code != http.StatusForbidden {
+			t.Errorf("%s: got %v want %v", body, rr.Code, http.StatusForbidden)
+		}
+	}
+	if rr := serveUsersRequest(router, "POST", "/shorten", "", `{"url": "http://example.com", "password": "secret"}`); rr.Code != http.StatusCreated {
+		t.Errorf("anonymous link on the default plan: got %v want %v", rr.Code, http.StatusCreated)
+	}
+
+	// Test 2: The monthly quota counts the links created this month
+	var shortCode string
+	for i := 0; i < 3; i++ {
+		rr := serveUsersRequest(router, "POST", "/shorten", free.ApiKey, `{"url": "http://example.com"}`)
+		want := http.StatusCreated
+		if i == 2 {
+			want = http.StatusPaymentRequired
+		}
+		if rr.Code != want {
+			t.Errorf("link %d: got %v want %v", i+1, rr.Code, want)
+		}
+
+		var response map[string]string
+		json.NewDecoder(rr.Body).Decode(&response)
+		if i == 0 {
+			shortCode = response["short_code"]
+		}
+	}
+
+	// Test 3: Editing cannot add what the plan does not include
+	if rr := serveUsersRequest(router, "PUT", "/shorten", free.ApiKey, `{"short_code": "`+shortCode+`", "password": "secret"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("adding a password: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	if rr := serveUsersRequest(router, "PUT", "/shorten", free.ApiKey, `{"short_code": "`+shortCode+`", "password": null, "redirect_type": 301}`); rr.Code != http.StatusOK {
+		t.Errorf("editing without plan features: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	// Test 4: Bulk shortening needs a plan with bulk, up to its size
+	if rr := serveUsersRequest(router, "POST", "/shorten/bulk", hobby.ApiKey, `{"urls": [{"url": "http://example.com"}]}`); rr.Code != http.StatusForbidden {
+		t.Errorf("bulk on the hobby plan: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	fourLinks := `{"urls": [{"url": "http://example.com/1"}, {"url": "http://example.com/2"}, {"url": "http://example.com/3"}, {"url": "http://example.com/4"}]}`
+	if rr := serveUsersRequest(router, "POST", "/shorten/bulk", team.ApiKey, fourLinks); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("bulk over max_bulk_size: got %v want %v", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	// Test 5: Bulk items fail one by one, the whole request once the quota is used up
+	var response struct {
+		Results []bulkShortenResult `json:"results"`
+	}
+	rr := serveUsersRequest(router, "POST", "/shorten/bulk", team.ApiKey, `{"urls": [{"url": "http://example.com/1"}, {"url": "http://example.com/2", "password": "secret"}, {"url": "http://example.com/3"}]}`)
+	json.NewDecoder(rr.Body).Decode(&response)
+	if rr.Code != http.StatusMultiStatus || len(response.Results) != 3 || response.Results[1].ErrorCode != planErrorPasswords || response.Results[2].ShortCode == "" {
+		t.Errorf("got %v %+v want the password protected link to fail", rr.Code, response.Results)
+	}
+
+	rr = serveUsersRequest(router, "POST", "/shorten/bulk", team.ApiKey, `{"urls": [{"url": "http://example.com/4"}]}`)
+	var quotaErr urlValidationError
+	json.NewDecoder(rr.Body).Decode(&quotaErr)
+	if rr.Code != http.StatusPaymentRequired || quotaErr.Code != planErrorMonthlyLinks {
+		t.Errorf("got %v %+v want %v", rr.Code, quotaErr, planErrorMonthlyLinks)
+	}
+}
+
+func TestRefundUsage(t *testing.T) {
+	store := newMemoryLinkStore()
+	ctx := withStore(context.Background(), store)
+	user := createPlanTestUser(t, store, "team")
+
+	// Test 1: A refund gives back what was reserved this month
+	reserved, month := reserveUsage(ctx, user, usageLinksCreated, 3, 10)
+	if reserved != 3 || month != usageMonth(time.Now()) {
+		t.Fatalf("got %d in %s want 3 in %s", reserved, month, usageMonth(time.Now()))
+	}
+	refundUsage(ctx, user, usageLinksCreated, 2, month)
+
+	// Test 2: A reservation made before the month changed is refunded in
+	// the month it was made
+	lastMonth := usageMonth(time.Now().UTC().AddDate(0, 0, -time.Now().UTC().Day()))
+	store.ReserveUsage(ctx, user.Id, lastMonth, usageLinksCreated, 4, 10)
+	refundUsage(ctx, user, usageLinksCreated, 4, lastMonth)
+
+	if usage, _ := store.GetUsage(ctx, user.Id, month); usage == nil || usage.LinksCreated != 1 {
+		t.Errorf("got %+v want 1 link this month", usage)
+	}
+	if usage, _ := store.GetUsage(ctx, user.Id, lastMonth); usage != nil && usage.LinksCreated != 0 {
+		t.Errorf("got %+v want no links last month", usage)
+	}
+}
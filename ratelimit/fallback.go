@@ -0,0 +1,57 @@
+package ratelimit
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// fallbackRetryInterval is how long a Fallback keeps using the fallback
+// limiter after the primary failed, so an unreachable Redis does not slow
+// down every request.
+const fallbackRetryInterval = 5 * time.Second
+
+// Fallback asks the primary limiter and, when it fails, the fallback one.
+type Fallback struct {
+	primary  Limiter
+	fallback Limiter
+
+	mu       sync.Mutex
+	failedAt time.Time
+	now      func() time.Time
+}
+
+func NewFallback(primary Limiter, fallback Limiter) *Fallback {
+	return &Fallback{primary: primary, fallback: fallback, now: time.Now}
+}
+
+func (f *Fallback) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	f.mu.Lock()
+	failedAt := f.failedAt
+	f.mu.Unlock()
+
+	if !failedAt.IsZero() && f.now().Sub(failedAt) < fallbackRetryInterval {
+		return f.fallback.Allow(ctx, key, limit)
+	}
+
+	result, err := f.primary.Allow(ctx, key, limit)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err == nil {
+		if !f.failedAt.IsZero() {
+			log.Printf("Rate limiter recovered, counting requests in the primary limiter again")
+			f.failedAt = time.Time{}
+		}
+		return result, nil
+	}
+
+	if f.failedAt.IsZero() {
+		log.Printf("Error in the rate limiter, counting requests in process memory: %v", err)
+	}
+	f.failedAt = f.now()
+
+	return f.fallback.Allow(ctx, key, limit)
+}
@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often a Memory limiter drops the keys that were not
+// used for a whole window.
+const sweepInterval = time.Minute
+
+// Memory counts requests in process memory, each instance on its own.
+type Memory struct {
+	mu        sync.Mutex
+	entries   map[string]*memoryEntry
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type memoryEntry struct {
+	// tokens and updated are the state of a token bucket.
+	tokens  float64
+	updated time.Time
+	// log holds the times of the requests in the window of a sliding log,
+	// oldest first.
+	log       []time.Time
+	expiresAt time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{entries: map[string]*memoryEntry{}, now: time.Now}
+}
+
+func (m *Memory) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	key = string(limit.algorithm()) + ":" + key
+	entry, exists := m.entries[key]
+	if !exists {
+		entry = &memoryEntry{tokens: float64(limit.Requests), updated: now}
+		m.entries[key] = entry
+	}
+	entry.expiresAt = now.Add(limit.Window)
+
+	if limit.algorithm() == TokenBucket {
+		return entry.takeToken(now, limit), nil
+	}
+	return entry.appendLog(now, limit), nil
+}
+
+func (e *memoryEntry) takeToken(now time.Time, limit Limit) Result {
+	capacity := float64(limit.Requests)
+	refill := capacity / float64(limit.Window)
+
+	if elapsed := now.Sub(e.updated); elapsed > 0 {
+		e.tokens = math.Min(capacity, e.tokens+float64(elapsed)*refill)
+	}
+	e.updated = now
+
+	if e.tokens < 1 {
+		return Result{RetryAfter: time.Duration(math.Ceil((1 - e.tokens) / refill))}
+	}
+
+	e.tokens--
+	return Result{Allowed: true, Remaining: int64(e.tokens)}
+}
+
+func (e *memoryEntry) appendLog(now time.Time, limit Limit) Result {
+	start := now.Add(-limit.Window)
+	expired := 0
+	for expired < len(e.log) && !e.log[expired].After(start) {
+		expired++
+	}
+	e.log = e.log[expired:]
+
+	if int64(len(e.log)) >= limit.Requests {
+		return Result{RetryAfter: e.log[0].Add(limit.Window).Sub(now)}
+	}
+
+	e.log = append(e.log, now)
+	return Result{Allowed: true, Remaining: limit.Requests - int64(len(e.log))}
+}
+
+func (m *Memory) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < sweepInterval {
+		return
+	}
+	m.lastSweep = now
+
+	for key, entry := range m.entries {
+		if !entry.expiresAt.After(now) {
+			delete(m.entries, key)
+		}
+	}
+}
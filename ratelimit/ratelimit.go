@@ -0,0 +1,62 @@
+// Package ratelimit counts requests per key with a token bucket or a sliding
+// log, either in Redis, shared by every instance, or in process memory.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Algorithm decides how requests are counted against a Limit.
+type Algorithm string
+
+const (
+	// SlidingLog remembers the time of every request in the window, so at
+	// most Requests pass in any Window long period.
+	SlidingLog Algorithm = "sliding_log"
+	// TokenBucket holds up to Requests tokens and refills Requests tokens
+	// per Window. Bursts up to the bucket size pass right away.
+	TokenBucket Algorithm = "token_bucket"
+)
+
+// ParseAlgorithm returns the algorithm named name.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	switch Algorithm(name) {
+	case SlidingLog, TokenBucket:
+		return Algorithm(name), nil
+	default:
+		return "", fmt.Errorf("unknown rate limit algorithm %q, expected %s or %s", name, SlidingLog, TokenBucket)
+	}
+}
+
+// Limit allows Requests per Window, counted with Algorithm.
+type Limit struct {
+	Algorithm Algorithm
+	Requests  int64
+	Window    time.Duration
+}
+
+// algorithm defaults to SlidingLog.
+func (l Limit) algorithm() Algorithm {
+	if l.Algorithm == "" {
+		return SlidingLog
+	}
+	return l.Algorithm
+}
+
+// Result tells whether a request may pass.
+type Result struct {
+	Allowed bool
+	// Remaining is the number of requests that may still pass right now.
+	Remaining int64
+	// RetryAfter is how long to wait before the next request may pass when
+	// this one was not allowed.
+	RetryAfter time.Duration
+}
+
+// Limiter counts a request for key and tells whether it is within limit.
+// Keys of different algorithms never share their count.
+type Limiter interface {
+	Allow(ctx context.Context, key string, limit Limit) (Result, error)
+}
@@ -0,0 +1,170 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// clock is a time that only moves when the test says so.
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func testLimiters(t *testing.T, run func(t *testing.T, limiter Limiter, clock *clock)) {
+	t.Run("Memory", func(t *testing.T) {
+		clock := &clock{now: time.Now()}
+		limiter := NewMemory()
+		limiter.now = clock.Now
+		run(t, limiter, clock)
+	})
+
+	t.Run("Redis", func(t *testing.T) {
+		client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+		defer client.Close()
+
+		clock := &clock{now: time.Now()}
+		limiter := NewRedis(client)
+		limiter.now = clock.Now
+		run(t, limiter, clock)
+	})
+}
+
+func allowN(t *testing.T, limiter Limiter, key string, limit Limit, n int) []Result {
+	t.Helper()
+
+	results := []Result{}
+	for i := 0; i < n; i++ {
+		result, err := limiter.Allow(context.Background(), key, limit)
+		if err != nil {
+			t.Fatalf("Allow returned error: %v", err)
+		}
+		results = append(results, result)
+	}
+
+	return results
+}
+
+func TestSlidingLog(t *testing.T) {
+	testLimiters(t, func(t *testing.T, limiter Limiter, clock *clock) {
+		key := uuid.NewString()
+		limit := Limit{Algorithm: SlidingLog, Requests: 3, Window: time.Minute}
+
+		results := allowN(t, limiter, key, limit, 4)
+		for i, result := range results[:3] {
+			if !result.Allowed || result.Remaining != int64(2-i) {
+				t.Errorf("request %d: got %+v want allowed with %d remaining", i+1, result, 2-i)
+			}
+		}
+		if results[3].Allowed || results[3].RetryAfter != time.Minute {
+			t.Errorf("request 4: got %+v want denied for a minute", results[3])
+		}
+
+		// The requests of a fixed window's edge still count right after it.
+		clock.now = clock.now.Add(59 * time.Second)
+		if result := allowN(t, limiter, key, limit, 1)[0]; result.Allowed || result.RetryAfter != time.Second {
+			t.Errorf("before the window passed: got %+v want denied for a second", result)
+		}
+
+		clock.now = clock.now.Add(time.Second)
+		if result := allowN(t, limiter, key, limit, 1)[0]; !result.Allowed {
+			t.Errorf("after the window passed: got %+v want allowed", result)
+		}
+
+		// Denied requests are not logged.
+		clock.now = clock.now.Add(time.Minute)
+		if results := allowN(t, limiter, key, limit, 3); !results[2].Allowed {
+			t.Errorf("got %+v want 3 requests allowed again", results)
+		}
+	})
+}
+
+func TestTokenBucket(t *testing.T) {
+	testLimiters(t, func(t *testing.T, limiter Limiter, clock *clock) {
+		key := uuid.NewString()
+		limit := Limit{Algorithm: TokenBucket, Requests: 4, Window: 4 * time.Second}
+
+		results := allowN(t, limiter, key, limit, 5)
+		if !results[3].Allowed || results[3].Remaining != 0 {
+			t.Errorf("got %+v want a burst of 4 allowed", results[3])
+		}
+		if results[4].Allowed || results[4].RetryAfter != time.Second {
+			t.Errorf("got %+v want the fifth request denied for a second", results[4])
+		}
+
+		// A token per second comes back.
+		clock.now = clock.now.Add(1500 * time.Millisecond)
+		results = allowN(t, limiter, key, limit, 2)
+		if !results[0].Allowed || results[1].Allowed || results[1].RetryAfter != 500*time.Millisecond {
+			t.Errorf("got %+v want one request allowed and the next one in 500ms", results)
+		}
+
+		// The bucket never holds more than its size.
+		clock.now = clock.now.Add(time.Hour)
+		if results := allowN(t, limiter, key, limit, 5); !results[3].Allowed || results[4].Allowed {
+			t.Errorf("got %+v want a burst of 4 allowed after an hour", results)
+		}
+	})
+}
+
+func TestAlgorithmsDoNotShareKeys(t *testing.T) {
+	testLimiters(t, func(t *testing.T, limiter Limiter, clock *clock) {
+		key := uuid.NewString()
+		allowN(t, limiter, key, Limit{Algorithm: SlidingLog, Requests: 1, Window: time.Minute}, 2)
+
+		if result := allowN(t, limiter, key, Limit{Algorithm: TokenBucket, Requests: 1, Window: time.Minute}, 1)[0]; !result.Allowed {
+			t.Errorf("got %+v want the token bucket of the key untouched", result)
+		}
+	})
+}
+
+type failingLimiter struct {
+	calls int
+}
+
+func (f *failingLimiter) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	f.calls++
+	return Result{}, errors.New("connection refused")
+}
+
+func TestFallback(t *testing.T) {
+	clock := &clock{now: time.Now()}
+	primary := &failingLimiter{}
+	limiter := NewFallback(primary, NewMemory())
+	limiter.now = clock.Now
+
+	limit := Limit{Requests: 2, Window: time.Minute}
+	results := allowN(t, limiter, "key", limit, 3)
+	if !results[1].Allowed || results[2].Allowed {
+		t.Errorf("got %+v want the memory limiter to allow 2 requests", results)
+	}
+
+	// The primary is not asked again until the retry interval passed.
+	if primary.calls != 1 {
+		t.Errorf("got %d calls to the primary want 1", primary.calls)
+	}
+	clock.now = clock.now.Add(fallbackRetryInterval)
+	allowN(t, limiter, "key", limit, 1)
+	if primary.calls != 2 {
+		t.Errorf("got %d calls to the primary want 2", primary.calls)
+	}
+}
+
+func TestParseAlgorithm(t *testing.T) {
+	for _, name := range []string{"sliding_log", "token_bucket"} {
+		if algorithm, err := ParseAlgorithm(name); err != nil || string(algorithm) != name {
+			t.Errorf("%s: got %v, %v", name, algorithm, err)
+		}
+	}
+	if _, err := ParseAlgorithm("fixed_window"); err == nil {
+		t.Error("expected an error for an unknown algorithm")
+	}
+}
@@ -0,0 +1,113 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// keyPrefix keeps the keys of the limiter apart from the rest of the
+// database.
+const keyPrefix = "ratelimit:"
+
+// tokenBucketScript refills and takes a token in one step. The bucket is a
+// hash of the tokens left and the time they were counted, it expires once
+// it would be full again. Times are in milliseconds.
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(state[1]) or capacity
+local updated = tonumber(state[2]) or now
+
+if now > updated then
+	tokens = math.min(capacity, tokens + (now - updated) * capacity / window)
+end
+
+local allowed = 0
+local retry_after = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry_after = math.ceil((1 - tokens) * window / capacity)
+end
+
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'updated', now)
+redis.call('PEXPIRE', KEYS[1], window)
+
+return {allowed, math.floor(tokens), retry_after}
+`)
+
+// slidingLogScript drops the requests that left the window and logs the new
+// one if there is room. The log is a sorted set scored by the request time
+// in milliseconds, ARGV[4] makes the member unique.
+var slidingLogScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+
+local count = redis.call('ZCARD', KEYS[1])
+if count >= limit then
+	local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+	return {0, 0, tonumber(oldest[2]) + window - now}
+end
+
+redis.call('ZADD', KEYS[1], now, ARGV[3] .. '-' .. ARGV[4])
+redis.call('PEXPIRE', KEYS[1], window)
+
+return {1, limit - count - 1, 0}
+`)
+
+// Redis counts requests in Redis, shared by every instance using the same
+// database. Each request runs a single script, so the count and its expiry
+// are updated atomically.
+type Redis struct {
+	client *redis.Client
+	now    func() time.Time
+}
+
+func NewRedis(client *redis.Client) *Redis {
+	return &Redis{client: client, now: time.Now}
+}
+
+func (l *Redis) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	now := l.now().UnixMilli()
+	window := limit.Window.Milliseconds()
+	key = keyPrefix + string(limit.algorithm()) + ":" + key
+
+	var cmd *redis.Cmd
+	if limit.algorithm() == TokenBucket {
+		cmd = tokenBucketScript.Run(ctx, l.client, []string{key}, limit.Requests, window, now)
+	} else {
+		cmd = slidingLogScript.Run(ctx, l.client, []string{key}, limit.Requests, window, now, strconv.FormatUint(rand.Uint64(), 36))
+	}
+
+	reply, err := cmd.Result()
+	if err != nil {
+		return Result{}, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 3 {
+		return Result{}, fmt.Errorf("unexpected rate limit script reply %v", reply)
+	}
+
+	allowed, _ := values[0].(int64)
+	remaining, _ := values[1].(int64)
+	retryAfter, _ := values[2].(int64)
+
+	return Result{
+		Allowed:    allowed == 1,
+		Remaining:  remaining,
+		RetryAfter: time.Duration(retryAfter) * time.Millisecond,
+	}, nil
+}
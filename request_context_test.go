@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// TestConcurrentApiKeysKeepTheirIdentity is meant to be run with -race. Two
+// users hammer the authenticated endpoints at the same time and must never
+// act as, or see the links of, each other.
+func TestConcurrentApiKeysKeepTheirIdentity(t *testing.T) {
+	store := newMemoryLinkStore()
+	ctx := context.Background()
+
+	router := mux.NewRouter()
+	router.Use(requestContextMiddleware(store, nil, nil))
+	router.Use(userRateLimitMiddleware(defaultConfig().RateLimits, defaultConfig().Plans))
+	router.Use(apiKeyMiddleware())
+	router.HandleFunc("/shorten", deleteShortCode).Methods("DELETE")
+	router.HandleFunc("/shorten", editUrl).Methods("PUT")
+	router.HandleFunc("/user/urls", getUserUrls).Methods("GET")
+
+	type account struct {
+		user       *Users
+		shortCodes map[string]bool
+	}
+
+	accounts := make([]*account, 2)
+	for i := range accounts {
+		user := &Users{Email: uuid.NewString() + "@example.com", ApiKey: uuid.NewString()}
+		if err := store.CreateUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+
+		accounts[i] = &account{user: user, shortCodes: make(map[string]bool)}
+		for j := 0; j < 3; j++ {
+			shortCode := uuid.NewString()[:8]
+			store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com", ShortCode: shortCode, UserId: &user.Id})
+			accounts[i].shortCodes[shortCode] = true
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i, current := range accounts {
+		other := accounts[1-i]
+		var otherShortCode string
+		for shortCode := range other.shortCodes {
+			otherShortCode = shortCode
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for n := 0; n < 200; n++ {
+				req := httptest.NewRequest("GET", "/user/urls?pageSize=10", nil)
+				req.Header.Set("X-API-Key", current.user.ApiKey)
+				rr := httptest.NewRecorder()
+				router.ServeHTTP(rr, req)
+
+				var response struct {
+					Urls []UrlShortener `json:"urls"`
+				}
+				if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+					t.Errorf("user %d: failed to decode /user/urls response: %v", current.user.Id, err)
+					return
+				}
+				for _, url := range response.Urls {
+					if !current.shortCodes[url.ShortCode] {
+						t.Errorf("user %d saw short code %s owned by someone else", current.user.Id, url.ShortCode)
+						return
+					}
+				}
+
+				body := strings.NewReader(`{"short_code": "` + otherShortCode + `", "activate": false}`)
+				req = httptest.NewRequest("PUT", "/shorten", body)
+				req.Header.Set("X-API-Key", current.user.ApiKey)
+				rr = httptest.NewRecorder()
+				router.ServeHTTP(rr, req)
+				if rr.Code != http.StatusForbidden {
+					t.Errorf("user %d editing another user's link: got %v want %v", current.user.Id, rr.Code, http.StatusForbidden)
+					return
+				}
+
+				req = httptest.NewRequest("DELETE", "/shorten?code="+otherShortCode, nil)
+				req.Header.Set("X-API-Key", current.user.ApiKey)
+				rr = httptest.NewRecorder()
+				router.ServeHTTP(rr, req)
+				if rr.Code != http.StatusForbidden {
+					t.Errorf("user %d deleting another user's link: got %v want %v", current.user.Id, rr.Code, http.StatusForbidden)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestRequestContextMiddlewareRequestId(t *testing.T) {
+	store := newMemoryLinkStore()
+
+	var seenRequestId string
+	var seenStore LinkStore
+	handler := requestContextMiddleware(store, nil, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenRequestId = getRequestIdFromContext(r.Context())
+		seenStore = getStoreFromContext(r.Context())
+	}))
+
+	req := httptest.NewRequest("GET", "/health", nil)
+	req.Header.Set("X-Request-ID", "abc-123")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if seenRequestId != "abc-123" || rr.Header().Get("X-Request-ID") != "abc-123" {
+		t.Errorf("got request id %q and header %q want abc-123", seenRequestId, rr.Header().Get("X-Request-ID"))
+	}
+	if seenStore != store {
+		t.Error("store was not attached to the request context")
+	}
+
+	req = httptest.NewRequest("GET", "/health", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if seenRequestId == "" || seenRequestId == "abc-123" {
+		t.Errorf("expected a generated request id, got %q", seenRequestId)
+	}
+}
+
+func TestCacheHonorsCancellation(t *testing.T) {
+	initRedis(defaultConfig().Redis)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := getCachedUrl(ctx, uuid.NewString()); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v want %v", err, context.Canceled)
+	}
+	if err := cacheUrl(ctx, uuid.NewString(), &UrlShortener{OriginalUrl: "http://example.com"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v want %v", err, context.Canceled)
+	}
+}
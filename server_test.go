@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServeUntilDoneDrainsInFlightRequests(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requestStarted := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(requestStarted)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("finished"))
+	})
+
+	cfg := defaultConfig().Server
+	server := newHttpServer(cfg, handler)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serveUntilDone(ctx, server, listener, time.Second)
+	}()
+
+	type result struct {
+		body string
+		err  error
+	}
+	responses := make(chan result, 1)
+	go func() {
+		res, err := http.Get("http://" + listener.Addr().String() + "/slow")
+		if err != nil {
+			responses <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		responses <- result{body: string(body), err: err}
+	}()
+
+	<-requestStarted
+	cancel()
+
+	response := <-responses
+	if response.err != nil {
+		t.Fatalf("in-flight request failed during shutdown: %v", response.err)
+	}
+	if response.body != "finished" {
+		t.Errorf("got body %q want %q", response.body, "finished")
+	}
+
+	if err := <-serveErr; err != nil {
+		t.Errorf("serveUntilDone returned error: %v", err)
+	}
+
+	if _, err := http.Get("http://" + listener.Addr().String() + "/slow"); err == nil {
+		t.Error("server still accepted connections after shutdown")
+	}
+}
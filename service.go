@@ -1,20 +1,21 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
 
+	"github.com/gorilla/mux"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func health(ctx *context.Context, w http.ResponseWriter, r *http.Request) {
-	db := getDbFromContext(ctx)
+func health(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store := getStoreFromContext(ctx)
 
-	result := db.Raw("SELECT 1")
-	if result.Error != nil {
+	if err := store.Ping(ctx); err != nil {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{
@@ -29,12 +30,24 @@ func health(ctx *context.Context, w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
-func shortenUrl(ctx *context.Context, w http.ResponseWriter, r *http.Request) {
+func shortenUrl(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	var requestBody struct {
-		URL       string  `json:"url"`
-		ExpiresAt *string `json:"expires_at"`
-		CustomUrl *string `json:"custom_url"`
-		Password  *string `json:"password"`
+		URL          string  `json:"url"`
+		ExpiresAt    *string `json:"expires_at"`
+		CustomUrl    *string `json:"custom_url"`
+		Password     *string `json:"password"`
+		RedirectType *int    `json:"redirect_type"`
+		WorkspaceId  *uint   `json:"workspace_id"`
+	}
+
+	// Anonymous requests may shorten too, but a key that was sent has to be
+	// allowed to create links.
+	user := getUserFromContext(ctx)
+	if user != nil && !user.hasScope(scopeLinksWrite) {
+		http.Error(w, "This API key is missing the scope for this resource", http.StatusForbidden)
+		return
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
@@ -47,17 +60,58 @@ func shortenUrl(ctx *context.Context, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	originalUrl, validationErr := normalizeUrl(requestBody.URL)
+	if validationErr != nil {
+		writeUrlValidationError(w, validationErr)
+		return
+	}
+
+	if isBlockedDestination(ctx, clientIp(r), "shorten", "", originalUrl) {
+		writeUrlValidationError(w, blockedDestinationError())
+		return
+	}
+
 	if requestBody.CustomUrl != nil && *requestBody.CustomUrl == "" {
 		http.Error(w, "Custom URL cannot be empty", http.StatusBadRequest)
 		return
 	}
 
-	apiKey := r.Header.Get("X-API-Key")
-	user := getUserFromApiKeyIfExists(ctx, apiKey)
+	if requestBody.CustomUrl != nil && isReservedShortCode(*requestBody.CustomUrl) {
+		http.Error(w, "This custom URL is reserved", http.StatusBadRequest)
+		return
+	}
+
+	if requestBody.RedirectType != nil && !isValidRedirectType(*requestBody.RedirectType) {
+		http.Error(w, "Redirect type must be one of 301, 302, 307 or 308", http.StatusBadRequest)
+		return
+	}
+
+	if requestBody.WorkspaceId != nil {
+		if user == nil {
+			http.Error(w, "An API key is required to create links in a workspace", http.StatusUnauthorized)
+			return
+		}
+		if !hasWorkspaceRole(getWorkspaceMember(ctx, *requestBody.WorkspaceId, user.Id), workspaceRoleEditor) {
+			http.Error(w, "You are not authorized to create links in this workspace", http.StatusForbidden)
+			return
+		}
+	}
+
+	plan := userPlan(ctx, user)
+	if code := checkPlanFeatures(plan, requestBody.CustomUrl, requestBody.Password); code != "" {
+		http.Error(w, planErrorMessages[code], http.StatusForbidden)
+		return
+	}
 
 	shortCode := ""
 	if requestBody.CustomUrl != nil {
-		if doesShortCodeExist(ctx, *requestBody.CustomUrl) {
+		// Deleted and expired links keep their short code.
+		taken, err := isShortCodeTaken(ctx, *requestBody.CustomUrl)
+		if err != nil {
+			http.Error(w, "Error creating the short URL", http.StatusInternalServerError)
+			return
+		}
+		if taken {
 			http.Error(w, "This custom URL already exists", http.StatusBadRequest)
 			return
 		}
@@ -66,12 +120,18 @@ func shortenUrl(ctx *context.Context, w http.ResponseWriter, r *http.Request) {
 		shortCode = createShortCode(ctx, 0)
 	}
 
-	urlShortener := &UrlShortener{OriginalUrl: requestBody.URL, ShortCode: shortCode}
+	urlShortener := &UrlShortener{OriginalUrl: originalUrl, ShortCode: shortCode, RedirectType: defaultRedirectType}
 
 	if user != nil {
 		urlShortener.UserId = &user.Id
 	}
 
+	urlShortener.WorkspaceId = requestBody.WorkspaceId
+
+	if requestBody.RedirectType != nil {
+		urlShortener.RedirectType = *requestBody.RedirectType
+	}
+
 	if requestBody.ExpiresAt != nil {
 		expiresAt, err := time.Parse(time.RFC3339, *requestBody.ExpiresAt)
 		if err != nil {
@@ -91,8 +151,15 @@ func shortenUrl(ctx *context.Context, w http.ResponseWriter, r *http.Request) {
 		urlShortener.Password = &hashedPasswordString
 	}
 
-	err := insertUrl(ctx, urlShortener)
-	if err != nil {
+	reserved, month := reserveUsage(ctx, user, usageLinksCreated, 1, plan.MonthlyLinks)
+	if reserved == 0 {
+		writeQuotaError(w, planErrorMonthlyLinks)
+		return
+	}
+
+	revisions := []LinkRevisions{newLinkRevision(user, revisionCreate, nil, urlShortener)}
+	if err := getStoreFromContext(ctx).InsertUrls(ctx, []*UrlShortener{urlShortener}, revisions); err != nil {
+		refundUsage(ctx, user, usageLinksCreated, 1, month)
 		http.Error(w, "Error creating the short URL", http.StatusInternalServerError)
 		return
 	}
@@ -102,16 +169,15 @@ func shortenUrl(ctx *context.Context, w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"short_code": shortCode})
 }
 
-func shortenUrlBulk(ctx *context.Context, w http.ResponseWriter, r *http.Request) {
+// shortenUrlBulk answers 201 when every link was created, 207 when only some
+// were and 400 when none was. The results list every item in request order.
+func shortenUrlBulk(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	user := getUserFromContext(ctx)
 
 	var requestBody struct {
-		URLs []struct {
-			URL       string  `json:"url"`
-			ExpiresAt *string `json:"expires_at"`
-			CustomUrl *string `json:"custom_url"`
-			Password  *string `json:"password"`
-		} `json:"urls"`
+		URLs   []bulkShortenItem `json:"urls"`
+		Atomic bool              `json:"atomic"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
@@ -119,137 +185,230 @@ func shortenUrlBulk(ctx *context.Context, w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// Validations
 	if len(requestBody.URLs) == 0 {
 		http.Error(w, "URLs are required", http.StatusBadRequest)
 		return
 	}
 
-	existingCustomUrls := []string{}
-	for i, urlStruct := range requestBody.URLs {
-		if urlStruct.URL == "" {
-			http.Error(w, "Empty url at position "+strconv.Itoa(i+1), http.StatusBadRequest)
-			return
+	plan := userPlan(ctx, user)
+	if plan.MaxBulkSize > 0 && len(requestBody.URLs) > plan.MaxBulkSize {
+		http.Error(w, bulkSizeMessage(plan), http.StatusRequestEntityTooLarge)
+		return
+	}
+	// Without links left there is nothing to report per item. shortenBulk
+	// reserves the links it creates, so requests racing past this check
+	// still cannot go over the quota.
+	if left, limited := monthlyLinksLeft(ctx, user, plan); limited && left == 0 {
+		writeQuotaError(w, planErrorMonthlyLinks)
+		return
+	}
+	if reserved, _ := reserveUsage(ctx, user, usageBulkJobs, 1, plan.MonthlyBulkJobs); reserved == 0 {
+		writeQuotaError(w, planErrorMonthlyBulkJobs)
+		return
+	}
+
+	results := shortenBulk(ctx, clientIp(r), user, requestBody.URLs, requestBody.Atomic)
+
+	failedCount := 0
+	for _, result := range results {
+		if result.failed() {
+			failedCount++
 		}
+	}
 
-		if urlStruct.CustomUrl != nil && *urlStruct.CustomUrl == "" {
-			http.Error(w, "Custom URL cannot be empty", http.StatusBadRequest)
+	status := http.StatusCreated
+	switch {
+	case failedCount == len(results) || (requestBody.Atomic && failedCount > 0):
+		status = http.StatusBadRequest
+	case failedCount > 0:
+		status = http.StatusMultiStatus
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+}
+
+// editUrl applies a partial update, only the fields present in the body are
+// changed. expires_at and password can be set to null to remove them and
+// custom_url renames the short code. Every field is validated like in
+// shortenUrl before anything is written.
+func editUrl(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var requestBody struct {
+		ShortCode    string           `json:"short_code"`
+		Activate     *bool            `json:"activate"`
+		URL          *string          `json:"url"`
+		ExpiresAt    optional[string] `json:"expires_at"`
+		Password     optional[string] `json:"password"`
+		CustomUrl    *string          `json:"custom_url"`
+		RedirectType *int             `json:"redirect_type"`
+		WorkspaceId  *uint            `json:"workspace_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if requestBody.ShortCode == "" {
+		http.Error(w, "Short code is required", http.StatusBadRequest)
+		return
+	}
+
+	// Deactivated and expired links can be edited too, that is how they are
+	// reactivated or given a new expiry.
+	urlModel, err := getStoreFromContext(ctx).GetUrl(ctx, requestBody.ShortCode)
+	if err != nil {
+		http.Error(w, "Short code not found", http.StatusNotFound)
+		return
+	}
+
+	user := getUserFromContext(ctx)
+
+	if !canManageUrl(ctx, user, urlModel) {
+		http.Error(w, "You are not authorized to edit this short code", http.StatusForbidden)
+		return
+	}
+
+	before := *urlModel
+
+	// Moving a link needs the editor role in the workspace it moves to.
+	if requestBody.WorkspaceId != nil && !hasWorkspaceRole(getWorkspaceMember(ctx, *requestBody.WorkspaceId, user.Id), workspaceRoleEditor) {
+		http.Error(w, "You are not authorized to move links to this workspace", http.StatusForbidden)
+		return
+	}
+
+	if requestBody.URL != nil {
+		if *requestBody.URL == "" {
+			http.Error(w, "URL is required", http.StatusBadRequest)
 			return
 		}
 
-		if urlStruct.CustomUrl != nil && doesShortCodeExist(ctx, *urlStruct.CustomUrl) {
-			existingCustomUrls = append(existingCustomUrls, *urlStruct.CustomUrl)
+		originalUrl, validationErr := normalizeUrl(*requestBody.URL)
+		if validationErr != nil {
+			writeUrlValidationError(w, validationErr)
+			return
 		}
-	}
 
-	if len(existingCustomUrls) > 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Header().Set("Content-Type", "application/json")
-		marshelledExistingCustomUrls, err := json.Marshal(existingCustomUrls)
-		if err != nil {
-			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		if isBlockedDestination(ctx, clientIp(r), "edit", requestBody.ShortCode, originalUrl) {
+			writeUrlValidationError(w, blockedDestinationError())
 			return
 		}
 
-		json.NewEncoder(w).
-			Encode(map[string]string{
-				"existingCustomUrls": string(marshelledExistingCustomUrls),
-				"message":            "These custom URLs already exist",
-			})
+		urlModel.OriginalUrl = originalUrl
+	}
+
+	// Only new custom URLs and passwords need the plan, links keep what they
+	// have when the user changes plans.
+	var newCustomUrl *string
+	if requestBody.CustomUrl != nil && *requestBody.CustomUrl != requestBody.ShortCode {
+		newCustomUrl = requestBody.CustomUrl
+	}
+	if code := checkPlanFeatures(userPlan(ctx, user), newCustomUrl, requestBody.Password.Value); code != "" {
+		http.Error(w, planErrorMessages[code], http.StatusForbidden)
 		return
 	}
 
-	shortCodes := []string{}
-	for _, urlStruct := range requestBody.URLs {
-		shortCode := ""
-		if urlStruct.CustomUrl != nil {
-			shortCode = *urlStruct.CustomUrl
-		} else {
-			shortCode = createShortCode(ctx, 0)
+	if requestBody.CustomUrl != nil && *requestBody.CustomUrl != requestBody.ShortCode {
+		if *requestBody.CustomUrl == "" {
+			http.Error(w, "Custom URL cannot be empty", http.StatusBadRequest)
+			return
 		}
 
-		urlShortener := &UrlShortener{OriginalUrl: urlStruct.URL, ShortCode: shortCode}
+		if isReservedShortCode(*requestBody.CustomUrl) {
+			http.Error(w, "This custom URL is reserved", http.StatusBadRequest)
+			return
+		}
 
-		if user != nil {
-			urlShortener.UserId = &user.Id
+		// Deleted and expired links keep their code, so they count too.
+		if taken, err := isShortCodeTaken(ctx, *requestBody.CustomUrl); err != nil {
+			http.Error(w, "Error updating the short URL", http.StatusInternalServerError)
+			return
+		} else if taken {
+			http.Error(w, "This custom URL already exists", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if requestBody.RedirectType != nil {
+		if !isValidRedirectType(*requestBody.RedirectType) {
+			http.Error(w, "Redirect type must be one of 301, 302, 307 or 308", http.StatusBadRequest)
+			return
 		}
+		urlModel.RedirectType = *requestBody.RedirectType
+	}
 
-		if urlStruct.ExpiresAt != nil {
-			expiresAt, err := time.Parse(time.RFC3339, *urlStruct.ExpiresAt)
+	if requestBody.ExpiresAt.Set {
+		urlModel.ExpiresAt = nil
+		if requestBody.ExpiresAt.Value != nil {
+			expiresAt, err := time.Parse(time.RFC3339, *requestBody.ExpiresAt.Value)
 			if err != nil {
-				shortCodes = append(shortCodes, "Invalid expiry date")
-				continue
+				http.Error(w, "Invalid expiry date", http.StatusBadRequest)
+				return
 			}
-			urlShortener.ExpiresAt = &expiresAt
+			urlModel.ExpiresAt = &expiresAt
 		}
+	}
 
-		if urlStruct.Password != nil {
-			hashedPassword, err := bcrypt.GenerateFromPassword([]byte(*urlStruct.Password), bcrypt.DefaultCost)
+	if requestBody.Password.Set {
+		urlModel.Password = nil
+		if requestBody.Password.Value != nil {
+			hashedPassword, err := bcrypt.GenerateFromPassword([]byte(*requestBody.Password.Value), bcrypt.DefaultCost)
 			if err != nil {
-				http.Error(w, "Error creating the short URL", http.StatusInternalServerError)
+				http.Error(w, "Error updating the short URL", http.StatusInternalServerError)
 				return
 			}
 			hashedPasswordString := string(hashedPassword)
-			urlShortener.Password = &hashedPasswordString
-		}
-
-		err := insertUrl(ctx, urlShortener)
-		if err == nil {
-			shortCodes = append(shortCodes, shortCode)
-		} else {
-			shortCodes = append(shortCodes, "Error creating short URL")
+			urlModel.Password = &hashedPasswordString
 		}
 	}
 
-	masheledShortCodes, err := json.Marshal(shortCodes)
-	if err != nil {
-		http.Error(w, "Something went wrong", http.StatusInternalServerError)
-		return
+	if requestBody.WorkspaceId != nil {
+		urlModel.WorkspaceId = requestBody.WorkspaceId
 	}
 
-	w.WriteHeader(http.StatusCreated)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"short_codes": string(masheledShortCodes)})
-}
-
-func editUrl(ctx *context.Context, w http.ResponseWriter, r *http.Request) {
-	var requestBody struct {
-		ShortCode string `json:"short_code"`
-		Activate  *bool  `json:"activate"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+	shortCode := requestBody.ShortCode
+	if requestBody.CustomUrl != nil {
+		urlModel.ShortCode = *requestBody.CustomUrl
 	}
 
-	urlModel := getUrlModel(ctx, requestBody.ShortCode)
-	if urlModel == nil {
-		http.Error(w, "Short code not found", http.StatusNotFound)
-		return
+	if requestBody.Activate != nil {
+		if *requestBody.Activate {
+			urlModel.DeletedAt = nil
+		} else if urlModel.DeletedAt == nil {
+			urlModel.DeletedAt = addressOf(time.Now())
+		}
 	}
 
-	user := getUserFromContext(ctx)
-
-	if urlModel.UserId == nil || *urlModel.UserId != user.Id {
-		http.Error(w, "You are not authorized to delete this short code", http.StatusForbidden)
+	// The fields, the new code and the activation are written together, a
+	// failed edit leaves the link as it was.
+	revision := newLinkRevision(user, editRevisionAction(&before, urlModel), &before, urlModel)
+	if err := getStoreFromContext(ctx).EditUrl(ctx, shortCode, urlModel, &revision); errors.Is(err, ErrConflict) {
+		http.Error(w, "This custom URL already exists", http.StatusBadRequest)
 		return
-	}
-
-	if requestBody.ShortCode == "" {
-		http.Error(w, "Short code is required", http.StatusBadRequest)
+	} else if err != nil {
+		http.Error(w, "Error updating the short URL", http.StatusInternalServerError)
 		return
 	}
 
-	if requestBody.Activate != nil {
-		if *requestBody.Activate {
-			activateUrl(ctx, requestBody.ShortCode)
-		} else {
-			deleteUrl(ctx, requestBody.ShortCode)
+	if urlModel.ShortCode != shortCode {
+		// The old code stops resolving right away instead of when its cache
+		// entry expires.
+		if err := removeCachedUrl(ctx, shortCode); err != nil {
+			http.Error(w, "Error removing cached URL", http.StatusInternalServerError)
+			return
 		}
+
+		shortCode = urlModel.ShortCode
 	}
 
-	err := updateCachedUrl(requestBody.ShortCode, urlModel)
+	if urlModel.DeletedAt != nil {
+		err = removeCachedUrl(ctx, shortCode)
+	} else {
+		err = updateCachedUrl(ctx, shortCode, urlModel)
+	}
 	if err != nil {
 		http.Error(w, "Error updating cached URL", http.StatusInternalServerError)
 		return
@@ -257,17 +416,23 @@ func editUrl(ctx *context.Context, w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok", "short_code": shortCode})
 }
 
-func redirectToOriginalUrl(ctx *context.Context, w http.ResponseWriter, r *http.Request) {
-	shortCode := r.URL.Query().Get("code")
+func redirectToOriginalUrl(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	// GET /{code} carries the code in the path, /redirect in the query.
+	shortCode := mux.Vars(r)["code"]
+	if shortCode == "" {
+		shortCode = r.URL.Query().Get("code")
+	}
 	if shortCode == "" {
 		http.Error(w, "Missing code parameter", http.StatusBadRequest)
 		return
 	}
 
-	urlModel, err := getCachedUrl(shortCode)
+	urlModel, err := getCachedUrl(ctx, shortCode)
 	if err != nil {
 		http.Error(w, "Error getting cached URL", http.StatusInternalServerError)
 		return
@@ -281,13 +446,20 @@ func redirectToOriginalUrl(ctx *context.Context, w http.ResponseWriter, r *http.
 			return
 		}
 
-		err = cacheUrl(shortCode, urlModel)
+		err = cacheUrl(ctx, shortCode, urlModel)
 		if err != nil {
 			http.Error(w, "Error caching URL", http.StatusInternalServerError)
 			return
 		}
 	}
 
+	// Checked on every redirect so links created before a host was banned
+	// stop resolving as soon as the blocklist is reloaded.
+	if isBlockedDestination(ctx, clientIp(r), "redirect", shortCode, urlModel.OriginalUrl) {
+		http.Error(w, "This link points to a blocked destination", http.StatusForbidden)
+		return
+	}
+
 	if urlModel.Password != nil {
 		password := r.Header.Get("X-Password")
 		if password == "" {
@@ -302,10 +474,14 @@ func redirectToOriginalUrl(ctx *context.Context, w http.ResponseWriter, r *http.
 		}
 	}
 
-	http.Redirect(w, r, urlModel.OriginalUrl, http.StatusTemporaryRedirect)
+	recordClick(ctx, shortCode, r)
+
+	http.Redirect(w, r, urlModel.OriginalUrl, redirectStatusCode(urlModel))
 }
 
-func deleteShortCode(ctx *context.Context, w http.ResponseWriter, r *http.Request) {
+func deleteShortCode(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	shortCode := r.URL.Query().Get("code")
 	if shortCode == "" {
 		http.Error(w, "Missing code parameter", http.StatusBadRequest)
@@ -320,17 +496,21 @@ func deleteShortCode(ctx *context.Context, w http.ResponseWriter, r *http.Reques
 
 	user := getUserFromContext(ctx)
 
-	if urlModel.UserId == nil || *urlModel.UserId != user.Id {
+	if !canManageUrl(ctx, user, urlModel) {
 		http.Error(w, "You are not authorized to delete this short code", http.StatusForbidden)
 		return
 	}
 
-	if err := deleteUrl(ctx, shortCode); err != nil {
+	// The link is deleted through EditUrl so the revision is written with it.
+	deleted := *urlModel
+	deleted.DeletedAt = addressOf(time.Now())
+	revision := newLinkRevision(user, revisionDelete, urlModel, &deleted)
+	if err := getStoreFromContext(ctx).EditUrl(ctx, shortCode, &deleted, &revision); err != nil {
 		http.Error(w, "Error deleting short code", http.StatusInternalServerError)
 		return
 	}
 
-	err := removeCachedUrl(shortCode)
+	err := removeCachedUrl(ctx, shortCode)
 	if err != nil {
 		http.Error(w, "Error removing cached URL", http.StatusInternalServerError)
 		return
@@ -341,7 +521,13 @@ func deleteShortCode(ctx *context.Context, w http.ResponseWriter, r *http.Reques
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
-func getUserUrls(ctx *context.Context, w http.ResponseWriter, r *http.Request) {
+// getUserUrls lists the links of the user or, with workspace_id, of a
+// workspace. Pages are numbered with page unless a cursor is passed, an empty
+// one for the first page, which continues after the last link of the previous
+// page and returns the cursor of the next one as next_cursor. count=false
+// skips counting the links.
+func getUserUrls(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	user := getUserFromContext(ctx)
 
 	if user == nil {
@@ -349,32 +535,109 @@ func getUserUrls(ctx *context.Context, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	query := r.URL.Query()
+
+	page, err := strconv.Atoi(query.Get("page"))
 	if err != nil || page < 1 {
 		page = 1
 	}
 
-	pageSize, err := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	pageSize, err := strconv.Atoi(query.Get("pageSize"))
 	if err != nil || pageSize < 1 {
 		pageSize = 10
 	}
 
-	urls := getUrlsByUserId(ctx, user.Id, page, pageSize)
+	filter, err := parseUrlFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	var totalCount int64
-	db := getDbFromContext(ctx)
-	db.Model(&UrlShortener{}).Where("user_id = ?", user.Id).Count(&totalCount)
+	sort, err := parseUrlSort(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	totalPages := (totalCount + int64(pageSize) - 1) / int64(pageSize)
+	withCount := true
+	if raw := query.Get("count"); raw != "" {
+		if withCount, err = strconv.ParseBool(raw); err != nil {
+			http.Error(w, "count must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
 
+	withCursor := query.Has("cursor")
+	if withCursor {
+		if sort.Field != "" && sort.Field != urlSortCreatedAt {
+			http.Error(w, "cursor pagination only supports sorting by created_at", http.StatusBadRequest)
+			return
+		}
+		if raw := query.Get("cursor"); raw != "" {
+			if sort.After, err = decodeUrlCursor(raw); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	store := getStoreFromContext(ctx)
+	listUrls := func(page int, pageSize int) []UrlShortener {
+		return getUrlsByUserId(ctx, user.Id, filter, sort, page, pageSize)
+	}
+	countUrls := func() (int64, error) {
+		return store.CountUrlsByUserId(ctx, user.Id, filter)
+	}
+
+	// With workspace_id the links of that workspace are listed, which every
+	// member may see, otherwise the links the user created
+	// outside the workspaces they left.
+	if rawWorkspaceId := query.Get("workspace_id"); rawWorkspaceId != "" {
+		workspaceId, err := strconv.ParseUint(rawWorkspaceId, 10, 0)
+		if err != nil || getWorkspaceMember(ctx, uint(workspaceId), user.Id) == nil {
+			http.Error(w, "Workspace not found", http.StatusNotFound)
+			return
+		}
+
+		listUrls = func(page int, pageSize int) []UrlShortener {
+			urls, _ := store.GetUrlsByWorkspaceId(ctx, uint(workspaceId), filter, sort, page, pageSize)
+			return urls
+		}
+		countUrls = func() (int64, error) {
+			return store.CountUrlsByWorkspaceId(ctx, uint(workspaceId), filter)
+		}
+	}
+
+	pagination := map[string]interface{}{
+		"pageSize": pageSize,
+	}
 	response := map[string]interface{}{
-		"urls": urls,
-		"pagination": map[string]interface{}{
-			"currentPage": page,
-			"pageSize":    pageSize,
-			"totalCount":  totalCount,
-			"totalPages":  totalPages,
-		},
+		"pagination": pagination,
+	}
+
+	var urls []UrlShortener
+	if withCursor {
+		// One more link than asked for tells whether there is a next page.
+		urls = listUrls(1, pageSize+1)
+
+		var nextCursor *string
+		if len(urls) > pageSize {
+			urls = urls[:pageSize]
+			nextCursor = addressOf(encodeUrlCursor(urls[pageSize-1]))
+		}
+		response["next_cursor"] = nextCursor
+	} else {
+		urls = listUrls(page, pageSize)
+		pagination["currentPage"] = page
+	}
+	response["urls"] = urls
+
+	if withCount {
+		totalCount, _ := countUrls()
+		pagination["totalCount"] = totalCount
+		if !withCursor {
+			pagination["totalPages"] = (totalCount + int64(pageSize) - 1) / int64(pageSize)
+		}
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrNotFound = errors.New("record not found")
+
+// ErrConflict is returned when a write breaks a unique constraint.
+var ErrConflict = errors.New("record already exists")
+
+// Statuses of a link, see linkStatus.
+const (
+	linkStatusActive  = "active"
+	linkStatusDeleted = "deleted"
+	linkStatusExpired = "expired"
+)
+
+// linkStatus tells whether a link redirects, was deleted or expired.
+func linkStatus(urlModel *UrlShortener, now time.Time) string {
+	switch {
+	case urlModel.DeletedAt != nil:
+		return linkStatusDeleted
+	case urlModel.ExpiresAt != nil && !urlModel.ExpiresAt.After(now):
+		return linkStatusExpired
+	default:
+		return linkStatusActive
+	}
+}
+
+// urlFilterPasswordProtected is the UrlFilter status matching the links with
+// a password, whatever their linkStatus.
+const urlFilterPasswordProtected = "password_protected"
+
+// UrlFilter narrows down the links of a user or a workspace. The zero value
+// matches every link.
+type UrlFilter struct {
+	// Status is a linkStatus or urlFilterPasswordProtected.
+	Status string
+	// Search matches links whose original URL or short code contains it,
+	// ignoring case.
+	Search string
+	// CreatedFrom and CreatedTo bound the creation time, both inclusive.
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+}
+
+// Fields links can be sorted by.
+const (
+	urlSortCreatedAt  = "created_at"
+	urlSortViews      = "views"
+	urlSortLastViewed = "last_viewed"
+)
+
+// UrlSort orders listed links by Field, created_at when it is empty. Ties
+// are broken by the short code and links never viewed come last when
+// sorting by last_viewed.
+type UrlSort struct {
+	Field      string
+	Descending bool
+	// After skips the links up to and including the cursor in this order.
+	// It only applies when sorting by created_at.
+	After *UrlCursor
+}
+
+// UrlCursor is the position of a link when sorting by created_at. Links
+// have no id column, adding one as primary key would mean rebuilding the
+// table on SQLite, so ties on created_at are broken by the unique short
+// code instead. Short codes change when a link is renamed: a link renamed
+// while a client pages through its tie can be listed twice or skipped.
+type UrlCursor struct {
+	CreatedAt time.Time
+	ShortCode string
+}
+
+// LinkStore is the persistence layer used by the handlers. Every backend must
+// pass the conformance suite in store_test.go.
+type LinkStore interface {
+	Ping(ctx context.Context) error
+	Close() error
+
+	// InsertUrl returns ErrConflict when a link in any state has the short
+	// code.
+	InsertUrl(ctx context.Context, urlShortener *UrlShortener) error
+	// InsertUrls inserts all links and their revisions in one transaction,
+	// either everything is stored or nothing is. It returns ErrConflict when
+	// a short code is taken.
+	InsertUrls(ctx context.Context, urlShorteners []*UrlShortener, revisions []LinkRevisions) error
+	// GetActiveUrl returns ErrNotFound for deleted and expired short codes.
+	GetActiveUrl(ctx context.Context, shortCode string) (*UrlShortener, error)
+	// GetUrl also returns deleted and expired links.
+	GetUrl(ctx context.Context, shortCode string) (*UrlShortener, error)
+	ShortCodeExists(ctx context.Context, shortCode string) (bool, error)
+	// TakenShortCodes returns which of shortCodes a link in any state has,
+	// deleted and expired links keep their short code.
+	TakenShortCodes(ctx context.Context, shortCodes []string) (map[string]bool, error)
+	DeleteUrl(ctx context.Context, shortCode string) error
+	ActivateUrl(ctx context.Context, shortCode string) error
+	// EditUrl writes the editable fields of urlShortener (OriginalUrl,
+	// ExpiresAt, Password, RedirectType, WorkspaceId and DeletedAt) to the
+	// link with shortCode, nil values clear the column. When its ShortCode
+	// differs from shortCode the link, its clicks and its revisions move to
+	// the new code, ErrConflict is returned when a link in any state already
+	// has it. The revision describing the change, when not nil, is stored
+	// under the new code. Everything is written in one transaction.
+	EditUrl(ctx context.Context, shortCode string, urlShortener *UrlShortener, revision *LinkRevisions) error
+	// GetUrlsByUserId lists the links the user created, except the ones of
+	// workspaces they no longer belong to. CountUrlsByUserId and
+	// EachUrlByUserId cover the same links.
+	GetUrlsByUserId(ctx context.Context, userId uint, filter UrlFilter, sort UrlSort, page int, pageSize int) ([]UrlShortener, error)
+	CountUrlsByUserId(ctx context.Context, userId uint, filter UrlFilter) (int64, error)
+	// EachUrlByUserId calls fn for every link of the user matching filter,
+	// oldest first. Links are read in batches so they never all have to fit
+	// in memory, an error from fn stops the iteration and is returned.
+	EachUrlByUserId(ctx context.Context, userId uint, filter UrlFilter, fn func(UrlShortener) error) error
+	GetUrlsByWorkspaceId(ctx context.Context, workspaceId uint, filter UrlFilter, sort UrlSort, page int, pageSize int) ([]UrlShortener, error)
+	CountUrlsByWorkspaceId(ctx context.Context, workspaceId uint, filter UrlFilter) (int64, error)
+
+	// CreateUser returns ErrConflict when the email or the key is taken.
+	CreateUser(ctx context.Context, user *Users) error
+	GetUserByEmail(ctx context.Context, email string) (*Users, error)
+	// GetUserByApiKey takes the plaintext key. It accepts the account key,
+	// the previous account key until its grace period ends and unexpired
+	// named keys, whose LastUsedAt it updates. ApiKey, Scopes and ApiKeyId
+	// are set on the returned user.
+	GetUserByApiKey(ctx context.Context, apiKey string) (*Users, error)
+	// RotateApiKey makes the plaintext newApiKey the primary key and keeps
+	// the current one valid as the previous key until previousExpiresAt.
+	RotateApiKey(ctx context.Context, userId uint, newApiKey string, previousExpiresAt time.Time) error
+	RevokePreviousApiKey(ctx context.Context, userId uint) error
+	// CreateApiKey stores the digest of the plaintext key.Key.
+	CreateApiKey(ctx context.Context, key *ApiKeys) error
+	ListApiKeys(ctx context.Context, userId uint) ([]ApiKeys, error)
+	// DeleteApiKey returns ErrNotFound when the user has no key with that id.
+	DeleteApiKey(ctx context.Context, userId uint, keyId uint) error
+
+	// CreateWorkspace stores the workspace and makes ownerId its owner.
+	CreateWorkspace(ctx context.Context, workspace *Workspaces, ownerId uint) error
+	// GetWorkspaceMember returns ErrNotFound when the user is not a member,
+	// Workspace is set on the returned member.
+	GetWorkspaceMember(ctx context.Context, workspaceId uint, userId uint) (*WorkspaceMembers, error)
+	// ListWorkspaceMembers returns the members with User set.
+	ListWorkspaceMembers(ctx context.Context, workspaceId uint) ([]WorkspaceMembers, error)
+	// ListWorkspacesByUserId returns the memberships of a user with Workspace
+	// set.
+	ListWorkspacesByUserId(ctx context.Context, userId uint) ([]WorkspaceMembers, error)
+	// SaveWorkspaceMember adds the user to the workspace or changes the role
+	// of an existing member.
+	SaveWorkspaceMember(ctx context.Context, member *WorkspaceMembers) error
+	// DeleteWorkspaceMember returns ErrNotFound when the user is not a member.
+	DeleteWorkspaceMember(ctx context.Context, workspaceId uint, userId uint) error
+
+	InsertLinkRevisions(ctx context.Context, revisions []LinkRevisions) error
+	// ListLinkRevisions returns the revisions of a link, newest first.
+	ListLinkRevisions(ctx context.Context, shortCode string) ([]LinkRevisions, error)
+	// GetLinkRevision returns ErrNotFound when the link has no revision with
+	// that id.
+	GetLinkRevision(ctx context.Context, shortCode string, revisionId uint) (*LinkRevisions, error)
+
+	CreateJob(ctx context.Context, job *Jobs) error
+	// GetJob returns ErrNotFound when there is no job with that id.
+	GetJob(ctx context.Context, jobId string) (*Jobs, error)
+	// ClaimJob marks the oldest queued job as running with a lease until
+	// leaseExpiresAt and returns it, or ErrNotFound when no job is queued. A
+	// job is claimed only once even when several workers ask at the same
+	// time.
+	ClaimJob(ctx context.Context, leaseExpiresAt time.Time) (*Jobs, error)
+	// RenewJobLease extends the lease of a running job.
+	RenewJobLease(ctx context.Context, jobId string, leaseExpiresAt time.Time) error
+	UpdateJobProgress(ctx context.Context, jobId string, processedRows int, failedRows int) error
+	// FinishJob writes the Status, progress, Result, Error and FinishedAt of
+	// job and clears its Input.
+	FinishJob(ctx context.Context, job *Jobs) error
+	// RequeueJob queues a running job again with the progress and the
+	// Result of job, without a lease, so the next worker continues it.
+	RequeueJob(ctx context.Context, job *Jobs) error
+	// FailExpiredJobs marks the running jobs whose lease expired before now
+	// as failed with message, for jobs of instances that stopped.
+	FailExpiredJobs(ctx context.Context, now time.Time, message string) error
+
+	// ListIpRules returns every rule in the order they were created.
+	ListIpRules(ctx context.Context) ([]IpRules, error)
+	CreateIpRule(ctx context.Context, rule *IpRules) error
+	DeleteIpRule(ctx context.Context, ruleId uint) error
+
+	InsertRequestLogs(ctx context.Context, logRequests []LogRequests) error
+	// RecordClicks stores the click events and adds them to the Views and
+	// LastViewed columns of the links they belong to, and to the Redirects
+	// usage of their owners.
+	RecordClicks(ctx context.Context, clicks []Clicks) error
+	// AddUsages adds the counters of each usage to the row of its UserId and
+	// Month, creating the row when there is none.
+	AddUsages(ctx context.Context, usages []Usages) error
+	// ReserveUsage adds up to n to counter (usageLinksCreated or
+	// usageBulkJobs) of the user in month without going over limit, 0 for no
+	// limit, and returns how much it added. Concurrent reservations never
+	// exceed the limit together.
+	ReserveUsage(ctx context.Context, userId uint, month string, counter string, n int64, limit int64) (int64, error)
+	// GetUsage returns the usage of a user in month, with every counter at 0
+	// when nothing was counted yet.
+	GetUsage(ctx context.Context, userId uint, month string) (*Usages, error)
+	InsertBlockedAttempts(ctx context.Context, blockedAttempts []BlockedAttempts) error
+}
+
+// NewLinkStore opens the backend selected by driver. dsn is the database file
+// for sqlite, the connection string for postgres and is ignored for memory.
+func NewLinkStore(driver string, dsn string) (LinkStore, error) {
+	switch driver {
+	case "sqlite":
+		return newSqliteLinkStore(dsn)
+	case "postgres":
+		return newPostgresLinkStore(dsn)
+	case "memory":
+		return newMemoryLinkStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown store driver %q", driver)
+	}
+}
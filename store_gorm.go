@@ -0,0 +1,911 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// gormLinkStore backs both the SQLite and the Postgres stores, they only
+// differ in the dialector used to open the connection.
+type gormLinkStore struct {
+	db *gorm.DB
+}
+
+func newSqliteLinkStore(dbPath string) (*gormLinkStore, error) {
+	db, err := NewDatabase(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return newGormLinkStore(db), nil
+}
+
+func newPostgresLinkStore(dsn string) (*gormLinkStore, error) {
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{TranslateError: true})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrateDatabase(db); err != nil {
+		return nil, err
+	}
+
+	return newGormLinkStore(db), nil
+}
+
+func newGormLinkStore(db *gorm.DB) *gormLinkStore {
+	return &gormLinkStore{db: db}
+}
+
+func (s *gormLinkStore) Ping(ctx context.Context) error {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+
+	return sqlDB.PingContext(ctx)
+}
+
+func (s *gormLinkStore) Close() error {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+
+	return sqlDB.Close()
+}
+
+func (s *gormLinkStore) InsertUrl(ctx context.Context, urlShortener *UrlShortener) error {
+	if urlShortener.RedirectType == 0 {
+		urlShortener.RedirectType = defaultRedirectType
+	}
+
+	return translateGormError(s.db.WithContext(ctx).Create(urlShortener).Error)
+}
+
+// insertUrlsBatchSize keeps a batch well below the bind variable limits of
+// sqlite and postgres.
+const insertUrlsBatchSize = 500
+
+// eachUrlBatchSize is the number of links EachUrlByUserId reads per query.
+var eachUrlBatchSize = 1000
+
+func (s *gormLinkStore) InsertUrls(ctx context.Context, urlShorteners []*UrlShortener, revisions []LinkRevisions) error {
+	if len(urlShorteners) == 0 {
+		return nil
+	}
+
+	// Rows are written as maps into the table, a struct batch where only some
+	// links have a password or an expiry makes gorm emit DEFAULT, which
+	// sqlite rejects.
+	now := time.Now()
+	rows := make([]map[string]interface{}, len(urlShorteners))
+	for i, urlShortener := range urlShorteners {
+		if urlShortener.RedirectType == 0 {
+			urlShortener.RedirectType = defaultRedirectType
+		}
+		if urlShortener.CreatedAt.IsZero() {
+			urlShortener.CreatedAt = now
+		}
+		if urlShortener.UpdatedAt.IsZero() {
+			urlShortener.UpdatedAt = now
+		}
+
+		rows[i] = map[string]interface{}{
+			"original_url":  urlShortener.OriginalUrl,
+			"short_code":    urlShortener.ShortCode,
+			"views":         urlShortener.Views,
+			"user_id":       urlShortener.UserId,
+			"password":      urlShortener.Password,
+			"created_at":    urlShortener.CreatedAt,
+			"updated_at":    urlShortener.UpdatedAt,
+			"expires_at":    urlShortener.ExpiresAt,
+			"redirect_type": urlShortener.RedirectType,
+			"workspace_id":  urlShortener.WorkspaceId,
+		}
+	}
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table("url_shorteners").CreateInBatches(rows, insertUrlsBatchSize).Error; err != nil {
+			return err
+		}
+		if len(revisions) == 0 {
+			return nil
+		}
+
+		return tx.CreateInBatches(&revisions, insertUrlsBatchSize).Error
+	})
+
+	return translateGormError(err)
+}
+
+func (s *gormLinkStore) GetActiveUrl(ctx context.Context, shortCode string) (*UrlShortener, error) {
+	urlShortener := UrlShortener{}
+	result := s.db.WithContext(ctx).
+		Model(&UrlShortener{}).
+		Where("short_code = ?", shortCode).
+		Where("deleted_at IS NULL").
+		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		First(&urlShortener)
+
+	if result.Error != nil {
+		return nil, translateGormError(result.Error)
+	}
+
+	return &urlShortener, nil
+}
+
+func (s *gormLinkStore) GetUrl(ctx context.Context, shortCode string) (*UrlShortener, error) {
+	urlShortener := UrlShortener{}
+	result := s.db.WithContext(ctx).Where("short_code = ?", shortCode).First(&urlShortener)
+
+	if result.Error != nil {
+		return nil, translateGormError(result.Error)
+	}
+
+	return &urlShortener, nil
+}
+
+func (s *gormLinkStore) ShortCodeExists(ctx context.Context, shortCode string) (bool, error) {
+	var exists int64
+
+	result := s.db.WithContext(ctx).
+		Model(&UrlShortener{}).
+		Where("short_code = ?", shortCode).
+		Where("deleted_at IS NULL").
+		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		Count(&exists)
+
+	if result.Error != nil {
+		return false, result.Error
+	}
+
+	return exists > 0, nil
+}
+
+func (s *gormLinkStore) TakenShortCodes(ctx context.Context, shortCodes []string) (map[string]bool, error) {
+	taken := make(map[string]bool)
+
+	for start := 0; start < len(shortCodes); start += insertUrlsBatchSize {
+		batch := shortCodes[start:min(start+insertUrlsBatchSize, len(shortCodes))]
+
+		var found []string
+		err := s.db.WithContext(ctx).
+			Model(&UrlShortener{}).
+			Where("short_code IN ?", batch).
+			Pluck("short_code", &found).Error
+		if err != nil {
+			return nil, err
+		}
+
+		for _, shortCode := range found {
+			taken[shortCode] = true
+		}
+	}
+
+	return taken, nil
+}
+
+func (s *gormLinkStore) DeleteUrl(ctx context.Context, shortCode string) error {
+	now := time.Now()
+	newUrlShortener := UrlShortener{
+		DeletedAt: &now,
+	}
+
+	return s.db.WithContext(ctx).
+		Model(UrlShortener{}).
+		Where(UrlShortener{
+			ShortCode: shortCode,
+		}).Updates(newUrlShortener).Error
+}
+
+func (s *gormLinkStore) ActivateUrl(ctx context.Context, shortCode string) error {
+	return s.db.WithContext(ctx).
+		Model(&UrlShortener{}).
+		Where("short_code = ?", shortCode).
+		Update("deleted_at", nil).Error
+}
+
+func (s *gormLinkStore) EditUrl(ctx context.Context, shortCode string, urlShortener *UrlShortener, revision *LinkRevisions) error {
+	urlShortener.UpdatedAt = time.Now()
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&UrlShortener{}).
+			Where("short_code = ?", shortCode).
+			Select("short_code", "original_url", "expires_at", "password", "redirect_type", "workspace_id", "deleted_at", "updated_at").
+			Updates(urlShortener)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotFound
+		}
+
+		if urlShortener.ShortCode != shortCode {
+			if err := tx.Model(&Clicks{}).Where("short_code = ?", shortCode).Update("short_code", urlShortener.ShortCode).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&LinkRevisions{}).Where("short_code = ?", shortCode).Update("short_code", urlShortener.ShortCode).Error; err != nil {
+				return err
+			}
+		}
+
+		if revision == nil {
+			return nil
+		}
+
+		return tx.Create(revision).Error
+	})
+
+	return translateGormError(err)
+}
+
+// userUrls narrows db down to the links of userId, see GetUrlsByUserId.
+func userUrls(db *gorm.DB, userId uint) *gorm.DB {
+	memberships := db.Session(&gorm.Session{NewDB: true}).Model(&WorkspaceMembers{}).Select("workspace_id").Where("user_id = ?", userId)
+	return db.Where("user_id = ? AND (workspace_id IS NULL OR workspace_id IN (?))", userId, memberships)
+}
+
+func (s *gormLinkStore) GetUrlsByUserId(ctx context.Context, userId uint, filter UrlFilter, sort UrlSort, page int, pageSize int) ([]UrlShortener, error) {
+	var urls []UrlShortener
+
+	offset := (page - 1) * pageSize
+	query := applyUrlFilter(userUrls(s.db.WithContext(ctx), userId), filter, time.Now())
+	result := applyUrlSort(query, sort).
+		Limit(pageSize).
+		Offset(offset).
+		Find(&urls)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return urls, nil
+}
+
+func (s *gormLinkStore) CountUrlsByUserId(ctx context.Context, userId uint, filter UrlFilter) (int64, error) {
+	var totalCount int64
+
+	result := applyUrlFilter(userUrls(s.db.WithContext(ctx).Model(&UrlShortener{}), userId), filter, time.Now()).
+		Count(&totalCount)
+
+	return totalCount, result.Error
+}
+
+func (s *gormLinkStore) EachUrlByUserId(ctx context.Context, userId uint, filter UrlFilter, fn func(UrlShortener) error) error {
+	now := time.Now()
+
+	// Batches continue after the last link of the previous one instead of
+	// using an offset, so links created meanwhile do not shift the rows.
+	var last *UrlShortener
+	for {
+		sort := UrlSort{}
+		if last != nil {
+			sort.After = &UrlCursor{CreatedAt: last.CreatedAt, ShortCode: last.ShortCode}
+		}
+
+		batch := []UrlShortener{}
+		query := applyUrlSort(applyUrlFilter(userUrls(s.db.WithContext(ctx), userId), filter, now), sort)
+		if err := query.Limit(eachUrlBatchSize).Find(&batch).Error; err != nil {
+			return err
+		}
+
+		for _, urlShortener := range batch {
+			if err := fn(urlShortener); err != nil {
+				return err
+			}
+		}
+
+		if len(batch) < eachUrlBatchSize {
+			return nil
+		}
+		last = &batch[len(batch)-1]
+	}
+}
+
+func applyUrlFilter(query *gorm.DB, filter UrlFilter, now time.Time) *gorm.DB {
+	switch filter.Status {
+	case linkStatusActive:
+		query = query.Where("deleted_at IS NULL").Where("(expires_at IS NULL OR expires_at > ?)", now)
+	case linkStatusDeleted:
+		query = query.Where("deleted_at IS NOT NULL")
+	case linkStatusExpired:
+		query = query.Where("deleted_at IS NULL").Where("expires_at <= ?", now)
+	case urlFilterPasswordProtected:
+		query = query.Where("password IS NOT NULL")
+	}
+	if filter.Search != "" {
+		pattern := "%" + likeEscaper.Replace(strings.ToLower(filter.Search)) + "%"
+		query = query.Where(`(LOWER(original_url) LIKE ? ESCAPE '\' OR LOWER(short_code) LIKE ? ESCAPE '\')`, pattern, pattern)
+	}
+	if filter.CreatedFrom != nil {
+		query = query.Where("created_at >= ?", *filter.CreatedFrom)
+	}
+	if filter.CreatedTo != nil {
+		query = query.Where("created_at <= ?", *filter.CreatedTo)
+	}
+
+	return query
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// applyUrlSort orders the query by sort and skips the links up to its
+// cursor. The cursor compares created_at and short_code so links created
+// meanwhile or sharing a timestamp do not shift the following pages.
+func applyUrlSort(query *gorm.DB, sort UrlSort) *gorm.DB {
+	if sort.After != nil && (sort.Field == "" || sort.Field == urlSortCreatedAt) {
+		comparison := ">"
+		if sort.Descending {
+			comparison = "<"
+		}
+		query = query.Where("(created_at "+comparison+" ? OR (created_at = ? AND short_code "+comparison+" ?))", sort.After.CreatedAt, sort.After.CreatedAt, sort.After.ShortCode)
+	}
+
+	return query.Order(urlSortOrder(sort))
+}
+
+// urlSortOrder is the ORDER BY clause of sort.
+func urlSortOrder(sort UrlSort) string {
+	direction := " ASC"
+	if sort.Descending {
+		direction = " DESC"
+	}
+
+	switch sort.Field {
+	case urlSortViews:
+		return "views" + direction + ", short_code" + direction
+	case urlSortLastViewed:
+		return "last_viewed IS NULL, last_viewed" + direction + ", short_code" + direction
+	default:
+		return "created_at" + direction + ", short_code" + direction
+	}
+}
+
+func (s *gormLinkStore) GetUrlsByWorkspaceId(ctx context.Context, workspaceId uint, filter UrlFilter, sort UrlSort, page int, pageSize int) ([]UrlShortener, error) {
+	var urls []UrlShortener
+
+	offset := (page - 1) * pageSize
+	query := applyUrlFilter(s.db.WithContext(ctx).Where("workspace_id = ?", workspaceId), filter, time.Now())
+	result := applyUrlSort(query, sort).
+		Limit(pageSize).
+		Offset(offset).
+		Find(&urls)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return urls, nil
+}
+
+func (s *gormLinkStore) CountUrlsByWorkspaceId(ctx context.Context, workspaceId uint, filter UrlFilter) (int64, error) {
+	var totalCount int64
+
+	result := applyUrlFilter(s.db.WithContext(ctx).Model(&UrlShortener{}).Where("workspace_id = ?", workspaceId), filter, time.Now()).
+		Count(&totalCount)
+
+	return totalCount, result.Error
+}
+
+func (s *gormLinkStore) CreateUser(ctx context.Context, user *Users) error {
+	return translateGormError(s.db.WithContext(ctx).Create(user).Error)
+}
+
+func (s *gormLinkStore) GetUserByEmail(ctx context.Context, email string) (*Users, error) {
+	var user Users
+	if err := s.db.WithContext(ctx).Where("email = ?", email).First(&user).Error; err != nil {
+		return nil, translateGormError(err)
+	}
+
+	return &user, nil
+}
+
+func (s *gormLinkStore) GetUserByApiKey(ctx context.Context, apiKey string) (*Users, error) {
+	var candidates []Users
+
+	now := time.Now()
+	prefix := apiKeyPrefix(apiKey)
+	result := s.db.WithContext(ctx).
+		Where("api_key_prefix = ?", prefix).
+		Or("previous_api_key_prefix = ? AND previous_api_key_expires_at > ?", prefix, now).
+		Find(&candidates)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	for i := range candidates {
+		if matchesApiKey(&candidates[i], apiKey, now) {
+			return resolvedUser(candidates[i], apiKey, nil), nil
+		}
+	}
+
+	var keys []ApiKeys
+	result = s.db.WithContext(ctx).Where("prefix = ?", prefix).Find(&keys)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	for i := range keys {
+		key := &keys[i]
+		if !matchesNamedApiKey(key, apiKey, now) {
+			continue
+		}
+
+		var user Users
+		if err := s.db.WithContext(ctx).First(&user, key.UserId).Error; err != nil {
+			return nil, translateGormError(err)
+		}
+
+		if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyLastUsedResolution {
+			err := s.db.WithContext(ctx).Model(key).UpdateColumn("last_used_at", now).Error
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return resolvedUser(user, apiKey, key), nil
+	}
+
+	return nil, ErrNotFound
+}
+
+func (s *gormLinkStore) RotateApiKey(ctx context.Context, userId uint, newApiKey string, previousExpiresAt time.Time) error {
+	result := s.db.WithContext(ctx).
+		Model(&Users{}).
+		Where("id = ?", userId).
+		Updates(map[string]interface{}{
+			"previous_api_key":            gorm.Expr("api_key"),
+			"previous_api_key_prefix":     gorm.Expr("api_key_prefix"),
+			"previous_api_key_expires_at": previousExpiresAt,
+			"api_key":                     apiKeyDigest(newApiKey),
+			"api_key_prefix":              apiKeyPrefix(newApiKey),
+		})
+
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *gormLinkStore) RevokePreviousApiKey(ctx context.Context, userId uint) error {
+	return s.db.WithContext(ctx).
+		Model(&Users{}).
+		Where("id = ?", userId).
+		Updates(map[string]interface{}{
+			"previous_api_key":            nil,
+			"previous_api_key_prefix":     nil,
+			"previous_api_key_expires_at": nil,
+		}).Error
+}
+
+func (s *gormLinkStore) CreateApiKey(ctx context.Context, key *ApiKeys) error {
+	return s.db.WithContext(ctx).Create(key).Error
+}
+
+func (s *gormLinkStore) ListApiKeys(ctx context.Context, userId uint) ([]ApiKeys, error) {
+	keys := []ApiKeys{}
+
+	result := s.db.WithContext(ctx).Where("user_id = ?", userId).Order("id").Find(&keys)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return keys, nil
+}
+
+func (s *gormLinkStore) DeleteApiKey(ctx context.Context, userId uint, keyId uint) error {
+	result := s.db.WithContext(ctx).Where("id = ? AND user_id = ?", keyId, userId).Delete(&ApiKeys{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *gormLinkStore) CreateWorkspace(ctx context.Context, workspace *Workspaces, ownerId uint) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(workspace).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&WorkspaceMembers{WorkspaceId: workspace.Id, UserId: ownerId, Role: workspaceRoleOwner}).Error
+	})
+}
+
+func (s *gormLinkStore) GetWorkspaceMember(ctx context.Context, workspaceId uint, userId uint) (*WorkspaceMembers, error) {
+	var member WorkspaceMembers
+
+	result := s.db.WithContext(ctx).
+		Preload("Workspace").
+		Where("workspace_id = ? AND user_id = ?", workspaceId, userId).
+		First(&member)
+	if result.Error != nil {
+		return nil, translateGormError(result.Error)
+	}
+
+	return &member, nil
+}
+
+func (s *gormLinkStore) ListWorkspaceMembers(ctx context.Context, workspaceId uint) ([]WorkspaceMembers, error) {
+	members := []WorkspaceMembers{}
+
+	result := s.db.WithContext(ctx).Preload("User").Where("workspace_id = ?", workspaceId).Order("id").Find(&members)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return members, nil
+}
+
+func (s *gormLinkStore) ListWorkspacesByUserId(ctx context.Context, userId uint) ([]WorkspaceMembers, error) {
+	members := []WorkspaceMembers{}
+
+	result := s.db.WithContext(ctx).Preload("Workspace").Where("user_id = ?", userId).Order("workspace_id").Find(&members)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return members, nil
+}
+
+func (s *gormLinkStore) SaveWorkspaceMember(ctx context.Context, member *WorkspaceMembers) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var existing WorkspaceMembers
+		result := tx.Where("workspace_id = ? AND user_id = ?", member.WorkspaceId, member.UserId).Limit(1).Find(&existing)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return tx.Omit("Workspace", "User").Create(member).Error
+		}
+
+		member.Id = existing.Id
+		member.CreatedAt = existing.CreatedAt
+		return tx.Model(&existing).Update("role", member.Role).Error
+	})
+}
+
+func (s *gormLinkStore) DeleteWorkspaceMember(ctx context.Context, workspaceId uint, userId uint) error {
+	result := s.db.WithContext(ctx).Where("workspace_id = ? AND user_id = ?", workspaceId, userId).Delete(&WorkspaceMembers{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *gormLinkStore) InsertLinkRevisions(ctx context.Context, revisions []LinkRevisions) error {
+	if len(revisions) == 0 {
+		return nil
+	}
+
+	return s.db.WithContext(ctx).Create(&revisions).Error
+}
+
+func (s *gormLinkStore) ListLinkRevisions(ctx context.Context, shortCode string) ([]LinkRevisions, error) {
+	revisions := []LinkRevisions{}
+
+	result := s.db.WithContext(ctx).Where("short_code = ?", shortCode).Order("id DESC").Find(&revisions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return revisions, nil
+}
+
+func (s *gormLinkStore) GetLinkRevision(ctx context.Context, shortCode string, revisionId uint) (*LinkRevisions, error) {
+	var revision LinkRevisions
+
+	result := s.db.WithContext(ctx).Where("id = ? AND short_code = ?", revisionId, shortCode).First(&revision)
+	if result.Error != nil {
+		return nil, translateGormError(result.Error)
+	}
+
+	return &revision, nil
+}
+
+func (s *gormLinkStore) CreateJob(ctx context.Context, job *Jobs) error {
+	return s.db.WithContext(ctx).Create(job).Error
+}
+
+func (s *gormLinkStore) GetJob(ctx context.Context, jobId string) (*Jobs, error) {
+	var job Jobs
+
+	result := s.db.WithContext(ctx).Where("id = ?", jobId).First(&job)
+	if result.Error != nil {
+		return nil, translateGormError(result.Error)
+	}
+
+	return &job, nil
+}
+
+func (s *gormLinkStore) ClaimJob(ctx context.Context, leaseExpiresAt time.Time) (*Jobs, error) {
+	for {
+		var job Jobs
+
+		result := s.db.WithContext(ctx).Where("status = ?", jobStatusQueued).Order("created_at").First(&job)
+		if result.Error != nil {
+			return nil, translateGormError(result.Error)
+		}
+
+		// The status condition makes the update a no-op when another worker
+		// claimed the job first, the next queued job is tried then.
+		now := time.Now()
+		result = s.db.WithContext(ctx).
+			Model(&Jobs{}).
+			Where("id = ? AND status = ?", job.Id, jobStatusQueued).
+			Updates(map[string]interface{}{
+				"status":           jobStatusRunning,
+				"started_at":       now,
+				"lease_expires_at": leaseExpiresAt,
+				"updated_at":       now,
+			})
+
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 1 {
+			job.Status = jobStatusRunning
+			job.StartedAt = &now
+			job.LeaseExpiresAt = &leaseExpiresAt
+			job.UpdatedAt = now
+			return &job, nil
+		}
+	}
+}
+
+func (s *gormLinkStore) RenewJobLease(ctx context.Context, jobId string, leaseExpiresAt time.Time) error {
+	// UpdateColumns keeps the heartbeat from bumping updated_at.
+	return s.db.WithContext(ctx).
+		Model(&Jobs{}).
+		Where("id = ? AND status = ?", jobId, jobStatusRunning).
+		UpdateColumn("lease_expires_at", leaseExpiresAt).Error
+}
+
+func (s *gormLinkStore) UpdateJobProgress(ctx context.Context, jobId string, processedRows int, failedRows int) error {
+	return s.db.WithContext(ctx).
+		Model(&Jobs{}).
+		Where("id = ?", jobId).
+		Updates(map[string]interface{}{
+			"processed_rows": processedRows,
+			"failed_rows":    failedRows,
+			"updated_at":     time.Now(),
+		}).Error
+}
+
+func (s *gormLinkStore) FinishJob(ctx context.Context, job *Jobs) error {
+	job.Input = ""
+
+	return s.db.WithContext(ctx).
+		Model(&Jobs{}).
+		Where("id = ?", job.Id).
+		Updates(map[string]interface{}{
+			"status":         job.Status,
+			"processed_rows": job.ProcessedRows,
+			"failed_rows":    job.FailedRows,
+			"input":          "",
+			"result":         job.Result,
+			"error":          job.Error,
+			"finished_at":    job.FinishedAt,
+			"updated_at":     time.Now(),
+		}).Error
+}
+
+func (s *gormLinkStore) RequeueJob(ctx context.Context, job *Jobs) error {
+	job.Status = jobStatusQueued
+	job.LeaseExpiresAt = nil
+
+	return s.db.WithContext(ctx).
+		Model(&Jobs{}).
+		Where("id = ? AND status = ?", job.Id, jobStatusRunning).
+		Updates(map[string]interface{}{
+			"status":           jobStatusQueued,
+			"processed_rows":   job.ProcessedRows,
+			"failed_rows":      job.FailedRows,
+			"result":           job.Result,
+			"lease_expires_at": nil,
+			"updated_at":       time.Now(),
+		}).Error
+}
+
+func (s *gormLinkStore) FailExpiredJobs(ctx context.Context, now time.Time, message string) error {
+	// Jobs started before leases existed have none and count as expired.
+	return s.db.WithContext(ctx).
+		Model(&Jobs{}).
+		Where("status = ? AND (lease_expires_at IS NULL OR lease_expires_at < ?)", jobStatusRunning, now).
+		Updates(map[string]interface{}{
+			"status":      jobStatusFailed,
+			"input":       "",
+			"error":       message,
+			"finished_at": now,
+			"updated_at":  now,
+		}).Error
+}
+
+func (s *gormLinkStore) InsertRequestLogs(ctx context.Context, logRequests []LogRequests) error {
+	if len(logRequests) == 0 {
+		return nil
+	}
+
+	return s.db.WithContext(ctx).Create(&logRequests).Error
+}
+
+func (s *gormLinkStore) RecordClicks(ctx context.Context, clicks []Clicks) error {
+	if len(clicks) == 0 {
+		return nil
+	}
+
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&clicks).Error; err != nil {
+			return err
+		}
+
+		for shortCode, summary := range summarizeClicks(clicks) {
+			// UpdateColumns keeps analytics from bumping updated_at.
+			result := tx.Model(&UrlShortener{}).
+				Where("short_code = ?", shortCode).
+				UpdateColumns(map[string]interface{}{
+					"views":       gorm.Expr("views + ?", summary.count),
+					"last_viewed": summary.lastViewed,
+				})
+
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+
+		// Redirects of anonymous links are not anyone's usage.
+		var owners []UrlShortener
+		err := tx.Select("short_code", "user_id").
+			Where("short_code IN ? AND user_id IS NOT NULL", clickedShortCodes(clicks)).
+			Find(&owners).Error
+		if err != nil {
+			return err
+		}
+
+		ownerIds := make(map[string]uint)
+		for _, owner := range owners {
+			ownerIds[owner.ShortCode] = *owner.UserId
+		}
+
+		return addUsages(tx, redirectUsages(clicks, ownerIds))
+	})
+}
+
+func (s *gormLinkStore) AddUsages(ctx context.Context, usages []Usages) error {
+	return addUsages(s.db.WithContext(ctx), usages)
+}
+
+// addUsages inserts the usages with a single upsert that adds to the rows
+// already there.
+func addUsages(db *gorm.DB, usages []Usages) error {
+	usages = mergeUsages(usages)
+	if len(usages) == 0 {
+		return nil
+	}
+
+	return db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "user_id"}, {Name: "month"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"links_created": gorm.Expr("usages.links_created + excluded.links_created"),
+			"redirects":     gorm.Expr("usages.redirects + excluded.redirects"),
+			"bulk_jobs":     gorm.Expr("usages.bulk_jobs + excluded.bulk_jobs"),
+			"updated_at":    gorm.Expr("excluded.updated_at"),
+		}),
+	}).Create(&usages).Error
+}
+
+func (s *gormLinkStore) ReserveUsage(ctx context.Context, userId uint, month string, counter string, n int64, limit int64) (int64, error) {
+	if counter != usageLinksCreated && counter != usageBulkJobs {
+		return 0, fmt.Errorf("unknown usage counter %q", counter)
+	}
+
+	db := s.db.WithContext(ctx)
+	if limit == 0 {
+		return n, addUsages(db, []Usages{counterUsage(userId, month, counter, n)})
+	}
+
+	// The row has to exist for the conditional update.
+	if err := addUsages(db, []Usages{{UserId: userId, Month: month}}); err != nil {
+		return 0, err
+	}
+
+	for {
+		var usage Usages
+		if err := db.Where("user_id = ? AND month = ?", userId, month).Take(&usage).Error; err != nil {
+			return 0, err
+		}
+
+		used := usageCounter(&usage, counter)
+		reserved := min(n, limit-used)
+		if reserved <= 0 {
+			return 0, nil
+		}
+
+		// The update only applies when no other request changed the counter
+		// since it was read, the reservation is tried again otherwise.
+		result := db.Model(&Usages{}).
+			Where("user_id = ? AND month = ? AND "+counter+" = ?", userId, month, used).
+			Updates(map[string]interface{}{
+				counter:      gorm.Expr(counter+" + ?", reserved),
+				"updated_at": time.Now(),
+			})
+		if result.Error != nil {
+			return 0, result.Error
+		}
+		if result.RowsAffected == 1 {
+			return reserved, nil
+		}
+	}
+}
+
+func (s *gormLinkStore) GetUsage(ctx context.Context, userId uint, month string) (*Usages, error) {
+	usage := &Usages{UserId: userId, Month: month}
+	err := s.db.WithContext(ctx).Where("user_id = ? AND month = ?", userId, month).Take(usage).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+func (s *gormLinkStore) ListIpRules(ctx context.Context) ([]IpRules, error) {
+	rules := []IpRules{}
+	err := s.db.WithContext(ctx).Order("id").Find(&rules).Error
+	return rules, err
+}
+
+func (s *gormLinkStore) CreateIpRule(ctx context.Context, rule *IpRules) error {
+	return s.db.WithContext(ctx).Create(rule).Error
+}
+
+func (s *gormLinkStore) DeleteIpRule(ctx context.Context, ruleId uint) error {
+	result := s.db.WithContext(ctx).Where("id = ?", ruleId).Delete(&IpRules{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *gormLinkStore) InsertBlockedAttempts(ctx context.Context, blockedAttempts []BlockedAttempts) error {
+	if len(blockedAttempts) == 0 {
+		return nil
+	}
+
+	return s.db.WithContext(ctx).Create(&blockedAttempts).Error
+}
+
+func translateGormError(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return ErrConflict
+	}
+
+	return err
+}
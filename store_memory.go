@@ -0,0 +1,1071 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryLinkStore keeps everything in process memory. It is meant for local
+// development and tests, nothing survives a restart.
+type memoryLinkStore struct {
+	mu         sync.RWMutex
+	urls       map[string]*UrlShortener
+	users      map[uint]*Users
+	lastUserId uint
+	apiKeys    map[uint]*ApiKeys
+	lastKeyId  uint
+
+	workspaces      map[uint]*Workspaces
+	lastWorkspaceId uint
+	members         []*WorkspaceMembers
+	lastMemberId    uint
+
+	revisions []LinkRevisions
+	jobs      []*Jobs
+	logs      []LogRequests
+	clicks    []Clicks
+	usages    map[string]*Usages
+	blocked   []BlockedAttempts
+
+	ipRules      []IpRules
+	lastIpRuleId uint
+}
+
+func newMemoryLinkStore() *memoryLinkStore {
+	return &memoryLinkStore{
+		urls:       make(map[string]*UrlShortener),
+		users:      make(map[uint]*Users),
+		apiKeys:    make(map[uint]*ApiKeys),
+		workspaces: make(map[uint]*Workspaces),
+		usages:     make(map[string]*Usages),
+	}
+}
+
+func (s *memoryLinkStore) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (s *memoryLinkStore) Close() error {
+	return nil
+}
+
+func (s *memoryLinkStore) InsertUrl(ctx context.Context, urlShortener *UrlShortener) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.urls[urlShortener.ShortCode]; exists {
+		return fmt.Errorf("short code %q already exists: %w", urlShortener.ShortCode, ErrConflict)
+	}
+
+	now := time.Now()
+	if urlShortener.CreatedAt.IsZero() {
+		urlShortener.CreatedAt = now
+	}
+	if urlShortener.UpdatedAt.IsZero() {
+		urlShortener.UpdatedAt = now
+	}
+	if urlShortener.RedirectType == 0 {
+		urlShortener.RedirectType = defaultRedirectType
+	}
+
+	stored := *urlShortener
+	s.urls[urlShortener.ShortCode] = &stored
+
+	return nil
+}
+
+func (s *memoryLinkStore) InsertUrls(ctx context.Context, urlShorteners []*UrlShortener, revisions []LinkRevisions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := make(map[string]bool, len(urlShorteners))
+	for _, urlShortener := range urlShorteners {
+		if _, exists := s.urls[urlShortener.ShortCode]; exists || seen[urlShortener.ShortCode] {
+			return fmt.Errorf("short code %q already exists: %w", urlShortener.ShortCode, ErrConflict)
+		}
+		seen[urlShortener.ShortCode] = true
+	}
+
+	now := time.Now()
+	for _, urlShortener := range urlShorteners {
+		if urlShortener.CreatedAt.IsZero() {
+			urlShortener.CreatedAt = now
+		}
+		if urlShortener.UpdatedAt.IsZero() {
+			urlShortener.UpdatedAt = now
+		}
+		if urlShortener.RedirectType == 0 {
+			urlShortener.RedirectType = defaultRedirectType
+		}
+
+		stored := *urlShortener
+		s.urls[urlShortener.ShortCode] = &stored
+	}
+	s.appendRevisions(revisions)
+
+	return nil
+}
+
+func (s *memoryLinkStore) GetActiveUrl(ctx context.Context, shortCode string) (*UrlShortener, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	urlShortener, exists := s.urls[shortCode]
+	if !exists || !isActiveUrl(urlShortener, time.Now()) {
+		return nil, ErrNotFound
+	}
+
+	found := *urlShortener
+	return &found, nil
+}
+
+func (s *memoryLinkStore) GetUrl(ctx context.Context, shortCode string) (*UrlShortener, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	urlShortener, exists := s.urls[shortCode]
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	found := *urlShortener
+	return &found, nil
+}
+
+func (s *memoryLinkStore) ShortCodeExists(ctx context.Context, shortCode string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	urlShortener, exists := s.urls[shortCode]
+	return exists && isActiveUrl(urlShortener, time.Now()), nil
+}
+
+func (s *memoryLinkStore) TakenShortCodes(ctx context.Context, shortCodes []string) (map[string]bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	taken := make(map[string]bool)
+	for _, shortCode := range shortCodes {
+		if _, exists := s.urls[shortCode]; exists {
+			taken[shortCode] = true
+		}
+	}
+
+	return taken, nil
+}
+
+func (s *memoryLinkStore) DeleteUrl(ctx context.Context, shortCode string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if urlShortener, exists := s.urls[shortCode]; exists {
+		now := time.Now()
+		urlShortener.DeletedAt = &now
+		urlShortener.UpdatedAt = now
+	}
+
+	return nil
+}
+
+func (s *memoryLinkStore) ActivateUrl(ctx context.Context, shortCode string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if urlShortener, exists := s.urls[shortCode]; exists {
+		urlShortener.DeletedAt = nil
+		urlShortener.UpdatedAt = time.Now()
+	}
+
+	return nil
+}
+
+func (s *memoryLinkStore) EditUrl(ctx context.Context, shortCode string, urlShortener *UrlShortener, revision *LinkRevisions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, exists := s.urls[shortCode]
+	if !exists {
+		return ErrNotFound
+	}
+
+	newShortCode := urlShortener.ShortCode
+	if _, taken := s.urls[newShortCode]; taken && newShortCode != shortCode {
+		return fmt.Errorf("short code %q already exists: %w", newShortCode, ErrConflict)
+	}
+
+	urlShortener.UpdatedAt = time.Now()
+
+	updated := *urlShortener
+	stored.OriginalUrl = updated.OriginalUrl
+	stored.ExpiresAt = updated.ExpiresAt
+	stored.Password = updated.Password
+	stored.RedirectType = updated.RedirectType
+	stored.WorkspaceId = updated.WorkspaceId
+	stored.DeletedAt = updated.DeletedAt
+	stored.UpdatedAt = updated.UpdatedAt
+
+	if newShortCode != shortCode {
+		delete(s.urls, shortCode)
+		stored.ShortCode = newShortCode
+		s.urls[newShortCode] = stored
+
+		for i := range s.clicks {
+			if s.clicks[i].ShortCode == shortCode {
+				s.clicks[i].ShortCode = newShortCode
+			}
+		}
+
+		for i := range s.revisions {
+			if s.revisions[i].ShortCode == shortCode {
+				s.revisions[i].ShortCode = newShortCode
+			}
+		}
+	}
+
+	if revision != nil {
+		s.appendRevisions([]LinkRevisions{*revision})
+		*revision = s.revisions[len(s.revisions)-1]
+	}
+
+	return nil
+}
+
+func (s *memoryLinkStore) GetUrlsByUserId(ctx context.Context, userId uint, filter UrlFilter, sort UrlSort, page int, pageSize int) ([]UrlShortener, error) {
+	urls := s.filterUrls(s.ownedBy(userId), filter)
+	sortUrls(urls, sort)
+
+	return pageOfUrls(urlsAfter(urls, sort), page, pageSize), nil
+}
+
+func (s *memoryLinkStore) CountUrlsByUserId(ctx context.Context, userId uint, filter UrlFilter) (int64, error) {
+	urls := s.filterUrls(s.ownedBy(userId), filter)
+
+	return int64(len(urls)), nil
+}
+
+func (s *memoryLinkStore) EachUrlByUserId(ctx context.Context, userId uint, filter UrlFilter, fn func(UrlShortener) error) error {
+	urls := s.filterUrls(s.ownedBy(userId), filter)
+	sortUrls(urls, UrlSort{})
+
+	for _, urlShortener := range urls {
+		if err := fn(urlShortener); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryLinkStore) GetUrlsByWorkspaceId(ctx context.Context, workspaceId uint, filter UrlFilter, sort UrlSort, page int, pageSize int) ([]UrlShortener, error) {
+	urls := s.filterUrls(func(urlShortener *UrlShortener) bool {
+		return urlShortener.WorkspaceId != nil && *urlShortener.WorkspaceId == workspaceId
+	}, filter)
+	sortUrls(urls, sort)
+
+	return pageOfUrls(urlsAfter(urls, sort), page, pageSize), nil
+}
+
+func (s *memoryLinkStore) CountUrlsByWorkspaceId(ctx context.Context, workspaceId uint, filter UrlFilter) (int64, error) {
+	urls := s.filterUrls(func(urlShortener *UrlShortener) bool {
+		return urlShortener.WorkspaceId != nil && *urlShortener.WorkspaceId == workspaceId
+	}, filter)
+
+	return int64(len(urls)), nil
+}
+
+// filterUrls copies the links owned according to owned that match filter.
+// ownedBy matches the links of userId, see GetUrlsByUserId. It runs under
+// the lock taken by filterUrls.
+func (s *memoryLinkStore) ownedBy(userId uint) func(*UrlShortener) bool {
+	return func(urlShortener *UrlShortener) bool {
+		if urlShortener.UserId == nil || *urlShortener.UserId != userId {
+			return false
+		}
+		if urlShortener.WorkspaceId == nil {
+			return true
+		}
+
+		_, member := s.findWorkspaceMember(*urlShortener.WorkspaceId, userId)
+		return member != nil
+	}
+}
+
+func (s *memoryLinkStore) filterUrls(owned func(*UrlShortener) bool, filter UrlFilter) []UrlShortener {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	urls := []UrlShortener{}
+	for _, urlShortener := range s.urls {
+		if owned(urlShortener) && matchesUrlFilter(urlShortener, filter, now) {
+			urls = append(urls, *urlShortener)
+		}
+	}
+
+	return urls
+}
+
+// sortUrls orders urls like urlSortOrder does in SQL.
+func sortUrls(urls []UrlShortener, urlSort UrlSort) {
+	sort.Slice(urls, func(i, j int) bool {
+		a, b := &urls[i], &urls[j]
+		if urlSort.Descending {
+			a, b = b, a
+		}
+
+		switch urlSort.Field {
+		case urlSortViews:
+			if a.Views != b.Views {
+				return a.Views < b.Views
+			}
+		case urlSortLastViewed:
+			// Never viewed links come last in both directions.
+			if (urls[i].LastViewed == nil) != (urls[j].LastViewed == nil) {
+				return urls[j].LastViewed == nil
+			}
+			if a.LastViewed != nil && b.LastViewed != nil && !a.LastViewed.Equal(*b.LastViewed) {
+				return a.LastViewed.Before(*b.LastViewed)
+			}
+		default:
+			if !a.CreatedAt.Equal(b.CreatedAt) {
+				return a.CreatedAt.Before(b.CreatedAt)
+			}
+		}
+		return a.ShortCode < b.ShortCode
+	})
+}
+
+// urlsAfter drops the sorted urls up to the cursor of urlSort, like
+// applyUrlSort does in SQL.
+func urlsAfter(urls []UrlShortener, urlSort UrlSort) []UrlShortener {
+	if urlSort.After == nil || (urlSort.Field != "" && urlSort.Field != urlSortCreatedAt) {
+		return urls
+	}
+
+	for i := range urls {
+		after := urls[i].CreatedAt.After(urlSort.After.CreatedAt) ||
+			urls[i].CreatedAt.Equal(urlSort.After.CreatedAt) && urls[i].ShortCode > urlSort.After.ShortCode
+		if urlSort.Descending {
+			after = urls[i].CreatedAt.Before(urlSort.After.CreatedAt) ||
+				urls[i].CreatedAt.Equal(urlSort.After.CreatedAt) && urls[i].ShortCode < urlSort.After.ShortCode
+		}
+		if after {
+			return urls[i:]
+		}
+	}
+
+	return []UrlShortener{}
+}
+
+func pageOfUrls(urls []UrlShortener, page int, pageSize int) []UrlShortener {
+	offset := (page - 1) * pageSize
+	if offset >= len(urls) {
+		return []UrlShortener{}
+	}
+
+	return urls[offset:min(offset+pageSize, len(urls))]
+}
+
+func (s *memoryLinkStore) CreateUser(ctx context.Context, user *Users) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := hashUserApiKey(user); err != nil {
+		return err
+	}
+
+	for _, existing := range s.users {
+		if existing.Email == user.Email {
+			return fmt.Errorf("user with email %q already exists: %w", user.Email, ErrConflict)
+		}
+		if existing.ApiKeyDigest == user.ApiKeyDigest {
+			return fmt.Errorf("api key already exists: %w", ErrConflict)
+		}
+	}
+
+	s.lastUserId++
+	user.Id = s.lastUserId
+
+	now := time.Now()
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = now
+	}
+	if user.UpdatedAt.IsZero() {
+		user.UpdatedAt = now
+	}
+	if user.Tier == "" {
+		user.Tier = "hobby"
+	}
+
+	stored := *user
+	stored.ApiKey = ""
+	s.users[user.Id] = &stored
+
+	return nil
+}
+
+func (s *memoryLinkStore) GetUserByEmail(ctx context.Context, email string) (*Users, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users {
+		if user.Email == email {
+			found := *user
+			return &found, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (s *memoryLinkStore) GetUserByApiKey(ctx context.Context, apiKey string) (*Users, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, user := range s.users {
+		if matchesApiKey(user, apiKey, now) {
+			return resolvedUser(*user, apiKey, nil), nil
+		}
+	}
+
+	for _, key := range s.apiKeys {
+		if !matchesNamedApiKey(key, apiKey, now) {
+			continue
+		}
+
+		user, exists := s.users[key.UserId]
+		if !exists {
+			return nil, ErrNotFound
+		}
+
+		if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyLastUsedResolution {
+			lastUsedAt := now
+			key.LastUsedAt = &lastUsedAt
+		}
+
+		found := *key
+		return resolvedUser(*user, apiKey, &found), nil
+	}
+
+	return nil, ErrNotFound
+}
+
+func (s *memoryLinkStore) CreateApiKey(ctx context.Context, key *ApiKeys) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := hashNamedApiKey(key); err != nil {
+		return err
+	}
+
+	for _, existing := range s.apiKeys {
+		if existing.Digest == key.Digest {
+			return fmt.Errorf("api key already exists")
+		}
+	}
+
+	s.lastKeyId++
+	key.Id = s.lastKeyId
+
+	now := time.Now()
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = now
+	}
+	if key.UpdatedAt.IsZero() {
+		key.UpdatedAt = now
+	}
+
+	stored := *key
+	stored.Key = ""
+	s.apiKeys[key.Id] = &stored
+
+	return nil
+}
+
+func (s *memoryLinkStore) ListApiKeys(ctx context.Context, userId uint) ([]ApiKeys, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := []ApiKeys{}
+	for keyId := uint(1); keyId <= s.lastKeyId; keyId++ {
+		if key, exists := s.apiKeys[keyId]; exists && key.UserId == userId {
+			keys = append(keys, *key)
+		}
+	}
+
+	return keys, nil
+}
+
+func (s *memoryLinkStore) DeleteApiKey(ctx context.Context, userId uint, keyId uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, exists := s.apiKeys[keyId]
+	if !exists || key.UserId != userId {
+		return ErrNotFound
+	}
+
+	delete(s.apiKeys, keyId)
+
+	return nil
+}
+
+func (s *memoryLinkStore) RotateApiKey(ctx context.Context, userId uint, newApiKey string, previousExpiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, exists := s.users[userId]
+	if !exists {
+		return ErrNotFound
+	}
+
+	previousDigest, previousPrefix := user.ApiKeyDigest, user.ApiKeyPrefix
+	user.PreviousApiKeyDigest = &previousDigest
+	user.PreviousApiKeyPrefix = &previousPrefix
+	user.PreviousApiKeyExpiresAt = &previousExpiresAt
+	user.ApiKeyDigest = apiKeyDigest(newApiKey)
+	user.ApiKeyPrefix = apiKeyPrefix(newApiKey)
+	user.UpdatedAt = time.Now()
+
+	return nil
+}
+
+func (s *memoryLinkStore) RevokePreviousApiKey(ctx context.Context, userId uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, exists := s.users[userId]; exists {
+		user.PreviousApiKeyDigest = nil
+		user.PreviousApiKeyPrefix = nil
+		user.PreviousApiKeyExpiresAt = nil
+		user.UpdatedAt = time.Now()
+	}
+
+	return nil
+}
+
+func (s *memoryLinkStore) CreateWorkspace(ctx context.Context, workspace *Workspaces, ownerId uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastWorkspaceId++
+	workspace.Id = s.lastWorkspaceId
+
+	now := time.Now()
+	if workspace.CreatedAt.IsZero() {
+		workspace.CreatedAt = now
+	}
+	if workspace.UpdatedAt.IsZero() {
+		workspace.UpdatedAt = now
+	}
+
+	stored := *workspace
+	s.workspaces[workspace.Id] = &stored
+
+	s.lastMemberId++
+	s.members = append(s.members, &WorkspaceMembers{
+		Id:          s.lastMemberId,
+		WorkspaceId: workspace.Id,
+		UserId:      ownerId,
+		Role:        workspaceRoleOwner,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	})
+
+	return nil
+}
+
+// findWorkspaceMember expects the caller to hold s.mu.
+func (s *memoryLinkStore) findWorkspaceMember(workspaceId uint, userId uint) (int, *WorkspaceMembers) {
+	for i, member := range s.members {
+		if member.WorkspaceId == workspaceId && member.UserId == userId {
+			return i, member
+		}
+	}
+
+	return -1, nil
+}
+
+func (s *memoryLinkStore) GetWorkspaceMember(ctx context.Context, workspaceId uint, userId uint) (*WorkspaceMembers, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, member := s.findWorkspaceMember(workspaceId, userId)
+	if member == nil {
+		return nil, ErrNotFound
+	}
+
+	found := *member
+	found.Workspace = *s.workspaces[workspaceId]
+	return &found, nil
+}
+
+func (s *memoryLinkStore) ListWorkspaceMembers(ctx context.Context, workspaceId uint) ([]WorkspaceMembers, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	members := []WorkspaceMembers{}
+	for _, member := range s.members {
+		if member.WorkspaceId != workspaceId {
+			continue
+		}
+
+		found := *member
+		if user, exists := s.users[member.UserId]; exists {
+			found.User = *user
+		}
+		members = append(members, found)
+	}
+
+	return members, nil
+}
+
+func (s *memoryLinkStore) ListWorkspacesByUserId(ctx context.Context, userId uint) ([]WorkspaceMembers, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	members := []WorkspaceMembers{}
+	for _, member := range s.members {
+		if member.UserId != userId {
+			continue
+		}
+
+		found := *member
+		found.Workspace = *s.workspaces[member.WorkspaceId]
+		members = append(members, found)
+	}
+
+	return members, nil
+}
+
+func (s *memoryLinkStore) SaveWorkspaceMember(ctx context.Context, member *WorkspaceMembers) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.workspaces[member.WorkspaceId]; !exists {
+		return fmt.Errorf("workspace %d does not exist", member.WorkspaceId)
+	}
+
+	now := time.Now()
+	if _, existing := s.findWorkspaceMember(member.WorkspaceId, member.UserId); existing != nil {
+		existing.Role = member.Role
+		existing.UpdatedAt = now
+		member.Id = existing.Id
+		member.CreatedAt = existing.CreatedAt
+		return nil
+	}
+
+	s.lastMemberId++
+	member.Id = s.lastMemberId
+	member.CreatedAt = now
+	member.UpdatedAt = now
+
+	stored := *member
+	stored.Workspace = Workspaces{}
+	stored.User = Users{}
+	s.members = append(s.members, &stored)
+
+	return nil
+}
+
+func (s *memoryLinkStore) DeleteWorkspaceMember(ctx context.Context, workspaceId uint, userId uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, member := s.findWorkspaceMember(workspaceId, userId)
+	if member == nil {
+		return ErrNotFound
+	}
+
+	s.members = append(s.members[:i], s.members[i+1:]...)
+
+	return nil
+}
+
+func (s *memoryLinkStore) InsertLinkRevisions(ctx context.Context, revisions []LinkRevisions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.appendRevisions(revisions)
+
+	return nil
+}
+
+// appendRevisions stores revisions and sets their ids, s.mu must be held.
+func (s *memoryLinkStore) appendRevisions(revisions []LinkRevisions) {
+	for i := range revisions {
+		revisions[i].Id = uint(len(s.revisions) + 1)
+		if revisions[i].CreatedAt.IsZero() {
+			revisions[i].CreatedAt = time.Now()
+		}
+		s.revisions = append(s.revisions, revisions[i])
+	}
+}
+
+func (s *memoryLinkStore) ListLinkRevisions(ctx context.Context, shortCode string) ([]LinkRevisions, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	revisions := []LinkRevisions{}
+	for i := len(s.revisions) - 1; i >= 0; i-- {
+		if s.revisions[i].ShortCode == shortCode {
+			revisions = append(revisions, s.revisions[i])
+		}
+	}
+
+	return revisions, nil
+}
+
+func (s *memoryLinkStore) GetLinkRevision(ctx context.Context, shortCode string, revisionId uint) (*LinkRevisions, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, revision := range s.revisions {
+		if revision.Id == revisionId && revision.ShortCode == shortCode {
+			found := revision
+			return &found, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (s *memoryLinkStore) CreateJob(ctx context.Context, job *Jobs) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.jobs {
+		if existing.Id == job.Id {
+			return fmt.Errorf("job %q already exists", job.Id)
+		}
+	}
+
+	now := time.Now()
+	if job.CreatedAt.IsZero() {
+		job.CreatedAt = now
+	}
+	job.UpdatedAt = now
+
+	stored := *job
+	s.jobs = append(s.jobs, &stored)
+
+	return nil
+}
+
+func (s *memoryLinkStore) findJob(jobId string) *Jobs {
+	for _, job := range s.jobs {
+		if job.Id == jobId {
+			return job
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryLinkStore) GetJob(ctx context.Context, jobId string) (*Jobs, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	job := s.findJob(jobId)
+	if job == nil {
+		return nil, ErrNotFound
+	}
+
+	found := *job
+	return &found, nil
+}
+
+func (s *memoryLinkStore) ClaimJob(ctx context.Context, leaseExpiresAt time.Time) (*Jobs, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Jobs are kept in creation order, the first queued one is the oldest.
+	for _, job := range s.jobs {
+		if job.Status != jobStatusQueued {
+			continue
+		}
+
+		now := time.Now()
+		job.Status = jobStatusRunning
+		job.StartedAt = &now
+		job.LeaseExpiresAt = &leaseExpiresAt
+		job.UpdatedAt = now
+
+		claimed := *job
+		return &claimed, nil
+	}
+
+	return nil, ErrNotFound
+}
+
+func (s *memoryLinkStore) RenewJobLease(ctx context.Context, jobId string, leaseExpiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if job := s.findJob(jobId); job != nil && job.Status == jobStatusRunning {
+		job.LeaseExpiresAt = &leaseExpiresAt
+	}
+
+	return nil
+}
+
+func (s *memoryLinkStore) UpdateJobProgress(ctx context.Context, jobId string, processedRows int, failedRows int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job := s.findJob(jobId)
+	if job == nil {
+		return nil
+	}
+
+	job.ProcessedRows = processedRows
+	job.FailedRows = failedRows
+	job.UpdatedAt = time.Now()
+
+	return nil
+}
+
+func (s *memoryLinkStore) FinishJob(ctx context.Context, job *Jobs) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job.Input = ""
+
+	stored := s.findJob(job.Id)
+	if stored == nil {
+		return nil
+	}
+
+	stored.Status = job.Status
+	stored.ProcessedRows = job.ProcessedRows
+	stored.FailedRows = job.FailedRows
+	stored.Input = ""
+	stored.Result = job.Result
+	stored.Error = job.Error
+	stored.FinishedAt = job.FinishedAt
+	stored.UpdatedAt = time.Now()
+
+	return nil
+}
+
+func (s *memoryLinkStore) RequeueJob(ctx context.Context, job *Jobs) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job.Status = jobStatusQueued
+	job.LeaseExpiresAt = nil
+
+	stored := s.findJob(job.Id)
+	if stored == nil || stored.Status != jobStatusRunning {
+		return nil
+	}
+
+	stored.Status = jobStatusQueued
+	stored.ProcessedRows = job.ProcessedRows
+	stored.FailedRows = job.FailedRows
+	stored.Result = job.Result
+	stored.LeaseExpiresAt = nil
+	stored.UpdatedAt = time.Now()
+
+	return nil
+}
+
+func (s *memoryLinkStore) FailExpiredJobs(ctx context.Context, now time.Time, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, job := range s.jobs {
+		if job.Status != jobStatusRunning || (job.LeaseExpiresAt != nil && !job.LeaseExpiresAt.Before(now)) {
+			continue
+		}
+
+		job.Status = jobStatusFailed
+		job.Input = ""
+		job.Error = message
+		job.FinishedAt = &now
+		job.UpdatedAt = now
+	}
+
+	return nil
+}
+
+func (s *memoryLinkStore) InsertRequestLogs(ctx context.Context, logRequests []LogRequests) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.logs = append(s.logs, logRequests...)
+
+	return nil
+}
+
+func (s *memoryLinkStore) RecordClicks(ctx context.Context, clicks []Clicks) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clicks = append(s.clicks, clicks...)
+
+	ownerIds := make(map[string]uint)
+	for _, shortCode := range clickedShortCodes(clicks) {
+		if urlShortener, exists := s.urls[shortCode]; exists && urlShortener.UserId != nil {
+			ownerIds[shortCode] = *urlShortener.UserId
+		}
+	}
+	s.addUsages(redirectUsages(clicks, ownerIds))
+
+	for shortCode, summary := range summarizeClicks(clicks) {
+		urlShortener, exists := s.urls[shortCode]
+		if !exists {
+			continue
+		}
+
+		urlShortener.Views += summary.count
+		lastViewed := summary.lastViewed
+		urlShortener.LastViewed = &lastViewed
+	}
+
+	return nil
+}
+
+func (s *memoryLinkStore) AddUsages(ctx context.Context, usages []Usages) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.addUsages(usages)
+
+	return nil
+}
+
+// addUsages expects the caller to hold the lock.
+func (s *memoryLinkStore) addUsages(usages []Usages) {
+	for _, usage := range usages {
+		key := fmt.Sprintf("%d/%s", usage.UserId, usage.Month)
+		stored, exists := s.usages[key]
+		if !exists {
+			stored = &Usages{UserId: usage.UserId, Month: usage.Month}
+			s.usages[key] = stored
+		}
+
+		stored.LinksCreated += usage.LinksCreated
+		stored.Redirects += usage.Redirects
+		stored.BulkJobs += usage.BulkJobs
+		stored.UpdatedAt = time.Now()
+	}
+}
+
+func (s *memoryLinkStore) ReserveUsage(ctx context.Context, userId uint, month string, counter string, n int64, limit int64) (int64, error) {
+	if counter != usageLinksCreated && counter != usageBulkJobs {
+		return 0, fmt.Errorf("unknown usage counter %q", counter)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reserved := n
+	if limit != 0 {
+		used := int64(0)
+		if usage, exists := s.usages[fmt.Sprintf("%d/%s", userId, month)]; exists {
+			used = usageCounter(usage, counter)
+		}
+		reserved = max(min(n, limit-used), 0)
+	}
+
+	s.addUsages([]Usages{counterUsage(userId, month, counter, reserved)})
+
+	return reserved, nil
+}
+
+func (s *memoryLinkStore) GetUsage(ctx context.Context, userId uint, month string) (*Usages, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if usage, exists := s.usages[fmt.Sprintf("%d/%s", userId, month)]; exists {
+		usageCopy := *usage
+		return &usageCopy, nil
+	}
+
+	return &Usages{UserId: userId, Month: month}, nil
+}
+
+func (s *memoryLinkStore) ListIpRules(ctx context.Context) ([]IpRules, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]IpRules{}, s.ipRules...), nil
+}
+
+func (s *memoryLinkStore) CreateIpRule(ctx context.Context, rule *IpRules) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastIpRuleId++
+	rule.Id = s.lastIpRuleId
+	if rule.CreatedAt.IsZero() {
+		rule.CreatedAt = time.Now()
+	}
+	s.ipRules = append(s.ipRules, *rule)
+
+	return nil
+}
+
+func (s *memoryLinkStore) DeleteIpRule(ctx context.Context, ruleId uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, rule := range s.ipRules {
+		if rule.Id == ruleId {
+			s.ipRules = append(s.ipRules[:i], s.ipRules[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (s *memoryLinkStore) InsertBlockedAttempts(ctx context.Context, blockedAttempts []BlockedAttempts) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.blocked = append(s.blocked, blockedAttempts...)
+
+	return nil
+}
+
+func matchesUrlFilter(urlShortener *UrlShortener, filter UrlFilter, now time.Time) bool {
+	switch filter.Status {
+	case linkStatusActive, linkStatusDeleted, linkStatusExpired:
+		if linkStatus(urlShortener, now) != filter.Status {
+			return false
+		}
+	case urlFilterPasswordProtected:
+		if urlShortener.Password == nil {
+			return false
+		}
+	}
+	if filter.Search != "" {
+		search := strings.ToLower(filter.Search)
+		if !strings.Contains(strings.ToLower(urlShortener.OriginalUrl), search) && !strings.Contains(strings.ToLower(urlShortener.ShortCode), search) {
+			return false
+		}
+	}
+	if filter.CreatedFrom != nil && urlShortener.CreatedAt.Before(*filter.CreatedFrom) {
+		return false
+	}
+	if filter.CreatedTo != nil && urlShortener.CreatedAt.After(*filter.CreatedTo) {
+		return false
+	}
+
+	return true
+}
+
+func isActiveUrl(urlShortener *UrlShortener, now time.Time) bool {
+	if urlShortener.DeletedAt != nil {
+		return false
+	}
+
+	return urlShortener.ExpiresAt == nil || urlShortener.ExpiresAt.After(now)
+}
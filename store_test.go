@@ -0,0 +1,945 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestMemoryLinkStore(t *testing.T) {
+	runLinkStoreConformance(t, func(t *testing.T) LinkStore {
+		return newMemoryLinkStore()
+	})
+}
+
+func TestSqliteLinkStore(t *testing.T) {
+	runLinkStoreConformance(t, func(t *testing.T) LinkStore {
+		store, err := NewLinkStore("sqlite", filepath.Join(t.TempDir(), "conformance.sqlite"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+// TestPostgresLinkStore only runs when VYSON_TEST_POSTGRES_DSN points at a
+// scratch database, the suite creates rows with random keys but never drops
+// the tables.
+func TestPostgresLinkStore(t *testing.T) {
+	dsn := os.Getenv("VYSON_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("VYSON_TEST_POSTGRES_DSN is not set")
+	}
+
+	runLinkStoreConformance(t, func(t *testing.T) LinkStore {
+		store, err := NewLinkStore("postgres", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+// runLinkStoreConformance is the behaviour every LinkStore backend must agree
+// on. newStore is called once per subtest.
+func runLinkStoreConformance(t *testing.T, newStore func(t *testing.T) LinkStore) {
+	ctx := context.Background()
+
+	t.Run("Ping", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		if err := store.Ping(ctx); err != nil {
+			t.Errorf("Ping returned error: %v", err)
+		}
+	})
+
+	t.Run("InsertAndGet", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		shortCode := uuid.NewString()[:8]
+		err := store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com", ShortCode: shortCode})
+		if err != nil {
+			t.Fatalf("InsertUrl returned error: %v", err)
+		}
+
+		urlModel, err := store.GetActiveUrl(ctx, shortCode)
+		if err != nil {
+			t.Fatalf("GetActiveUrl returned error: %v", err)
+		}
+		if urlModel.OriginalUrl != "http://example.com" {
+			t.Errorf("got original url %v want %v", urlModel.OriginalUrl, "http://example.com")
+		}
+		if urlModel.CreatedAt.IsZero() {
+			t.Error("CreatedAt was not set on insert")
+		}
+
+		exists, err := store.ShortCodeExists(ctx, shortCode)
+		if err != nil || !exists {
+			t.Errorf("ShortCodeExists got %v, %v want true, nil", exists, err)
+		}
+	})
+
+	t.Run("DuplicateShortCode", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		shortCode := uuid.NewString()[:8]
+		store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com", ShortCode: shortCode})
+
+		err := store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.org", ShortCode: shortCode})
+		if !errors.Is(err, ErrConflict) {
+			t.Errorf("got error %v want %v", err, ErrConflict)
+		}
+
+		err = store.InsertUrls(ctx, []*UrlShortener{
+			{OriginalUrl: "http://example.org", ShortCode: uuid.NewString()[:8]},
+			{OriginalUrl: "http://example.org", ShortCode: shortCode},
+		}, nil)
+		if !errors.Is(err, ErrConflict) {
+			t.Errorf("InsertUrls got error %v want %v", err, ErrConflict)
+		}
+	})
+
+	t.Run("MissingShortCode", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		_, err := store.GetActiveUrl(ctx, "missing-"+uuid.NewString()[:8])
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("got error %v want %v", err, ErrNotFound)
+		}
+
+		exists, err := store.ShortCodeExists(ctx, "missing-"+uuid.NewString()[:8])
+		if err != nil || exists {
+			t.Errorf("ShortCodeExists got %v, %v want false, nil", exists, err)
+		}
+	})
+
+	t.Run("DeleteAndActivate", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		shortCode := uuid.NewString()[:8]
+		store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com", ShortCode: shortCode})
+
+		if err := store.DeleteUrl(ctx, shortCode); err != nil {
+			t.Fatalf("DeleteUrl returned error: %v", err)
+		}
+		if _, err := store.GetActiveUrl(ctx, shortCode); !errors.Is(err, ErrNotFound) {
+			t.Errorf("deleted url: got error %v want %v", err, ErrNotFound)
+		}
+		if exists, _ := store.ShortCodeExists(ctx, shortCode); exists {
+			t.Error("deleted short code should not exist")
+		}
+
+		if err := store.ActivateUrl(ctx, shortCode); err != nil {
+			t.Fatalf("ActivateUrl returned error: %v", err)
+		}
+		if _, err := store.GetActiveUrl(ctx, shortCode); err != nil {
+			t.Errorf("activated url: got error %v want nil", err)
+		}
+	})
+
+	t.Run("RedirectType", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		shortCode := uuid.NewString()[:8]
+		store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com", ShortCode: shortCode})
+
+		urlModel, _ := store.GetActiveUrl(ctx, shortCode)
+		if urlModel.RedirectType != http.StatusTemporaryRedirect {
+			t.Errorf("got default redirect type %v want %v", urlModel.RedirectType, http.StatusTemporaryRedirect)
+		}
+
+		urlModel.RedirectType = http.StatusMovedPermanently
+		if err := store.EditUrl(ctx, shortCode, urlModel, nil); err != nil {
+			t.Fatalf("EditUrl returned error: %v", err)
+		}
+
+		urlModel, _ = store.GetActiveUrl(ctx, shortCode)
+		if urlModel.RedirectType != http.StatusMovedPermanently {
+			t.Errorf("got redirect type %v want %v", urlModel.RedirectType, http.StatusMovedPermanently)
+		}
+	})
+
+	t.Run("EditUrl", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		shortCode := uuid.NewString()[:8]
+		deletedCode := uuid.NewString()[:8]
+		renamedCode := uuid.NewString()[:8]
+		store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com", ShortCode: shortCode})
+		store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com/deleted", ShortCode: deletedCode})
+		store.DeleteUrl(ctx, deletedCode)
+
+		urlModel, _ := store.GetUrl(ctx, shortCode)
+		urlModel.OriginalUrl = "http://example.com/edited"
+		urlModel.ShortCode = deletedCode
+		if err := store.EditUrl(ctx, shortCode, urlModel, nil); !errors.Is(err, ErrConflict) {
+			t.Errorf("rename to a deleted code: got error %v want %v", err, ErrConflict)
+		}
+		if found, err := store.GetUrl(ctx, shortCode); err != nil || found.OriginalUrl != "http://example.com" {
+			t.Errorf("GetUrl after a failed edit got %+v, %v want the link unchanged", found, err)
+		}
+
+		urlModel.ShortCode = renamedCode
+		urlModel.DeletedAt = addressOf(time.Now())
+		if err := store.EditUrl(ctx, shortCode, urlModel, nil); err != nil {
+			t.Fatalf("EditUrl returned error: %v", err)
+		}
+
+		found, err := store.GetUrl(ctx, renamedCode)
+		if err != nil || found.OriginalUrl != "http://example.com/edited" || found.DeletedAt == nil {
+			t.Errorf("GetUrl got %+v, %v want the edited and deleted link", found, err)
+		}
+		if _, err := store.GetUrl(ctx, shortCode); !errors.Is(err, ErrNotFound) {
+			t.Errorf("old short code: got error %v want %v", err, ErrNotFound)
+		}
+
+		if err := store.EditUrl(ctx, uuid.NewString()[:8], urlModel, nil); !errors.Is(err, ErrNotFound) {
+			t.Errorf("unknown short code: got error %v want %v", err, ErrNotFound)
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		shortCode := uuid.NewString()[:8]
+		expiresAt := time.Now().Add(-time.Minute)
+		store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com", ShortCode: shortCode, ExpiresAt: &expiresAt})
+
+		if _, err := store.GetActiveUrl(ctx, shortCode); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expired url: got error %v want %v", err, ErrNotFound)
+		}
+		if exists, _ := store.ShortCodeExists(ctx, shortCode); exists {
+			t.Error("expired short code should not exist")
+		}
+	})
+
+	t.Run("TakenShortCodes", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		active := uuid.NewString()[:8]
+		deleted := uuid.NewString()[:8]
+		expired := uuid.NewString()[:8]
+		missing := "missing-" + uuid.NewString()[:8]
+		store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com", ShortCode: active})
+		store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com", ShortCode: deleted})
+		store.DeleteUrl(ctx, deleted)
+		store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com", ShortCode: expired, ExpiresAt: addressOf(time.Now().Add(-time.Minute))})
+
+		taken, err := store.TakenShortCodes(ctx, []string{active, deleted, expired, missing})
+		if err != nil {
+			t.Fatalf("TakenShortCodes returned error: %v", err)
+		}
+		if !taken[active] || !taken[deleted] || !taken[expired] || taken[missing] {
+			t.Errorf("got %v want every code but %s", taken, missing)
+		}
+	})
+
+	t.Run("UsersAndPagination", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		user := &Users{Email: uuid.NewString() + "@example.com", ApiKey: uuid.NewString()}
+		if err := store.CreateUser(ctx, user); err != nil {
+			t.Fatalf("CreateUser returned error: %v", err)
+		}
+		if user.Id == 0 {
+			t.Fatal("CreateUser did not assign an id")
+		}
+
+		found, err := store.GetUserByApiKey(ctx, user.ApiKey)
+		if err != nil {
+			t.Fatalf("GetUserByApiKey returned error: %v", err)
+		}
+		if found.Id != user.Id || found.Email != user.Email {
+			t.Errorf("got user %v/%v want %v/%v", found.Id, found.Email, user.Id, user.Email)
+		}
+		if found.Tier != "hobby" {
+			t.Errorf("got default tier %v want hobby", found.Tier)
+		}
+
+		if _, err := store.GetUserByApiKey(ctx, uuid.NewString()); !errors.Is(err, ErrNotFound) {
+			t.Errorf("unknown api key: got error %v want %v", err, ErrNotFound)
+		}
+
+		duplicate := &Users{Email: user.Email, ApiKey: uuid.NewString()}
+		if err := store.CreateUser(ctx, duplicate); !errors.Is(err, ErrConflict) {
+			t.Errorf("duplicate email: got error %v want %v", err, ErrConflict)
+		}
+
+		for i := 0; i < 3; i++ {
+			store.InsertUrl(ctx, &UrlShortener{
+				OriginalUrl: "http://example.com",
+				ShortCode:   uuid.NewString()[:8],
+				UserId:      &user.Id,
+			})
+		}
+
+		totalCount, err := store.CountUrlsByUserId(ctx, user.Id, UrlFilter{})
+		if err != nil || totalCount != 3 {
+			t.Errorf("CountUrlsByUserId got %v, %v want 3, nil", totalCount, err)
+		}
+
+		firstPage, _ := store.GetUrlsByUserId(ctx, user.Id, UrlFilter{}, UrlSort{}, 1, 2)
+		secondPage, _ := store.GetUrlsByUserId(ctx, user.Id, UrlFilter{}, UrlSort{}, 2, 2)
+		if len(firstPage) != 2 || len(secondPage) != 1 {
+			t.Errorf("got page sizes %d and %d want 2 and 1", len(firstPage), len(secondPage))
+		}
+	})
+
+	t.Run("RotateApiKey", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		oldApiKey := uuid.NewString()
+		user := &Users{Email: uuid.NewString() + "@example.com", ApiKey: oldApiKey}
+		store.CreateUser(ctx, user)
+
+		newApiKey := uuid.NewString()
+		if err := store.RotateApiKey(ctx, user.Id, newApiKey, time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("RotateApiKey returned error: %v", err)
+		}
+
+		for _, apiKey := range []string{oldApiKey, newApiKey} {
+			found, err := store.GetUserByApiKey(ctx, apiKey)
+			if err != nil || found.Id != user.Id {
+				t.Errorf("GetUserByApiKey during the grace period got %v, %v want user %v", found, err, user.Id)
+			}
+		}
+
+		found, _ := store.GetUserByApiKey(ctx, newApiKey)
+		if found.ApiKeyPrefix != apiKeyPrefix(newApiKey) || found.PreviousApiKeyPrefix == nil || *found.PreviousApiKeyPrefix != apiKeyPrefix(oldApiKey) {
+			t.Errorf("got prefixes %v/%v want %v/%v", found.ApiKeyPrefix, found.PreviousApiKeyPrefix, apiKeyPrefix(newApiKey), apiKeyPrefix(oldApiKey))
+		}
+
+		// A second rotation with no grace period drops the previous key.
+		latestApiKey := uuid.NewString()
+		store.RotateApiKey(ctx, user.Id, latestApiKey, time.Now())
+		if _, err := store.GetUserByApiKey(ctx, newApiKey); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expired previous key: got error %v want %v", err, ErrNotFound)
+		}
+
+		store.RotateApiKey(ctx, user.Id, uuid.NewString(), time.Now().Add(time.Hour))
+		if err := store.RevokePreviousApiKey(ctx, user.Id); err != nil {
+			t.Fatalf("RevokePreviousApiKey returned error: %v", err)
+		}
+		if _, err := store.GetUserByApiKey(ctx, latestApiKey); !errors.Is(err, ErrNotFound) {
+			t.Errorf("revoked previous key: got error %v want %v", err, ErrNotFound)
+		}
+
+		if err := store.RotateApiKey(ctx, 0, uuid.NewString(), time.Now()); !errors.Is(err, ErrNotFound) {
+			t.Errorf("unknown user: got error %v want %v", err, ErrNotFound)
+		}
+	})
+
+	t.Run("NamedApiKeys", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		user := &Users{Email: uuid.NewString() + "@example.com", ApiKey: uuid.NewString()}
+		store.CreateUser(ctx, user)
+
+		readKey, _ := newApiKey()
+		if err := store.CreateApiKey(ctx, &ApiKeys{UserId: user.Id, Name: "ci", Key: readKey, Scopes: "links:read stats:read"}); err != nil {
+			t.Fatalf("CreateApiKey returned error: %v", err)
+		}
+
+		expiredKey, _ := newApiKey()
+		store.CreateApiKey(ctx, &ApiKeys{UserId: user.Id, Name: "old", Key: expiredKey, Scopes: "links:read", ExpiresAt: addressOf(time.Now().Add(-time.Minute))})
+
+		found, err := store.GetUserByApiKey(ctx, readKey)
+		if err != nil || found.Id != user.Id {
+			t.Fatalf("GetUserByApiKey with a named key got %v, %v want user %v", found, err, user.Id)
+		}
+		if found.ApiKeyId == nil || !found.hasScope(scopeLinksRead) || found.hasScope(scopeLinksWrite) {
+			t.Errorf("got key %v with scopes %v want links:read and stats:read", found.ApiKeyId, found.Scopes)
+		}
+
+		if _, err := store.GetUserByApiKey(ctx, expiredKey); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expired named key: got error %v want %v", err, ErrNotFound)
+		}
+
+		keys, err := store.ListApiKeys(ctx, user.Id)
+		if err != nil || len(keys) != 2 {
+			t.Fatalf("ListApiKeys got %d keys, %v want 2", len(keys), err)
+		}
+		if keys[0].Name != "ci" || keys[0].Prefix != apiKeyPrefix(readKey) || keys[0].LastUsedAt == nil {
+			t.Errorf("got key %+v want ci with prefix %v and a last used time", keys[0], apiKeyPrefix(readKey))
+		}
+
+		if err := store.DeleteApiKey(ctx, user.Id+1, keys[0].Id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("deleting another user's key: got error %v want %v", err, ErrNotFound)
+		}
+		if err := store.DeleteApiKey(ctx, user.Id, keys[0].Id); err != nil {
+			t.Fatalf("DeleteApiKey returned error: %v", err)
+		}
+		if _, err := store.GetUserByApiKey(ctx, readKey); !errors.Is(err, ErrNotFound) {
+			t.Errorf("deleted named key: got error %v want %v", err, ErrNotFound)
+		}
+	})
+
+	t.Run("Workspaces", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		owner := &Users{Email: uuid.NewString() + "@example.com", ApiKey: uuid.NewString()}
+		editor := &Users{Email: uuid.NewString() + "@example.com", ApiKey: uuid.NewString()}
+		store.CreateUser(ctx, owner)
+		store.CreateUser(ctx, editor)
+
+		workspace := &Workspaces{Name: "Team"}
+		if err := store.CreateWorkspace(ctx, workspace, owner.Id); err != nil {
+			t.Fatalf("CreateWorkspace returned error: %v", err)
+		}
+
+		member, err := store.GetWorkspaceMember(ctx, workspace.Id, owner.Id)
+		if err != nil || member.Role != workspaceRoleOwner || member.Workspace.Name != "Team" {
+			t.Fatalf("GetWorkspaceMember got %+v, %v want the owner of Team", member, err)
+		}
+
+		if _, err := store.GetWorkspaceMember(ctx, workspace.Id, editor.Id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("non-member: got error %v want %v", err, ErrNotFound)
+		}
+
+		store.SaveWorkspaceMember(ctx, &WorkspaceMembers{WorkspaceId: workspace.Id, UserId: editor.Id, Role: workspaceRoleViewer})
+		if err := store.SaveWorkspaceMember(ctx, &WorkspaceMembers{WorkspaceId: workspace.Id, UserId: editor.Id, Role: workspaceRoleEditor}); err != nil {
+			t.Fatalf("SaveWorkspaceMember returned error: %v", err)
+		}
+
+		members, err := store.ListWorkspaceMembers(ctx, workspace.Id)
+		if err != nil || len(members) != 2 || members[1].Role != workspaceRoleEditor || members[1].User.Email != editor.Email {
+			t.Fatalf("ListWorkspaceMembers got %+v, %v want the owner and the editor", members, err)
+		}
+
+		memberships, err := store.ListWorkspacesByUserId(ctx, editor.Id)
+		if err != nil || len(memberships) != 1 || memberships[0].Workspace.Name != "Team" {
+			t.Errorf("ListWorkspacesByUserId got %+v, %v want Team", memberships, err)
+		}
+
+		shortCode := uuid.NewString()[:8]
+		store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com", ShortCode: shortCode, UserId: &editor.Id, WorkspaceId: &workspace.Id})
+
+		urls, _ := store.GetUrlsByWorkspaceId(ctx, workspace.Id, UrlFilter{}, UrlSort{}, 1, 10)
+		if count, _ := store.CountUrlsByWorkspaceId(ctx, workspace.Id, UrlFilter{}); len(urls) != 1 || count != 1 || urls[0].ShortCode != shortCode {
+			t.Errorf("got %d urls and a count of %d want %s", len(urls), count, shortCode)
+		}
+
+		personalCode := uuid.NewString()[:8]
+		store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com", ShortCode: personalCode, UserId: &editor.Id})
+		if count, _ := store.CountUrlsByUserId(ctx, editor.Id, UrlFilter{}); count != 2 {
+			t.Errorf("member: got a count of %d own urls want 2", count)
+		}
+
+		if err := store.DeleteWorkspaceMember(ctx, workspace.Id, editor.Id); err != nil {
+			t.Fatalf("DeleteWorkspaceMember returned error: %v", err)
+		}
+		if err := store.DeleteWorkspaceMember(ctx, workspace.Id, editor.Id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("deleting a removed member: got error %v want %v", err, ErrNotFound)
+		}
+
+		// The links a removed member created in the workspace stay with it.
+		urls, _ = store.GetUrlsByUserId(ctx, editor.Id, UrlFilter{}, UrlSort{}, 1, 10)
+		count, _ := store.CountUrlsByUserId(ctx, editor.Id, UrlFilter{})
+		exported := 0
+		store.EachUrlByUserId(ctx, editor.Id, UrlFilter{}, func(UrlShortener) error {
+			exported++
+			return nil
+		})
+		if len(urls) != 1 || count != 1 || exported != 1 || urls[0].ShortCode != personalCode {
+			t.Errorf("removed member: got %d urls, a count of %d and %d exported want only %s", len(urls), count, exported, personalCode)
+		}
+
+		found, err := store.GetUserByEmail(ctx, owner.Email)
+		if err != nil || found.Id != owner.Id {
+			t.Errorf("GetUserByEmail got %v, %v want user %v", found, err, owner.Id)
+		}
+	})
+
+	t.Run("LinkRevisions", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		shortCode := uuid.NewString()[:8]
+		renamedCode := uuid.NewString()[:8]
+		store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com", ShortCode: shortCode})
+
+		err := store.InsertLinkRevisions(ctx, []LinkRevisions{
+			{ShortCode: shortCode, Action: revisionCreate, NewValues: `{"original_url": "http://example.com"}`, CreatedAt: time.Now()},
+			{ShortCode: shortCode, Action: revisionDeactivate, OldValues: "{}", NewValues: "{}", CreatedAt: time.Now()},
+		})
+		if err != nil {
+			t.Fatalf("InsertLinkRevisions returned error: %v", err)
+		}
+
+		urlModel, _ := store.GetUrl(ctx, shortCode)
+		before := *urlModel
+		urlModel.ShortCode = renamedCode
+		edit := newLinkRevision(nil, revisionEdit, &before, urlModel)
+		if err := store.EditUrl(ctx, shortCode, urlModel, &edit); err != nil {
+			t.Fatalf("EditUrl returned error: %v", err)
+		}
+
+		revisions, err := store.ListLinkRevisions(ctx, renamedCode)
+		if err != nil || len(revisions) != 3 || revisions[0].Action != revisionEdit || revisions[1].Action != revisionDeactivate {
+			t.Fatalf("ListLinkRevisions got %+v, %v want the edit and the deactivation first", revisions, err)
+		}
+
+		revision, err := store.GetLinkRevision(ctx, renamedCode, revisions[2].Id)
+		if err != nil || revision.Action != revisionCreate {
+			t.Errorf("GetLinkRevision got %+v, %v want the create revision", revision, err)
+		}
+
+		if _, err := store.GetLinkRevision(ctx, shortCode, revisions[2].Id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("revision of the old short code: got error %v want %v", err, ErrNotFound)
+		}
+
+		store.DeleteUrl(ctx, renamedCode)
+		if urlModel, err := store.GetUrl(ctx, renamedCode); err != nil || urlModel.DeletedAt == nil {
+			t.Errorf("GetUrl of a deleted link got %+v, %v want the deleted link", urlModel, err)
+		}
+	})
+
+	t.Run("EachUrlByUserId", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		// A batch of one link makes the gorm store continue after every link.
+		defer func(batchSize int) { eachUrlBatchSize = batchSize }(eachUrlBatchSize)
+		eachUrlBatchSize = 1
+
+		now := time.Now()
+		userId := uint(7)
+		otherUserId := uint(8)
+		urls := []*UrlShortener{
+			{OriginalUrl: "http://example.com/active", ShortCode: uuid.NewString()[:8], UserId: &userId, CreatedAt: now.Add(-3 * time.Hour)},
+			{OriginalUrl: "http://example.com/deleted", ShortCode: uuid.NewString()[:8], UserId: &userId, CreatedAt: now.Add(-2 * time.Hour)},
+			{OriginalUrl: "http://example.com/expired", ShortCode: uuid.NewString()[:8], UserId: &userId, CreatedAt: now.Add(-time.Hour), ExpiresAt: addressOf(now.Add(-time.Minute)), Password: addressOf("hash")},
+			{OriginalUrl: "http://example.com/other", ShortCode: uuid.NewString()[:8], UserId: &otherUserId, CreatedAt: now},
+		}
+		for _, urlShortener := range urls {
+			if err := store.InsertUrl(ctx, urlShortener); err != nil {
+				t.Fatalf("InsertUrl returned error: %v", err)
+			}
+		}
+		store.DeleteUrl(ctx, urls[1].ShortCode)
+
+		collect := func(filter UrlFilter) []string {
+			shortCodes := []string{}
+			err := store.EachUrlByUserId(ctx, userId, filter, func(urlShortener UrlShortener) error {
+				shortCodes = append(shortCodes, urlShortener.ShortCode)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("EachUrlByUserId returned error: %v", err)
+			}
+			return shortCodes
+		}
+
+		tests := []struct {
+			name   string
+			filter UrlFilter
+			want   []*UrlShortener
+		}{
+			{"every link", UrlFilter{}, urls[:3]},
+			{"active", UrlFilter{Status: linkStatusActive}, urls[:1]},
+			{"deleted", UrlFilter{Status: linkStatusDeleted}, urls[1:2]},
+			{"expired", UrlFilter{Status: linkStatusExpired}, urls[2:3]},
+			{"password protected", UrlFilter{Status: urlFilterPasswordProtected}, urls[2:3]},
+			{"search", UrlFilter{Search: "EXPIRED"}, urls[2:3]},
+			{"search by short code", UrlFilter{Search: urls[1].ShortCode[2:6]}, urls[1:2]},
+			{"search wildcards", UrlFilter{Search: "%"}, nil},
+			{"created from", UrlFilter{CreatedFrom: addressOf(now.Add(-150 * time.Minute))}, urls[1:3]},
+			{"created to", UrlFilter{CreatedTo: addressOf(now.Add(-90 * time.Minute))}, urls[:2]},
+		}
+		for _, tt := range tests {
+			got := collect(tt.filter)
+			want := []string{}
+			for _, urlShortener := range tt.want {
+				want = append(want, urlShortener.ShortCode)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("%s: got %v want %v", tt.name, got, want)
+			}
+		}
+
+		stop := errors.New("stop")
+		calls := 0
+		err := store.EachUrlByUserId(ctx, userId, UrlFilter{}, func(urlShortener UrlShortener) error {
+			calls++
+			return stop
+		})
+		if !errors.Is(err, stop) || calls != 1 {
+			t.Errorf("got %v after %d calls want the error of fn after 1 call", err, calls)
+		}
+	})
+
+	t.Run("GetUrlsByUserIdSorted", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		now := time.Now()
+		userId := uint(9)
+		urls := []*UrlShortener{
+			{OriginalUrl: "http://example.com/a", ShortCode: "sort" + uuid.NewString()[:4], UserId: &userId, CreatedAt: now.Add(-3 * time.Hour), Views: 5, LastViewed: addressOf(now.Add(-time.Hour))},
+			{OriginalUrl: "http://example.com/b", ShortCode: "sort" + uuid.NewString()[:4], UserId: &userId, CreatedAt: now.Add(-2 * time.Hour), Views: 9},
+			{OriginalUrl: "http://example.com/c", ShortCode: "sort" + uuid.NewString()[:4], UserId: &userId, CreatedAt: now.Add(-time.Hour), Views: 1, LastViewed: addressOf(now.Add(-time.Minute))},
+		}
+		for _, urlShortener := range urls {
+			if err := store.InsertUrl(ctx, urlShortener); err != nil {
+				t.Fatalf("InsertUrl returned error: %v", err)
+			}
+		}
+
+		tests := []struct {
+			sort UrlSort
+			want []int
+		}{
+			{UrlSort{}, []int{0, 1, 2}},
+			{UrlSort{Field: urlSortCreatedAt, Descending: true}, []int{2, 1, 0}},
+			{UrlSort{Field: urlSortViews}, []int{2, 0, 1}},
+			{UrlSort{Field: urlSortViews, Descending: true}, []int{1, 0, 2}},
+			{UrlSort{Field: urlSortLastViewed}, []int{0, 2, 1}},
+			{UrlSort{Field: urlSortLastViewed, Descending: true}, []int{2, 0, 1}},
+		}
+		for _, tt := range tests {
+			got, err := store.GetUrlsByUserId(ctx, userId, UrlFilter{}, tt.sort, 1, 10)
+			if err != nil || len(got) != len(tt.want) {
+				t.Fatalf("%+v: got %d urls, %v want %d", tt.sort, len(got), err, len(tt.want))
+			}
+			for i, index := range tt.want {
+				if got[i].ShortCode != urls[index].ShortCode {
+					t.Errorf("%+v: got %s at %d want %s", tt.sort, got[i].ShortCode, i, urls[index].ShortCode)
+				}
+			}
+		}
+
+		after := &UrlCursor{CreatedAt: urls[1].CreatedAt, ShortCode: urls[1].ShortCode}
+		if got, _ := store.GetUrlsByUserId(ctx, userId, UrlFilter{}, UrlSort{After: after}, 1, 10); len(got) != 1 || got[0].ShortCode != urls[2].ShortCode {
+			t.Errorf("got %v after the second link want the third", got)
+		}
+		if got, _ := store.GetUrlsByUserId(ctx, userId, UrlFilter{}, UrlSort{Descending: true, After: after}, 1, 10); len(got) != 1 || got[0].ShortCode != urls[0].ShortCode {
+			t.Errorf("got %v before the second link want the first", got)
+		}
+
+		page, _ := store.GetUrlsByUserId(ctx, userId, UrlFilter{}, UrlSort{Field: urlSortViews, Descending: true}, 2, 2)
+		count, _ := store.CountUrlsByUserId(ctx, userId, UrlFilter{Search: "example.com/"})
+		if len(page) != 1 || page[0].ShortCode != urls[2].ShortCode || count != 3 {
+			t.Errorf("got second page %v and a count of %d want %s and 3", page, count, urls[2].ShortCode)
+		}
+	})
+
+	t.Run("InsertUrls", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		expiresAt := time.Now().Add(time.Hour)
+		first := &UrlShortener{OriginalUrl: "http://example.com/1", ShortCode: uuid.NewString()[:8]}
+		second := &UrlShortener{OriginalUrl: "http://example.com/2", ShortCode: uuid.NewString()[:8], ExpiresAt: &expiresAt, Password: addressOf("hash")}
+		revisions := []LinkRevisions{newLinkRevision(nil, revisionCreate, nil, first), newLinkRevision(nil, revisionCreate, nil, second)}
+		if err := store.InsertUrls(ctx, []*UrlShortener{first, second}, revisions); err != nil {
+			t.Fatalf("InsertUrls returned error: %v", err)
+		}
+
+		found, err := store.GetActiveUrl(ctx, second.ShortCode)
+		if err != nil || found.Password == nil || found.ExpiresAt == nil || found.RedirectType != http.StatusTemporaryRedirect {
+			t.Errorf("GetActiveUrl got %+v, %v want the second link with its password and expiry", found, err)
+		}
+		if found, err := store.ListLinkRevisions(ctx, second.ShortCode); err != nil || len(found) != 1 {
+			t.Errorf("ListLinkRevisions got %+v, %v want the create revision", found, err)
+		}
+
+		// A taken short code fails the whole batch, revisions included.
+		third := &UrlShortener{OriginalUrl: "http://example.com/3", ShortCode: uuid.NewString()[:8]}
+		duplicate := &UrlShortener{OriginalUrl: "http://example.com/4", ShortCode: first.ShortCode}
+		revisions = []LinkRevisions{newLinkRevision(nil, revisionCreate, nil, third), newLinkRevision(nil, revisionCreate, nil, duplicate)}
+		if err := store.InsertUrls(ctx, []*UrlShortener{third, duplicate}, revisions); err == nil {
+			t.Error("InsertUrls with a taken short code returned no error")
+		}
+		if exists, _ := store.ShortCodeExists(ctx, third.ShortCode); exists {
+			t.Errorf("%s was inserted by a failed batch", third.ShortCode)
+		}
+		if found, _ := store.ListLinkRevisions(ctx, third.ShortCode); len(found) != 0 {
+			t.Errorf("got revisions %+v of a failed batch want none", found)
+		}
+	})
+
+	t.Run("Jobs", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		leaseExpiresAt := time.Now().Add(time.Minute)
+		if _, err := store.ClaimJob(ctx, leaseExpiresAt); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("ClaimJob without queued jobs got %v want ErrNotFound", err)
+		}
+
+		first := &Jobs{Id: uuid.NewString(), UserId: 1, Type: jobTypeBulkShorten, Status: jobStatusQueued, TotalRows: 2, Input: "input"}
+		second := &Jobs{Id: uuid.NewString(), UserId: 1, Type: jobTypeBulkShorten, Status: jobStatusQueued, TotalRows: 1, Input: "input", CreatedAt: time.Now().Add(time.Second)}
+		for _, job := range []*Jobs{first, second} {
+			if err := store.CreateJob(ctx, job); err != nil {
+				t.Fatalf("CreateJob returned error: %v", err)
+			}
+		}
+
+		claimed, err := store.ClaimJob(ctx, leaseExpiresAt)
+		if err != nil || claimed.Id != first.Id || claimed.Status != jobStatusRunning || claimed.StartedAt == nil || claimed.LeaseExpiresAt == nil || claimed.Input != "input" {
+			t.Fatalf("ClaimJob got %+v, %v want the oldest job running", claimed, err)
+		}
+
+		if err := store.UpdateJobProgress(ctx, first.Id, 1, 1); err != nil {
+			t.Fatalf("UpdateJobProgress returned error: %v", err)
+		}
+		if found, _ := store.GetJob(ctx, first.Id); found.ProcessedRows != 1 || found.FailedRows != 1 {
+			t.Errorf("got progress %d/%d want 1/1", found.ProcessedRows, found.FailedRows)
+		}
+
+		claimed.Status = jobStatusCompleted
+		claimed.ProcessedRows = 2
+		claimed.Result = "result"
+		claimed.FinishedAt = addressOf(time.Now())
+		if err := store.FinishJob(ctx, claimed); err != nil {
+			t.Fatalf("FinishJob returned error: %v", err)
+		}
+
+		found, err := store.GetJob(ctx, first.Id)
+		if err != nil || found.Status != jobStatusCompleted || found.Result != "result" || found.Input != "" || found.FinishedAt == nil {
+			t.Errorf("GetJob after FinishJob got %+v, %v want a completed job without input", found, err)
+		}
+
+		// A requeued job is claimed again with its progress and result.
+		claimed, err = store.ClaimJob(ctx, leaseExpiresAt)
+		if err != nil || claimed.Id != second.Id {
+			t.Fatalf("ClaimJob got %+v, %v want the second job", claimed, err)
+		}
+		claimed.ProcessedRows = 1
+		claimed.Result = "partial"
+		if err := store.RequeueJob(ctx, claimed); err != nil {
+			t.Fatalf("RequeueJob returned error: %v", err)
+		}
+		if found, _ := store.GetJob(ctx, second.Id); found.Status != jobStatusQueued || found.LeaseExpiresAt != nil || found.ProcessedRows != 1 || found.Result != "partial" || found.Input != "input" {
+			t.Errorf("GetJob after RequeueJob got %+v want a queued job with its progress", found)
+		}
+
+		// A running job is only failed once its lease expired.
+		claimed, err = store.ClaimJob(ctx, leaseExpiresAt)
+		if err != nil || claimed.Id != second.Id || claimed.Result != "partial" {
+			t.Fatalf("ClaimJob got %+v, %v want the requeued job with its result", claimed, err)
+		}
+		if err := store.FailExpiredJobs(ctx, time.Now(), "interrupted"); err != nil {
+			t.Fatalf("FailExpiredJobs returned error: %v", err)
+		}
+		if found, _ := store.GetJob(ctx, second.Id); found.Status != jobStatusRunning {
+			t.Errorf("got %s with an unexpired lease want running", found.Status)
+		}
+
+		if err := store.RenewJobLease(ctx, second.Id, leaseExpiresAt.Add(time.Minute)); err != nil {
+			t.Fatalf("RenewJobLease returned error: %v", err)
+		}
+		store.FailExpiredJobs(ctx, leaseExpiresAt.Add(time.Second), "interrupted")
+		if found, _ := store.GetJob(ctx, second.Id); found.Status != jobStatusRunning {
+			t.Errorf("got %s with a renewed lease want running", found.Status)
+		}
+
+		store.FailExpiredJobs(ctx, leaseExpiresAt.Add(2*time.Minute), "interrupted")
+		if found, _ := store.GetJob(ctx, second.Id); found.Status != jobStatusFailed || found.Error != "interrupted" || found.Input != "" {
+			t.Errorf("got %s %q want failed with the message", found.Status, found.Error)
+		}
+
+		if _, err := store.GetJob(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetJob of a missing job got %v want ErrNotFound", err)
+		}
+	})
+
+	t.Run("InsertRequestLogs", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		err := store.InsertRequestLogs(ctx, []LogRequests{
+			{Timestamp: time.Now(), Method: "GET", Url: "/health", UserAgent: "conformance", IpAddress: "127.0.0.1"},
+			{Timestamp: time.Now(), Method: "POST", Url: "/shorten", UserAgent: "conformance", IpAddress: "127.0.0.1"},
+		})
+		if err != nil {
+			t.Errorf("InsertRequestLogs returned error: %v", err)
+		}
+
+		if err := store.InsertRequestLogs(ctx, nil); err != nil {
+			t.Errorf("InsertRequestLogs with no logs returned error: %v", err)
+		}
+	})
+
+	t.Run("InsertBlockedAttempts", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		shortCode := uuid.NewString()[:8]
+		err := store.InsertBlockedAttempts(ctx, []BlockedAttempts{
+			{Timestamp: time.Now(), Action: "shorten", Url: "http://evil.example", Rule: "evil.example", IpAddress: "127.0.0.1"},
+			{Timestamp: time.Now(), Action: "redirect", Url: "http://evil.example", Rule: "evil.example", ShortCode: &shortCode, IpAddress: "127.0.0.1"},
+		})
+		if err != nil {
+			t.Errorf("InsertBlockedAttempts returned error: %v", err)
+		}
+	})
+
+	t.Run("RecordClicks", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		shortCode := uuid.NewString()[:8]
+		store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com", ShortCode: shortCode})
+		before, _ := store.GetActiveUrl(ctx, shortCode)
+
+		lastViewed := time.Now().Add(time.Minute).Truncate(time.Second)
+		err := store.RecordClicks(ctx, []Clicks{
+			{ShortCode: shortCode, Timestamp: time.Now()},
+			{ShortCode: shortCode, Timestamp: lastViewed},
+			{ShortCode: "missing-" + uuid.NewString()[:8], Timestamp: time.Now()},
+		})
+		if err != nil {
+			t.Fatalf("RecordClicks returned error: %v", err)
+		}
+
+		urlModel, _ := store.GetActiveUrl(ctx, shortCode)
+		if urlModel.Views != 2 {
+			t.Errorf("got %d views want 2", urlModel.Views)
+		}
+		if urlModel.LastViewed == nil || !urlModel.LastViewed.Equal(lastViewed) {
+			t.Errorf("got last viewed %v want %v", urlModel.LastViewed, lastViewed)
+		}
+		if !urlModel.UpdatedAt.Equal(before.UpdatedAt) {
+			t.Errorf("clicks should not change updated_at: got %v want %v", urlModel.UpdatedAt, before.UpdatedAt)
+		}
+	})
+
+	t.Run("Usages", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		user := &Users{Email: uuid.NewString() + "@example.com", ApiKey: uuid.NewString()}
+		store.CreateUser(ctx, user)
+		month := usageMonth(time.Now())
+
+		usage, err := store.GetUsage(ctx, user.Id, month)
+		if err != nil || usage.LinksCreated != 0 || usage.Redirects != 0 || usage.BulkJobs != 0 {
+			t.Fatalf("got %+v, %v want an empty usage", usage, err)
+		}
+
+		err = store.AddUsages(ctx, []Usages{
+			{UserId: user.Id, Month: month, LinksCreated: 2},
+			{UserId: user.Id, Month: month, LinksCreated: 1, BulkJobs: 1},
+			{UserId: user.Id, Month: "2001-01", LinksCreated: 5},
+		})
+		if err != nil {
+			t.Fatalf("AddUsages returned error: %v", err)
+		}
+		store.AddUsages(ctx, []Usages{{UserId: user.Id, Month: month, BulkJobs: 1}})
+
+		shortCode := uuid.NewString()[:8]
+		store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com", ShortCode: shortCode, UserId: &user.Id})
+		store.RecordClicks(ctx, []Clicks{{ShortCode: shortCode, Timestamp: time.Now()}, {ShortCode: shortCode, Timestamp: time.Now()}})
+
+		usage, _ = store.GetUsage(ctx, user.Id, month)
+		if usage.LinksCreated != 3 || usage.BulkJobs != 2 || usage.Redirects != 2 {
+			t.Errorf("got %+v want 3 links, 2 bulk jobs and 2 redirects", usage)
+		}
+	})
+
+	t.Run("ReserveUsage", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		user := &Users{Email: uuid.NewString() + "@example.com", ApiKey: uuid.NewString()}
+		store.CreateUser(ctx, user)
+		month := usageMonth(time.Now())
+
+		reserved, err := store.ReserveUsage(ctx, user.Id, month, usageLinksCreated, 3, 5)
+		if err != nil || reserved != 3 {
+			t.Fatalf("got %d, %v want 3", reserved, err)
+		}
+		if reserved, _ := store.ReserveUsage(ctx, user.Id, month, usageLinksCreated, 3, 5); reserved != 2 {
+			t.Errorf("got %d want the 2 left", reserved)
+		}
+		if reserved, _ := store.ReserveUsage(ctx, user.Id, month, usageLinksCreated, 1, 5); reserved != 0 {
+			t.Errorf("got %d want 0 once the limit is reached", reserved)
+		}
+		if reserved, _ := store.ReserveUsage(ctx, user.Id, month, usageBulkJobs, 4, 0); reserved != 4 {
+			t.Errorf("got %d want 4 without a limit", reserved)
+		}
+		if _, err := store.ReserveUsage(ctx, user.Id, month, "redirects", 1, 0); err == nil {
+			t.Error("got no error want one for an unknown counter")
+		}
+
+		usage, _ := store.GetUsage(ctx, user.Id, month)
+		if usage.LinksCreated != 5 || usage.BulkJobs != 4 {
+			t.Errorf("got %+v want 5 links and 4 bulk jobs", usage)
+		}
+
+		// Concurrent reservations never go over the limit together.
+		other := &Users{Email: uuid.NewString() + "@example.com", ApiKey: uuid.NewString()}
+		store.CreateUser(ctx, other)
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		total := int64(0)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				reserved, err := store.ReserveUsage(ctx, other.Id, month, usageBulkJobs, 1, 3)
+				if err != nil {
+					t.Errorf("ReserveUsage returned error: %v", err)
+				}
+				mu.Lock()
+				total += reserved
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		if usage, _ := store.GetUsage(ctx, other.Id, month); total != 3 || usage.BulkJobs != 3 {
+			t.Errorf("got %d reserved and %+v want 3", total, usage)
+		}
+	})
+
+	t.Run("IpRules", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		before, _ := store.ListIpRules(ctx)
+		first := &IpRules{Scope: ipRuleScopeRedirect, Action: ipRuleActionDeny, Cidr: "198.51.100.0/24"}
+		second := &IpRules{Scope: ipRuleScopeManagement, Action: ipRuleActionAllow, Cidr: "2001:db8::/32", Note: "office"}
+		for _, rule := range []*IpRules{first, second} {
+			if err := store.CreateIpRule(ctx, rule); err != nil {
+				t.Fatalf("CreateIpRule returned error: %v", err)
+			}
+		}
+
+		rules, err := store.ListIpRules(ctx)
+		if err != nil || len(rules) != len(before)+2 || rules[len(rules)-1].Note != "office" {
+			t.Fatalf("got %+v, %v want the two new rules last", rules, err)
+		}
+
+		if err := store.DeleteIpRule(ctx, first.Id); err != nil {
+			t.Errorf("DeleteIpRule returned error: %v", err)
+		}
+		if err := store.DeleteIpRule(ctx, first.Id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("deleting twice: got %v want ErrNotFound", err)
+		}
+		if rules, _ := store.ListIpRules(ctx); len(rules) != len(before)+1 {
+			t.Errorf("got %d rules want %d", len(rules), len(before)+1)
+		}
+	})
+}
@@ -12,7 +12,10 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 	"gorm.io/gorm"
+
+	"vyson/ratelimit"
 )
 
 func InitTest() *gorm.DB {
@@ -24,11 +27,19 @@ func InitTest() *gorm.DB {
 	return db
 }
 
+// serveWithContext runs handler with ctx as the request context, standing in
+// for the middlewares that populate it in the real router.
+func serveWithContext(ctx context.Context, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r.WithContext(ctx))
+	})
+}
+
 func TestShortenAndRedirect(t *testing.T) {
 	db := InitTest()
 
 	ctx := context.Background()
-	ctx = addValueToContext(&ctx, "db", db)
+	ctx = withStore(ctx, newGormLinkStore(db))
 
 	// Simulate a POST request with a URL in the request body
 	originalUrl := "http://example.com"
@@ -41,7 +52,7 @@ func TestShortenAndRedirect(t *testing.T) {
 
 	// Create a ResponseRecorder to record the response
 	shortenRR := httptest.NewRecorder()
-	handler := http.HandlerFunc(ctxServiceHandler(shortenUrl, &ctx))
+	handler := serveWithContext(ctx, shortenUrl)
 
 	// Serve the HTTP request
 	handler.ServeHTTP(shortenRR, shortenReq)
@@ -69,7 +80,7 @@ func TestShortenAndRedirect(t *testing.T) {
 
 	// Create a new ResponseRecorder for the redirect request
 	redirectRR := httptest.NewRecorder()
-	redirectHandler := http.HandlerFunc(ctxServiceHandler(redirectToOriginalUrl, &ctx))
+	redirectHandler := serveWithContext(ctx, redirectToOriginalUrl)
 
 	// Serve the redirect request
 	redirectHandler.ServeHTTP(redirectRR, redirectReq)
@@ -89,7 +100,7 @@ func TestRedirectNonExistentShortCode(t *testing.T) {
 	db := InitTest()
 
 	ctx := context.Background()
-	ctx = addValueToContext(&ctx, "db", db)
+	ctx = withStore(ctx, newGormLinkStore(db))
 
 	// Simulate a GET request to the redirect endpoint with a non-existent short code
 	nonExistentShortCode := "nonexistent123"
@@ -100,7 +111,7 @@ func TestRedirectNonExistentShortCode(t *testing.T) {
 
 	// Create a new ResponseRecorder for the redirect request
 	redirectRR := httptest.NewRecorder()
-	redirectHandler := http.HandlerFunc(ctxServiceHandler(redirectToOriginalUrl, &ctx))
+	redirectHandler := serveWithContext(ctx, redirectToOriginalUrl)
 
 	// Serve the redirect request
 	redirectHandler.ServeHTTP(redirectRR, redirectReq)
@@ -115,7 +126,7 @@ func TestShortenEmptyUrl(t *testing.T) {
 	db := InitTest()
 
 	ctx := context.Background()
-	ctx = addValueToContext(&ctx, "db", db)
+	ctx = withStore(ctx, newGormLinkStore(db))
 
 	// Simulate a POST request with an empty URL in the request body
 	shortenReqBody := strings.NewReader(`{"url": ""}`)
@@ -127,7 +138,7 @@ func TestShortenEmptyUrl(t *testing.T) {
 
 	// Create a ResponseRecorder to record the response
 	shortenRR := httptest.NewRecorder()
-	handler := http.HandlerFunc(ctxServiceHandler(shortenUrl, &ctx))
+	handler := serveWithContext(ctx, shortenUrl)
 
 	// Serve the HTTP request
 	handler.ServeHTTP(shortenRR, shortenReq)
@@ -149,7 +160,7 @@ func TestShortenEmptyUrl(t *testing.T) {
 func TestSameUrlReturnsDifferentShortCodes(t *testing.T) {
 	db := InitTest()
 	ctx := context.Background()
-	ctx = addValueToContext(&ctx, "db", db)
+	ctx = withStore(ctx, newGormLinkStore(db))
 
 	// Make multiple requests with the same URL
 	originalUrl := "http://example.com"
@@ -165,7 +176,7 @@ func TestSameUrlReturnsDifferentShortCodes(t *testing.T) {
 		shortenReq.Header.Set("Content-Type", "application/json")
 
 		shortenRR := httptest.NewRecorder()
-		handler := http.HandlerFunc(ctxServiceHandler(shortenUrl, &ctx))
+		handler := serveWithContext(ctx, shortenUrl)
 		handler.ServeHTTP(shortenRR, shortenReq)
 
 		// Check status code
@@ -198,7 +209,7 @@ func TestSameUrlReturnsDifferentShortCodes(t *testing.T) {
 func TestShortenUrlWithApiKey(t *testing.T) {
 	db := InitTest()
 	ctx := context.Background()
-	ctx = addValueToContext(&ctx, "db", db)
+	ctx = withStore(ctx, newGormLinkStore(db))
 
 	// First create a test user
 
@@ -225,10 +236,11 @@ func TestShortenUrlWithApiKey(t *testing.T) {
 	// Set headers
 	shortenReq.Header.Set("Content-Type", "application/json")
 	shortenReq.Header.Set("X-API-Key", testUser.ApiKey)
+	ctx = withUser(ctx, getUserFromApiKeyIfExists(ctx, testUser.ApiKey))
 
 	// Create response recorder and handle request
 	shortenRR := httptest.NewRecorder()
-	handler := http.HandlerFunc(ctxServiceHandler(shortenUrl, &ctx))
+	handler := serveWithContext(ctx, shortenUrl)
 	handler.ServeHTTP(shortenRR, shortenReq)
 
 	// Check status code
@@ -265,7 +277,7 @@ func TestShortenUrlWithApiKey(t *testing.T) {
 func TestDeleteShortCodeAuthorization(t *testing.T) {
 	db := InitTest()
 	ctx := context.Background()
-	ctx = addValueToContext(&ctx, "db", db)
+	ctx = withStore(ctx, newGormLinkStore(db))
 
 	// Create two test users
 	user1 := &Users{
@@ -285,8 +297,8 @@ func TestDeleteShortCodeAuthorization(t *testing.T) {
 	db.Create(user1)
 	db.Create(user2)
 
-	user1 = getUserFromApiKeyIfExists(&ctx, user1.ApiKey)
-	user2 = getUserFromApiKeyIfExists(&ctx, user2.ApiKey)
+	user1 = getUserFromApiKeyIfExists(ctx, user1.ApiKey)
+	user2 = getUserFromApiKeyIfExists(ctx, user2.ApiKey)
 
 	// Create a URL with user1's API key
 	originalUrl := "http://example.com"
@@ -297,10 +309,10 @@ func TestDeleteShortCodeAuthorization(t *testing.T) {
 	}
 	shortenReq.Header.Set("Content-Type", "application/json")
 	shortenReq.Header.Set("X-API-Key", user1.ApiKey)
-	ctx = addValueToContext(&ctx, "user", user1)
+	ctx = withUser(ctx, user1)
 
 	shortenRR := httptest.NewRecorder()
-	handler := http.HandlerFunc(ctxServiceHandler(shortenUrl, &ctx))
+	handler := serveWithContext(ctx, shortenUrl)
 	handler.ServeHTTP(shortenRR, shortenReq)
 
 	var response map[string]string
@@ -310,11 +322,11 @@ func TestDeleteShortCodeAuthorization(t *testing.T) {
 	shortCode := response["short_code"]
 
 	// Test 1: Try to delete with user2's API key (should fail)
-	ctx = addValueToContext(&ctx, "user", user2)
+	ctx = withUser(ctx, user2)
 	deleteReq, _ := http.NewRequest("DELETE", "/shorten?code="+shortCode, nil)
 	deleteReq.Header.Set("X-API-Key", user2.ApiKey)
 	deleteRR := httptest.NewRecorder()
-	deleteHandler := http.HandlerFunc(ctxServiceHandler(deleteShortCode, &ctx))
+	deleteHandler := serveWithContext(ctx, deleteShortCode)
 	deleteHandler.ServeHTTP(deleteRR, deleteReq)
 
 	if status := deleteRR.Code; status != http.StatusForbidden {
@@ -322,11 +334,11 @@ func TestDeleteShortCodeAuthorization(t *testing.T) {
 	}
 
 	// Test 2: Delete with user1's API key (should succeed)
-	ctx = addValueToContext(&ctx, "user", user1)
+	ctx = withUser(ctx, user1)
 	deleteReq, _ = http.NewRequest("DELETE", "/shorten?code="+shortCode, nil)
 	deleteReq.Header.Set("X-API-Key", user1.ApiKey)
 	deleteRR = httptest.NewRecorder()
-	deleteHandler = http.HandlerFunc(ctxServiceHandler(deleteShortCode, &ctx))
+	deleteHandler = serveWithContext(ctx, deleteShortCode)
 	deleteHandler.ServeHTTP(deleteRR, deleteReq)
 
 	if status := deleteRR.Code; status != http.StatusOK {
@@ -341,10 +353,10 @@ func TestDeleteShortCodeAuthorization(t *testing.T) {
 func TestHelperDeletionAndExpiry(t *testing.T) {
 	db := InitTest()
 	ctx := context.Background()
-	ctx = addValueToContext(&ctx, "db", db)
+	ctx = withStore(ctx, newGormLinkStore(db))
 
 	shortCode := "2wk9m"
-	exists := doesShortCodeExist(&ctx, shortCode)
+	exists := doesShortCodeExist(ctx, shortCode)
 
 	if exists {
 		t.Errorf("Expected short code to not exist, got %v", exists)
@@ -354,7 +366,7 @@ func TestHelperDeletionAndExpiry(t *testing.T) {
 func TestUrlExpiration(t *testing.T) {
 	db := InitTest()
 	ctx := context.Background()
-	ctx = addValueToContext(&ctx, "db", db)
+	ctx = withStore(ctx, newGormLinkStore(db))
 
 	// Create a URL that expires in 2 seconds
 	originalUrl := "http://example.com"
@@ -368,7 +380,7 @@ func TestUrlExpiration(t *testing.T) {
 	shortenReq.Header.Set("Content-Type", "application/json")
 
 	shortenRR := httptest.NewRecorder()
-	handler := http.HandlerFunc(ctxServiceHandler(shortenUrl, &ctx))
+	handler := serveWithContext(ctx, shortenUrl)
 	handler.ServeHTTP(shortenRR, shortenReq)
 
 	// Check if URL was created successfully
@@ -384,7 +396,7 @@ func TestUrlExpiration(t *testing.T) {
 	shortCode := response["short_code"]
 
 	// Verify URL exists before expiration
-	exists := doesShortCodeExist(&ctx, shortCode)
+	exists := doesShortCodeExist(ctx, shortCode)
 	if !exists {
 		t.Error("URL should exist before expiration")
 	}
@@ -393,7 +405,7 @@ func TestUrlExpiration(t *testing.T) {
 	time.Sleep(3 * time.Second)
 
 	// Verify URL doesn't exist after expiration
-	exists = doesShortCodeExist(&ctx, shortCode)
+	exists = doesShortCodeExist(ctx, shortCode)
 	if exists {
 		t.Error("URL should not exist after expiration")
 	}
@@ -401,7 +413,7 @@ func TestUrlExpiration(t *testing.T) {
 	// Try to access the expired URL
 	redirectReq, _ := http.NewRequest("GET", "/redirect?code="+shortCode, nil)
 	redirectRR := httptest.NewRecorder()
-	redirectHandler := http.HandlerFunc(ctxServiceHandler(redirectToOriginalUrl, &ctx))
+	redirectHandler := serveWithContext(ctx, redirectToOriginalUrl)
 	redirectHandler.ServeHTTP(redirectRR, redirectReq)
 
 	if status := redirectRR.Code; status != http.StatusNotFound {
@@ -412,7 +424,7 @@ func TestUrlExpiration(t *testing.T) {
 func TestCustomUrlShortening(t *testing.T) {
 	db := InitTest()
 	ctx := context.Background()
-	ctx = addValueToContext(&ctx, "db", db)
+	ctx = withStore(ctx, newGormLinkStore(db))
 
 	// Test 1: Create a URL with custom short code
 	originalUrl := "http://example.com"
@@ -426,7 +438,7 @@ func TestCustomUrlShortening(t *testing.T) {
 	shortenReq.Header.Set("Content-Type", "application/json")
 
 	shortenRR := httptest.NewRecorder()
-	handler := http.HandlerFunc(ctxServiceHandler(shortenUrl, &ctx))
+	handler := serveWithContext(ctx, shortenUrl)
 	handler.ServeHTTP(shortenRR, shortenReq)
 
 	// Check if URL was created successfully
@@ -459,7 +471,7 @@ func TestCustomUrlShortening(t *testing.T) {
 	// Test 3: Verify the URL works through redirection
 	redirectReq, _ := http.NewRequest("GET", "/redirect?code="+customUrl, nil)
 	redirectRR := httptest.NewRecorder()
-	redirectHandler := http.HandlerFunc(ctxServiceHandler(redirectToOriginalUrl, &ctx))
+	redirectHandler := serveWithContext(ctx, redirectToOriginalUrl)
 	redirectHandler.ServeHTTP(redirectRR, redirectReq)
 
 	if status := redirectRR.Code; status != http.StatusTemporaryRedirect {
@@ -470,14 +482,22 @@ func TestCustomUrlShortening(t *testing.T) {
 		t.Errorf("Expected redirect to %s, got %s", originalUrl, location)
 	}
 
-	// Clean up
-	deleteUrl(&ctx, customUrl)
+	// Test 4: A deleted link still holds its custom short code
+	deleteUrl(ctx, customUrl)
+	removeCachedUrl(ctx, customUrl)
+	shortenReq, _ = http.NewRequest("POST", "/shorten", strings.NewReader(fmt.Sprintf(`{"url": "%s", "custom_url": "%s"}`, originalUrl, customUrl)))
+	shortenRR = httptest.NewRecorder()
+	handler.ServeHTTP(shortenRR, shortenReq)
+
+	if status := shortenRR.Code; status != http.StatusBadRequest {
+		t.Errorf("Expected status BadRequest for the custom URL of a deleted link, got %v: %s", status, shortenRR.Body.String())
+	}
 }
 
 func TestShortenUrlBulk(t *testing.T) {
 	db := InitTest()
 	ctx := context.Background()
-	ctx = addValueToContext(&ctx, "db", db)
+	ctx = withStore(ctx, newGormLinkStore(db))
 
 	user1 := &Users{
 		Email:     uuid.New().String()[:5] + "@example.com",
@@ -489,7 +509,7 @@ func TestShortenUrlBulk(t *testing.T) {
 	}
 	db.Create(user1)
 
-	user1 = getUserFromApiKeyIfExists(&ctx, user1.ApiKey)
+	user1 = getUserFromApiKeyIfExists(ctx, user1.ApiKey)
 
 	// Test case 1: Successful bulk URL shortening
 	reqBody := strings.NewReader(`{
@@ -507,10 +527,10 @@ func TestShortenUrlBulk(t *testing.T) {
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("X-API-Key", user1.ApiKey)
-	ctx = addValueToContext(&ctx, "user", user1)
+	ctx = withUser(ctx, user1)
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(ctxServiceHandler(shortenUrlBulk, &ctx))
+	handler := serveWithContext(ctx, shortenUrlBulk)
 	handler.ServeHTTP(rr, req)
 
 	// Check status code
@@ -520,28 +540,30 @@ func TestShortenUrlBulk(t *testing.T) {
 	}
 
 	// Parse response
-	var response map[string]string
+	var response struct {
+		Results []bulkShortenResult `json:"results"`
+	}
 	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
 		t.Fatal("Failed to decode response body")
 	}
 
 	// Verify short codes were returned
-	shortCodesStr := response["short_codes"]
-	var shortCodes []string
-	if err := json.Unmarshal([]byte(shortCodesStr), &shortCodes); err != nil {
-		fmt.Println(shortCodesStr)
-		t.Fatal("Failed to parse short codes")
+	if len(response.Results) != 4 {
+		t.Fatalf("Expected 4 results, got %d", len(response.Results))
 	}
 
-	if len(shortCodes) != 4 {
-		t.Errorf("Expected 4 short codes, got %d", len(shortCodes))
+	for i, result := range response.Results {
+		if result.Index != i || result.ShortCode == "" || result.failed() {
+			t.Errorf("result %d: got %+v want a short code", i, result)
+		}
 	}
 
-	// Test case 2: Duplicate custom URLs
+	// Test case 2: Duplicate custom URLs fail the second item only
+	customUrl := "custom" + uuid.New().String()[:8]
 	reqBody = strings.NewReader(`{
 		"urls": [
-			{"url": "http://example1.com", "custom_url": "custom123"},
-			{"url": "http://example2.com", "custom_url": "custom123"}
+			{"url": "http://example1.com", "custom_url": "` + customUrl + `"},
+			{"url": "http://example2.com", "custom_url": "` + customUrl + `"}
 		]
 	}`)
 
@@ -551,15 +573,22 @@ func TestShortenUrlBulk(t *testing.T) {
 	rr = httptest.NewRecorder()
 	handler.ServeHTTP(rr, req)
 
-	if status := rr.Code; status != http.StatusBadRequest {
-		t.Errorf("handler should return BadRequest for duplicate custom URLs: got %v want %v",
-			status, http.StatusBadRequest)
+	if status := rr.Code; status != http.StatusMultiStatus {
+		t.Errorf("handler should return MultiStatus for duplicate custom URLs: got %v want %v",
+			status, http.StatusMultiStatus)
 	}
 
-	// Test case 3: Empty URL in batch
+	json.NewDecoder(rr.Body).Decode(&response)
+	if response.Results[0].ShortCode != customUrl || response.Results[1].ErrorCode != bulkErrorDuplicateCustomUrl {
+		t.Errorf("got results %+v want %s created and a duplicate_custom_url error", response.Results, customUrl)
+	}
+
+	// Test case 3: Empty URL in an atomic batch creates nothing
+	atomicCustomUrl := "custom" + uuid.New().String()[:8]
 	reqBody = strings.NewReader(`{
+		"atomic": true,
 		"urls": [
-			{"url": "http://example1.com"},
+			{"url": "http://example1.com", "custom_url": "` + atomicCustomUrl + `"},
 			{"url": ""}
 		]
 	}`)
@@ -575,30 +604,149 @@ func TestShortenUrlBulk(t *testing.T) {
 			status, http.StatusBadRequest)
 	}
 
+	json.NewDecoder(rr.Body).Decode(&response)
+	if response.Results[0].ErrorCode != bulkErrorAborted || response.Results[1].ErrorCode != bulkErrorUrlRequired {
+		t.Errorf("got results %+v want aborted and url_required", response.Results)
+	}
+	if doesShortCodeExist(ctx, atomicCustomUrl) {
+		t.Errorf("atomic batch with a failing item created %s", atomicCustomUrl)
+	}
+
+	// Test case 4: The custom URL of a deleted link is reported as existing
+	deleteUrl(ctx, customUrl)
+	removeCachedUrl(ctx, customUrl)
+	reqBody = strings.NewReader(`{"urls": [{"url": "http://example1.com", "custom_url": "` + customUrl + `"}]}`)
+
+	req, _ = http.NewRequest("POST", "/shorten/bulk", reqBody)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", user1.ApiKey)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	json.NewDecoder(rr.Body).Decode(&response)
+	if rr.Code != http.StatusBadRequest || response.Results[0].ErrorCode != bulkErrorCustomUrlExists {
+		t.Errorf("got %v and results %+v want %v and a custom_url_exists error", rr.Code, response.Results, http.StatusBadRequest)
+	}
+
 	// Clean up
 	db.Unscoped().Delete(user1)
 }
 
+// lookupCountingStore counts the short code lookups made through it.
+type lookupCountingStore struct {
+	LinkStore
+	singleLookups int
+	batchLookups  int
+}
+
+func (s *lookupCountingStore) ShortCodeExists(ctx context.Context, shortCode string) (bool, error) {
+	s.singleLookups++
+	return s.LinkStore.ShortCodeExists(ctx, shortCode)
+}
+
+func (s *lookupCountingStore) GetUrl(ctx context.Context, shortCode string) (*UrlShortener, error) {
+	s.singleLookups++
+	return s.LinkStore.GetUrl(ctx, shortCode)
+}
+
+func (s *lookupCountingStore) TakenShortCodes(ctx context.Context, shortCodes []string) (map[string]bool, error) {
+	s.batchLookups++
+	return s.LinkStore.TakenShortCodes(ctx, shortCodes)
+}
+
+func TestShortenBulkLooksUpShortCodesOnce(t *testing.T) {
+	store := &lookupCountingStore{LinkStore: newMemoryLinkStore()}
+	ctx := withPlans(withStore(context.Background(), store), defaultConfig().Plans)
+
+	takenCode := "taken" + uuid.NewString()[:8]
+	store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com", ShortCode: takenCode})
+
+	items := []bulkShortenItem{{URL: "http://example.com", CustomUrl: &takenCode}}
+	for i := 0; i < 50; i++ {
+		items = append(items, bulkShortenItem{URL: fmt.Sprintf("http://example.com/%d", i)})
+		items = append(items, bulkShortenItem{URL: "http://example.com", CustomUrl: addressOf(fmt.Sprintf("bulk%d-%s", i, uuid.NewString()[:8]))})
+	}
+
+	results := shortenBulk(ctx, "", nil, items, false)
+
+	if results[0].ErrorCode != bulkErrorCustomUrlExists {
+		t.Errorf("got %+v want a custom_url_exists error", results[0])
+	}
+	for _, result := range results[1:] {
+		if result.failed() || result.ShortCode == "" {
+			t.Errorf("got %+v want a short code", result)
+		}
+	}
+	if store.singleLookups != 0 || store.batchLookups != 2 {
+		t.Errorf("got %d single and %d batched lookups want 0 and 2", store.singleLookups, store.batchLookups)
+	}
+}
+
+// conflictingStore fails the first two inserts of each link, the batch and
+// the first single insert, as if another request took its short code in
+// between.
+type conflictingStore struct {
+	LinkStore
+	attempts map[string]int
+}
+
+func (s *conflictingStore) InsertUrls(ctx context.Context, urlShorteners []*UrlShortener, revisions []LinkRevisions) error {
+	conflict := false
+	for _, urlShortener := range urlShorteners {
+		s.attempts[urlShortener.OriginalUrl]++
+		conflict = conflict || s.attempts[urlShortener.OriginalUrl] <= 2
+	}
+	if conflict {
+		return ErrConflict
+	}
+	return s.LinkStore.InsertUrls(ctx, urlShorteners, revisions)
+}
+
+func TestShortenBulkRetriesConflictingShortCodes(t *testing.T) {
+	store := &conflictingStore{LinkStore: newMemoryLinkStore(), attempts: map[string]int{}}
+	ctx := withPlans(withStore(context.Background(), store), defaultConfig().Plans)
+
+	customUrl := "bulk" + uuid.NewString()[:8]
+	items := []bulkShortenItem{
+		{URL: "http://example.com/generated"},
+		{URL: "http://example.com/custom", CustomUrl: &customUrl},
+	}
+
+	results := shortenBulk(ctx, "", nil, items, false)
+
+	if results[0].failed() || results[0].ShortCode == "" {
+		t.Errorf("got %+v want a short code", results[0])
+	}
+	if results[1].ErrorCode != bulkErrorCustomUrlExists {
+		t.Errorf("got %+v want a custom_url_exists error", results[1])
+	}
+
+	revisions, _ := store.ListLinkRevisions(ctx, results[0].ShortCode)
+	if len(revisions) != 1 || revisions[0].Action != revisionCreate {
+		t.Errorf("got revisions %+v want one create revision", revisions)
+	}
+}
+
 func TestActivateUrl(t *testing.T) {
 	db := InitTest()
 	ctx := context.Background()
-	ctx = addValueToContext(&ctx, "db", db)
+	ctx = withStore(ctx, newGormLinkStore(db))
 
-	activateUrl(&ctx, "194d5")
+	activateUrl(ctx, "194d5")
 }
 
 func TestDeleteUrl(t *testing.T) {
 	db := InitTest()
 	ctx := context.Background()
-	ctx = addValueToContext(&ctx, "db", db)
+	ctx = withStore(ctx, newGormLinkStore(db))
 
-	deleteUrl(&ctx, "194d5")
+	deleteUrl(ctx, "194d5")
 }
 
 func TestPasswordProtectedUrl(t *testing.T) {
 	db := InitTest()
 	ctx := context.Background()
-	ctx = addValueToContext(&ctx, "db", db)
+	ctx = withStore(ctx, newGormLinkStore(db))
 
 	// Create a URL with password protection
 	originalUrl := "http://example.com"
@@ -615,7 +763,7 @@ func TestPasswordProtectedUrl(t *testing.T) {
 	shortenReq.Header.Set("Content-Type", "application/json")
 
 	shortenRR := httptest.NewRecorder()
-	handler := http.HandlerFunc(ctxServiceHandler(shortenUrl, &ctx))
+	handler := serveWithContext(ctx, shortenUrl)
 	handler.ServeHTTP(shortenRR, shortenReq)
 
 	// Check if URL was created successfully
@@ -633,7 +781,7 @@ func TestPasswordProtectedUrl(t *testing.T) {
 	// Test 1: Try to access URL without password
 	redirectReq, _ := http.NewRequest("GET", "/redirect?code="+shortCode, nil)
 	redirectRR := httptest.NewRecorder()
-	redirectHandler := http.HandlerFunc(ctxServiceHandler(redirectToOriginalUrl, &ctx))
+	redirectHandler := serveWithContext(ctx, redirectToOriginalUrl)
 	redirectHandler.ServeHTTP(redirectRR, redirectReq)
 
 	if status := redirectRR.Code; status != http.StatusBadRequest {
@@ -675,9 +823,9 @@ func TestPasswordProtectedUrl(t *testing.T) {
 func TestGetUserUrlsRepoFunction(t *testing.T) {
 	db := InitTest()
 	ctx := context.Background()
-	ctx = addValueToContext(&ctx, "db", db)
+	ctx = withStore(ctx, newGormLinkStore(db))
 
-	urls := getUrlsByUserId(&ctx, 1, 1, 10)
+	urls := getUrlsByUserId(ctx, 1, UrlFilter{}, UrlSort{}, 1, 10)
 
 	fmt.Println(len(urls))
 	if len(urls) <= 0 {
@@ -688,7 +836,7 @@ func TestGetUserUrlsRepoFunction(t *testing.T) {
 func TestGetUserUrls(t *testing.T) {
 	db := InitTest()
 	ctx := context.Background()
-	ctx = addValueToContext(&ctx, "db", db)
+	ctx = withStore(ctx, newGormLinkStore(db))
 
 	// Create a test user
 	testUser := &Users{
@@ -700,8 +848,8 @@ func TestGetUserUrls(t *testing.T) {
 	}
 	db.Create(testUser)
 
-	testUser = getUserFromApiKeyIfExists(&ctx, testUser.ApiKey)
-	ctx = addValueToContext(&ctx, "user", testUser)
+	testUser = getUserFromApiKeyIfExists(ctx, testUser.ApiKey)
+	ctx = withUser(ctx, testUser)
 
 	// Create multiple URLs for this user
 	urls := []UrlShortener{
@@ -733,7 +881,7 @@ func TestGetUserUrls(t *testing.T) {
 	req.Header.Set("X-API-Key", testUser.ApiKey)
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(ctxServiceHandler(getUserUrls, &ctx))
+	handler := serveWithContext(ctx, getUserUrls)
 	handler.ServeHTTP(rr, req)
 
 	// Check status code
@@ -743,10 +891,13 @@ func TestGetUserUrls(t *testing.T) {
 	}
 
 	// Parse response
-	var response []UrlShortener
-	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+	var body struct {
+		Urls []UrlShortener `json:"urls"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
 		t.Fatal("Failed to decode response body")
 	}
+	response := body.Urls
 
 	// Verify number of URLs returned
 	if len(response) != len(urls) {
@@ -768,12 +919,12 @@ func TestGetUserUrls(t *testing.T) {
 	}
 
 	ctx = context.Background()
-	ctx = addValueToContext(&ctx, "db", db)
+	ctx = withStore(ctx, newGormLinkStore(db))
 
 	// Test 2: Try without API key
 	req, _ = http.NewRequest("GET", "/urls", nil)
 	rr = httptest.NewRecorder()
-	handler = http.HandlerFunc(ctxServiceHandler(getUserUrls, &ctx))
+	handler = serveWithContext(ctx, getUserUrls)
 	handler.ServeHTTP(rr, req)
 
 	if status := rr.Code; status != http.StatusNotFound {
@@ -802,10 +953,10 @@ func TestGetUserUrls(t *testing.T) {
 func TestRedirectCaching(t *testing.T) {
 	db := InitTest()
 	ctx := context.Background()
-	ctx = addValueToContext(&ctx, "db", db)
+	ctx = withStore(ctx, newGormLinkStore(db))
 
 	// Initialize Redis client for testing
-	initRedis()
+	initRedis(defaultConfig().Redis)
 
 	// Create a test URL
 	originalUrl := "http://example.com/caching-test"
@@ -817,7 +968,7 @@ func TestRedirectCaching(t *testing.T) {
 	shortenReq.Header.Set("Content-Type", "application/json")
 
 	shortenRR := httptest.NewRecorder()
-	handler := http.HandlerFunc(ctxServiceHandler(shortenUrl, &ctx))
+	handler := serveWithContext(ctx, shortenUrl)
 	handler.ServeHTTP(shortenRR, shortenReq)
 
 	// Check if URL was created successfully
@@ -833,7 +984,7 @@ func TestRedirectCaching(t *testing.T) {
 	shortCode := response["short_code"]
 
 	// Verify Redis cache is empty before first request
-	cachedUrl, err := getCachedUrl(shortCode)
+	cachedUrl, err := getCachedUrl(ctx, shortCode)
 	if err != nil {
 		t.Fatalf("Error checking Redis cache: %v", err)
 	}
@@ -844,7 +995,7 @@ func TestRedirectCaching(t *testing.T) {
 	// First request - should hit the database and populate the Redis cache
 	redirectReq1, _ := http.NewRequest("GET", "/redirect?code="+shortCode, nil)
 	redirectRR1 := httptest.NewRecorder()
-	redirectHandler := http.HandlerFunc(ctxServiceHandler(redirectToOriginalUrl, &ctx))
+	redirectHandler := serveWithContext(ctx, redirectToOriginalUrl)
 	redirectHandler.ServeHTTP(redirectRR1, redirectReq1)
 
 	// Verify first request was successful
@@ -853,7 +1004,7 @@ func TestRedirectCaching(t *testing.T) {
 	}
 
 	// Verify URL was cached in Redis after first request
-	cachedUrl, err = getCachedUrl(shortCode)
+	cachedUrl, err = getCachedUrl(ctx, shortCode)
 	if err != nil {
 		t.Fatalf("Error checking Redis cache: %v", err)
 	}
@@ -885,13 +1036,13 @@ func TestRedirectCaching(t *testing.T) {
 	}
 
 	// Verify that if we clear the Redis cache and try again, it fails (proving we were using the cache)
-	err = removeCachedUrl(shortCode)
+	err = removeCachedUrl(ctx, shortCode)
 	if err != nil {
 		t.Fatalf("Error clearing Redis cache: %v", err)
 	}
 
 	// Verify the cache is now empty
-	cachedUrl, err = getCachedUrl(shortCode)
+	cachedUrl, err = getCachedUrl(ctx, shortCode)
 	if err != nil {
 		t.Fatalf("Error checking Redis cache: %v", err)
 	}
@@ -920,7 +1071,7 @@ func TestRedirectCaching(t *testing.T) {
 	db.Create(newUrlModel)
 
 	// Cache the URL
-	err = cacheUrl(shortCode, newUrlModel)
+	err = cacheUrl(ctx, shortCode, newUrlModel)
 	if err != nil {
 		t.Fatalf("Error caching URL: %v", err)
 	}
@@ -934,13 +1085,13 @@ func TestRedirectCaching(t *testing.T) {
 	}
 
 	// Update the cache
-	err = updateCachedUrl(shortCode, updatedUrlModel)
+	err = updateCachedUrl(ctx, shortCode, updatedUrlModel)
 	if err != nil {
 		t.Fatalf("Error updating cached URL: %v", err)
 	}
 
 	// Verify the cache was updated
-	cachedUrl, err = getCachedUrl(shortCode)
+	cachedUrl, err = getCachedUrl(ctx, shortCode)
 	if err != nil {
 		t.Fatalf("Error checking Redis cache: %v", err)
 	}
@@ -952,13 +1103,13 @@ func TestRedirectCaching(t *testing.T) {
 	}
 
 	// Clean up
-	removeCachedUrl(shortCode)
+	removeCachedUrl(ctx, shortCode)
 	db.Unscoped().Delete(&UrlShortener{ShortCode: shortCode})
 }
 
 func TestIpRateLimitMiddleware(t *testing.T) {
 	// Initialize Redis for testing
-	initRedis()
+	initRedis(defaultConfig().Redis)
 
 	// Create a simple test handler that always returns 200 OK
 	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -967,7 +1118,7 @@ func TestIpRateLimitMiddleware(t *testing.T) {
 	})
 
 	// Apply the rate limit middleware to the test handler
-	handler := ipRateLimitMiddleware()(testHandler)
+	handler := ipRateLimitMiddleware(defaultConfig().RateLimits)(testHandler)
 
 	// Test cases for different endpoints
 	testCases := []struct {
@@ -1035,7 +1186,7 @@ func TestIpRateLimitMiddleware(t *testing.T) {
 			} else {
 				redisKey = "default:" + testIP
 			}
-			redisClient.Del(redisKey)
+			redisClient.Del(context.Background(), redisKey)
 
 			// Make requests up to the specified count
 			var lastStatus int
@@ -1085,16 +1236,53 @@ func TestIpRateLimitMiddleware(t *testing.T) {
 			}
 
 			// Clean up
-			redisClient.Del(redisKey)
+			redisClient.Del(context.Background(), redisKey)
 		})
 	}
 }
 
+func TestUserRateLimitMiddleware(t *testing.T) {
+	// The memory store numbers users from 1 on every run, so the requests
+	// are counted in memory instead of next to those of earlier runs.
+	defer func(limiter ratelimit.Limiter) { rateLimiter = limiter }(rateLimiter)
+	rateLimiter = ratelimit.NewMemory()
+
+	store := newMemoryLinkStore()
+	ctx := context.Background()
+	user := &Users{Email: uuid.NewString() + "@example.com", ApiKey: uuid.NewString(), Tier: "free"}
+	store.CreateUser(ctx, user)
+
+	calls := 0
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusOK)
+	})
+
+	plans := defaultConfig().Plans
+	plans.Tiers["free"] = Plan{RateLimit: RateLimit{Requests: 2, Window: time.Minute}}
+	handler := requestContextMiddleware(store, nil, nil)(userRateLimitMiddleware(defaultConfig().RateLimits, plans)(testHandler))
+
+	var rr *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/user/urls", nil)
+		req.Header.Set("X-API-Key", user.ApiKey)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+	}
+
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "60" {
+		t.Errorf("got %v with Retry-After %q want %v after 60 seconds", rr.Code, rr.Header().Get("Retry-After"), http.StatusTooManyRequests)
+	}
+	if calls != 2 {
+		t.Errorf("got %d requests through want 2", calls)
+	}
+}
+
 func TestCreateNUrlEntriesBatch(t *testing.T) {
 	db := InitTest()
 	ctx := context.Background()
-	initRedis()
-	ctx = addValueToContext(&ctx, "db", db)
+	initRedis(defaultConfig().Redis)
+	ctx = withStore(ctx, newGormLinkStore(db))
 
 	n := 15_00_000   // Number of entries
 	batchSize := 100 // Insert in batches of 100
@@ -1112,7 +1300,7 @@ func TestCreateNUrlEntriesBatch(t *testing.T) {
 
 			batch = append(batch, UrlShortener{
 				OriginalUrl: originalUrl,
-				ShortCode:   createShortCode(&ctx, 0),
+				ShortCode:   createShortCode(ctx, 0),
 				CreatedAt:   time.Now(),
 				UpdatedAt:   time.Now(),
 			})
@@ -1131,3 +1319,432 @@ func TestCreateNUrlEntriesBatch(t *testing.T) {
 	t.Logf("Created %d URL entries in %v (%.2f entries/sec)",
 		n, elapsed, float64(n)/elapsed.Seconds())
 }
+
+func TestPathBasedRedirect(t *testing.T) {
+	initRedis(defaultConfig().Redis)
+
+	store := newMemoryLinkStore()
+	ctx := withStore(context.Background(), store)
+
+	router := mux.NewRouter()
+	router.Use(requestContextMiddleware(store, nil, nil))
+	router.HandleFunc("/health", health).Methods("GET")
+	router.HandleFunc("/{code}", redirectToOriginalUrl).Methods("GET").Name("resolve_code")
+
+	// Create a URL directly in the store
+	originalUrl := "http://example.com/path-redirect"
+	shortCode := uuid.New().String()[:8]
+	store.InsertUrl(ctx, &UrlShortener{OriginalUrl: originalUrl, ShortCode: shortCode})
+	defer removeCachedUrl(ctx, shortCode)
+
+	// Test 1: GET /{code} redirects like /redirect?code=
+	req, _ := http.NewRequest("GET", "/"+shortCode, nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusTemporaryRedirect {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusTemporaryRedirect)
+	}
+	if location := rr.Header().Get("Location"); location != originalUrl {
+		t.Errorf("redirect handler returned wrong location: got %v want %v", location, originalUrl)
+	}
+
+	// Test 2: Registered routes still win over the catch-all
+	req, _ = http.NewRequest("GET", "/health", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("/health should not be treated as a short code: got %v want %v", status, http.StatusOK)
+	}
+
+	// Test 3: Unknown codes are not found
+	req, _ = http.NewRequest("GET", "/missing-"+uuid.New().String()[:8], nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
+
+func TestReservedCustomUrl(t *testing.T) {
+	ctx := withStore(context.Background(), newMemoryLinkStore())
+
+	for _, customUrl := range []string{"health", "Shorten", "user"} {
+		shortenReqBody := strings.NewReader(fmt.Sprintf(`{"url": "http://example.com", "custom_url": "%s"}`, customUrl))
+		shortenReq, _ := http.NewRequest("POST", "/shorten", shortenReqBody)
+		shortenRR := httptest.NewRecorder()
+		serveWithContext(ctx, shortenUrl).ServeHTTP(shortenRR, shortenReq)
+
+		if status := shortenRR.Code; status != http.StatusBadRequest {
+			t.Errorf("custom URL %q should be rejected: got %v want %v", customUrl, status, http.StatusBadRequest)
+		}
+	}
+
+	bulkReqBody := strings.NewReader(`{"urls": [{"url": "http://example.com"}, {"url": "http://example.com", "custom_url": "redirect"}]}`)
+	bulkReq, _ := http.NewRequest("POST", "/shorten/bulk", bulkReqBody)
+	bulkRR := httptest.NewRecorder()
+	serveWithContext(ctx, shortenUrlBulk).ServeHTTP(bulkRR, bulkReq)
+
+	if status := bulkRR.Code; status != http.StatusMultiStatus {
+		t.Errorf("bulk request with a reserved custom URL: got %v want %v", status, http.StatusMultiStatus)
+	}
+
+	var bulkResponse struct {
+		Results []bulkShortenResult `json:"results"`
+	}
+	json.NewDecoder(bulkRR.Body).Decode(&bulkResponse)
+	if len(bulkResponse.Results) != 2 || bulkResponse.Results[1].ErrorCode != bulkErrorReservedCustomUrl {
+		t.Errorf("got results %+v want a reserved_custom_url error for the second item", bulkResponse.Results)
+	}
+}
+
+func TestRedirectType(t *testing.T) {
+	initRedis(defaultConfig().Redis)
+
+	store := newMemoryLinkStore()
+	user := &Users{Email: uuid.NewString() + "@example.com", ApiKey: uuid.NewString()}
+	store.CreateUser(context.Background(), user)
+	ctx := withUser(withStore(context.Background(), store), user)
+
+	// Test 1: Invalid redirect types are rejected
+	shortenReqBody := strings.NewReader(`{"url": "http://example.com", "redirect_type": 303}`)
+	shortenReq, _ := http.NewRequest("POST", "/shorten", shortenReqBody)
+	shortenRR := httptest.NewRecorder()
+	serveWithContext(ctx, shortenUrl).ServeHTTP(shortenRR, shortenReq)
+
+	if status := shortenRR.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	// Test 2: The redirect uses the status stored on the link
+	shortenReqBody = strings.NewReader(`{"url": "http://example.com", "redirect_type": 301}`)
+	shortenReq, _ = http.NewRequest("POST", "/shorten", shortenReqBody)
+	shortenReq.Header.Set("X-API-Key", user.ApiKey)
+	shortenRR = httptest.NewRecorder()
+	serveWithContext(ctx, shortenUrl).ServeHTTP(shortenRR, shortenReq)
+
+	var shortenResponse map[string]string
+	json.NewDecoder(shortenRR.Body).Decode(&shortenResponse)
+	shortCode := shortenResponse["short_code"]
+	defer removeCachedUrl(ctx, shortCode)
+
+	redirectReq, _ := http.NewRequest("GET", "/redirect?code="+shortCode, nil)
+	redirectRR := httptest.NewRecorder()
+	serveWithContext(ctx, redirectToOriginalUrl).ServeHTTP(redirectRR, redirectReq)
+
+	if status := redirectRR.Code; status != http.StatusMovedPermanently {
+		t.Errorf("redirect returned wrong status code: got %v want %v", status, http.StatusMovedPermanently)
+	}
+
+	// Test 3: PUT /shorten changes the status, including the cached copy
+	editReqBody := strings.NewReader(`{"short_code": "` + shortCode + `", "redirect_type": 308}`)
+	editReq, _ := http.NewRequest("PUT", "/shorten", editReqBody)
+	editRR := httptest.NewRecorder()
+	serveWithContext(ctx, editUrl).ServeHTTP(editRR, editReq)
+
+	if status := editRR.Code; status != http.StatusOK {
+		t.Errorf("edit handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	redirectReq, _ = http.NewRequest("GET", "/redirect?code="+shortCode, nil)
+	redirectRR = httptest.NewRecorder()
+	serveWithContext(ctx, redirectToOriginalUrl).ServeHTTP(redirectRR, redirectReq)
+
+	if status := redirectRR.Code; status != http.StatusPermanentRedirect {
+		t.Errorf("redirect returned wrong status code: got %v want %v", status, http.StatusPermanentRedirect)
+	}
+
+	// Test 4: Entries cached before redirect_type existed fall back to 307
+	legacyCode := uuid.New().String()[:8]
+	redisClient.Set(context.Background(), legacyCode, `{"OriginalUrl": "http://example.com/legacy", "ShortCode": "`+legacyCode+`"}`, time.Minute)
+	defer removeCachedUrl(ctx, legacyCode)
+
+	redirectReq, _ = http.NewRequest("GET", "/redirect?code="+legacyCode, nil)
+	redirectRR = httptest.NewRecorder()
+	serveWithContext(ctx, redirectToOriginalUrl).ServeHTTP(redirectRR, redirectReq)
+
+	if status := redirectRR.Code; status != http.StatusTemporaryRedirect {
+		t.Errorf("redirect returned wrong status code: got %v want %v", status, http.StatusTemporaryRedirect)
+	}
+}
+
+func TestEditUrlPartialUpdate(t *testing.T) {
+	initRedis(defaultConfig().Redis)
+
+	store := newMemoryLinkStore()
+	user := &Users{Email: uuid.NewString() + "@example.com", ApiKey: uuid.NewString()}
+	store.CreateUser(context.Background(), user)
+	ctx := withUser(withStore(context.Background(), store), user)
+
+	shortCode := uuid.NewString()[:8]
+	renamedCode := uuid.NewString()[:8]
+	store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com/old", ShortCode: shortCode, UserId: &user.Id})
+	store.RecordClicks(ctx, []Clicks{{ShortCode: shortCode, Timestamp: time.Now()}})
+	defer removeCachedUrl(ctx, shortCode)
+	defer removeCachedUrl(ctx, renamedCode)
+
+	edit := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PUT", "/shorten", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		serveWithContext(ctx, editUrl).ServeHTTP(rr, req)
+		return rr
+	}
+
+	redirect := func(code string, password string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/redirect?code="+code, nil)
+		if password != "" {
+			req.Header.Set("X-Password", password)
+		}
+		rr := httptest.NewRecorder()
+		serveWithContext(ctx, redirectToOriginalUrl).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Cache the link so the edits have to replace the cached copy
+	redirect(shortCode, "")
+
+	// Test 1: Invalid fields are rejected without changing anything
+	if rr := edit(`{"short_code": "` + shortCode + `", "url": "ftp://example.com", "redirect_type": 301}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid url: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	if rr := edit(`{"short_code": "` + shortCode + `", "custom_url": "health"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("reserved custom url: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	if rr := redirect(shortCode, ""); rr.Code != http.StatusTemporaryRedirect || rr.Header().Get("Location") != "http://example.com/old" {
+		t.Errorf("link changed by a rejected edit: got %v to %v", rr.Code, rr.Header().Get("Location"))
+	}
+
+	// Test 2: Destination and password are updated, including the cached copy
+	if rr := edit(`{"short_code": "` + shortCode + `", "url": "http://example.com/new", "password": "secret"}`); rr.Code != http.StatusOK {
+		t.Fatalf("edit handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := redirect(shortCode, ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("redirect without the new password: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	if rr := redirect(shortCode, "secret"); rr.Header().Get("Location") != "http://example.com/new" {
+		t.Errorf("got location %v want %v", rr.Header().Get("Location"), "http://example.com/new")
+	}
+
+	// Test 3: null clears the password, absent fields are left alone
+	if rr := edit(`{"short_code": "` + shortCode + `", "password": null}`); rr.Code != http.StatusOK {
+		t.Fatalf("edit handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := redirect(shortCode, ""); rr.Code != http.StatusTemporaryRedirect || rr.Header().Get("Location") != "http://example.com/new" {
+		t.Errorf("after clearing the password: got %v to %v", rr.Code, rr.Header().Get("Location"))
+	}
+
+	// Test 4: custom_url renames the link and keeps its clicks
+	rr := edit(`{"short_code": "` + shortCode + `", "custom_url": "` + renamedCode + `"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("rename returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var response map[string]string
+	json.NewDecoder(rr.Body).Decode(&response)
+	if response["short_code"] != renamedCode {
+		t.Errorf("got short code %v want %v", response["short_code"], renamedCode)
+	}
+
+	if rr := redirect(shortCode, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("old short code after the rename: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+	if rr := redirect(renamedCode, ""); rr.Header().Get("Location") != "http://example.com/new" {
+		t.Errorf("renamed short code: got location %v want %v", rr.Header().Get("Location"), "http://example.com/new")
+	}
+
+	store.mu.RLock()
+	clickCode := store.clicks[0].ShortCode
+	store.mu.RUnlock()
+	if clickCode != renamedCode {
+		t.Errorf("got click for %v want %v", clickCode, renamedCode)
+	}
+
+	// Test 5: The code of a deleted link is taken, the edit changes nothing
+	deletedCode := uuid.NewString()[:8]
+	store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com/deleted", ShortCode: deletedCode, UserId: &user.Id})
+	store.DeleteUrl(ctx, deletedCode)
+	revisionsBefore, _ := store.ListLinkRevisions(ctx, renamedCode)
+
+	rr = edit(`{"short_code": "` + renamedCode + `", "url": "http://example.com/other", "custom_url": "` + deletedCode + `", "activate": false}`)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("rename to a deleted code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	if urlModel, _ := store.GetUrl(ctx, renamedCode); urlModel.OriginalUrl != "http://example.com/new" || urlModel.DeletedAt != nil {
+		t.Errorf("link changed by a rejected rename: got %v, deleted at %v", urlModel.OriginalUrl, urlModel.DeletedAt)
+	}
+	if revisions, _ := store.ListLinkRevisions(ctx, renamedCode); len(revisions) != len(revisionsBefore) {
+		t.Errorf("got %d revisions want %d, the rejected rename must not add one", len(revisions), len(revisionsBefore))
+	}
+}
+
+func TestGetUserUrlsFiltered(t *testing.T) {
+	initRedis(defaultConfig().Redis)
+
+	store := newMemoryLinkStore()
+	ctx := context.Background()
+	user := &Users{Email: uuid.NewString() + "@example.com", ApiKey: uuid.NewString()}
+	store.CreateUser(ctx, user)
+
+	now := time.Now()
+	urls := []*UrlShortener{
+		{OriginalUrl: "http://example.com/spring-sale", ShortCode: uuid.NewString()[:8], UserId: &user.Id, Views: 2, CreatedAt: now.Add(-48 * time.Hour)},
+		{OriginalUrl: "http://example.com/summer-sale", ShortCode: uuid.NewString()[:8], UserId: &user.Id, Views: 7, CreatedAt: now.Add(-time.Hour)},
+		{OriginalUrl: "http://example.com/about", ShortCode: uuid.NewString()[:8], UserId: &user.Id, CreatedAt: now},
+	}
+	for _, urlShortener := range urls {
+		store.InsertUrl(ctx, urlShortener)
+	}
+	store.DeleteUrl(ctx, urls[2].ShortCode)
+
+	router := mux.NewRouter()
+	router.Use(requestContextMiddleware(store, nil, nil))
+	router.Use(userRateLimitMiddleware(defaultConfig().RateLimits, defaultConfig().Plans))
+	router.Use(apiKeyMiddleware())
+	router.HandleFunc("/user/urls", getUserUrls).Methods("GET").Name("user_urls")
+
+	list := func(query string) ([]string, int64) {
+		rr := serveUsersRequest(router, "GET", "/user/urls?"+query, user.ApiKey, "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: got %v want %v", query, rr.Code, http.StatusOK)
+		}
+
+		var body struct {
+			Urls       []UrlShortener `json:"urls"`
+			Pagination struct {
+				TotalCount int64 `json:"totalCount"`
+			} `json:"pagination"`
+		}
+		json.NewDecoder(rr.Body).Decode(&body)
+
+		shortCodes := []string{}
+		for _, urlShortener := range body.Urls {
+			shortCodes = append(shortCodes, urlShortener.ShortCode)
+		}
+		return shortCodes, body.Pagination.TotalCount
+	}
+
+	// Test 1: Every link is listed by default, oldest first
+	if got, count := list(""); len(got) != 3 || count != 3 || got[0] != urls[0].ShortCode {
+		t.Errorf("got %v and a count of %d want all 3 links", got, count)
+	}
+
+	// Test 2: Filters are combined and counted
+	if got, count := list("status=active&search=SALE&sort=-views"); fmt.Sprint(got) != fmt.Sprint([]string{urls[1].ShortCode, urls[0].ShortCode}) || count != 2 {
+		t.Errorf("got %v and a count of %d want both sales, most viewed first", got, count)
+	}
+	if got, count := list("status=deleted"); len(got) != 1 || got[0] != urls[2].ShortCode || count != 1 {
+		t.Errorf("got %v and a count of %d want the deleted link", got, count)
+	}
+	if got, _ := list("created_from=" + now.Add(-2*time.Hour).Format(time.RFC3339) + "&pageSize=1&page=2"); len(got) != 1 || got[0] != urls[2].ShortCode {
+		t.Errorf("got %v want the last link created in the range on the second page", got)
+	}
+
+	// Test 3: Invalid parameters are rejected
+	for _, query := range []string{"status=archived", "sort=name", "created_to=tomorrow"} {
+		if rr := serveUsersRequest(router, "GET", "/user/urls?"+query, user.ApiKey, ""); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %v want %v", query, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestGetUserUrlsCursor(t *testing.T) {
+	initRedis(defaultConfig().Redis)
+
+	store := newMemoryLinkStore()
+	ctx := context.Background()
+	user := &Users{Email: uuid.NewString() + "@example.com", ApiKey: uuid.NewString()}
+	store.CreateUser(ctx, user)
+
+	// Links sharing a timestamp are told apart by their short code.
+	createdAt := time.Now().Add(-time.Hour)
+	want := []string{}
+	for i := 0; i < 5; i++ {
+		shortCode := fmt.Sprintf("cursor%d", i)
+		store.InsertUrl(ctx, &UrlShortener{OriginalUrl: "http://example.com", ShortCode: shortCode, UserId: &user.Id, CreatedAt: createdAt.Add(time.Duration(i/2) * time.Minute)})
+		want = append(want, shortCode)
+	}
+
+	router := mux.NewRouter()
+	router.Use(requestContextMiddleware(store, nil, nil))
+	router.Use(userRateLimitMiddleware(defaultConfig().RateLimits, defaultConfig().Plans))
+	router.Use(apiKeyMiddleware())
+	router.HandleFunc("/user/urls", getUserUrls).Methods("GET").Name("user_urls")
+
+	type response struct {
+		Urls       []UrlShortener         `json:"urls"`
+		NextCursor *string                `json:"next_cursor"`
+		Pagination map[string]interface{} `json:"pagination"`
+	}
+	list := func(query string) response {
+		rr := serveUsersRequest(router, "GET", "/user/urls?"+query, user.ApiKey, "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: got %v want %v: %s", query, rr.Code, http.StatusOK, rr.Body.String())
+		}
+
+		var body response
+		json.NewDecoder(rr.Body).Decode(&body)
+		return body
+	}
+
+	// Test 1: Following next_cursor walks every link once
+	got := []string{}
+	body := list("cursor=&pageSize=2")
+	if body.Pagination["totalCount"] != 5.0 {
+		t.Errorf("got pagination %v want a total count of 5", body.Pagination)
+	}
+	for pages := 1; ; pages++ {
+		for _, urlShortener := range body.Urls {
+			got = append(got, urlShortener.ShortCode)
+		}
+		if body.NextCursor == nil {
+			break
+		}
+		if pages > 5 {
+			t.Fatal("next_cursor does not stop")
+		}
+		body = list("pageSize=2&count=false&cursor=" + *body.NextCursor)
+		if _, counted := body.Pagination["totalCount"]; counted {
+			t.Errorf("got pagination %v want no count", body.Pagination)
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+
+	// Test 2: Descending order and the offset mode keep working
+	if body := list("cursor=&sort=-created_at&pageSize=4"); len(body.Urls) != 4 || body.Urls[0].ShortCode != "cursor4" || body.NextCursor == nil {
+		t.Errorf("got %+v want the 4 newest links and a cursor", body)
+	}
+	if body := list("page=3&pageSize=2"); len(body.Urls) != 1 || body.Urls[0].ShortCode != "cursor4" || body.Pagination["totalPages"] != 3.0 {
+		t.Errorf("got %+v want the last link on page 3 of 3", body)
+	}
+
+	// Test 3: Broken cursors and other sort orders are rejected
+	for _, query := range []string{"cursor=abc", "cursor=&sort=views", "count=sometimes"} {
+		if rr := serveUsersRequest(router, "GET", "/user/urls?"+query, user.ApiKey, ""); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %v want %v", query, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestRouteNamesAreUnique(t *testing.T) {
+	router := newRouter(defaultConfig(), newMemoryLinkStore(), nil, nil, nil, nil)
+
+	names := make(map[string]string)
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, _ := route.GetPathTemplate()
+		if name := route.GetName(); name != "" {
+			if other, exists := names[name]; exists {
+				t.Errorf("route name %q is used by %s and %s", name, other, path)
+			}
+			names[name] = path
+		}
+		return nil
+	})
+
+	if path, _ := router.Get("resolve_code").GetPathTemplate(); path != "/{code}" {
+		t.Errorf("got %v want the catch-all", path)
+	}
+}
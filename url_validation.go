@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// maxUrlLength matches the original_url column in
+// migrations/0001_create_url_shortener.sql.
+const maxUrlLength = 2048
+
+var allowedUrlSchemes = map[string]bool{
+	"http":  true,
+	"https": true,
+}
+
+// urlValidationError is returned to the client as the JSON body of a 400.
+type urlValidationError struct {
+	Code    string `json:"error"`
+	Message string `json:"message"`
+}
+
+func (e *urlValidationError) Error() string {
+	return e.Message
+}
+
+// normalizeUrl parses rawUrl as an absolute http(s) URL and returns it with a
+// lower-case, punycode encoded host so equal destinations are stored the same
+// way.
+func normalizeUrl(rawUrl string) (string, *urlValidationError) {
+	rawUrl = strings.TrimSpace(rawUrl)
+	if len(rawUrl) > maxUrlLength {
+		return "", &urlValidationError{Code: "url_too_long", Message: "URL must be at most 2048 characters"}
+	}
+
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", &urlValidationError{Code: "invalid_url", Message: "URL could not be parsed"}
+	}
+
+	if parsedUrl.Scheme == "" {
+		return "", &urlValidationError{Code: "invalid_url", Message: "URL must be absolute"}
+	}
+
+	if !allowedUrlSchemes[strings.ToLower(parsedUrl.Scheme)] {
+		return "", &urlValidationError{Code: "unsupported_scheme", Message: "URL scheme must be http or https"}
+	}
+
+	hostname := parsedUrl.Hostname()
+	if hostname == "" {
+		return "", &urlValidationError{Code: "missing_host", Message: "URL must have a host"}
+	}
+
+	host := strings.ToLower(hostname)
+	if net.ParseIP(hostname) == nil {
+		host, err = idna.Lookup.ToASCII(hostname)
+		if err != nil {
+			return "", &urlValidationError{Code: "invalid_host", Message: "URL host is not a valid domain name"}
+		}
+	}
+
+	switch {
+	case parsedUrl.Port() != "":
+		parsedUrl.Host = net.JoinHostPort(host, parsedUrl.Port())
+	case strings.Contains(host, ":"):
+		// IPv6 literals have to be bracketed again.
+		parsedUrl.Host = "[" + host + "]"
+	default:
+		parsedUrl.Host = host
+	}
+	parsedUrl.Scheme = strings.ToLower(parsedUrl.Scheme)
+
+	normalizedUrl := parsedUrl.String()
+	if len(normalizedUrl) > maxUrlLength {
+		return "", &urlValidationError{Code: "url_too_long", Message: "URL must be at most 2048 characters"}
+	}
+
+	return normalizedUrl, nil
+}
+
+func writeUrlValidationError(w http.ResponseWriter, validationErr *urlValidationError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(validationErr)
+}
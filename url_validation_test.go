@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeUrl(t *testing.T) {
+	tests := []struct {
+		rawUrl    string
+		want      string
+		errorCode string
+	}{
+		{rawUrl: "http://example.com", want: "http://example.com"},
+		{rawUrl: "  HTTPS://Example.COM/Path?q=1#top ", want: "https://example.com/Path?q=1#top"},
+		{rawUrl: "http://bücher.example/buch", want: "http://xn--bcher-kva.example/buch"},
+		{rawUrl: "http://Example.com:8080/", want: "http://example.com:8080/"},
+		{rawUrl: "http://[::1]:8080/", want: "http://[::1]:8080/"},
+		{rawUrl: "http://127.0.0.1/", want: "http://127.0.0.1/"},
+		{rawUrl: "javascript:alert(1)", errorCode: "unsupported_scheme"},
+		{rawUrl: "ftp://example.com/file", errorCode: "unsupported_scheme"},
+		{rawUrl: "not a url", errorCode: "invalid_url"},
+		{rawUrl: "/relative/path", errorCode: "invalid_url"},
+		{rawUrl: "http://", errorCode: "missing_host"},
+		{rawUrl: "http://exa mple.com", errorCode: "invalid_url"},
+		{rawUrl: "http://example.com/" + strings.Repeat("a", maxUrlLength), errorCode: "url_too_long"},
+	}
+
+	for _, test := range tests {
+		got, validationErr := normalizeUrl(test.rawUrl)
+
+		if test.errorCode != "" {
+			if validationErr == nil || validationErr.Code != test.errorCode {
+				t.Errorf("normalizeUrl(%q): got error %v want %v", test.rawUrl, validationErr, test.errorCode)
+			}
+			continue
+		}
+
+		if validationErr != nil {
+			t.Errorf("normalizeUrl(%q) returned error: %v", test.rawUrl, validationErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("normalizeUrl(%q): got %v want %v", test.rawUrl, got, test.want)
+		}
+	}
+}
+
+func TestShortenRejectsInvalidUrls(t *testing.T) {
+	ctx := withStore(context.Background(), newMemoryLinkStore())
+
+	shortenReq, _ := http.NewRequest("POST", "/shorten", strings.NewReader(`{"url": "javascript:alert(1)"}`))
+	shortenRR := httptest.NewRecorder()
+	serveWithContext(ctx, shortenUrl).ServeHTTP(shortenRR, shortenReq)
+
+	if status := shortenRR.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	var response urlValidationError
+	if err := json.NewDecoder(shortenRR.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode error response: %v", err)
+	}
+	if response.Code != "unsupported_scheme" {
+		t.Errorf("got error code %v want %v", response.Code, "unsupported_scheme")
+	}
+
+	bulkReqBody := strings.NewReader(`{"urls": [{"url": "http://example.com"}, {"url": "/relative"}]}`)
+	bulkReq, _ := http.NewRequest("POST", "/shorten/bulk", bulkReqBody)
+	bulkRR := httptest.NewRecorder()
+	serveWithContext(ctx, shortenUrlBulk).ServeHTTP(bulkRR, bulkReq)
+
+	if status := bulkRR.Code; status != http.StatusMultiStatus {
+		t.Errorf("bulk handler returned wrong status code: got %v want %v", status, http.StatusMultiStatus)
+	}
+
+	var bulkResponse struct {
+		Results []bulkShortenResult `json:"results"`
+	}
+	if err := json.NewDecoder(bulkRR.Body).Decode(&bulkResponse); err != nil {
+		t.Fatalf("failed to decode bulk response: %v", err)
+	}
+	if len(bulkResponse.Results) != 2 || bulkResponse.Results[1].ErrorCode != "invalid_url" {
+		t.Errorf("got results %+v want invalid_url for the second item", bulkResponse.Results)
+	}
+}
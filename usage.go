@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Counters of Usages with a monthly quota, named after their column.
+const (
+	usageLinksCreated = "links_created"
+	usageBulkJobs     = "bulk_jobs"
+)
+
+// counterUsage is a usage of n for counter.
+func counterUsage(userId uint, month string, counter string, n int64) Usages {
+	usage := Usages{UserId: userId, Month: month}
+	switch counter {
+	case usageLinksCreated:
+		usage.LinksCreated = n
+	case usageBulkJobs:
+		usage.BulkJobs = n
+	}
+	return usage
+}
+
+// usageCounter is the value of counter in usage.
+func usageCounter(usage *Usages, counter string) int64 {
+	switch counter {
+	case usageLinksCreated:
+		return usage.LinksCreated
+	case usageBulkJobs:
+		return usage.BulkJobs
+	default:
+		return 0
+	}
+}
+
+// usageMonth is the Month of the usage counted at t.
+func usageMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// nextMonth is the start of the month after t, when the monthly quotas are
+// reset.
+func nextMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// mergeUsages adds up the usages of the same user and month, in the order
+// they first appear.
+func mergeUsages(usages []Usages) []Usages {
+	merged := []Usages{}
+	indexes := make(map[string]int)
+	for _, usage := range usages {
+		key := fmt.Sprintf("%d/%s", usage.UserId, usage.Month)
+		i, exists := indexes[key]
+		if !exists {
+			indexes[key] = len(merged)
+			merged = append(merged, Usages{UserId: usage.UserId, Month: usage.Month})
+			i = len(merged) - 1
+		}
+
+		merged[i].LinksCreated += usage.LinksCreated
+		merged[i].Redirects += usage.Redirects
+		merged[i].BulkJobs += usage.BulkJobs
+	}
+
+	return merged
+}
+
+// recordUsage adds usage to the counters of user this month. Anonymous
+// requests are not counted, and like clicks a failed write is only logged.
+func recordUsage(ctx context.Context, user *Users, usage Usages) {
+	if user == nil {
+		return
+	}
+
+	usage.UserId = user.Id
+	usage.Month = usageMonth(time.Now())
+	if err := getStoreFromContext(ctx).AddUsages(ctx, []Usages{usage}); err != nil {
+		log.Printf("Error recording the usage of user %d: %v request_id=%s", user.Id, err, getRequestIdFromContext(ctx))
+	}
+}
+
+// getUserUsage returns the counters of the current month, or of ?month=
+// (2006-01), next to the quotas of the user's plan. A quota of null means
+// no limit.
+func getUserUsage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := getUserFromContext(ctx)
+
+	month := usageMonth(time.Now())
+	if r.URL.Query().Has("month") {
+		parsed, err := time.Parse("2006-01", r.URL.Query().Get("month"))
+		if err != nil {
+			http.Error(w, "month must look like 2006-01", http.StatusBadRequest)
+			return
+		}
+		month = usageMonth(parsed)
+	}
+
+	usage, err := getStoreFromContext(ctx).GetUsage(ctx, user.Id, month)
+	if err != nil {
+		http.Error(w, "Error fetching the usage", http.StatusInternalServerError)
+		return
+	}
+
+	plan := userPlan(ctx, user)
+	quota := func(limit int64) *int64 {
+		if limit == 0 {
+			return nil
+		}
+		return &limit
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"month":         usage.Month,
+		"links_created": usage.LinksCreated,
+		"redirects":     usage.Redirects,
+		"bulk_jobs":     usage.BulkJobs,
+		"quotas": map[string]interface{}{
+			"monthly_links":     quota(plan.MonthlyLinks),
+			"monthly_bulk_jobs": quota(plan.MonthlyBulkJobs),
+		},
+		"resets_at": nextMonth(time.Now()),
+	})
+}
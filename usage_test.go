@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type usageResponse struct {
+	Month        string `json:"month"`
+	LinksCreated int64  `json:"links_created"`
+	Redirects    int64  `json:"redirects"`
+	BulkJobs     int64  `json:"bulk_jobs"`
+	Quotas       struct {
+		MonthlyLinks    *int64 `json:"monthly_links"`
+		MonthlyBulkJobs *int64 `json:"monthly_bulk_jobs"`
+	} `json:"quotas"`
+}
+
+func TestUserUsage(t *testing.T) {
+	initRedis(defaultConfig().Redis)
+
+	plans := defaultConfig().Plans
+	plans.Tiers["team"] = Plan{Bulk: true, MonthlyLinks: 10, MonthlyBulkJobs: 1}
+
+	store := newMemoryLinkStore()
+	router := newTestRouter(t, store, nil, func(cfg *Config) { cfg.Plans = plans })
+	team := createPlanTestUser(t, store, "team")
+
+	// Test 1: Links, bulk requests and redirects are counted
+	rr := serveUsersRequest(router, "POST", "/shorten", team.ApiKey, `{"url": "http://example.com"}`)
+	var created map[string]string
+	json.NewDecoder(rr.Body).Decode(&created)
+
+	if rr := serveUsersRequest(router, "POST", "/shorten/bulk", team.ApiKey, `{"urls": [{"url": "http://example.com/1"}, {"url": "/relative"}, {"url": "http://example.com/3"}]}`); rr.Code != http.StatusMultiStatus {
+		t.Fatalf("bulk: got %v want %v", rr.Code, http.StatusMultiStatus)
+	}
+
+	lastMonth := time.Now().UTC().AddDate(0, 0, -time.Now().UTC().Day())
+	store.RecordClicks(context.Background(), []Clicks{
+		{ShortCode: created["short_code"], Timestamp: time.Now()},
+		{ShortCode: created["short_code"], Timestamp: time.Now()},
+		{ShortCode: created["short_code"], Timestamp: lastMonth},
+	})
+
+	rr = serveUsersRequest(router, "GET", "/user/usage", team.ApiKey, "")
+	var usage usageResponse
+	json.NewDecoder(rr.Body).Decode(&usage)
+	if rr.Code != http.StatusOK || usage.Month != usageMonth(time.Now()) || usage.LinksCreated != 3 || usage.Redirects != 2 || usage.BulkJobs != 1 {
+		t.Errorf("got %v %+v want 3 links, 2 redirects and 1 bulk job this month", rr.Code, usage)
+	}
+	if usage.Quotas.MonthlyLinks == nil || *usage.Quotas.MonthlyLinks != 10 || *usage.Quotas.MonthlyBulkJobs != 1 {
+		t.Errorf("got quotas %+v want the ones of the team plan", usage.Quotas)
+	}
+
+	// Test 2: Earlier months are kept apart
+	rr = serveUsersRequest(router, "GET", "/user/usage?month="+usageMonth(lastMonth), team.ApiKey, "")
+	usage = usageResponse{}
+	json.NewDecoder(rr.Body).Decode(&usage)
+	if usage.Redirects != 1 || usage.LinksCreated != 0 {
+		t.Errorf("got %+v want only the redirect of last month", usage)
+	}
+	if rr := serveUsersRequest(router, "GET", "/user/usage?month=october", team.ApiKey, ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid month: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	// Test 3: Bulk requests over the quota are limited until the next month
+	rr = serveUsersRequest(router, "POST", "/shorten/bulk", team.ApiKey, `{"urls": [{"url": "http://example.com"}]}`)
+	var quotaErr urlValidationError
+	json.NewDecoder(rr.Body).Decode(&quotaErr)
+	if rr.Code != http.StatusTooManyRequests || quotaErr.Code != planErrorMonthlyBulkJobs {
+		t.Errorf("got %v %+v want %v", rr.Code, quotaErr, planErrorMonthlyBulkJobs)
+	}
+	retryAfter, _ := strconv.Atoi(rr.Header().Get("Retry-After"))
+	if until := time.Until(nextMonth(time.Now())); retryAfter < int(until.Seconds()) || retryAfter > int(until.Seconds())+1 {
+		t.Errorf("got Retry-After %v want %v", retryAfter, until)
+	}
+
+	// Test 4: The usage endpoint needs a key
+	if rr := serveUsersRequest(router, "GET", "/user/usage", "", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("without a key: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestNextMonth(t *testing.T) {
+	got := nextMonth(time.Date(2026, 12, 31, 23, 0, 0, 0, time.FixedZone("", -2*60*60)))
+	if want := time.Date(2027, 2, 1, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	primaryApiKeyId  = "primary"
+	previousApiKeyId = "previous"
+)
+
+// apiKeyInfo describes a key without revealing it, only the prefix is
+// returned so users can tell their keys apart. Named keys have their numeric
+// id, the account keys are "primary" and "previous".
+type apiKeyInfo struct {
+	Id         string     `json:"id"`
+	Name       string     `json:"name,omitempty"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+func createUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var requestBody struct {
+		Email string  `json:"email"`
+		Name  *string `json:"name"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	email := strings.TrimSpace(requestBody.Email)
+	if address, err := mail.ParseAddress(email); err != nil || address.Address != email {
+		http.Error(w, "A valid email is required", http.StatusBadRequest)
+		return
+	}
+
+	apiKey, err := newApiKey()
+	if err != nil {
+		http.Error(w, "Error creating the user", http.StatusInternalServerError)
+		return
+	}
+
+	store := getStoreFromContext(ctx)
+	user := &Users{Email: strings.ToLower(email), Name: requestBody.Name, ApiKey: apiKey}
+	if err := store.CreateUser(ctx, user); errors.Is(err, ErrConflict) {
+		// The unique index on email is the only constraint a new user with a
+		// random key can realistically hit.
+		http.Error(w, "A user with this email already exists", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Error creating user: %v request_id=%s", err, getRequestIdFromContext(ctx))
+		http.Error(w, "Error creating the user", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":      user.Id,
+		"email":   user.Email,
+		"name":    user.Name,
+		"tier":    user.Tier,
+		"api_key": apiKey,
+	})
+}
+
+// rotateApiKey issues a new primary key. The key used until now stays valid
+// for gracePeriod, replacing any previous key that was still in its grace
+// period.
+func rotateApiKey(gracePeriod time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		user := getUserFromContext(ctx)
+
+		apiKey, err := newApiKey()
+		if err != nil {
+			http.Error(w, "Error rotating the API key", http.StatusInternalServerError)
+			return
+		}
+
+		previousExpiresAt := time.Now().Add(gracePeriod)
+		if err := getStoreFromContext(ctx).RotateApiKey(ctx, user.Id, apiKey, previousExpiresAt); err != nil {
+			http.Error(w, "Error rotating the API key", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"api_key":                 apiKey,
+			"previous_key_expires_at": previousExpiresAt,
+		})
+	}
+}
+
+// createApiKey issues a named key limited to the requested scopes. Like at
+// signup the key is only returned in this response.
+func createApiKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := getUserFromContext(ctx)
+
+	var requestBody struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(requestBody.Name)
+	if name == "" || len(name) > 100 {
+		http.Error(w, "A name of at most 100 characters is required", http.StatusBadRequest)
+		return
+	}
+
+	if len(requestBody.Scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+
+	var scopes []string
+	for _, scope := range requestBody.Scopes {
+		if !slices.Contains(apiKeyScopes, scope) {
+			http.Error(w, "Unknown scope "+strconv.Quote(scope)+", valid scopes are "+strings.Join(apiKeyScopes, ", "), http.StatusBadRequest)
+			return
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	if requestBody.ExpiresAt != nil && !requestBody.ExpiresAt.After(time.Now()) {
+		http.Error(w, "Expiration date must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	apiKey, err := newApiKey()
+	if err != nil {
+		http.Error(w, "Error creating the API key", http.StatusInternalServerError)
+		return
+	}
+
+	key := &ApiKeys{
+		UserId:    user.Id,
+		Name:      name,
+		Key:       apiKey,
+		Scopes:    strings.Join(scopes, " "),
+		ExpiresAt: requestBody.ExpiresAt,
+	}
+	if err := getStoreFromContext(ctx).CreateApiKey(ctx, key); err != nil {
+		http.Error(w, "Error creating the API key", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":         strconv.FormatUint(uint64(key.Id), 10),
+		"name":       key.Name,
+		"prefix":     key.Prefix,
+		"scopes":     scopes,
+		"expires_at": key.ExpiresAt,
+		"api_key":    apiKey,
+	})
+}
+
+func listApiKeys(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := getUserFromContext(ctx)
+
+	keys := []apiKeyInfo{{Id: primaryApiKeyId, Prefix: user.ApiKeyPrefix, Scopes: accountKeyScopes}}
+	if user.PreviousApiKeyPrefix != nil && user.PreviousApiKeyExpiresAt != nil && user.PreviousApiKeyExpiresAt.After(time.Now()) {
+		keys = append(keys, apiKeyInfo{
+			Id:        previousApiKeyId,
+			Prefix:    *user.PreviousApiKeyPrefix,
+			Scopes:    accountKeyScopes,
+			ExpiresAt: user.PreviousApiKeyExpiresAt,
+		})
+	}
+
+	namedKeys, err := getStoreFromContext(ctx).ListApiKeys(ctx, user.Id)
+	if err != nil {
+		http.Error(w, "Error listing the API keys", http.StatusInternalServerError)
+		return
+	}
+
+	for _, key := range namedKeys {
+		keys = append(keys, apiKeyInfo{
+			Id:         strconv.FormatUint(uint64(key.Id), 10),
+			Name:       key.Name,
+			Prefix:     key.Prefix,
+			Scopes:     key.scopeList(),
+			ExpiresAt:  key.ExpiresAt,
+			LastUsedAt: key.LastUsedAt,
+		})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+// revokeApiKey deletes a named key or ends the grace period of the previous
+// key. The primary key cannot be revoked, that would lock the user out, it
+// has to be rotated.
+func revokeApiKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := getUserFromContext(ctx)
+	store := getStoreFromContext(ctx)
+
+	switch id := mux.Vars(r)["id"]; id {
+	case primaryApiKeyId:
+		http.Error(w, "The primary key cannot be revoked, rotate it instead", http.StatusBadRequest)
+		return
+	case previousApiKeyId:
+		if err := store.RevokePreviousApiKey(ctx, user.Id); err != nil {
+			http.Error(w, "Error revoking the API key", http.StatusInternalServerError)
+			return
+		}
+	default:
+		keyId, err := strconv.ParseUint(id, 10, 0)
+		if err != nil {
+			http.Error(w, "API key not found", http.StatusNotFound)
+			return
+		}
+
+		if err := store.DeleteApiKey(ctx, user.Id, uint(keyId)); errors.Is(err, ErrNotFound) {
+			http.Error(w, "API key not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Error revoking the API key", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// newTestRouter is the router of the server on store, with the default
+// config changed by configure when it is not nil. The IP rate limits are
+// lifted so tests are not refused because of the requests of the ones
+// before, and the request logs are written to store.
+func newTestRouter(t *testing.T, store LinkStore, runner *jobRunner, configure func(cfg *Config)) *mux.Router {
+	t.Helper()
+
+	cfg := defaultConfig()
+	unlimited := RateLimit{Requests: 1 << 30, Window: time.Second}
+	cfg.RateLimits.Redirect = unlimited
+	cfg.RateLimits.Shorten = unlimited
+	cfg.RateLimits.Default = unlimited
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	requestLogger := newRequestLogger(store, cfg.RequestLog.BufferSize, cfg.RequestLog.FlushInterval)
+	t.Cleanup(func() { requestLogger.Close(context.Background()) })
+
+	return newRouter(cfg, store, requestLogger, nil, nil, runner)
+}
+
+func serveUsersRequest(router http.Handler, method string, path string, apiKey string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestCreateUser(t *testing.T) {
+	router := newTestRouter(t, newMemoryLinkStore(), nil, nil)
+
+	// Test 1: Signing up returns a working API key
+	rr := serveUsersRequest(router, "POST", "/users", "", `{"email": "Someone@Example.com", "name": "Someone"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+
+	var response struct {
+		Email  string `json:"email"`
+		Tier   string `json:"tier"`
+		ApiKey string `json:"api_key"`
+	}
+	json.NewDecoder(rr.Body).Decode(&response)
+	if response.ApiKey == "" || response.Email != "someone@example.com" || response.Tier != "hobby" {
+		t.Errorf("got %+v want a hobby user someone@example.com with an API key", response)
+	}
+
+	if rr := serveUsersRequest(router, "GET", "/user/keys", response.ApiKey, ""); rr.Code != http.StatusOK {
+		t.Errorf("new API key was rejected: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	// Test 2: The email can only be registered once
+	rr = serveUsersRequest(router, "POST", "/users", "", `{"email": "someone@example.com"}`)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("duplicate email: got %v want %v", rr.Code, http.StatusConflict)
+	}
+
+	// Test 3: Invalid emails are rejected
+	rr = serveUsersRequest(router, "POST", "/users", "", `{"email": "not an email"}`)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid email: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	// Test 4: A failing store is not reported as a duplicate email
+	router = newTestRouter(t, failingUserStore{newMemoryLinkStore()}, nil, nil)
+	rr = serveUsersRequest(router, "POST", "/users", "", `{"email": "other@example.com"}`)
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("failing store: got %v want %v", rr.Code, http.StatusInternalServerError)
+	}
+}
+
+type failingUserStore struct {
+	LinkStore
+}
+
+func (failingUserStore) CreateUser(ctx context.Context, user *Users) error {
+	return errors.New("database is down")
+}
+
+func TestRotateAndRevokeApiKey(t *testing.T) {
+	router := newTestRouter(t, newMemoryLinkStore(), nil, nil)
+
+	rr := serveUsersRequest(router, "POST", "/users", "", `{"email": "rotate@example.com"}`)
+	var user struct {
+		ApiKey string `json:"api_key"`
+	}
+	json.NewDecoder(rr.Body).Decode(&user)
+	oldApiKey := user.ApiKey
+
+	// Test 1: After a rotation both keys work during the grace period
+	rr = serveUsersRequest(router, "POST", "/user/keys/rotate", oldApiKey, "")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("rotate returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+
+	var rotated struct {
+		ApiKey string `json:"api_key"`
+	}
+	json.NewDecoder(rr.Body).Decode(&rotated)
+	if rotated.ApiKey == "" || rotated.ApiKey == oldApiKey {
+		t.Fatalf("rotate did not issue a new key: got %q", rotated.ApiKey)
+	}
+
+	for _, apiKey := range []string{oldApiKey, rotated.ApiKey} {
+		if rr := serveUsersRequest(router, "GET", "/user/keys", apiKey, ""); rr.Code != http.StatusOK {
+			t.Errorf("key %s rejected during the grace period: got %v want %v", apiKeyPrefix(apiKey), rr.Code, http.StatusOK)
+		}
+	}
+
+	rr = serveUsersRequest(router, "GET", "/user/keys", rotated.ApiKey, "")
+	var listed struct {
+		Keys []apiKeyInfo `json:"keys"`
+	}
+	json.NewDecoder(rr.Body).Decode(&listed)
+	if len(listed.Keys) != 2 || listed.Keys[0].Id != primaryApiKeyId || listed.Keys[1].Id != previousApiKeyId {
+		t.Errorf("got keys %+v want primary and previous", listed.Keys)
+	}
+	if listed.Keys[0].Prefix != apiKeyPrefix(rotated.ApiKey) || listed.Keys[1].Prefix != apiKeyPrefix(oldApiKey) {
+		t.Errorf("got prefixes %v and %v want %v and %v", listed.Keys[0].Prefix, listed.Keys[1].Prefix, apiKeyPrefix(rotated.ApiKey), apiKeyPrefix(oldApiKey))
+	}
+	if strings.Contains(rr.Body.String(), rotated.ApiKey) {
+		t.Error("listing keys must not reveal them")
+	}
+
+	// Test 2: The primary key cannot be revoked
+	rr = serveUsersRequest(router, "DELETE", "/user/keys/primary", rotated.ApiKey, "")
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("revoking the primary key: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	// Test 3: Revoking the previous key ends its grace period
+	rr = serveUsersRequest(router, "DELETE", "/user/keys/previous", rotated.ApiKey, "")
+	if rr.Code != http.StatusOK {
+		t.Errorf("revoking the previous key: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	if rr := serveUsersRequest(router, "GET", "/user/keys", oldApiKey, ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("revoked key: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+	if rr := serveUsersRequest(router, "GET", "/user/keys", rotated.ApiKey, ""); rr.Code != http.StatusOK {
+		t.Errorf("primary key after revoking the previous one: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestNamedApiKeyScopes(t *testing.T) {
+	router := newTestRouter(t, newMemoryLinkStore(), nil, nil)
+
+	rr := serveUsersRequest(router, "POST", "/users", "", `{"email": "scopes@example.com"}`)
+	var user struct {
+		ApiKey string `json:"api_key"`
+	}
+	json.NewDecoder(rr.Body).Decode(&user)
+
+	// Test 1: Unknown scopes are rejected
+	rr = serveUsersRequest(router, "POST", "/user/keys", user.ApiKey, `{"name": "ci", "scopes": ["links:delete"]}`)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown scope: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	// Test 2: A read-only key can list links but cannot manage keys
+	rr = serveUsersRequest(router, "POST", "/user/keys", user.ApiKey, `{"name": "dashboard", "scopes": ["links:read"]}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create key returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+
+	var created struct {
+		Id     string `json:"id"`
+		ApiKey string `json:"api_key"`
+	}
+	json.NewDecoder(rr.Body).Decode(&created)
+
+	if rr := serveUsersRequest(router, "GET", "/user/urls", created.ApiKey, ""); rr.Code != http.StatusOK {
+		t.Errorf("read-only key listing links: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := serveUsersRequest(router, "GET", "/user/keys", created.ApiKey, ""); rr.Code != http.StatusForbidden {
+		t.Errorf("read-only key listing keys: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// Test 3: The account key lists the named key without revealing it
+	rr = serveUsersRequest(router, "GET", "/user/keys", user.ApiKey, "")
+	var listed struct {
+		Keys []apiKeyInfo `json:"keys"`
+	}
+	json.NewDecoder(rr.Body).Decode(&listed)
+	if len(listed.Keys) != 2 || listed.Keys[1].Name != "dashboard" || listed.Keys[1].LastUsedAt == nil {
+		t.Errorf("got keys %+v want primary and a used dashboard key", listed.Keys)
+	}
+	if strings.Contains(rr.Body.String(), created.ApiKey) {
+		t.Error("listing keys must not reveal them")
+	}
+
+	// Test 4: A revoked named key stops working
+	if rr := serveUsersRequest(router, "DELETE", "/user/keys/"+created.Id, user.ApiKey, ""); rr.Code != http.StatusOK {
+		t.Errorf("revoking a named key: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := serveUsersRequest(router, "GET", "/user/urls", created.ApiKey, ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("revoked named key: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+	if rr := serveUsersRequest(router, "DELETE", "/user/keys/"+created.Id, user.ApiKey, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("revoking a deleted key: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
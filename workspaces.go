@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Members of a workspace have one of these roles, each including the ones
+// below it: viewers list the links, editors create, edit and delete them,
+// admins manage the members and owners can also add or remove owners.
+const (
+	workspaceRoleViewer = "viewer"
+	workspaceRoleEditor = "editor"
+	workspaceRoleAdmin  = "admin"
+	workspaceRoleOwner  = "owner"
+)
+
+var workspaceRoleRanks = map[string]int{
+	workspaceRoleViewer: 1,
+	workspaceRoleEditor: 2,
+	workspaceRoleAdmin:  3,
+	workspaceRoleOwner:  4,
+}
+
+func isValidWorkspaceRole(role string) bool {
+	_, exists := workspaceRoleRanks[role]
+	return exists
+}
+
+// hasWorkspaceRole reports whether member has at least the role required.
+// A nil member is not part of the workspace.
+func hasWorkspaceRole(member *WorkspaceMembers, required string) bool {
+	return member != nil && workspaceRoleRanks[member.Role] >= workspaceRoleRanks[required]
+}
+
+func getWorkspaceMember(ctx context.Context, workspaceId uint, userId uint) *WorkspaceMembers {
+	member, err := getStoreFromContext(ctx).GetWorkspaceMember(ctx, workspaceId, userId)
+	if err != nil {
+		return nil
+	}
+
+	return member
+}
+
+// canManageUrl reports whether user may edit or delete the link. Links of a
+// workspace are managed by its editors, other links only by their creator.
+func canManageUrl(ctx context.Context, user *Users, urlModel *UrlShortener) bool {
+	if urlModel.WorkspaceId != nil {
+		return hasWorkspaceRole(getWorkspaceMember(ctx, *urlModel.WorkspaceId, user.Id), workspaceRoleEditor)
+	}
+
+	return urlModel.UserId != nil && *urlModel.UserId == user.Id
+}
+
+// requestWorkspaceMember returns the membership of the current user in the
+// workspace of the {id} route variable. Workspaces the user is not a member
+// of are reported as not found, so their ids do not leak.
+func requestWorkspaceMember(w http.ResponseWriter, r *http.Request) *WorkspaceMembers {
+	ctx := r.Context()
+	user := getUserFromContext(ctx)
+
+	workspaceId, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 0)
+	if err != nil {
+		http.Error(w, "Workspace not found", http.StatusNotFound)
+		return nil
+	}
+
+	member := getWorkspaceMember(ctx, uint(workspaceId), user.Id)
+	if member == nil {
+		http.Error(w, "Workspace not found", http.StatusNotFound)
+		return nil
+	}
+
+	return member
+}
+
+func countWorkspaceOwners(members []WorkspaceMembers) int {
+	owners := 0
+	for _, member := range members {
+		if member.Role == workspaceRoleOwner {
+			owners++
+		}
+	}
+
+	return owners
+}
+
+func createWorkspace(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := getUserFromContext(ctx)
+
+	var requestBody struct {
+		Name string `json:"name"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(requestBody.Name)
+	if name == "" || len(name) > 100 {
+		http.Error(w, "A name of at most 100 characters is required", http.StatusBadRequest)
+		return
+	}
+
+	workspace := &Workspaces{Name: name}
+	if err := getStoreFromContext(ctx).CreateWorkspace(ctx, workspace, user.Id); err != nil {
+		http.Error(w, "Error creating the workspace", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":   workspace.Id,
+		"name": workspace.Name,
+		"role": workspaceRoleOwner,
+	})
+}
+
+func listWorkspaces(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := getUserFromContext(ctx)
+
+	memberships, err := getStoreFromContext(ctx).ListWorkspacesByUserId(ctx, user.Id)
+	if err != nil {
+		http.Error(w, "Error listing the workspaces", http.StatusInternalServerError)
+		return
+	}
+
+	workspaces := []map[string]interface{}{}
+	for _, membership := range memberships {
+		workspaces = append(workspaces, map[string]interface{}{
+			"id":   membership.WorkspaceId,
+			"name": membership.Workspace.Name,
+			"role": membership.Role,
+		})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"workspaces": workspaces})
+}
+
+func listWorkspaceMembers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	member := requestWorkspaceMember(w, r)
+	if member == nil {
+		return
+	}
+
+	members, err := getStoreFromContext(ctx).ListWorkspaceMembers(ctx, member.WorkspaceId)
+	if err != nil {
+		http.Error(w, "Error listing the members", http.StatusInternalServerError)
+		return
+	}
+
+	response := []map[string]interface{}{}
+	for _, member := range members {
+		response = append(response, map[string]interface{}{
+			"user_id": member.UserId,
+			"email":   member.User.Email,
+			"name":    member.User.Name,
+			"role":    member.Role,
+		})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"members": response})
+}
+
+// saveWorkspaceMember adds a user by email or changes the role of a member.
+// Admins manage everyone but the owners, only owners can make or unmake
+// owners, and the last owner cannot be demoted.
+func saveWorkspaceMember(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store := getStoreFromContext(ctx)
+
+	member := requestWorkspaceMember(w, r)
+	if member == nil {
+		return
+	}
+
+	if !hasWorkspaceRole(member, workspaceRoleAdmin) {
+		http.Error(w, "Only admins can manage the members of a workspace", http.StatusForbidden)
+		return
+	}
+
+	var requestBody struct {
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !isValidWorkspaceRole(requestBody.Role) {
+		http.Error(w, "Role must be one of owner, admin, editor or viewer", http.StatusBadRequest)
+		return
+	}
+
+	target, err := store.GetUserByEmail(ctx, strings.ToLower(strings.TrimSpace(requestBody.Email)))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Error saving the member", http.StatusInternalServerError)
+		return
+	}
+
+	existing := getWorkspaceMember(ctx, member.WorkspaceId, target.Id)
+	changesOwner := requestBody.Role == workspaceRoleOwner || (existing != nil && existing.Role == workspaceRoleOwner)
+	if changesOwner && !hasWorkspaceRole(member, workspaceRoleOwner) {
+		http.Error(w, "Only owners can add or change owners", http.StatusForbidden)
+		return
+	}
+
+	if existing != nil && existing.Role == workspaceRoleOwner && requestBody.Role != workspaceRoleOwner {
+		members, err := store.ListWorkspaceMembers(ctx, member.WorkspaceId)
+		if err != nil {
+			http.Error(w, "Error saving the member", http.StatusInternalServerError)
+			return
+		}
+		if countWorkspaceOwners(members) == 1 {
+			http.Error(w, "A workspace needs at least one owner", http.StatusConflict)
+			return
+		}
+	}
+
+	saved := &WorkspaceMembers{WorkspaceId: member.WorkspaceId, UserId: target.Id, Role: requestBody.Role}
+	if err := store.SaveWorkspaceMember(ctx, saved); err != nil {
+		http.Error(w, "Error saving the member", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id": target.Id,
+		"email":   target.Email,
+		"role":    saved.Role,
+	})
+}
+
+// removeWorkspaceMember removes a member. Members can always leave, the
+// same rules as in saveWorkspaceMember apply to removing someone else. The
+// links they created stay in the workspace.
+func removeWorkspaceMember(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store := getStoreFromContext(ctx)
+
+	member := requestWorkspaceMember(w, r)
+	if member == nil {
+		return
+	}
+
+	userId, err := strconv.ParseUint(mux.Vars(r)["user_id"], 10, 0)
+	if err != nil {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+
+	existing := getWorkspaceMember(ctx, member.WorkspaceId, uint(userId))
+	if existing == nil {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+
+	if existing.UserId != member.UserId {
+		if !hasWorkspaceRole(member, workspaceRoleAdmin) {
+			http.Error(w, "Only admins can manage the members of a workspace", http.StatusForbidden)
+			return
+		}
+		if existing.Role == workspaceRoleOwner && !hasWorkspaceRole(member, workspaceRoleOwner) {
+			http.Error(w, "Only owners can add or change owners", http.StatusForbidden)
+			return
+		}
+	}
+
+	if existing.Role == workspaceRoleOwner {
+		members, err := store.ListWorkspaceMembers(ctx, member.WorkspaceId)
+		if err != nil {
+			http.Error(w, "Error removing the member", http.StatusInternalServerError)
+			return
+		}
+		if countWorkspaceOwners(members) == 1 {
+			http.Error(w, "A workspace needs at least one owner", http.StatusConflict)
+			return
+		}
+	}
+
+	if err := store.DeleteWorkspaceMember(ctx, member.WorkspaceId, existing.UserId); err != nil {
+		http.Error(w, "Error removing the member", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func signUpTestUser(t *testing.T, router http.Handler, email string) (uint, string) {
+	t.Helper()
+
+	rr := serveUsersRequest(router, "POST", "/users", "", `{"email": "`+email+`"}`)
+	var user struct {
+		Id     uint   `json:"id"`
+		ApiKey string `json:"api_key"`
+	}
+	json.NewDecoder(rr.Body).Decode(&user)
+	if user.ApiKey == "" {
+		t.Fatalf("signing up %s failed: %v", email, rr.Body.String())
+	}
+
+	return user.Id, user.ApiKey
+}
+
+func TestWorkspaceRoles(t *testing.T) {
+	initRedis(defaultConfig().Redis)
+
+	router := newTestRouter(t, newMemoryLinkStore(), nil, nil)
+
+	_, ownerKey := signUpTestUser(t, router, "owner@example.com")
+	editorId, editorKey := signUpTestUser(t, router, "editor@example.com")
+	_, viewerKey := signUpTestUser(t, router, "viewer@example.com")
+	_, outsiderKey := signUpTestUser(t, router, "outsider@example.com")
+
+	rr := serveUsersRequest(router, "POST", "/workspaces", ownerKey, `{"name": "Marketing"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create workspace returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+
+	var workspace struct {
+		Id uint `json:"id"`
+	}
+	json.NewDecoder(rr.Body).Decode(&workspace)
+	membersPath := fmt.Sprintf("/workspaces/%d/members", workspace.Id)
+
+	// Test 1: Only admins can add members
+	rr = serveUsersRequest(router, "PUT", membersPath, outsiderKey, `{"email": "viewer@example.com", "role": "viewer"}`)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("outsider adding a member: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	for email, role := range map[string]string{"editor@example.com": "editor", "viewer@example.com": "viewer"} {
+		rr = serveUsersRequest(router, "PUT", membersPath, ownerKey, `{"email": "`+email+`", "role": "`+role+`"}`)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("adding %s returned wrong status code: got %v want %v", email, rr.Code, http.StatusOK)
+		}
+	}
+
+	rr = serveUsersRequest(router, "PUT", membersPath, editorKey, `{"email": "outsider@example.com", "role": "viewer"}`)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("editor adding a member: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// Test 2: Editors create and manage workspace links, viewers only see them
+	body := fmt.Sprintf(`{"url": "http://example.com", "workspace_id": %d}`, workspace.Id)
+	if rr := serveUsersRequest(router, "POST", "/shorten", viewerKey, body); rr.Code != http.StatusForbidden {
+		t.Errorf("viewer creating a workspace link: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	rr = serveUsersRequest(router, "POST", "/shorten", editorKey, body)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("editor creating a workspace link: got %v want %v", rr.Code, http.StatusCreated)
+	}
+
+	var shortened struct {
+		ShortCode string `json:"short_code"`
+	}
+	json.NewDecoder(rr.Body).Decode(&shortened)
+	defer removeCachedUrl(context.Background(), shortened.ShortCode)
+
+	rr = serveUsersRequest(router, "GET", fmt.Sprintf("/user/urls?workspace_id=%d", workspace.Id), viewerKey, "")
+	if shortened.ShortCode == "" || !strings.Contains(rr.Body.String(), shortened.ShortCode) {
+		t.Errorf("viewer listing workspace links: got %v want %s", rr.Body.String(), shortened.ShortCode)
+	}
+
+	if rr := serveUsersRequest(router, "GET", fmt.Sprintf("/user/urls?workspace_id=%d", workspace.Id), outsiderKey, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("outsider listing workspace links: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	editBody := `{"short_code": "` + shortened.ShortCode + `", "redirect_type": 301}`
+	if rr := serveUsersRequest(router, "PUT", "/shorten", viewerKey, editBody); rr.Code != http.StatusForbidden {
+		t.Errorf("viewer editing a workspace link: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// Test 3: The links stay manageable after their creator left
+	if rr := serveUsersRequest(router, "DELETE", fmt.Sprintf("%s/%d", membersPath, editorId), editorKey, ""); rr.Code != http.StatusOK {
+		t.Errorf("editor leaving: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	if rr := serveUsersRequest(router, "PUT", "/shorten", editorKey, editBody); rr.Code != http.StatusForbidden {
+		t.Errorf("former editor editing a workspace link: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	if rr := serveUsersRequest(router, "PUT", "/shorten", ownerKey, editBody); rr.Code != http.StatusOK {
+		t.Errorf("owner editing a link of a former member: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := serveUsersRequest(router, "DELETE", "/shorten?code="+shortened.ShortCode, ownerKey, ""); rr.Code != http.StatusOK {
+		t.Errorf("owner deleting a link of a former member: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	// Test 4: The last owner cannot be demoted
+	rr = serveUsersRequest(router, "PUT", membersPath, ownerKey, `{"email": "owner@example.com", "role": "admin"}`)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("demoting the last owner: got %v want %v", rr.Code, http.StatusConflict)
+	}
+}